@@ -19,11 +19,16 @@ import (
 	"path/filepath"
 	"strings"
 
+	"google.golang.org/grpc/keepalive"
+
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pkg/bootstrap/platform"
+	"istio.io/istio/pkg/cluster"
 	istioagent "istio.io/istio/pkg/istio-agent"
+	istiokeepalive "istio.io/istio/pkg/keepalive"
+	"istio.io/istio/pkg/log"
 	"istio.io/istio/pkg/util/sets"
 	"istio.io/istio/pkg/wasm"
 )
@@ -36,6 +41,14 @@ func NewAgentOptions(proxy *model.Proxy, cfg *meshconfig.ProxyConfig) *istioagen
 	if wasmInsecureRegistries != "" {
 		insecureRegistries = strings.Split(wasmInsecureRegistries, ",")
 	}
+	var allowedHosts []string
+	if wasmAllowedHosts != "" {
+		allowedHosts = strings.Split(wasmAllowedHosts, ",")
+	}
+	var prewarmURLs []string
+	if wasmPrewarmModules != "" {
+		prewarmURLs = strings.Split(wasmPrewarmModules, ",")
+	}
 	o := &istioagent.AgentOptions{
 		XDSRootCerts:             xdsRootCA,
 		CARootCerts:              caRootCA,
@@ -50,32 +63,184 @@ func NewAgentOptions(proxy *model.Proxy, cfg *meshconfig.ProxyConfig) *istioagen
 			PurgeInterval:         wasmPurgeInterval,
 			HTTPRequestTimeout:    wasmHTTPRequestTimeout,
 			HTTPRequestMaxRetries: wasmHTTPRequestMaxRetries,
+			FetchMaxAttempts:      wasmFetchMaxAttempts,
+			FetchMaxElapsedTime:   wasmFetchMaxElapsedTime,
+			FetchGracePeriod:      wasmFetchGracePeriod,
+			MaxModuleSize:         int64(wasmMaxModuleSize),
+			MaxCacheSize:          int64(wasmMaxCacheSize),
+			MaxModuleVersions:     wasmMaxModuleVersions,
+			ModuleFetchTimeout:    wasmModuleFetchTimeout,
+			AllowedHosts:          sets.New(allowedHosts...),
+			PrewarmURLs:           prewarmURLs,
+			PrewarmTimeout:        wasmPrewarmTimeout,
+			LocalOverrides:        parseWasmLocalOverrides(wasmLocalOverrides),
+			InMemory:              wasmInMemoryCache,
+			HTTPProxy:             wasmHTTPProxy,
+			CompressModules:       wasmCompressModules,
+			DecompressedDir:       wasmDecompressedDir,
+			ConversionWorkers:     wasmConversionWorkers,
 		},
-		ProxyIPAddresses:            proxy.IPAddresses,
-		ServiceNode:                 proxy.ServiceNode(),
-		EnvoyStatusPort:             envoyStatusPortEnv,
-		EnvoyPrometheusPort:         envoyPrometheusPortEnv,
-		MinimumDrainDuration:        minimumDrainDurationEnv,
-		ExitOnZeroActiveConnections: exitOnZeroActiveConnectionsEnv,
-		Platform:                    platform.Discover(proxy.SupportsIPv6()),
-		GRPCBootstrapPath:           grpcBootstrapEnv,
-		DisableEnvoy:                disableEnvoyEnv,
-		ProxyXDSDebugViaAgent:       proxyXDSDebugViaAgent,
-		ProxyXDSDebugViaAgentPort:   proxyXDSDebugViaAgentPort,
-		DNSCapture:                  DNSCaptureByAgent.Get(),
-		DNSForwardParallel:          DNSForwardParallel.Get(),
-		DNSAddr:                     DNSCaptureAddr.Get(),
-		ProxyNamespace:              PodNamespaceVar.Get(),
-		ProxyDomain:                 proxy.DNSDomain,
-		IstiodSAN:                   istiodSAN.Get(),
-		DualStack:                   features.EnableDualStack,
-		UseExternalWorkloadSDS:      useExternalWorkloadSDSEnv,
-		MetadataDiscovery:           enableWDSEnv,
+		ProxyIPAddresses:              proxy.IPAddresses,
+		ServiceNode:                   proxy.ServiceNode(),
+		EnvoyStatusPort:               envoyStatusPortEnv,
+		EnvoyPrometheusPort:           envoyPrometheusPortEnv,
+		MinimumDrainDuration:          minimumDrainDurationEnv,
+		ExitOnZeroActiveConnections:   exitOnZeroActiveConnectionsEnv,
+		Platform:                      platform.Discover(proxy.SupportsIPv6()),
+		GRPCBootstrapPath:             grpcBootstrapEnv,
+		DisableEnvoy:                  disableEnvoyEnv,
+		ProxyXDSDebugViaAgent:         proxyXDSDebugViaAgent,
+		ProxyXDSDebugViaAgentPort:     proxyXDSDebugViaAgentPort,
+		DNSCapture:                    DNSCaptureByAgent.Get(),
+		DNSForwardParallel:            DNSForwardParallel.Get(),
+		DNSAddr:                       DNSCaptureAddr.Get(),
+		ProxyNamespace:                PodNamespaceVar.Get(),
+		ProxyDomain:                   proxy.DNSDomain,
+		IstiodSAN:                     istiodSAN.Get(),
+		DualStack:                     features.EnableDualStack,
+		UseExternalWorkloadSDS:        useExternalWorkloadSDSEnv,
+		MetadataDiscovery:             enableWDSEnv,
+		DeltaToSotwUpstream:           deltaToSotwUpstreamEnv,
+		DeltaUpstreamReconnect:        deltaUpstreamReconnectEnv,
+		HoldDownstreamOnUpstreamLoss:  xdsProxyHoldOnUpstreamLossEnv,
+		ServeLastGoodResources:        xdsProxyServeLastGoodEnv,
+		DeltaResponseQueueSize:        deltaResponseQueueSizeEnv,
+		XDSProxyDryRun:                xdsProxyDryRunEnv,
+		UpstreamKeepalive:             upstreamKeepalive(),
+		UpstreamMaxIdle:               xdsProxyMaxIdleEnv,
+		UpstreamDialTimeout:           xdsProxyDialTimeoutEnv,
+		UpstreamRecvIdleTimeout:       xdsProxyRecvIdleTimeoutEnv,
+		MaxDownstreamStreams:          xdsProxyMaxDownstreamStreamsEnv,
+		DeltaFlushTimeout:             xdsProxyFlushTimeoutEnv,
+		UpstreamDisconnectedThreshold: xdsProxyDisconnectedThresholdEnv,
+		UpstreamCompression:           xdsProxyUpstreamCompressionEnv,
+		ReloadXDSRootCert:             xdsProxyReloadRootCertEnv,
+		UpstreamRequestRate:           xdsProxyRequestRateEnv,
+		UpstreamRequestBurst:          xdsProxyRequestBurstEnv,
+		CircuitBreakerFailures:        xdsProxyCircuitBreakerFailuresEnv,
+		CircuitBreakerCooldown:        xdsProxyCircuitBreakerCooldownEnv,
+		MaxDeltaResponseSize:          xdsProxyMaxResponseSizeEnv,
+		XDSProxyGRPCWeb:               xdsProxyGRPCWebEnv,
+		RedactLoggedResponses:         xdsProxyRedactLoggedResponsesEnv,
+		XDSProxyBootstrapResources:    xdsProxyBootstrapResourcesEnv,
+		MeshMetricLabels:              xdsProxyMeshMetricLabelsEnv,
+		MaxInflightResponses:          xdsProxyMaxInflightResponsesEnv,
+		AckTimeoutResends:             xdsProxyAckTimeoutResendsEnv,
+		SharedUpstream:                xdsProxySharedUpstreamEnv,
+		ReportWasmFailures:            wasmReportFailures,
+		PartialECDSAck:                wasmPartialECDSAck,
+		InlineWasmModules:             wasmInlineModules,
+		EnvoyInlineWasmSupported:      envoyInlineWasmSupported,
+		ReconnectCoalesceWindow:       xdsProxyReconnectCoalesceWindowEnv,
+		UpstreamStartupJitter:         xdsProxyStartupJitterEnv,
+		UpstreamDNSCacheTTL:           xdsProxyDNSCacheTTLEnv,
+	}
+	o.DownstreamHTTP2 = istioagent.DownstreamHTTP2Settings{
+		MaxConcurrentStreams:  uint32(xdsProxyDownstreamMaxConcurrentStreamsEnv),
+		InitialWindowSize:     int32(xdsProxyDownstreamInitialWindowSizeEnv),
+		InitialConnWindowSize: int32(xdsProxyDownstreamInitialConnWindowSizeEnv),
+	}
+	if xdsProxyFailoverAddressesEnv != "" {
+		o.FailoverDiscoveryAddresses = strings.Split(xdsProxyFailoverAddressesEnv, ",")
+	}
+	if xdsProxyECDSTypeURLsEnv != "" {
+		o.ECDSTypeURLAliases = strings.Split(xdsProxyECDSTypeURLsEnv, ",")
+	}
+	if xdsProxyResponseOrderEnv != "" {
+		o.ResponsePrerequisites = istioagent.ParseResponsePrerequisites(xdsProxyResponseOrderEnv)
+	}
+	if xdsProxyAckTimeoutsEnv != "" {
+		o.AckTimeouts = istioagent.ParseAckTimeouts(xdsProxyAckTimeoutsEnv)
+	}
+	if xdsProxyRequestPrioritiesEnv != "" {
+		o.RequestPriorities = istioagent.ParseRequestPriorities(xdsProxyRequestPrioritiesEnv)
+	}
+	if xdsProxyResubscribeCodesEnv != "" {
+		o.ResubscribeCodes = istioagent.ParseResubscribeCodes(xdsProxyResubscribeCodesEnv)
+	}
+	if xdsProxyRequiredNodeMetadataEnv != "" {
+		o.RequiredNodeMetadata = strings.Split(xdsProxyRequiredNodeMetadataEnv, ",")
+	}
+	if xdsProxyAllowedTypeURLsEnv != "" {
+		o.AllowedTypeURLs = strings.Split(xdsProxyAllowedTypeURLsEnv, ",")
+	}
+	if xdsProxyDeniedTypeURLsEnv != "" {
+		o.DeniedTypeURLs = strings.Split(xdsProxyDeniedTypeURLsEnv, ",")
+	}
+	if xdsProxyDefaultNodeMetadataEnv {
+		meshID := meshIDVar.Get()
+		if meshID == "" {
+			meshID = cfg.MeshId
+		}
+		o.DefaultNodeMetadata = &model.NodeMetadata{
+			Namespace: PodNamespaceVar.Get(),
+			ClusterID: cluster.ID(clusterIDVar.Get()),
+			MeshID:    meshID,
+		}
+	}
+	if wasmLargeModuleDir != "" {
+		dir := wasm.CacheDir{Path: wasmLargeModuleDir, MinModuleSize: int64(wasmLargeModuleMinSize)}
+		if wasmLargeModuleDirModules != "" {
+			dir.Modules = sets.New(strings.Split(wasmLargeModuleDirModules, ",")...)
+		}
+		o.WASMOptions.ExtraDirs = []wasm.CacheDir{dir}
+	}
+	if wasmModulePublicKey != "" {
+		o.WASMOptions.Verifier = wasm.NewSignatureVerifier(wasm.FilePublicKey(wasmModulePublicKey))
+	}
+	if wasmFetchBearerTokenFiles != "" {
+		auth := wasm.HostAuthProviders{}
+		for _, pair := range strings.Split(wasmFetchBearerTokenFiles, ",") {
+			host, path, ok := strings.Cut(pair, "=")
+			if !ok {
+				log.Warnf("ignoring invalid WASM_FETCH_BEARER_TOKEN_FILES entry %q, expected host=path", pair)
+				continue
+			}
+			auth[host] = wasm.BearerTokenAuth(wasm.FileToken(path))
+		}
+		o.WASMOptions.FetchAuth = auth
 	}
 	extractXDSHeadersFromEnv(o)
 	return o
 }
 
+// upstreamKeepalive returns the keepalive of the connection to the upstream XDS server, or nil to keep the
+// default if it is not configured. Values that are not configured are taken from the default.
+func upstreamKeepalive() *keepalive.ClientParameters {
+	if xdsProxyKeepaliveTimeEnv == 0 && xdsProxyKeepaliveTimeoutEnv == 0 && !xdsProxyKeepalivePermitWithoutStreamEnv {
+		return nil
+	}
+	defaults := istiokeepalive.DefaultOption()
+	params := &keepalive.ClientParameters{
+		Time:                defaults.Time,
+		Timeout:             defaults.Timeout,
+		PermitWithoutStream: xdsProxyKeepalivePermitWithoutStreamEnv,
+	}
+	if xdsProxyKeepaliveTimeEnv > 0 {
+		params.Time = xdsProxyKeepaliveTimeEnv
+	}
+	if xdsProxyKeepaliveTimeoutEnv > 0 {
+		params.Timeout = xdsProxyKeepaliveTimeoutEnv
+	}
+	return params
+}
+
+// parseWasmLocalOverrides parses a comma separated list of name=path pairs. Malformed pairs are ignored.
+func parseWasmLocalOverrides(overrides string) map[string]string {
+	if overrides == "" {
+		return nil
+	}
+	parsed := map[string]string{}
+	for _, pair := range strings.Split(overrides, ",") {
+		name, path, found := strings.Cut(pair, "=")
+		if !found || name == "" || path == "" {
+			continue
+		}
+		parsed[name] = path
+	}
+	return parsed
+}
+
 // Simplified extraction of gRPC headers from environment.
 // Unlike ISTIO_META, where we need JSON and advanced features - this is just for small string headers.
 func extractXDSHeadersFromEnv(o *istioagent.AgentOptions) {
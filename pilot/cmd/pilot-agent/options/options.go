@@ -39,6 +39,7 @@ var (
 
 	serviceAccountVar = env.Register("SERVICE_ACCOUNT", "", "Name of service account")
 	clusterIDVar      = env.Register("ISTIO_META_CLUSTER_ID", "", "")
+	meshIDVar         = env.Register("ISTIO_META_MESH_ID", "", "")
 	// Provider for XDS auth, e.g., gcp. By default, it is empty, meaning no auth provider.
 	xdsAuthProvider = env.Register("XDS_AUTH_PROVIDER", "", "Provider for XDS auth")
 
@@ -109,6 +110,10 @@ var (
 	wasmInsecureRegistries = env.Register("WASM_INSECURE_REGISTRIES", "",
 		"allow agent pull wasm plugin from insecure registries or https server, for example: 'localhost:5000,docker-registry:5000'").Get()
 
+	wasmAllowedHosts = env.Register("WASM_ALLOWED_HOSTS", "",
+		"comma separated list of the hosts the agent may pull Wasm modules from over http/https or OCI, with or without "+
+			"port, for example: 'registry.example.com,localhost:5000'. If set, modules at any other host are rejected").Get()
+
 	wasmModuleExpiry = env.Register("WASM_MODULE_EXPIRY", wasm.DefaultModuleExpiry,
 		"cache expiration duration for a wasm module.").Get()
 
@@ -121,9 +126,294 @@ var (
 	wasmHTTPRequestMaxRetries = env.Register("WASM_HTTP_REQUEST_MAX_RETRIES", wasm.DefaultHTTPRequestMaxRetries,
 		"maximum number of HTTP/HTTPS request retries for pulling a Wasm module via http/https").Get()
 
+	wasmFetchMaxAttempts = env.Register("WASM_FETCH_MAX_ATTEMPTS", wasm.DefaultFetchMaxAttempts,
+		"maximum number of attempts to fetch the Wasm modules of an ECDS update before it is rejected").Get()
+
+	wasmFetchMaxElapsedTime = env.Register("WASM_FETCH_MAX_ELAPSED_TIME", wasm.DefaultFetchMaxElapsedTime,
+		"maximum time spent retrying the Wasm module fetches of an ECDS update before it is rejected").Get()
+
+	wasmFetchGracePeriod = env.Register("WASM_FETCH_GRACE_PERIOD", time.Duration(0),
+		"if set, the time an ECDS update is held pending, neither accepted nor rejected, while the fetches of its "+
+			"Wasm modules are retried. The update is only rejected once the grace period elapses. "+
+			"It supersedes WASM_FETCH_MAX_ATTEMPTS and WASM_FETCH_MAX_ELAPSED_TIME").Get()
+
+	wasmMaxModuleSize = env.Register("WASM_MAX_MODULE_SIZE", wasm.DefaultMaxModuleSize,
+		"maximum size in bytes of a Wasm module. Larger modules are rejected while they are downloaded").Get()
+
+	wasmMaxCacheSize = env.Register("WASM_MAX_CACHE_SIZE", 0,
+		"maximum total size in bytes of the cached Wasm modules. When exceeded, the least recently used modules not "+
+			"referenced by any extension config are evicted. 0 means unlimited").Get()
+
+	wasmMaxModuleVersions = env.Register("WASM_MAX_MODULE_VERSIONS", 0,
+		"maximum number of versions of a Wasm module, by checksum of the same URL or OCI repository, kept in the cache "+
+			"besides the versions referenced by an extension config. Older versions are pruned. 0 means unlimited").Get()
+
+	wasmModuleFetchTimeout = env.Register("WASM_MODULE_FETCH_TIMEOUT", time.Duration(0),
+		"maximum time to fetch a single Wasm module, including retries. When exceeded, the fetch is cancelled and "+
+			"the extension config referencing the module is rejected. If not set, the timeout of the remote source is used").Get()
+
+	wasmPrewarmModules = env.Register("WASM_PREWARM_MODULES", "",
+		"comma separated list of the URLs of Wasm modules the agent fetches into its cache at startup, before Envoy "+
+			"connects, so that the first extension configs referencing them are not delayed by the fetch").Get()
+
+	wasmPrewarmTimeout = env.Register("WASM_PREWARM_TIMEOUT", wasm.DefaultPrewarmTimeout,
+		"maximum time the agent startup waits for the modules of WASM_PREWARM_MODULES to be fetched. "+
+			"The remaining fetches continue in the background").Get()
+
+	wasmLocalOverrides = env.Register("WASM_LOCAL_OVERRIDES", "",
+		"comma separated list of extension config names mapped to local Wasm module files, for example: "+
+			"'extension-config=/var/local/wasm/known-good.wasm'. The Wasm modules of these extension configs are "+
+			"loaded from the local files instead of the modules pushed by Istiod, which are not fetched").Get()
+
+	wasmInMemoryCache = env.Register("WASM_IN_MEMORY_CACHE", false,
+		"if true, the Wasm modules are held in memory and inlined in the extension configs sent to Envoy, instead "+
+			"of being written to the local cache directory. This supports read-only filesystems, at the cost of memory").Get()
+
+	wasmHTTPProxy = env.Register("WASM_HTTP_PROXY", "",
+		"URL of the proxy the agent fetches the Wasm modules through, over HTTP(S) or OCI. If not set, the proxy "+
+			"configured by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables is used").Get()
+
+	wasmCompressModules = env.Register("WASM_COMPRESS_MODULES", false,
+		"if true, the Wasm modules are stored zstd-compressed in the cache directory, and decompressed on demand "+
+			"into WASM_DECOMPRESSED_DIR for Envoy to read. The module checksums apply to the decompressed modules").Get()
+
+	wasmDecompressedDir = env.Register("WASM_DECOMPRESSED_DIR", "",
+		"path to the directory of the decompressed copies of the Wasm modules stored compressed, such as a tmpfs. "+
+			"If not set, a directory in the temporary directory is used").Get()
+
+	wasmConversionWorkers = env.Register("WASM_CONVERSION_WORKERS", wasm.DefaultConversionWorkers,
+		"number of ECDS resources the agent converts in parallel, fetching their Wasm modules. ECDS updates are held, "+
+			"neither forwarded to Envoy nor acknowledged, while all the workers are busy").Get()
+
+	wasmLargeModuleDir = env.Register("WASM_LARGE_MODULE_DIR", "",
+		"path to an additional directory storing the Wasm modules of at least WASM_LARGE_MODULE_MIN_SIZE bytes, "+
+			"or listed in WASM_LARGE_MODULE_DIR_MODULES, such as a larger but slower volume. The other modules are "+
+			"stored in the cache directory").Get()
+
+	wasmLargeModuleMinSize = env.Register("WASM_LARGE_MODULE_MIN_SIZE", 0,
+		"minimum size in bytes of the Wasm modules stored in WASM_LARGE_MODULE_DIR. 0 means the modules are only "+
+			"placed there if listed in WASM_LARGE_MODULE_DIR_MODULES").Get()
+
+	wasmLargeModuleDirModules = env.Register("WASM_LARGE_MODULE_DIR_MODULES", "",
+		"comma separated list of the Wasm modules stored in WASM_LARGE_MODULE_DIR whatever their size: the URL of "+
+			"HTTP(S) modules, or the repository of OCI modules such as oci://docker.io/test").Get()
+
+	wasmReportFailures = env.Register("WASM_REPORT_FAILURES", false,
+		"if true, each Wasm module which failed to be fetched or verified is detailed in the NACK sent to Istiod, "+
+			"with the name of the extension config, the URL of the module and the reason").Get()
+
+	wasmPartialECDSAck = env.Register("WASM_PARTIAL_ECDS_ACK", false,
+		"if true, the extension configs of a delta ECDS update whose Wasm modules were loaded are applied even if "+
+			"others failed, which keep their previous version. The update is then NACKed to Istiod naming the failed "+
+			"extension configs. Otherwise, the update is NACKed as a whole").Get()
+
+	wasmInlineModules = env.Register("WASM_INLINE_MODULES", false,
+		"if true, the Wasm modules are inlined in the extension configs sent to Envoy as base64 data, instead of "+
+			"being referenced by the path of their file in the cache directory. It only applies if "+
+			"ENVOY_INLINE_WASM_SUPPORTED is set").Get()
+
+	envoyInlineWasmSupported = env.Register("ENVOY_INLINE_WASM_SUPPORTED", false,
+		"declares that the Envoy version of the proxy accepts the Wasm modules inlined in the extension configs. "+
+			"Older Envoy versions do not, and WASM_INLINE_MODULES is then ignored").Get()
+
+	wasmModulePublicKey = env.Register("WASM_MODULE_PUBLIC_KEY", "",
+		"path to a PEM encoded public key. If set, only Wasm modules with a valid detached signature made with "+
+			"this key are loaded. The signature of a module is fetched from the module URL suffixed with .sig").Get()
+
+	wasmFetchBearerTokenFiles = env.Register("WASM_FETCH_BEARER_TOKEN_FILES", "",
+		"Comma separated list of host=path pairs, such as registry.example.com=/var/run/secrets/wasm/token. The HTTP(S) "+
+			"Wasm module fetches from a host are authenticated with the bearer token read from its file on every "+
+			"request, so the token can be rotated").Get()
+
 	enableWDSEnv = env.Register("PEER_METADATA_DISCOVERY", false,
 		"If set to true, enable the peer metadata discovery extension in Envoy").Get()
 
+	deltaToSotwUpstreamEnv = env.Register("XDS_PROXY_DELTA_TO_SOTW", false,
+		"If set to true, the agent serves delta XDS requests from Envoy using a state of the world XDS "+
+			"connection to the upstream, for upstreams which do not support delta XDS").Get()
+
+	deltaUpstreamReconnectEnv = env.Register("XDS_PROXY_DELTA_RECONNECT", false,
+		"If set to true, the agent reconnects delta XDS connections to the upstream on transient failures, "+
+			"resuming the resources known by Envoy instead of closing the connection from Envoy").Get()
+
+	xdsProxyHoldOnUpstreamLossEnv = env.Register("XDS_PROXY_HOLD_ON_UPSTREAM_LOSS", false,
+		"If set to true, the agent holds the delta XDS connections from Envoy open while the upstream XDS server is "+
+			"unreachable, reconnecting until it is reachable again, so Envoy keeps its last configuration").Get()
+
+	xdsProxyServeLastGoodEnv = env.Register("XDS_PROXY_SERVE_LAST_GOOD", false,
+		"If set to true, the agent keeps the resources last acknowledged by Envoy in memory, and serves them to Envoy "+
+			"reconnecting while the upstream XDS server is unreachable").Get()
+
+	deltaResponseQueueSizeEnv = env.Register("XDS_PROXY_DELTA_RESPONSE_QUEUE_SIZE", 0,
+		"If positive, the number of delta XDS responses from the upstream the agent queues while Envoy is slow, "+
+			"after which responses of the same type are coalesced. If zero, the upstream is blocked instead").Get()
+
+	xdsProxyMaxResponseSizeEnv = env.Register("XDS_PROXY_MAX_RESPONSE_SIZE", 0,
+		"If positive, the size in bytes above which the agent splits the delta XDS responses from the upstream into "+
+			"several responses before forwarding them to Envoy, to stay under the maximum message size of Envoy").Get()
+
+	xdsProxyGRPCWebEnv = env.Register("XDS_PROXY_GRPC_WEB", false,
+		"If set to true, the agent serves delta XDS streams to gRPC-web clients, such as browser based debugging "+
+			"tools, on the debug port enabled by PROXY_XDS_DEBUG_VIA_AGENT").Get()
+
+	xdsProxyDryRunEnv = env.Register("XDS_PROXY_DRY_RUN", false,
+		"If set to true, the agent processes delta XDS responses from the upstream but reports whether they "+
+			"would be ACKed or NACKed instead of forwarding them to Envoy. This is meant to canary config changes").Get()
+
+	xdsProxyKeepaliveTimeEnv = env.Register("XDS_PROXY_KEEPALIVE_TIME", time.Duration(0),
+		"If set, the interval of the gRPC keepalive pings the agent sends to the upstream XDS server. "+
+			"If not set, the default keepalive is used").Get()
+
+	xdsProxyKeepaliveTimeoutEnv = env.Register("XDS_PROXY_KEEPALIVE_TIMEOUT", time.Duration(0),
+		"If set, the time the agent waits for a gRPC keepalive ping acknowledgement from the upstream XDS server "+
+			"before closing the connection. If not set, the default keepalive is used").Get()
+
+	xdsProxyKeepalivePermitWithoutStreamEnv = env.Register("XDS_PROXY_KEEPALIVE_PERMIT_WITHOUT_STREAM", false,
+		"If set to true, the agent sends gRPC keepalive pings to the upstream XDS server even without active streams").Get()
+
+	xdsProxyMaxIdleEnv = env.Register("XDS_PROXY_MAX_IDLE", time.Duration(0),
+		"If set, the time without any message exchanged with the upstream XDS server after which the agent "+
+			"proactively reconnects, keeping the streams of Envoy. If not set, idle connections are kept").Get()
+
+	xdsProxyDialTimeoutEnv = env.Register("XDS_PROXY_DIAL_TIMEOUT", time.Duration(0),
+		"If set, the time the agent allows for establishing the connection to the upstream XDS server before "+
+			"failing the attempt. It does not apply to established streams. If not set, a default of 5s is used").Get()
+
+	xdsProxyRecvIdleTimeoutEnv = env.Register("XDS_PROXY_RECV_IDLE_TIMEOUT", time.Duration(0),
+		"If set, the time without any response received from the upstream XDS server after which the agent "+
+			"reconnects, keeping the streams of Envoy. If not set, quiet streams are kept").Get()
+
+	xdsProxyMaxDownstreamStreamsEnv = env.Register("XDS_PROXY_MAX_DOWNSTREAM_STREAMS", 0,
+		"If set, the maximum number of concurrent XDS streams the agent serves to Envoy. Beyond it, new streams are "+
+			"rejected with ResourceExhausted. If not set, the streams are not limited").Get()
+
+	xdsProxyDownstreamMaxConcurrentStreamsEnv = env.Register("XDS_PROXY_DOWNSTREAM_MAX_CONCURRENT_STREAMS", 0,
+		"If set, the HTTP/2 maximum number of concurrent streams of a connection from Envoy to the agent").Get()
+
+	xdsProxyDownstreamInitialWindowSizeEnv = env.Register("XDS_PROXY_DOWNSTREAM_INITIAL_WINDOW_SIZE", 0,
+		"If set, the HTTP/2 initial flow control window in bytes of the streams from Envoy to the agent. "+
+			"Values below 65536 are ignored").Get()
+
+	xdsProxyDownstreamInitialConnWindowSizeEnv = env.Register("XDS_PROXY_DOWNSTREAM_INITIAL_CONN_WINDOW_SIZE", 0,
+		"If set, the HTTP/2 initial flow control window in bytes of the connections from Envoy to the agent. "+
+			"Values below 65536 are ignored").Get()
+
+	xdsProxyFlushTimeoutEnv = env.Register("XDS_PROXY_FLUSH_TIMEOUT", time.Duration(0),
+		"If set, the time the agent spends forwarding the delta XDS responses already queued for Envoy once Envoy "+
+			"gracefully closes its stream. If not set, the queued responses are dropped").Get()
+
+	xdsProxyDefaultNodeMetadataEnv = env.Register("XDS_PROXY_DEFAULT_NODE_METADATA", false,
+		"If set to true, the agent sets the namespace, cluster ID and mesh ID of the node of the delta XDS "+
+			"requests from Envoy when Envoy omits them").Get()
+
+	xdsProxyRequiredNodeMetadataEnv = env.Register("XDS_PROXY_REQUIRED_NODE_METADATA", "",
+		"Comma separated list of the node metadata fields, such as NAMESPACE,INSTANCE_IPS, that Envoy must set. "+
+			"The XDS streams whose node lacks any of them are rejected with an error naming the missing fields").Get()
+
+	xdsProxyAllowedTypeURLsEnv = env.Register("XDS_PROXY_ALLOWED_TYPE_URLS", "",
+		"Comma separated list of the only type URLs Envoy may subscribe to through the XDS proxy. The XDS streams "+
+			"subscribing to any other type URL are rejected with PermissionDenied. If not set, all type URLs are allowed").Get()
+
+	xdsProxyDeniedTypeURLsEnv = env.Register("XDS_PROXY_DENIED_TYPE_URLS", "",
+		"Comma separated list of the type URLs Envoy may not subscribe to through the XDS proxy. The XDS streams "+
+			"subscribing to any of them are rejected with PermissionDenied").Get()
+
+	xdsProxyDNSCacheTTLEnv = env.Register("XDS_PROXY_DNS_CACHE_TTL", time.Duration(0),
+		"If set, the time the resolved addresses of the upstream XDS server are reused across reconnects. They are "+
+			"resolved again when the connection to them fails, and still used while they fail to be resolved").Get()
+
+	xdsProxyReconnectCoalesceWindowEnv = env.Register("XDS_PROXY_RECONNECT_COALESCE_WINDOW", time.Duration(0),
+		"If set, the time a new XDS stream from Envoy is held before it is forwarded upstream. The streams closed or "+
+			"replaced by a reconnect of Envoy within the window never reach the upstream XDS server, and the initial "+
+			"requests are batched without duplicates. This smooths reconnect storms, but delays every new stream").Get()
+
+	xdsProxyStartupJitterEnv = env.Register("XDS_PROXY_STARTUP_JITTER", time.Duration(0),
+		"If set, the first upstream XDS subscription of the agent is delayed by a random interval up to the jitter, "+
+			"to spread the load of a fleet of agents starting together on the upstream XDS server").Get()
+
+	xdsProxyRedactLoggedResponsesEnv = env.Register("XDS_PROXY_REDACT_LOGGED_RESPONSES", false,
+		"If enabled, the inline data, such as Wasm modules and secrets, and the credentials of the delta XDS responses "+
+			"logged by the xdsresponses scope are replaced by their hash. Resource names and nonces are kept").Get()
+
+	xdsProxyBootstrapResourcesEnv = env.Register("XDS_PROXY_BOOTSTRAP_RESOURCES", "",
+		"If set, the path of an Envoy bootstrap file whose static clusters and listeners the agent serves to Envoy on "+
+			"a new delta XDS stream before the upstream XDS server responds. They are superseded by the first response "+
+			"of the upstream of each type").Get()
+
+	xdsProxyMeshMetricLabelsEnv = env.Register("XDS_PROXY_MESH_METRIC_LABELS", false,
+		"If enabled, the XDS proxy metrics recorded for Envoy, such as xds_proxy_bytes, xds_proxy_ack_latency and "+
+			"wasm_remote_fetch_duration, are labeled with the cluster_id and mesh_id of the node metadata of Envoy").Get()
+
+	xdsProxyMaxInflightResponsesEnv = env.Register("XDS_PROXY_MAX_INFLIGHT_RESPONSES", 0,
+		"If positive, the number of delta XDS responses of a type the agent forwards to Envoy before Envoy "+
+			"acknowledges them. The following responses of the type are held until an ACK. If not set, responses are "+
+			"forwarded as soon as they are received").Get()
+
+	xdsProxyAckTimeoutsEnv = env.Register("XDS_PROXY_ACK_TIMEOUTS", "",
+		"Comma separated list of type=timeout pairs of XDS types, such as CDS=30s,LDS=30s. If set, the last delta XDS "+
+			"response of a type Envoy does not acknowledge within its timeout is resent, and a warning logged").Get()
+
+	xdsProxyAckTimeoutResendsEnv = env.Register("XDS_PROXY_ACK_TIMEOUT_RESENDS", 1,
+		"The number of times the agent resends a delta XDS response Envoy does not acknowledge within the timeout of "+
+			"its type, see XDS_PROXY_ACK_TIMEOUTS").Get()
+
+	xdsProxyResponseOrderEnv = env.Register("XDS_PROXY_RESPONSE_ORDER", "",
+		"Comma separated list of prerequisite>dependent pairs of XDS types, such as CDS>EDS,LDS>RDS. If set, the delta "+
+			"XDS responses of a dependent type are held until Envoy acknowledges the responses of its prerequisites").Get()
+
+	xdsProxyRequestPrioritiesEnv = env.Register("XDS_PROXY_REQUEST_PRIORITIES", "",
+		"Comma separated list of type=priority pairs of XDS types, such as CDS=2,LDS=2,SDS=1. If set, the pending delta "+
+			"XDS requests from Envoy are sent upstream by priority of their type, higher first, so that critical types "+
+			"converge first. The types not listed have priority 0").Get()
+
+	xdsProxyResubscribeCodesEnv = env.Register("XDS_PROXY_RESUBSCRIBE_CODES", "",
+		"Comma separated list of gRPC status codes, such as UNAVAILABLE. If the delta XDS stream to the upstream fails "+
+			"with one of them, the agent cleanly resubscribes to the resources of Envoy on a new stream after a backoff, "+
+			"instead of forwarding the error to Envoy").Get()
+
+	xdsProxySharedUpstreamEnv = env.Register("XDS_PROXY_SHARED_UPSTREAM", false,
+		"If enabled, the delta XDS streams of the Envoys connecting to the agent while an Envoy is connected share "+
+			"the upstream XDS stream of the latter, with the responses fanned out to each Envoy according to its "+
+			"subscriptions, instead of replacing it. For nodes running several Envoys sharing an identity").Get()
+
+	xdsProxyDisconnectedThresholdEnv = env.Register("XDS_PROXY_DISCONNECTED_THRESHOLD", time.Duration(0),
+		"If set, the agent reports not ready once it has been disconnected from the upstream XDS server "+
+			"for longer than this duration. If not set, the connectivity to the upstream is not part of the readiness").Get()
+
+	xdsProxyFailoverAddressesEnv = env.Register("XDS_PROXY_FAILOVER_ADDRESSES", "",
+		"Comma separated list of the addresses of the XDS servers the agent fails over to, in order, "+
+			"when the discovery address is unreachable").Get()
+
+	xdsProxyUpstreamCompressionEnv = env.Register("XDS_PROXY_UPSTREAM_COMPRESSION", false,
+		"If set to true, the agent compresses the XDS streams to the upstream XDS server with gzip. "+
+			"This reduces the bandwidth used by large pushes, at the cost of CPU").Get()
+
+	xdsProxyReloadRootCertEnv = env.Register("XDS_PROXY_RELOAD_ROOT_CERT", false,
+		"If set to true, the agent verifies the new handshakes of its connection to the upstream XDS server against "+
+			"the rotated root certificate, without redialing. Otherwise, the connection is replaced once the root or "+
+			"client certificate rotates, resuming the delta XDS state of Envoy on the new connection").Get()
+
+	xdsProxyECDSTypeURLsEnv = env.Register("XDS_PROXY_ECDS_TYPE_URLS", "",
+		"Comma separated list of the type URLs the agent handles as ECDS, rewriting their Wasm modules, in addition "+
+			"to the standard one. Used by Envoy builds subscribing to extension configs with a different type URL").Get()
+
+	xdsProxyRequestRateEnv = env.Register("XDS_PROXY_REQUEST_RATE", 0.0,
+		"If positive, the maximum rate in requests per second of the delta XDS requests the agent sends to the "+
+			"upstream on behalf of Envoy. Requests above the rate are delayed, and duplicates of a delayed request are "+
+			"dropped. This protects the upstream from a flapping Envoy").Get()
+
+	xdsProxyRequestBurstEnv = env.Register("XDS_PROXY_REQUEST_BURST", 0,
+		"The number of delta XDS requests the agent may send at once above XDS_PROXY_REQUEST_RATE. "+
+			"If not positive, it defaults to the rate").Get()
+
+	xdsProxyCircuitBreakerFailuresEnv = env.Register("XDS_PROXY_CIRCUIT_BREAKER_FAILURES", 0,
+		"If positive, the number of consecutive upstream failures of a type, responses rejected by the agent or "+
+			"stream errors, after which the agent holds the delta XDS requests of the type other than ACKs and "+
+			"subscription changes for XDS_PROXY_CIRCUIT_BREAKER_COOLDOWN, before probing the upstream again").Get()
+
+	xdsProxyCircuitBreakerCooldownEnv = env.Register("XDS_PROXY_CIRCUIT_BREAKER_COOLDOWN", 30*time.Second,
+		"The time the agent holds the delta XDS requests of a type once its circuit breaker opened").Get()
+
 	envoyStatusPortEnv = env.Register("ENVOY_STATUS_PORT", 15021,
 		"Envoy health status port value").Get()
 	envoyPrometheusPortEnv = env.Register("ENVOY_PROMETHEUS_PORT", 15090,
@@ -15,12 +15,15 @@
 package grpc
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"sync"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -36,6 +39,9 @@ type TLSOptions struct {
 	Cert          string
 	ServerAddress string
 	SAN           string
+	// ReloadRootCert if true reloads RootCert when it changes, so that the new handshakes of established
+	// clients are verified against the rotated root certificate. The client certificate is always reloaded.
+	ReloadRootCert bool
 }
 
 func getTLSDialOption(opts *TLSOptions) (grpc.DialOption, error) {
@@ -79,10 +85,65 @@ func getTLSDialOption(opts *TLSOptions) (grpc.DialOption, error) {
 	if opts.SAN != "" {
 		config.ServerName = opts.SAN
 	}
+	if opts.ReloadRootCert && opts.RootCert != "" {
+		roots := &rootCertReloader{file: opts.RootCert}
+		// The server certificate is verified by VerifyConnection instead, against the current root certificate.
+		// nolint: gosec
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = roots.verifyConnection
+	}
 	transportCreds := credentials.NewTLS(&config)
 	return grpc.WithTransportCredentials(transportCreds), nil
 }
 
+// rootCertReloader loads the root certificates from a file, reloading them when the file content changes.
+type rootCertReloader struct {
+	file string
+	mu   sync.Mutex
+	raw  []byte
+	pool *x509.CertPool
+}
+
+func (r *rootCertReloader) get() (*x509.CertPool, error) {
+	raw, err := os.ReadFile(r.file)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool != nil && bytes.Equal(raw, r.raw) {
+		return r.pool, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("failed to load root certificates from %v", r.file)
+	}
+	r.raw, r.pool = raw, pool
+	return pool, nil
+}
+
+// verifyConnection verifies the certificate chain of the server against the current root certificates,
+// as the TLS client would with static root certificates.
+func (r *rootCertReloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	roots, err := r.get()
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
 func getRootCertificate(rootCertFile string) (*x509.CertPool, error) {
 	var certPool *x509.CertPool
 	var rootCert []byte
@@ -0,0 +1,116 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"istio.io/istio/security/pkg/pki/util"
+)
+
+const testServerName = "istiod.istio-system.svc"
+
+// genServerCert generates a root certificate, and a server certificate signed by it.
+func genServerCert(t *testing.T) ([]byte, tls.Certificate) {
+	t.Helper()
+	rootPem, rootKeyPem, err := util.GenCertKeyFromOptions(util.CertOptions{
+		Org:          "istio",
+		NotBefore:    time.Now(),
+		TTL:          time.Hour,
+		IsCA:         true,
+		IsSelfSigned: true,
+		ECSigAlg:     util.EcdsaSigAlg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert, err := util.ParsePemEncodedCertificate(rootPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootKey, err := util.ParsePemEncodedKey(rootKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem, keyPem, err := util.GenCertKeyFromOptions(util.CertOptions{
+		Host:       testServerName,
+		NotBefore:  time.Now(),
+		TTL:        time.Hour,
+		SignerCert: rootCert,
+		SignerPriv: rootKey,
+		IsServer:   true,
+		ECSigAlg:   util.EcdsaSigAlg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rootPem, cert
+}
+
+// handshake runs a TLS handshake between a client verifying the server with roots and a server presenting cert.
+func handshake(roots *rootCertReloader, cert tls.Certificate) error {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go func() {
+		_ = server.Handshake()
+		server.Close()
+	}()
+	// nolint: gosec
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName:         testServerName,
+		InsecureSkipVerify: true,
+		VerifyConnection:   roots.verifyConnection,
+	})
+	return client.Handshake()
+}
+
+func TestRootCertReloader(t *testing.T) {
+	rootFile := filepath.Join(t.TempDir(), "root-cert.pem")
+	root1, cert1 := genServerCert(t)
+	root2, cert2 := genServerCert(t)
+	if err := os.WriteFile(rootFile, root1, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	roots := &rootCertReloader{file: rootFile}
+
+	if err := handshake(roots, cert1); err != nil {
+		t.Fatalf("expected handshake to succeed with the current root, got %v", err)
+	}
+	if err := handshake(roots, cert2); err == nil {
+		t.Fatal("expected handshake to fail with an unknown root")
+	}
+
+	// Rotate the root certificate: new handshakes are verified against it without recreating the client.
+	if err := os.WriteFile(rootFile, root2, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(roots, cert2); err != nil {
+		t.Fatalf("expected handshake to succeed with the rotated root, got %v", err)
+	}
+	if err := handshake(roots, cert1); err == nil {
+		t.Fatal("expected handshake to fail with the previous root")
+	}
+}
@@ -27,6 +27,8 @@ import (
 	"go.uber.org/atomic"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	// Registers the gzip compressor, so that clients such as the istio-agent can compress their streams.
+	_ "google.golang.org/grpc/encoding/gzip"
 
 	"istio.io/istio/pilot/pkg/autoregistration"
 	"istio.io/istio/pilot/pkg/features"
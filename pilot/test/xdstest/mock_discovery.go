@@ -15,6 +15,9 @@
 package xdstest
 
 import (
+	"sync"
+	"time"
+
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/test/bufconn"
@@ -24,11 +27,16 @@ import (
 )
 
 // MockDiscovery is a DiscoveryServer that allows users full control over responses.
+// The requests it receives are recorded.
 type MockDiscovery struct {
 	Listener       *bufconn.Listener
 	responses      chan *discovery.DiscoveryResponse
 	deltaResponses chan *discovery.DeltaDiscoveryResponse
 	close          chan struct{}
+
+	mu            sync.Mutex
+	requests      []*discovery.DiscoveryRequest
+	deltaRequests []*discovery.DeltaDiscoveryRequest
 }
 
 func NewMockServer(t test.Failer) *MockDiscovery {
@@ -56,11 +64,24 @@ func NewMockServer(t test.Failer) *MockDiscovery {
 }
 
 func (f *MockDiscovery) StreamAggregatedResources(server discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	go func() {
+		for {
+			req, err := server.Recv()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.requests = append(f.requests, req)
+			f.mu.Unlock()
+		}
+	}()
 	numberOfSends := 0
 	for {
 		select {
 		case <-f.close:
 			return nil
+		case <-server.Context().Done():
+			return nil
 		case resp := <-f.responses:
 			numberOfSends++
 			log.Infof("sending response from mock: %v", numberOfSends)
@@ -72,11 +93,24 @@ func (f *MockDiscovery) StreamAggregatedResources(server discovery.AggregatedDis
 }
 
 func (f *MockDiscovery) DeltaAggregatedResources(server discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	go func() {
+		for {
+			req, err := server.Recv()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.deltaRequests = append(f.deltaRequests, req)
+			f.mu.Unlock()
+		}
+	}()
 	numberOfSends := 0
 	for {
 		select {
 		case <-f.close:
 			return nil
+		case <-server.Context().Done():
+			return nil
 		case resp := <-f.deltaResponses:
 			numberOfSends++
 			log.Infof("sending delta response from mock: %v", numberOfSends)
@@ -97,4 +131,50 @@ func (f *MockDiscovery) SendDeltaResponse(dr *discovery.DeltaDiscoveryResponse)
 	f.deltaResponses <- dr
 }
 
+// Requests returns the requests of typeURL received so far, over all the streams.
+func (f *MockDiscovery) Requests(typeURL string) []*discovery.DiscoveryRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*discovery.DiscoveryRequest
+	for _, req := range f.requests {
+		if req.TypeUrl == typeURL {
+			out = append(out, req)
+		}
+	}
+	return out
+}
+
+// DeltaRequests returns the delta requests of typeURL received so far, over all the streams.
+func (f *MockDiscovery) DeltaRequests(typeURL string) []*discovery.DeltaDiscoveryRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*discovery.DeltaDiscoveryRequest
+	for _, req := range f.deltaRequests {
+		if req.TypeUrl == typeURL {
+			out = append(out, req)
+		}
+	}
+	return out
+}
+
+// ExpectNoRequest fails the test if a request of typeURL is received within d.
+func (f *MockDiscovery) ExpectNoRequest(t test.Failer, typeURL string, d time.Duration) {
+	t.Helper()
+	seen := len(f.Requests(typeURL))
+	time.Sleep(d)
+	if got := f.Requests(typeURL); len(got) > seen {
+		t.Fatalf("got unexpected request: %v", got[seen])
+	}
+}
+
+// ExpectNoDeltaRequest fails the test if a delta request of typeURL is received within d.
+func (f *MockDiscovery) ExpectNoDeltaRequest(t test.Failer, typeURL string, d time.Duration) {
+	t.Helper()
+	seen := len(f.DeltaRequests(typeURL))
+	time.Sleep(d)
+	if got := f.DeltaRequests(typeURL); len(got) > seen {
+		t.Fatalf("got unexpected delta request: %v", got[seen])
+	}
+}
+
 var _ discovery.AggregatedDiscoveryServiceServer = &MockDiscovery{}
@@ -1895,6 +1895,11 @@ func ValidateMeshConfigProxyConfig(config *meshconfig.ProxyConfig) (errs error)
 	// but that requires additional test validation
 	if config.DiscoveryAddress == "" {
 		errs = multierror.Append(errs, errors.New("discovery address must be set to the proxy discovery service"))
+	} else if uds, ok := strings.CutPrefix(config.DiscoveryAddress, "unix://"); ok {
+		// The discovery service may be reachable over a unix domain socket, e.g. through a local XDS broker.
+		if !strings.HasPrefix(uds, "/") {
+			errs = multierror.Append(errs, fmt.Errorf("invalid discovery address: %q is not an absolute unix domain socket path", uds))
+		}
 	} else if err := ValidateProxyAddress(config.DiscoveryAddress); err != nil {
 		errs = multierror.Append(errs, multierror.Prefix(err, "invalid discovery address:"))
 	}
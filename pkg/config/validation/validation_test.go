@@ -537,6 +537,16 @@ func TestValidateMeshConfigProxyConfig(t *testing.T) {
 			in:      modify(valid, func(c *meshconfig.ProxyConfig) { c.DiscoveryAddress = "10.0.0.100" }),
 			isValid: false,
 		},
+		{
+			name:    "discovery address unix domain socket",
+			in:      modify(valid, func(c *meshconfig.ProxyConfig) { c.DiscoveryAddress = "unix:///var/run/xds/xds.sock" }),
+			isValid: true,
+		},
+		{
+			name:    "discovery address relative unix domain socket",
+			in:      modify(valid, func(c *meshconfig.ProxyConfig) { c.DiscoveryAddress = "unix://xds.sock" }),
+			isValid: false,
+		},
 		{
 			name:    "proxy admin port invalid",
 			in:      modify(valid, func(c *meshconfig.ProxyConfig) { c.ProxyAdminPort = 0 }),
@@ -26,9 +26,12 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/protobuf/proto"
 
 	mesh "istio.io/api/mesh/v1alpha1"
@@ -184,13 +187,28 @@ type AgentOptions struct {
 	GRPCBootstrapPath string
 
 	// Disables all envoy agent features
-	DisableEnvoy          bool
+	DisableEnvoy bool
+
+	// DownstreamGrpcOptions are added to the options of the XDS proxy gRPC server Envoy connects to,
+	// for instance to add interceptors.
 	DownstreamGrpcOptions []grpc.ServerOption
 
+	// ResourceTransformers transform the resources of their type URL before the XDS proxy forwards them to Envoy,
+	// ahead of the Wasm rewrite of the ECDS resources. The resources of the other types are forwarded as is.
+	ResourceTransformers map[string]ResourceTransformer
+
+	// UpstreamGrpcOptions are added to the dial options of the XDS proxy connection to the upstream XDS server,
+	// for instance to add interceptors. They are applied after the options built by the agent.
+	UpstreamGrpcOptions []grpc.DialOption
+
 	IstiodSAN string
 
 	WASMOptions wasm.Options
 
+	// WASMCache if set is the cache the XDS proxy fetches the Wasm modules referenced by ECDS with, instead of
+	// the local file cache configured by WASMOptions. It is cleaned up when the agent is closed.
+	WASMCache wasm.Cache
+
 	// Is the proxy in Dual Stack environment
 	DualStack bool
 
@@ -198,6 +216,235 @@ type AgentOptions struct {
 
 	// Enable metadata discovery bootstrap extension
 	MetadataDiscovery bool
+
+	// DeltaToSotwUpstream if true translates delta XDS streams from Envoy to state of the world
+	// streams to the upstream, for upstreams which do not support delta XDS.
+	DeltaToSotwUpstream bool
+
+	// DeltaUpstreamReconnect if true reconnects delta XDS streams to the upstream on transient failures,
+	// resuming the state of Envoy instead of closing the stream from Envoy.
+	DeltaUpstreamReconnect bool
+
+	// ResubscribeCodes are the gRPC status codes of the failures of the upstream delta XDS stream, such as UNAVAILABLE
+	// during a rollout of the upstream, on which the XDS proxy cleanly resubscribes to the resources tracked for
+	// Envoy on a new stream after a backoff, without the versions known by Envoy. Failures with other codes are
+	// forwarded to Envoy as errors, unless reconnected otherwise. See ParseResubscribeCodes.
+	ResubscribeCodes []codes.Code
+
+	// HoldDownstreamOnUpstreamLoss if true holds the delta XDS streams from Envoy open while the upstream XDS server
+	// is unreachable, including when Envoy connects, so Envoy keeps its configuration instead of reconnecting. The
+	// XDS proxy reconnects to the upstream until it is reachable again, and resumes the state of Envoy on it.
+	HoldDownstreamOnUpstreamLoss bool
+
+	// ServeLastGoodResources if true keeps an in-memory snapshot of the resources acknowledged by Envoy on the delta
+	// XDS streams. While the upstream XDS server is unreachable, the snapshot is served to an Envoy subscribing on a
+	// new stream without resources, and superseded by the first response of the upstream of each type.
+	ServeLastGoodResources bool
+
+	// DeltaResponseQueueSize if positive queues delta XDS responses from the upstream instead of blocking the
+	// upstream when Envoy is slow, coalescing the responses of a type URL once the queue is full.
+	DeltaResponseQueueSize int
+
+	// XDSProxyDryRun if true processes the delta XDS responses from the upstream, including the Wasm module
+	// rewriting of ECDS, but reports whether they would be ACKed or NACKed instead of forwarding them to Envoy.
+	XDSProxyDryRun bool
+
+	// UpstreamKeepalive if set configures the gRPC keepalive of the connection to the upstream XDS server.
+	// Otherwise, the default keepalive options are used.
+	UpstreamKeepalive *keepalive.ClientParameters
+
+	// UpstreamMaxIdle if positive is the time without any request sent to or response received from the upstream
+	// XDS server after which the connection is proactively reestablished. The stream of Envoy is kept, and its
+	// requests are resent on the new connection.
+	UpstreamMaxIdle time.Duration
+
+	// UpstreamDialTimeout if positive bounds the time spent establishing the connection to the upstream XDS server,
+	// so that a stalled connection attempt fails fast and Envoy reconnects. It does not apply to established
+	// streams, see UpstreamRecvIdleTimeout. Otherwise, the connection attempt is bounded by a default of 5s.
+	UpstreamDialTimeout time.Duration
+
+	// UpstreamRecvIdleTimeout if positive is the time without any response received from the upstream XDS server
+	// after which the connection is reestablished, even if requests are still sent. The stream of Envoy is kept, and
+	// its requests are resent on the new connection.
+	UpstreamRecvIdleTimeout time.Duration
+
+	// MaxDownstreamStreams if positive is the maximum number of concurrent XDS streams the agent serves to Envoy.
+	// Beyond it, new streams are rejected with ResourceExhausted, while the streams being served are unaffected.
+	MaxDownstreamStreams int
+
+	// DownstreamHTTP2 are the HTTP/2 settings of the XDS proxy gRPC server Envoy connects to. The unset settings
+	// keep their defaults.
+	DownstreamHTTP2 DownstreamHTTP2Settings
+
+	// DeltaFlushTimeout if positive is the time the agent spends forwarding the delta XDS responses already
+	// queued for Envoy once Envoy gracefully closes its stream, before tearing down the connection.
+	// Otherwise, the queued responses are dropped.
+	DeltaFlushTimeout time.Duration
+
+	// AckCallback if set is invoked asynchronously with the outcome of each XDS response, so that external
+	// controllers can observe the convergence of the configuration of the proxy.
+	AckCallback AckCallback
+
+	// WasmRewritePredicate if set decides from the node metadata sent by Envoy whether the XDS proxy rewrites the
+	// remote Wasm modules of the ECDS resources to local files. Envoy fetches the modules itself when it returns
+	// false. Otherwise, the modules are always rewritten.
+	WasmRewritePredicate func(meta *model.NodeMetadata) bool
+
+	// ReportWasmFailures if set details each Wasm module which failed to be fetched or verified in the NACK sent
+	// upstream for the ECDS response, as an ErrorInfo with the name of the resource, the URL of the module and the
+	// reason, so that the failures of the agent are visible from Istiod.
+	ReportWasmFailures bool
+
+	// PartialECDSAck if set forwards to Envoy the resources of an ECDS delta response whose Wasm modules were
+	// rewritten when only some resources failed, instead of NACKing the whole response. Envoy keeps the previous
+	// version of the resources left out, and its ACK is sent upstream as a NACK naming them.
+	PartialECDSAck bool
+
+	// InlineWasmModules if set inlines the Wasm modules fetched for the ECDS resources in the extension configs
+	// forwarded to Envoy, as base64 data, instead of referencing their files in the cache directory. Envoy then does
+	// not need to read the cache directory. It only applies if EnvoyInlineWasmSupported is set.
+	InlineWasmModules bool
+
+	// EnvoyInlineWasmSupported declares that Envoy accepts the Wasm modules inlined in the extension configs.
+	// Older Envoy versions do not, and InlineWasmModules is then ignored.
+	EnvoyInlineWasmSupported bool
+
+	// DefaultNodeMetadata if set is merged into the node of the delta XDS requests from Envoy before they are
+	// sent upstream. Only the fields absent from the node metadata sent by Envoy are set.
+	DefaultNodeMetadata *model.NodeMetadata
+
+	// RequiredNodeMetadata are the fields of the node metadata, by their JSON name such as NAMESPACE or INSTANCE_IPS,
+	// that Envoy must set. The XDS streams whose node lacks any of them are rejected with InvalidArgument naming the
+	// missing fields, rather than forwarded to the upstream XDS server which would compute an empty configuration.
+	RequiredNodeMetadata []string
+
+	// AllowedTypeURLs if not empty are the only type URLs Envoy may subscribe to through the XDS proxy, and
+	// DeniedTypeURLs are type URLs it may not subscribe to. The XDS streams subscribing to any other type URL are
+	// rejected with PermissionDenied, without the request being forwarded to the upstream XDS server.
+	AllowedTypeURLs []string
+	DeniedTypeURLs  []string
+
+	// UpstreamDNSCacheTTL if positive is the time the resolved addresses of the upstream XDS server are reused across
+	// the reconnects, instead of being resolved again. They are resolved again when the connection to them fails,
+	// and still used if they fail to be resolved again, so that reconnects are not delayed or failed by DNS blips.
+	UpstreamDNSCacheTTL time.Duration
+
+	// ReconnectCoalesceWindow if positive is the time a new XDS stream from Envoy is held before it is forwarded to
+	// the upstream XDS server. The streams closed or replaced by a reconnect of Envoy within the window never reach
+	// the upstream, and the initial requests are batched, without duplicates, which smooths reconnect storms of a
+	// flapping Envoy at the cost of delaying the first response of every stream.
+	ReconnectCoalesceWindow time.Duration
+
+	// UpstreamStartupJitter if positive delays the first upstream subscription of the agent by a random interval
+	// up to the jitter, so that a fleet of agents restarting together, or reconnecting to a restarted control
+	// plane, spreads its load on the upstream XDS server. The static bootstrap resources are still served at once.
+	UpstreamStartupJitter time.Duration
+
+	// RedactLoggedResponses if set replaces the inline data, such as Wasm modules and secrets, and the credentials
+	// of the delta XDS responses logged by the xdsresponses scope at debug level by their hash. The names of the
+	// resources and the nonces are kept, so the logs can be safely enabled in regulated environments.
+	RedactLoggedResponses bool
+
+	// MeshMetricLabels if set labels the XDS proxy metrics recorded for Envoy, such as the bytes of the XDS
+	// messages, the latency of the ACKs and the duration of the Wasm module fetches, with the cluster_id and
+	// mesh_id of the node metadata of Envoy. The number of distinct values of the labels is bounded.
+	MeshMetricLabels bool
+
+	// MaxInflightResponses if positive is the number of delta XDS responses of a type the XDS proxy forwards to Envoy
+	// before Envoy acknowledges them. The following responses of the type are held, in order, until Envoy
+	// acknowledges one, which keeps the nonces of the data planes acknowledging late in step.
+	MaxInflightResponses int
+
+	// AckTimeouts if set are the ACK timeouts of type URLs. If Envoy does not acknowledge the last delta XDS response
+	// of a type within its timeout, the XDS proxy logs a warning and resends the response, up to AckTimeoutResends
+	// times. See ParseAckTimeouts.
+	AckTimeouts map[string]time.Duration
+
+	// AckTimeoutResends is the number of times a response Envoy does not acknowledge within its ACK timeout is resent.
+	AckTimeoutResends int
+
+	// ResponsePrerequisites if set are the prerequisite type URLs of dependent type URLs, such as CDS for EDS and
+	// LDS for RDS. The XDS proxy holds the delta XDS responses of a dependent type while a response of one of its
+	// prerequisites is not acknowledged by Envoy yet, so that Envoy warms the dependent resources against the
+	// prerequisites they reference. See ParseResponsePrerequisites.
+	ResponsePrerequisites map[string][]string
+
+	// RequestPriorities if set are the priorities of type URLs, such as CDS and LDS over SDS and ECDS. When delta
+	// requests from Envoy are pending, for instance after a reconnect, the XDS proxy sends them to the upstream by
+	// priority, higher first. The types not listed have priority 0. See ParseRequestPriorities.
+	RequestPriorities map[string]int
+
+	// Tracer if set traces the delta XDS responses handled by the XDS proxy: their receipt from the upstream, the
+	// rewrite of their Wasm modules and their forwarding to Envoy. The spans of a response carry its type URL, nonce
+	// and the correlation ID of the proxy logs.
+	Tracer trace.Tracer
+
+	// SharedUpstream if set serves the delta XDS streams of the Envoys connecting to the XDS proxy while an Envoy is
+	// connected from the upstream XDS stream of the latter, instead of replacing it. The responses are fanned out to
+	// each Envoy, filtered by its subscriptions. This saves connections to the upstream XDS server when several
+	// Envoys sharing an identity run on a node. The Envoys reconnect once the Envoy owning the upstream stream leaves.
+	SharedUpstream bool
+
+	// XDSProxyBootstrapResources if set is the path of an Envoy bootstrap, in YAML or JSON, whose static clusters
+	// and listeners the XDS proxy serves to Envoy as soon as Envoy subscribes to them on a new delta stream, without
+	// waiting for the upstream XDS server. The first response of the upstream of each type supersedes them, and
+	// removes those it does not include, which shortens the time to the first configuration of a cold start.
+	XDSProxyBootstrapResources string
+
+	// UpstreamDisconnectedThreshold if positive is the time the XDS proxy may be disconnected from the upstream
+	// XDS server before the agent reports not ready.
+	UpstreamDisconnectedThreshold time.Duration
+
+	// FailoverDiscoveryAddresses are the addresses of the XDS servers the XDS proxy fails over to, in order,
+	// when the discovery address is unreachable. The same TLS settings are used for all the addresses.
+	FailoverDiscoveryAddresses []string
+
+	// UpstreamCompression if true compresses the XDS streams to the upstream XDS server with gzip.
+	UpstreamCompression bool
+
+	// ReloadXDSRootCert if true reloads the rotated root certificate of the upstream XDS server on the new
+	// handshakes of the established connection. Otherwise, the connection is replaced once the root or client
+	// certificate rotates, resuming the delta XDS state of Envoy on the new connection.
+	ReloadXDSRootCert bool
+
+	// ECDSTypeURLAliases are the type URLs the XDS proxy handles as ECDS, in addition to the standard one,
+	// for Envoy builds subscribing to extension configs with a different type URL.
+	ECDSTypeURLAliases []string
+
+	// UpstreamRequestRate if positive limits the rate in requests per second of the delta XDS requests the XDS
+	// proxy sends to the upstream on each stream. Requests exceeding the rate are delayed, and dropped if they
+	// duplicate a delayed request of the same type.
+	UpstreamRequestRate float64
+
+	// UpstreamRequestBurst is the number of delta XDS requests which may be sent at once above
+	// UpstreamRequestRate. If not positive, it defaults to the rate.
+	UpstreamRequestBurst int
+
+	// CircuitBreakerFailures if positive is the number of consecutive upstream failures of a type URL, responses
+	// rejected by the XDS proxy or upstream stream errors, after which the proxy holds the delta XDS requests of
+	// the type other than ACKs and subscription changes for CircuitBreakerCooldown, before probing the upstream
+	// again.
+	CircuitBreakerFailures int
+
+	// CircuitBreakerCooldown is the time the delta XDS requests of a type are held once its circuit breaker opened.
+	CircuitBreakerCooldown time.Duration
+
+	// MaxDeltaResponseSize if positive is the size in bytes above which the delta XDS responses from the upstream
+	// are split into several responses before being forwarded to Envoy, so that they do not exceed the maximum
+	// message size of Envoy. Envoy acknowledges each chunk, and the upstream the whole response.
+	MaxDeltaResponseSize int
+
+	// XDSProxyGRPCWeb if true serves delta XDS streams to gRPC-web clients, such as browser based debugging tools,
+	// on the debug interface enabled by ProxyXDSDebugViaAgent. These streams do not replace the stream of Envoy.
+	XDSProxyGRPCWeb bool
+
+	// NodeIDParser if set decomposes the node IDs of the proxies connecting to the XDS proxy, for proxies whose
+	// node IDs do not follow the Istio convention. Otherwise, DefaultNodeIDParser is used.
+	NodeIDParser NodeIDParser
+
+	// NodeMetadataMutators if set transform, in order, the node of the delta XDS requests from Envoy before they are
+	// forwarded to the upstream XDS server. More can be registered with XdsProxy.RegisterNodeMetadataMutator.
+	NodeMetadataMutators []NodeMetadataMutator
 }
 
 // NewAgent hosts the functionality for local SDS and XDS. This consists of the local SDS server and
@@ -354,11 +601,18 @@ func (a *Agent) Run(ctx context.Context) (func(), error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to find root XDS CA: %v", err)
 		}
-		go a.startFileWatcher(ctx, rootCAForXDS, func() {
+		rotated := func() {
 			if err := a.xdsProxy.initIstiodDialOptions(a); err != nil {
 				log.Warnf("Failed to init xds proxy dial options")
+				return
 			}
-		})
+			a.xdsProxy.upstreamCertsRotated()
+		}
+		go a.startFileWatcher(ctx, rootCAForXDS, rotated)
+		if _, cert := a.GetKeyCertsForXDS(); cert != "" && !a.cfg.ReloadXDSRootCert {
+			// The client certificate is loaded on each handshake, the upstream is redialed so that it is presented.
+			go a.startFileWatcher(ctx, cert, rotated)
+		}
 	}
 
 	if !a.EnvoyDisabled() {
@@ -514,7 +768,8 @@ func (a *Agent) generateGRPCBootstrap() error {
 	return nil
 }
 
-// Check is used in to readiness check of agent to ensure DNSServer is ready.
+// Check is used in to readiness check of agent to ensure DNSServer is ready, and that the XDS proxy
+// is not disconnected from the upstream XDS server for too long.
 func (a *Agent) Check() (err error) {
 	// we dont need dns server on gateways
 	if a.cfg.DNSCapture && a.cfg.ProxyType == model.SidecarProxy {
@@ -522,6 +777,9 @@ func (a *Agent) Check() (err error) {
 			return errors.New("istio DNS capture is turned ON and DNS lookup table is not ready yet")
 		}
 	}
+	if a.cfg.UpstreamDisconnectedThreshold > 0 && a.xdsProxy != nil {
+		return a.xdsProxy.UpstreamHealth().check(a.cfg.UpstreamDisconnectedThreshold)
+	}
 	return nil
 }
 
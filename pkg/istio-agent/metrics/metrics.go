@@ -15,16 +15,35 @@
 package metrics
 
 import (
+	"sync"
+	"time"
+
 	"istio.io/istio/pkg/monitoring"
 )
 
 const (
 	Cancel = "cancelled"
 	Error  = "error"
+
+	// Directions of the xDS messages flowing through the proxy.
+	UpstreamReceived   = "upstream_received"
+	UpstreamSent       = "upstream_sent"
+	DownstreamReceived = "downstream_received"
+	DownstreamSent     = "downstream_sent"
+
+	// Sides of the delta xDS streams of the proxy.
+	Upstream   = "upstream"
+	Downstream = "downstream"
 )
 
 var (
 	disconnectionTypeTag = monitoring.CreateLabel("type")
+	xdsTypeTag           = monitoring.CreateLabel("type")
+	verdictTag           = monitoring.CreateLabel("verdict")
+	directionTag         = monitoring.CreateLabel("direction")
+	outcomeTag           = monitoring.CreateLabel("outcome")
+	clusterIDTag         = monitoring.CreateLabel("cluster_id")
+	meshIDTag            = monitoring.CreateLabel("mesh_id")
 
 	// IstiodConnectionFailures records total number of connection failures to Istiod.
 	IstiodConnectionFailures = monitoring.NewSum(
@@ -58,8 +77,220 @@ var (
 		"The total number of Xds Proxy Responses",
 	)
 
+	// xdsProxyAckLatency records the delay between a response being forwarded to Envoy and its ACK.
+	xdsProxyAckLatency = monitoring.NewDistribution(
+		"xds_proxy_ack_latency",
+		"Delay in seconds between a response being forwarded to Envoy and Envoy acknowledging it, by type.",
+		[]float64{.01, .1, .5, 1, 3, 5, 10, 20, 30},
+	)
+
+	// xdsProxyTimeToFirstConfig records the delay between Envoy connecting and the first response forwarded to it.
+	xdsProxyTimeToFirstConfig = monitoring.NewDistribution(
+		"xds_proxy_time_to_first_config",
+		"Delay in seconds between Envoy connecting to the Xds Proxy and the first response forwarded to it, by type "+
+			"of the first response.",
+		[]float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	)
+
+	// xdsProxyDryRunVerdicts records the verdicts of the responses processed in dry run mode.
+	xdsProxyDryRunVerdicts = monitoring.NewSum(
+		"xds_proxy_dry_run_verdicts",
+		"The total number of responses processed in dry run mode, by type and whether they would be ACKed or NACKed.",
+	)
+
+	// xdsProxyAckTimeouts records the responses Envoy did not acknowledge within their ACK timeout.
+	xdsProxyAckTimeouts = monitoring.NewSum(
+		"xds_proxy_ack_timeouts",
+		"The total number of responses Envoy did not acknowledge within the ACK timeout of their type, by type and "+
+			"whether they were resent or given up on.",
+	)
+
+	// xdsProxyBytes records the size of the xDS messages flowing through the proxy.
+	xdsProxyBytes = monitoring.NewSum(
+		"xds_proxy_bytes",
+		"The total size in bytes of the Xds Proxy requests and responses, by type and direction.",
+	)
+
+	// xdsProxyRateLimitedRequests records the requests to the upstream exceeding the rate limit.
+	xdsProxyRateLimitedRequests = monitoring.NewSum(
+		"xds_proxy_rate_limited_requests",
+		"The total number of Xds Proxy requests to the upstream exceeding the rate limit, by type and whether "+
+			"they were delayed or dropped as duplicates of a delayed request.",
+	)
+
+	// xdsProxyCircuitBreakers records the open circuit breakers of the requests to the upstream.
+	xdsProxyCircuitBreakers = monitoring.NewGauge(
+		"xds_proxy_circuit_breakers_open",
+		"The number of Xds Proxy connections whose circuit breaker is open or half-open for a type, holding the "+
+			"requests of the type after repeated upstream failures, by type.",
+	)
+
+	// xdsProxyQueuedResponses records the responses from the upstream queued toward Envoy.
+	xdsProxyQueuedResponses = monitoring.NewGauge(
+		"xds_proxy_downstream_queued_responses",
+		"The number of responses received by the Xds Proxy from the upstream and not sent to Envoy yet, by type.",
+	)
+
+	// xdsProxyDeltaStreams records the number of active delta xDS streams of the proxy.
+	xdsProxyDeltaStreams = monitoring.NewGauge(
+		"xds_proxy_delta_streams",
+		"The number of active Xds Proxy delta streams, from Envoy (downstream) and to the upstream (upstream).",
+	)
+
+	// xdsProxyDeltaGoroutines records the number of goroutines running for the delta xDS connections of the proxy.
+	xdsProxyDeltaGoroutines = monitoring.NewGauge(
+		"xds_proxy_delta_goroutines",
+		"The number of goroutines running for the Xds Proxy delta connections.",
+	)
+
 	IstiodConnectionCancellations = istiodDisconnections.With(disconnectionTypeTag.Value(Cancel))
 	IstiodConnectionErrors        = istiodDisconnections.With(disconnectionTypeTag.Value(Error))
 	EnvoyConnectionCancellations  = envoyDisconnections.With(disconnectionTypeTag.Value(Cancel))
 	EnvoyConnectionErrors         = envoyDisconnections.With(disconnectionTypeTag.Value(Error))
 )
+
+// RecordAckLatency records the delay between a response of the given xDS type being forwarded to Envoy and its ACK,
+// with the given extra labels, such as the MeshLabels of the Envoy.
+func RecordAckLatency(typ string, latency time.Duration, labels ...monitoring.LabelValue) {
+	xdsProxyAckLatency.With(xdsTypeTag.Value(typ)).With(labels...).Record(latency.Seconds())
+}
+
+// RecordTimeToFirstConfig records the delay between Envoy connecting and the first response, of the given xDS type,
+// forwarded to it, with the given extra labels, such as the MeshLabels of the Envoy.
+func RecordTimeToFirstConfig(typ string, delay time.Duration, labels ...monitoring.LabelValue) {
+	xdsProxyTimeToFirstConfig.With(xdsTypeTag.Value(typ)).With(labels...).Record(delay.Seconds())
+}
+
+// RecordDryRunVerdict records whether a response of the given xDS type processed in dry run mode would be ACKed.
+func RecordDryRunVerdict(typ string, ack bool) {
+	verdict := "nack"
+	if ack {
+		verdict = "ack"
+	}
+	xdsProxyDryRunVerdicts.With(xdsTypeTag.Value(typ), verdictTag.Value(verdict)).Increment()
+}
+
+// RecordAckTimeout records a response of the given xDS type Envoy did not acknowledge within its ACK timeout, and
+// whether it was resent or given up on.
+func RecordAckTimeout(typ string, resent bool) {
+	outcome := "abandoned"
+	if resent {
+		outcome = "resent"
+	}
+	xdsProxyAckTimeouts.With(xdsTypeTag.Value(typ), outcomeTag.Value(outcome)).Increment()
+}
+
+// RecordBytes records the size of an xDS message of the given type flowing through the proxy in the given direction,
+// with the given extra labels, such as the MeshLabels of the Envoy.
+func RecordBytes(direction, typ string, size int, labels ...monitoring.LabelValue) {
+	xdsProxyBytes.With(directionTag.Value(direction), xdsTypeTag.Value(typ)).With(labels...).RecordInt(int64(size))
+}
+
+// maxMeshLabelValues bounds the number of distinct cluster IDs, and of mesh IDs, labeling the metrics. The metrics
+// of the clusters and meshes seen beyond are labeled "other".
+const maxMeshLabelValues = 16
+
+var (
+	meshLabelsMu    sync.Mutex
+	clusterIDValues = map[string]struct{}{}
+	meshIDValues    = map[string]struct{}{}
+)
+
+// MeshLabels returns the cluster_id and mesh_id labels of the metrics recorded for an Envoy of the given cluster
+// and mesh, as set in its node metadata.
+func MeshLabels(clusterID, meshID string) []monitoring.LabelValue {
+	meshLabelsMu.Lock()
+	defer meshLabelsMu.Unlock()
+	return []monitoring.LabelValue{
+		clusterIDTag.Value(boundedMeshValue(clusterIDValues, clusterID)),
+		meshIDTag.Value(boundedMeshValue(meshIDValues, meshID)),
+	}
+}
+
+func boundedMeshValue(values map[string]struct{}, value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	if _, f := values[value]; f {
+		return value
+	}
+	if len(values) >= maxMeshLabelValues {
+		return "other"
+	}
+	values[value] = struct{}{}
+	return value
+}
+
+// RecordRateLimitedRequest records a request of the given xDS type exceeding the rate limit of the requests to the
+// upstream, which is either delayed or dropped as a duplicate of a delayed request.
+func RecordRateLimitedRequest(typ string, coalesced bool) {
+	outcome := "delayed"
+	if coalesced {
+		outcome = "coalesced"
+	}
+	xdsProxyRateLimitedRequests.With(xdsTypeTag.Value(typ), outcomeTag.Value(outcome)).Increment()
+}
+
+var (
+	activeMu         sync.Mutex
+	activeStreams    = map[string]int{}
+	activeGoroutines int
+	openBreakers     = map[string]int{}
+	queuedResponses  = map[string]int{}
+)
+
+// RecordCircuitBreakerOpen records that the circuit breaker of a connection for the given xDS type opened, or
+// closed if open is false.
+func RecordCircuitBreakerOpen(typ string, open bool) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if open {
+		openBreakers[typ]++
+	} else {
+		openBreakers[typ]--
+	}
+	xdsProxyCircuitBreakers.With(xdsTypeTag.Value(typ)).Record(float64(openBreakers[typ]))
+}
+
+// RecordQueuedResponses records that delta responses of the given xDS type were queued toward Envoy, or
+// dequeued if delta is negative.
+func RecordQueuedResponses(typ string, delta int) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	queuedResponses[typ] += delta
+	xdsProxyQueuedResponses.With(xdsTypeTag.Value(typ)).Record(float64(queuedResponses[typ]))
+}
+
+// DeltaStreamOpened records that a delta xDS stream was opened on the given side of the proxy.
+func DeltaStreamOpened(side string) {
+	recordDeltaStreams(side, 1)
+}
+
+// DeltaStreamClosed records that a delta xDS stream was closed on the given side of the proxy.
+func DeltaStreamClosed(side string) {
+	recordDeltaStreams(side, -1)
+}
+
+func recordDeltaStreams(side string, delta int) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	activeStreams[side] += delta
+	xdsProxyDeltaStreams.With(directionTag.Value(side)).Record(float64(activeStreams[side]))
+}
+
+// DeltaGoroutineStarted records that a goroutine was started for a delta xDS connection.
+func DeltaGoroutineStarted() {
+	recordDeltaGoroutines(1)
+}
+
+// DeltaGoroutineStopped records that a goroutine of a delta xDS connection returned.
+func DeltaGoroutineStopped() {
+	recordDeltaGoroutines(-1)
+}
+
+func recordDeltaGoroutines(delta int) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	activeGoroutines += delta
+	xdsProxyDeltaGoroutines.Record(float64(activeGoroutines))
+}
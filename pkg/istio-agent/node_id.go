@@ -0,0 +1,66 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// NodeIdentity is the identity of a proxy, decomposed from the node ID it connects with.
+type NodeIdentity struct {
+	Type        model.NodeType
+	IPAddresses []string
+	// ID is the ID of the proxy within the node ID, usually of the form pod.namespace.
+	ID        string
+	Namespace string
+	DNSDomain string
+}
+
+// NodeIDParser decomposes the node IDs of the proxies connecting to the XDS proxy.
+type NodeIDParser interface {
+	Parse(nodeID string) (*NodeIdentity, error)
+}
+
+// DefaultNodeIDParser parses the node IDs generated for Istio proxies, of the form type~ip~pod.namespace~domain,
+// for instance sidecar~1.1.1.1~productpage-v1.default~default.svc.cluster.local.
+type DefaultNodeIDParser struct{}
+
+var _ NodeIDParser = DefaultNodeIDParser{}
+
+func (DefaultNodeIDParser) Parse(nodeID string) (*NodeIdentity, error) {
+	parts := strings.Split(nodeID, "~")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("missing parts in the node ID %q, expected 4 parts separated by ~", nodeID)
+	}
+	identity := &NodeIdentity{
+		Type:      model.NodeType(parts[0]),
+		ID:        parts[2],
+		DNSDomain: parts[3],
+	}
+	if !model.IsApplicationNodeType(identity.Type) {
+		return nil, fmt.Errorf("invalid node type %q in the node ID %q", parts[0], nodeID)
+	}
+	if parts[1] != "" {
+		identity.IPAddresses = []string{parts[1]}
+	}
+	// Pod names may contain dots, while namespaces may not.
+	if i := strings.LastIndex(identity.ID, "."); i >= 0 {
+		identity.Namespace = identity.ID[i+1:]
+	}
+	return identity, nil
+}
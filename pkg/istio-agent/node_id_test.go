@@ -0,0 +1,75 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+func TestDefaultNodeIDParser(t *testing.T) {
+	cases := []struct {
+		name    string
+		nodeID  string
+		want    *NodeIdentity
+		wantErr bool
+	}{
+		{
+			name:   "sidecar",
+			nodeID: "sidecar~10.0.0.1~productpage-v1.default~default.svc.cluster.local",
+			want: &NodeIdentity{
+				Type:        model.SidecarProxy,
+				IPAddresses: []string{"10.0.0.1"},
+				ID:          "productpage-v1.default",
+				Namespace:   "default",
+				DNSDomain:   "default.svc.cluster.local",
+			},
+		},
+		{
+			name:   "pod name with dots",
+			nodeID: "router~10.0.0.1~ingress.v1.istio-system~istio-system.svc.cluster.local",
+			want: &NodeIdentity{
+				Type:        model.Router,
+				IPAddresses: []string{"10.0.0.1"},
+				ID:          "ingress.v1.istio-system",
+				Namespace:   "istio-system",
+				DNSDomain:   "istio-system.svc.cluster.local",
+			},
+		},
+		{
+			name:   "no namespace",
+			nodeID: "sidecar~1.1.1.1~debug~cluster.local",
+			want: &NodeIdentity{
+				Type:        model.SidecarProxy,
+				IPAddresses: []string{"1.1.1.1"},
+				ID:          "debug",
+				DNSDomain:   "cluster.local",
+			},
+		},
+		{name: "missing parts", nodeID: "sidecar~1.1.1.1~debug", wantErr: true},
+		{name: "invalid type", nodeID: "gateway~1.1.1.1~debug~cluster.local", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := DefaultNodeIDParser{}.Parse(c.nodeID)
+			if gotErr := err != nil; gotErr != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			assert.Equal(t, got, c.want)
+		})
+	}
+}
@@ -17,6 +17,7 @@ package istioagent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net"
@@ -26,22 +27,31 @@ import (
 	"sync"
 	"time"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/atomic"
 	"golang.org/x/net/http2"
 	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	anypb "google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/cmd/pilot-agent/status/ready"
 	"istio.io/istio/pilot/pkg/features"
 	istiogrpc "istio.io/istio/pilot/pkg/grpc"
+	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/xds"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/backoff"
 	"istio.io/istio/pkg/channels"
 	"istio.io/istio/pkg/config/constants"
 	dnsProto "istio.io/istio/pkg/dns/proto"
@@ -50,9 +60,12 @@ import (
 	"istio.io/istio/pkg/istio-agent/metrics"
 	istiokeepalive "istio.io/istio/pkg/keepalive"
 	"istio.io/istio/pkg/log"
+	"istio.io/istio/pkg/monitoring"
 	"istio.io/istio/pkg/network"
+	"istio.io/istio/pkg/slices"
 	"istio.io/istio/pkg/uds"
 	"istio.io/istio/pkg/util/protomarshal"
+	"istio.io/istio/pkg/util/sets"
 	"istio.io/istio/pkg/wasm"
 	"istio.io/istio/security/pkg/nodeagent/caclient"
 	"istio.io/istio/security/pkg/pki/util"
@@ -60,6 +73,12 @@ import (
 
 const (
 	defaultClientMaxReceiveMessageSize = math.MaxInt32
+	defaultWasmFetchInitialBackoff     = 500 * time.Millisecond
+	defaultUpstreamDialTimeout         = 5 * time.Second
+
+	defaultDeltaReconnectInitialBackoff = 100 * time.Millisecond
+	deltaReconnectMaxInterval           = 5 * time.Second
+	deltaReconnectMaxElapsedTime        = 30 * time.Second
 )
 
 var connectionNumber = atomic.NewUint32(0)
@@ -89,7 +108,122 @@ type XdsProxy struct {
 	xdsHeaders           map[string]string
 	xdsUdsPath           string
 	proxyAddresses       []string
-	ia                   *Agent
+	// deltaToSotw if true serves delta xDS streams from Envoy using SotW streams to the upstream.
+	deltaToSotw bool
+	// deltaReconnect if true reconnects delta xDS streams to the upstream on transient failures,
+	// starting with a backoff of deltaReconnectBackoff.
+	deltaReconnect        bool
+	deltaReconnectBackoff time.Duration
+	// resubscribeCodes are the gRPC status codes of upstream delta stream failures which resubscribe to the resources
+	// tracked for Envoy on a new stream, without their versions.
+	resubscribeCodes sets.Set[codes.Code]
+	// holdDownstream if true holds the delta xDS streams of Envoy open while the upstream is lost, reconnecting
+	// until it is reachable again instead of closing the stream from Envoy.
+	holdDownstream bool
+	// lastGood if set is the snapshot of the resources acknowledged by Envoy, served to a reconnecting Envoy
+	// while the upstream is unreachable.
+	lastGood *deltaLastGood
+	// deltaResponseQueueSize if positive is the capacity of the coalescing queue of delta responses from the upstream.
+	deltaResponseQueueSize int
+	// deltaDryRun if true reports the verdict of delta responses instead of forwarding them to Envoy.
+	deltaDryRun bool
+	// maxDeltaResponseSize if positive is the size in bytes above which delta responses are split into several
+	// responses before being forwarded to Envoy.
+	maxDeltaResponseSize int
+	// grpcWeb if true serves delta XDS streams to gRPC-web clients on the debug interface.
+	grpcWeb bool
+	// upstreamKeepalive if set overrides the default keepalive of the connection to the upstream.
+	upstreamKeepalive *keepalive.ClientParameters
+	// upstreamMaxIdle if positive is the time without messages exchanged after which the upstream is reconnected.
+	upstreamMaxIdle time.Duration
+	// upstreamDialTimeout if positive bounds the time spent establishing the connection to the upstream.
+	upstreamDialTimeout time.Duration
+	// upstreamRecvIdleTimeout if positive is the time without responses after which the upstream is reconnected.
+	upstreamRecvIdleTimeout time.Duration
+	// maxDownstreamStreams if positive is the maximum number of concurrent streams served to Envoy.
+	maxDownstreamStreams int32
+	// downstreamStreams is the number of streams currently served to Envoy.
+	downstreamStreams atomic.Int32
+	// downstreamHTTP2 are the HTTP/2 settings of the server Envoy connects to.
+	downstreamHTTP2 DownstreamHTTP2Settings
+	// resourceTransformers transform the resources of their type URL before they are forwarded to Envoy.
+	resourceTransformers map[string]ResourceTransformer
+	// draining is set once Drain is called, to reject the new streams from Envoy.
+	draining atomic.Bool
+	// closeOnce tears down the proxy once, whether it is drained or closed.
+	closeOnce sync.Once
+	// deltaFlushTimeout if positive is the time allowed to flush the queued delta responses to Envoy once
+	// Envoy gracefully closes its stream.
+	deltaFlushTimeout time.Duration
+	// defaultNodeMetadata if set is merged into the node of the delta requests from Envoy.
+	defaultNodeMetadata *structpb.Struct
+	// requiredNodeMetadata are the fields of the node metadata that Envoy must set, otherwise its stream is rejected.
+	requiredNodeMetadata []string
+	// allowedTypeURLs if not empty are the only type URLs Envoy may subscribe to, deniedTypeURLs those it may not.
+	allowedTypeURLs sets.String
+	deniedTypeURLs  sets.String
+	// bootstrapResources are the resources served to Envoy, by type URL, before the upstream responds.
+	bootstrapResources map[string][]*discovery.Resource
+	// upstreamDNS if set caches the resolved addresses of the upstream across the reconnects.
+	upstreamDNS *upstreamDNSCache
+	// reconnectCoalesceWindow if positive is the time a new stream from Envoy is held before it is forwarded
+	// upstream, to drop the streams replaced meanwhile by a reconnect and coalesce the initial requests.
+	reconnectCoalesceWindow time.Duration
+	// startupDelay if positive delays the first upstream subscription of the agent, which startupDelayed records.
+	startupDelay   time.Duration
+	startupDelayed atomic.Bool
+	// sharedUpstream shares the upstream delta stream of the connected Envoy with the other Envoys connecting,
+	// instead of replacing it.
+	sharedUpstream bool
+	// maxInflightResponses if positive is the number of delta responses of a type that can be forwarded to Envoy
+	// before Envoy acknowledges them. The following responses are held until an ACK.
+	maxInflightResponses int
+	// ackTimeouts if set are the ACK timeouts of type URLs, after which the last delta response of the type is
+	// resent to Envoy, up to ackTimeoutResends times.
+	ackTimeouts       map[string]time.Duration
+	ackTimeoutResends int
+	// responsePrerequisites if set are the prerequisite type URLs of dependent type URLs, whose delta responses
+	// are held until the prerequisites are acknowledged.
+	responsePrerequisites map[string][]string
+	// requestPriorities if set are the priorities of type URLs, by which the pending delta requests from Envoy are
+	// sent to the upstream.
+	requestPriorities map[string]int
+	// tracer if set traces the handling of the delta responses, in spans linked by the correlation IDs.
+	tracer trace.Tracer
+	// meshMetricLabels labels the metrics of the connections with the cluster and mesh IDs of the node of Envoy.
+	meshMetricLabels bool
+	// redactLoggedResponses redacts the content of the sensitive fields of the logged delta responses.
+	redactLoggedResponses bool
+	// rewrites are the type URLs whose special handling is disabled at runtime by /debug/agent/rewritez.
+	rewrites rewriteToggles
+	// nodeMutators transform the nodes of the delta requests from Envoy, in order.
+	nodeMutators   []NodeMetadataMutator
+	nodeMutatorsMu sync.RWMutex
+	// nodeIDParser decomposes the node ID of the delta requests from Envoy.
+	nodeIDParser NodeIDParser
+	// upstreamHealth tracks the state of the connection to the upstream.
+	upstreamHealth upstreamHealthTracker
+	// failoverAddresses are the addresses of the upstream XDS servers to fail over to, in order,
+	// when istiodAddress is unreachable.
+	failoverAddresses []string
+	// activeAddress is the upstream address last connected to when failing over.
+	activeAddress atomic.String
+	// upstreamCompression if true compresses the streams to the upstream with gzip.
+	upstreamCompression bool
+	// reloadRootCert if true reloads the rotated root certificate on new handshakes with the upstream. Otherwise,
+	// the connection to the upstream is replaced once the certificates rotate, see upstreamCertsRotated.
+	reloadRootCert bool
+	// ecdsTypeURLAliases are the type URLs handled as ECDS in addition to v3.ExtensionConfigurationType.
+	ecdsTypeURLAliases []string
+	// upstreamRequestRate if positive is the rate in requests per second of the delta requests sent to the
+	// upstream on each stream, allowing bursts of upstreamRequestBurst requests.
+	upstreamRequestRate  float64
+	upstreamRequestBurst int
+	// circuitBreakerFailures if positive is the number of consecutive upstream failures of a type URL after which
+	// the delta requests of the type are held for circuitBreakerCooldown.
+	circuitBreakerFailures int
+	circuitBreakerCooldown time.Duration
+	ia                     *Agent
 
 	httpTapServer      *http.Server
 	tapMutex           sync.RWMutex
@@ -103,6 +237,35 @@ type XdsProxy struct {
 
 	// Wasm cache and ecds channel are used to replace wasm remote load with local file.
 	wasmCache wasm.Cache
+	// ecdsRewrites remembers the Wasm rewrite of the ECDS resources received from the upstream.
+	ecdsRewrites *ecdsRewriteCache
+	// wasmConversions are the workers converting the ECDS resources of all the connections.
+	wasmConversions *wasm.ConversionPool
+	// Retry settings for converting ECDS resources which fail to fetch remote Wasm modules.
+	wasmFetchMaxAttempts    int
+	wasmFetchMaxElapsedTime time.Duration
+	wasmFetchInitialBackoff time.Duration
+	// wasmFetchGracePeriod if set holds an ECDS response pending while its Wasm module fetches are retried,
+	// and only rejects it once the period elapses. It supersedes the retry settings above.
+	wasmFetchGracePeriod time.Duration
+	// wasmRewritePredicate if set decides from the node metadata of a connection whether the Wasm modules
+	// of its ECDS resources are rewritten. Otherwise, they are always rewritten.
+	wasmRewritePredicate func(meta *model.NodeMetadata) bool
+	// partialECDSAck forwards the resources of the ECDS delta responses which were rewritten when others failed.
+	partialECDSAck bool
+	// reportWasmFailures details the Wasm modules which failed to be fetched or verified in the ECDS NACKs.
+	reportWasmFailures bool
+	// inlineWasmModules inlines the fetched Wasm modules in the ECDS resources, instead of referencing their files.
+	inlineWasmModules bool
+
+	// ackNotifier dispatches the outcome of the XDS responses to the registered callbacks.
+	ackNotifier ackNotifier
+	// upstreamInfo identifies the upstream XDS server the proxy last connected to.
+	upstreamInfo atomic.Pointer[upstreamInfo]
+	// upstreamControlPlane is the control plane identifier last sent by the upstream XDS server.
+	upstreamControlPlane atomic.String
+	// ecdsStatuses tracks the fetch of the Wasm modules of the ECDS resources, by resource name.
+	ecdsStatuses ecdsResourceStatuses
 
 	// ecds version and nonce uses atomic only to prevent race in testing.
 	// In reality there should not be race as istiod will only have one
@@ -110,10 +273,14 @@ type XdsProxy struct {
 	// TODO(bianpengyuan): this relies on the fact that istiod versions all ECDS resources
 	// the same in a update response. This needs update to support per resource versioning,
 	// in case istiod changes its behavior, or a different ECDS server is used.
-	ecdsLastAckVersion    atomic.String
-	ecdsLastNonce         atomic.String
+	ecdsLastAckVersion atomic.String
+	ecdsLastNonce      atomic.String
+	// ecdsLastNack is the last ECDS update rejected by either the agent or Envoy.
+	ecdsLastNack          atomic.Pointer[ecdsNack]
 	downstreamGrpcOptions []grpc.ServerOption
-	istiodSAN             string
+	// upstreamGrpcOptions are appended to dialOptions when dialing the upstream.
+	upstreamGrpcOptions []grpc.DialOption
+	istiodSAN           string
 }
 
 var proxyLog = log.RegisterScope("xdsproxy", "XDS Proxy in Istio Agent")
@@ -137,20 +304,104 @@ func initXdsProxy(ia *Agent) (*XdsProxy, error) {
 		}
 	}
 
-	cache := wasm.NewLocalFileCache(constants.IstioDataDir, ia.cfg.WASMOptions)
+	cache := ia.cfg.WASMCache
+	if cache == nil {
+		cache = wasm.NewLocalFileCache(constants.IstioDataDir, ia.cfg.WASMOptions)
+	}
+	if ia.cfg.InlineWasmModules && !ia.cfg.EnvoyInlineWasmSupported {
+		proxyLog.Warnf("Wasm modules are not inlined in the extension configs: Envoy does not support it")
+	}
+	if overrides := ia.cfg.WASMOptions.LocalOverrides; len(overrides) > 0 {
+		proxyLog.Warnf("Wasm modules of extension configs overridden with local files: %v", overrides)
+		cache = wasm.WithLocalOverrides(cache, overrides)
+	}
 	proxy := &XdsProxy{
-		istiodAddress:         ia.proxyConfig.DiscoveryAddress,
-		istiodSAN:             ia.cfg.IstiodSAN,
-		clusterID:             ia.secOpts.ClusterID,
-		handlers:              map[string]ResponseHandler{},
-		stopChan:              make(chan struct{}),
-		healthChecker:         health.NewWorkloadHealthChecker(ia.proxyConfig.ReadinessProbe, envoyProbe, ia.cfg.ProxyIPAddresses, ia.cfg.IsIPv6),
-		xdsHeaders:            ia.cfg.XDSHeaders,
-		xdsUdsPath:            ia.cfg.XdsUdsPath,
-		wasmCache:             cache,
-		proxyAddresses:        ia.cfg.ProxyIPAddresses,
-		ia:                    ia,
-		downstreamGrpcOptions: ia.cfg.DownstreamGrpcOptions,
+		istiodAddress:           ia.proxyConfig.DiscoveryAddress,
+		istiodSAN:               ia.cfg.IstiodSAN,
+		clusterID:               ia.secOpts.ClusterID,
+		handlers:                map[string]ResponseHandler{},
+		stopChan:                make(chan struct{}),
+		healthChecker:           health.NewWorkloadHealthChecker(ia.proxyConfig.ReadinessProbe, envoyProbe, ia.cfg.ProxyIPAddresses, ia.cfg.IsIPv6),
+		xdsHeaders:              ia.cfg.XDSHeaders,
+		xdsUdsPath:              ia.cfg.XdsUdsPath,
+		wasmCache:               cache,
+		ecdsRewrites:            newECDSRewriteCache(),
+		wasmConversions:         wasm.NewConversionPool(ia.cfg.WASMOptions.ConversionWorkers),
+		wasmFetchMaxAttempts:    ia.cfg.WASMOptions.FetchMaxAttempts,
+		wasmFetchMaxElapsedTime: ia.cfg.WASMOptions.FetchMaxElapsedTime,
+		wasmFetchInitialBackoff: defaultWasmFetchInitialBackoff,
+		wasmFetchGracePeriod:    ia.cfg.WASMOptions.FetchGracePeriod,
+		wasmRewritePredicate:    ia.cfg.WasmRewritePredicate,
+		reportWasmFailures:      ia.cfg.ReportWasmFailures,
+		inlineWasmModules:       ia.cfg.InlineWasmModules && ia.cfg.EnvoyInlineWasmSupported,
+		partialECDSAck:          ia.cfg.PartialECDSAck,
+		proxyAddresses:          ia.cfg.ProxyIPAddresses,
+		deltaToSotw:             ia.cfg.DeltaToSotwUpstream,
+		deltaReconnect:          ia.cfg.DeltaUpstreamReconnect,
+		deltaReconnectBackoff:   defaultDeltaReconnectInitialBackoff,
+		resubscribeCodes:        sets.New(ia.cfg.ResubscribeCodes...),
+		holdDownstream:          ia.cfg.HoldDownstreamOnUpstreamLoss,
+		deltaResponseQueueSize:  ia.cfg.DeltaResponseQueueSize,
+		deltaDryRun:             ia.cfg.XDSProxyDryRun,
+		upstreamKeepalive:       ia.cfg.UpstreamKeepalive,
+		upstreamMaxIdle:         ia.cfg.UpstreamMaxIdle,
+		upstreamDialTimeout:     ia.cfg.UpstreamDialTimeout,
+		upstreamRecvIdleTimeout: ia.cfg.UpstreamRecvIdleTimeout,
+		maxDownstreamStreams:    int32(ia.cfg.MaxDownstreamStreams),
+		downstreamHTTP2:         ia.cfg.DownstreamHTTP2,
+		resourceTransformers:    ia.cfg.ResourceTransformers,
+		deltaFlushTimeout:       ia.cfg.DeltaFlushTimeout,
+		failoverAddresses:       ia.cfg.FailoverDiscoveryAddresses,
+		upstreamCompression:     ia.cfg.UpstreamCompression,
+		reloadRootCert:          ia.cfg.ReloadXDSRootCert,
+		ecdsTypeURLAliases:      ia.cfg.ECDSTypeURLAliases,
+		requiredNodeMetadata:    ia.cfg.RequiredNodeMetadata,
+		allowedTypeURLs:         sets.New(ia.cfg.AllowedTypeURLs...),
+		deniedTypeURLs:          sets.New(ia.cfg.DeniedTypeURLs...),
+		redactLoggedResponses:   ia.cfg.RedactLoggedResponses,
+		meshMetricLabels:        ia.cfg.MeshMetricLabels,
+		maxInflightResponses:    ia.cfg.MaxInflightResponses,
+		ackTimeouts:             ia.cfg.AckTimeouts,
+		ackTimeoutResends:       ia.cfg.AckTimeoutResends,
+		responsePrerequisites:   ia.cfg.ResponsePrerequisites,
+		requestPriorities:       ia.cfg.RequestPriorities,
+		tracer:                  ia.cfg.Tracer,
+		sharedUpstream:          ia.cfg.SharedUpstream,
+		reconnectCoalesceWindow: ia.cfg.ReconnectCoalesceWindow,
+		startupDelay:            startupJitterDelay(ia.cfg.UpstreamStartupJitter),
+		upstreamRequestRate:     ia.cfg.UpstreamRequestRate,
+		upstreamRequestBurst:    ia.cfg.UpstreamRequestBurst,
+		circuitBreakerFailures:  ia.cfg.CircuitBreakerFailures,
+		circuitBreakerCooldown:  ia.cfg.CircuitBreakerCooldown,
+		maxDeltaResponseSize:    ia.cfg.MaxDeltaResponseSize,
+		grpcWeb:                 ia.cfg.XDSProxyGRPCWeb,
+		ia:                      ia,
+		downstreamGrpcOptions:   ia.cfg.DownstreamGrpcOptions,
+		upstreamGrpcOptions:     ia.cfg.UpstreamGrpcOptions,
+	}
+	if ia.cfg.DefaultNodeMetadata != nil {
+		proxy.defaultNodeMetadata = ia.cfg.DefaultNodeMetadata.ToStruct()
+	}
+	if path := ia.cfg.XDSProxyBootstrapResources; path != "" {
+		if proxy.bootstrapResources, err = loadBootstrapResources(path); err != nil {
+			return nil, fmt.Errorf("failed to load the bootstrap resources: %v", err)
+		}
+	}
+	if ia.cfg.ServeLastGoodResources {
+		proxy.lastGood = newDeltaLastGood()
+	}
+	if ia.cfg.UpstreamDNSCacheTTL > 0 {
+		proxy.upstreamDNS = newUpstreamDNSCache(ia.cfg.UpstreamDNSCacheTTL)
+	}
+	if ia.cfg.AckCallback != nil {
+		proxy.RegisterAckCallback(ia.cfg.AckCallback)
+	}
+	for _, m := range ia.cfg.NodeMetadataMutators {
+		proxy.RegisterNodeMetadataMutator(m)
+	}
+	proxy.nodeIDParser = ia.cfg.NodeIDParser
+	if proxy.nodeIDParser == nil {
+		proxy.nodeIDParser = DefaultNodeIDParser{}
 	}
 
 	if ia.localDNSServer != nil {
@@ -181,6 +432,15 @@ func initXdsProxy(ia *Agent) (*XdsProxy, error) {
 		}
 	}
 
+	if urls := ia.cfg.WASMOptions.PrewarmURLs; len(urls) > 0 {
+		// Fetch the modules before Envoy can connect, so the first ECDS push does not wait for them.
+		timeout := ia.cfg.WASMOptions.PrewarmTimeout
+		if timeout <= 0 {
+			timeout = wasm.DefaultPrewarmTimeout
+		}
+		wasm.Prewarm(cache, urls, timeout)
+	}
+
 	proxyLog.Infof("Initializing with upstream address %q and cluster %q", proxy.istiodAddress, proxy.clusterID)
 
 	if err = proxy.initDownstreamServer(); err != nil {
@@ -254,7 +514,9 @@ func (p *XdsProxy) registerStream(c *ProxyConnection) {
 
 // ProxyConnection represents connection to downstream proxy.
 type ProxyConnection struct {
-	conID              uint32
+	conID uint32
+	// log is the logger of the connection, labeled with conID and the address of Envoy. Use logger() to access it.
+	log                *log.Scope
 	upstreamError      chan error
 	downstreamError    chan error
 	requestsChan       *channels.Unbounded[*discovery.DiscoveryRequest]
@@ -266,6 +528,156 @@ type ProxyConnection struct {
 	upstream           xds.DiscoveryClient
 	downstreamDeltas   xds.DeltaDiscoveryStream
 	upstreamDeltas     xds.DeltaDiscoveryClient
+	// deltaToSotw is set when the delta stream from Envoy is served by a SotW upstream.
+	deltaToSotw *deltaToSotwTranslator
+	// deltaSubscriptions tracks the resources subscribed to by the delta stream from Envoy.
+	deltaSubscriptions *deltaSubscriptions
+	// openDeltaUpstream opens a new delta stream to the upstream, on a new connection if redial is true. It is only
+	// set when the delta stream to the upstream is reconnected on transient failures or certificate rotations.
+	openDeltaUpstream func(redial bool) (xds.DeltaDiscoveryClient, error)
+	// certsRotated receives once the certificates of the connection to the upstream rotated, so that the delta
+	// stream to the upstream is moved to a new connection. It is only set when the certificates are not reloaded.
+	certsRotated chan struct{}
+	// deltaResponseQueue if set queues the delta responses from the upstream before deltaResponsesChan.
+	deltaResponseQueue *deltaResponseQueue
+	// deltaAcks tracks the responses forwarded to Envoy until they are acknowledged.
+	deltaAcks *deltaAckTracker
+	// dryRun if true reports the verdict of the delta responses instead of forwarding them to Envoy.
+	dryRun bool
+	// upstreamActivity is the last time a message was sent to or received from the upstream, and
+	// upstreamResponse the last time a response was received from it.
+	upstreamActivity atomic.Time
+	upstreamResponse atomic.Time
+	// cancelUpstream terminates the current stream to the upstream, so that it is replaced once idle. It is only
+	// used by the loop sending the requests upstream.
+	cancelUpstream context.CancelFunc
+	// connectedAt is the time Envoy connected, and firstResponse is set once a response is forwarded to Envoy.
+	connectedAt   time.Time
+	firstResponse atomic.Bool
+	// bytes counts the size of the messages flowing through the connection.
+	bytes xdsBytes
+	// upstreamHealth tracks the state of the connection to the upstream of the proxy.
+	upstreamHealth *upstreamHealthTracker
+	// nacks logs the reasons of the delta requests rejected by Envoy.
+	nacks nackLogger
+	// maxDeltaResponseSize if positive is the size above which delta responses are split before being forwarded to Envoy.
+	maxDeltaResponseSize int
+	// deltaSplits tracks the split responses until Envoy acknowledges all their chunks.
+	deltaSplits *deltaSplitTracker
+	// fanout if set shares the upstream delta stream of the connection with the delta streams of other Envoys.
+	fanout *deltaFanout
+	// deltaInflight if set holds the delta responses to Envoy beyond the cap of unacknowledged responses per type.
+	deltaInflight *deltaInflightLimiter
+	// ackTimeouts if set resends the delta responses Envoy does not acknowledge within the ACK timeout of their type.
+	ackTimeouts *deltaAckTimeouts
+	// breaker if set holds the delta requests of the types whose exchanges with the upstream keep failing.
+	breaker *deltaCircuitBreaker
+	// deltaOrder if set holds the delta responses to Envoy until the responses of their prerequisite types are
+	// acknowledged.
+	deltaOrder *deltaResponseOrder
+	// tracer if set traces the delta responses received from the upstream, rewritten and forwarded to Envoy.
+	tracer trace.Tracer
+	// deltaCorrelations maps the correlation IDs logged for the recent delta responses to the responses.
+	deltaCorrelations *deltaCorrelations
+	// deltaFlush receives the requests to flush the queued delta responses to Envoy. It is only set when
+	// the responses are flushed on graceful close.
+	deltaFlush chan deltaFlushRequest
+	// nodeMetadata is the metadata of the node sent by Envoy on the stream, once it is received.
+	nodeMetadata atomic.Pointer[model.NodeMetadata]
+	// partialNacks holds the NACKs sent upstream in place of the ACKs of the partially forwarded ECDS responses.
+	partialNacks partialECDSNacks
+	// bootstrap tracks the bootstrap and last good resources served to Envoy until the upstream supersedes them.
+	bootstrap deltaBootstrapState
+	// lastGood if set records the resources acknowledged by Envoy.
+	lastGood *deltaLastGood
+	// backlog counts the responses from the upstream queued toward Envoy.
+	backlog downstreamBacklog
+}
+
+// recordNode records the metadata of node, if it is the first node sent by Envoy on the stream.
+func (con *ProxyConnection) recordNode(node *core.Node) {
+	if node == nil || con.nodeMetadata.Load() != nil {
+		return
+	}
+	meta, err := model.ParseMetadata(node.Metadata)
+	if err != nil {
+		con.logger().Warnf("failed to parse node metadata: %v", err)
+		meta = &model.NodeMetadata{}
+	}
+	if con.nodeMetadata.CompareAndSwap(nil, meta) && con.bytes.labels.Load() != nil {
+		labels := metrics.MeshLabels(meta.ClusterID.String(), meta.MeshID)
+		con.bytes.labels.Store(&labels)
+	}
+}
+
+// initMetricLabels labels the metrics of con with the cluster and mesh IDs of Envoy, if enabled. They are unknown
+// until Envoy sends its node.
+func (p *XdsProxy) initMetricLabels(con *ProxyConnection) {
+	if !p.meshMetricLabels {
+		return
+	}
+	labels := metrics.MeshLabels("", "")
+	con.bytes.labels.Store(&labels)
+}
+
+// forwarded records the time to the first response forwarded to Envoy, of type typeURL, on con.
+func (con *ProxyConnection) forwarded(typeURL string) {
+	if con.connectedAt.IsZero() || !con.firstResponse.CompareAndSwap(false, true) {
+		return
+	}
+	metrics.RecordTimeToFirstConfig(v3.GetShortType(typeURL), time.Since(con.connectedAt), con.bytes.metricLabels()...)
+}
+
+// upstreamReceived records that a response was received from the upstream.
+func (con *ProxyConnection) upstreamReceived() {
+	now := time.Now()
+	con.upstreamActivity.Store(now)
+	con.upstreamResponse.Store(now)
+	con.upstreamHealth.received(con.conID)
+}
+
+// upstreamSent records that a request was sent to the upstream.
+func (con *ProxyConnection) upstreamSent() {
+	con.upstreamActivity.Store(time.Now())
+}
+
+// xdsBytes counts the bytes of the xDS messages flowing through a connection, in each direction.
+type xdsBytes struct {
+	upstreamReceived   atomic.Int64
+	upstreamSent       atomic.Int64
+	downstreamReceived atomic.Int64
+	downstreamSent     atomic.Int64
+	// labels if set are added to the metrics recorded for the connection, such as the MeshLabels of Envoy.
+	labels atomic.Pointer[[]monitoring.LabelValue]
+}
+
+// metricLabels returns the labels added to the metrics recorded for the connection.
+func (b *xdsBytes) metricLabels() []monitoring.LabelValue {
+	if labels := b.labels.Load(); labels != nil {
+		return *labels
+	}
+	return nil
+}
+
+// record counts msg of the given type URL flowing in the given direction, which is one of the directions
+// defined in the metrics package.
+func (b *xdsBytes) record(direction string, typeURL string, msg proto.Message) {
+	b.recordSize(direction, typeURL, proto.Size(msg))
+}
+
+// recordSize is like record, for a message whose size is already known.
+func (b *xdsBytes) recordSize(direction string, typeURL string, size int) {
+	switch direction {
+	case metrics.UpstreamReceived:
+		b.upstreamReceived.Add(int64(size))
+	case metrics.UpstreamSent:
+		b.upstreamSent.Add(int64(size))
+	case metrics.DownstreamReceived:
+		b.downstreamReceived.Add(int64(size))
+	case metrics.DownstreamSent:
+		b.downstreamSent.Add(int64(size))
+	}
+	metrics.RecordBytes(direction, v3.GetShortType(typeURL), size, b.metricLabels()...)
 }
 
 // sendRequest is a small wrapper around sending to con.requestsChan. This ensures that we do not
@@ -295,6 +707,7 @@ type adsStream interface {
 // as the new connection may not go to the same istiod. Vice versa case also applies.
 func (p *XdsProxy) StreamAggregatedResources(downstream xds.DiscoveryStream) error {
 	proxyLog.Debugf("accepted XDS connection from Envoy, forwarding to upstream XDS server")
+	advertiseAPIType(downstream, sotwAPIType)
 	return p.handleStream(downstream)
 }
 
@@ -323,21 +736,30 @@ func (p *XdsProxy) handleStream(downstream adsStream) error {
 		// smallest relative to other channels.
 		requestsChan: channels.NewUnbounded[*discovery.DiscoveryRequest](),
 		// Allow a buffer of 1. This ensures we queue up at most 2 (one in process, 1 pending) responses before forwarding.
-		responsesChan: make(chan *discovery.DiscoveryResponse, 1),
-		stopChan:      make(chan struct{}),
-		downstream:    downstream,
+		responsesChan:  make(chan *discovery.DiscoveryResponse, 1),
+		stopChan:       make(chan struct{}),
+		connectedAt:    time.Now(),
+		downstream:     downstream,
+		upstreamHealth: &p.upstreamHealth,
 	}
+	con.log = newConnectionLogger(downstream.Context(), con.conID)
+	p.initMetricLabels(con)
 
 	p.registerStream(con)
 	defer p.unregisterStream(con)
+	defer con.backlog.close()
+	if !p.awaitCoalesceWindow(downstream.Context(), con) {
+		return nil
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout())
 	defer cancel()
 
 	upstreamConn, err := p.buildUpstreamConn(ctx)
 	if err != nil {
-		proxyLog.Errorf("failed to connect to upstream %s: %v", p.istiodAddress, err)
+		con.logger().Errorf("failed to connect to upstream %s: %v", p.istiodAddress, err)
 		metrics.IstiodConnectionFailures.Increment()
+		p.upstreamHealth.disconnected(con.conID, err)
 		return err
 	}
 	defer upstreamConn.Close()
@@ -348,49 +770,59 @@ func (p *XdsProxy) handleStream(downstream adsStream) error {
 		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
 	}
 	// We must propagate upstream termination to Envoy. This ensures that we resume the full XDS sequence on new connection
-	return p.handleUpstream(ctx, con, xds)
+	err = p.handleUpstream(ctx, con, xds)
+	p.upstreamHealth.disconnected(con.conID, err)
+	return err
+}
+
+// dialTimeout returns the time allowed to establish the connection to the upstream.
+func (p *XdsProxy) dialTimeout() time.Duration {
+	if p.upstreamDialTimeout > 0 {
+		return p.upstreamDialTimeout
+	}
+	return defaultUpstreamDialTimeout
 }
 
 func (p *XdsProxy) buildUpstreamConn(ctx context.Context) (*grpc.ClientConn, error) {
 	p.optsMutex.RLock()
 	opts := p.dialOptions
 	p.optsMutex.RUnlock()
-	return grpc.DialContext(ctx, p.istiodAddress, opts...)
+	if len(p.upstreamGrpcOptions) > 0 {
+		opts = append(slices.Clone(opts), p.upstreamGrpcOptions...)
+	}
+	if p.upstreamDialTimeout > 0 {
+		// Block until connected, so that a stalled connection attempt fails once the dial timeout elapses
+		// rather than leaving the stream waiting for the connection.
+		opts = append(slices.Clone(opts), grpc.WithBlock())
+	}
+	if len(p.failoverAddresses) > 0 {
+		return p.dialWithFailover(ctx, opts)
+	}
+	return p.dialUpstream(ctx, p.istiodAddress, opts...)
 }
 
 func (p *XdsProxy) handleUpstream(ctx context.Context, con *ProxyConnection, xds discovery.AggregatedDiscoveryServiceClient) error {
-	log := proxyLog.WithLabels("id", con.conID)
-	upstream, err := xds.StreamAggregatedResources(ctx,
+	log := con.logger()
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	upstream, err := xds.StreamAggregatedResources(streamCtx,
 		grpc.MaxCallRecvMsgSize(defaultClientMaxReceiveMessageSize))
 	if err != nil {
+		cancelStream()
 		// Envoy logs errors again, so no need to log beyond debug level
 		log.Debugf("failed to create upstream grpc client: %v", err)
 		// Increase metric when xds connection error, for example: forgot to restart ingressgateway or sidecar after changing root CA.
 		metrics.IstiodConnectionErrors.Increment()
 		return err
 	}
-	log.Infof("connected to upstream XDS server: %s", p.istiodAddress)
-	defer log.Debugf("disconnected from XDS server: %s", p.istiodAddress)
+	con.cancelUpstream = cancelStream
+	log.Infof("connected to upstream XDS server: %s", p.activeUpstreamAddress())
+	p.upstreamHealth.connected(con.conID)
+	go p.recordUpstreamHeaders(con, upstream)
+	defer log.Debugf("disconnected from XDS server: %s", p.activeUpstreamAddress())
 
 	con.upstream = upstream
 
-	// Handle upstream xds recv
-	go func() {
-		for {
-			// from istiod
-			resp, err := con.upstream.Recv()
-			if err != nil {
-				upstreamErr(con, err)
-				return
-			}
-			select {
-			case con.responsesChan <- resp:
-			case <-con.stopChan:
-			}
-		}
-	}()
-
-	go p.handleUpstreamRequest(con)
+	go p.handleUpstreamRequest(ctx, con)
 	go p.handleUpstreamResponse(con)
 
 	for {
@@ -409,16 +841,53 @@ func (p *XdsProxy) handleUpstream(ctx context.Context, con *ProxyConnection, xds
 	}
 }
 
-func (p *XdsProxy) handleUpstreamRequest(con *ProxyConnection) {
+// forwardUpstreamResponses forwards the responses of the upstream stream to handleUpstreamResponse, until the
+// stream fails. The failure is reported on the returned channel.
+func (p *XdsProxy) forwardUpstreamResponses(con *ProxyConnection, upstream xds.DiscoveryClient) <-chan error {
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			// from istiod
+			resp, err := upstream.Recv()
+			if err != nil {
+				failed <- err
+				return
+			}
+			con.upstreamReceived()
+			p.recordControlPlane(con, resp.ControlPlane)
+			con.bytes.record(metrics.UpstreamReceived, resp.TypeUrl, resp)
+			con.backlog.add(resp.TypeUrl)
+			select {
+			case con.responsesChan <- resp:
+			case <-con.stopChan:
+			}
+		}
+	}()
+	return failed
+}
+
+// handleUpstreamRequest forwards the requests of Envoy upstream. If the upstream is idle, it is replaced with a
+// stream on a new connection opened with ctx, and the latest requests are resent on it.
+func (p *XdsProxy) handleUpstreamRequest(ctx context.Context, con *ProxyConnection) {
 	initialRequestsSent := atomic.NewBool(false)
 	go func() {
 		for {
 			// recv xds requests from envoy
 			req, err := con.downstream.Recv()
 			if err != nil {
+				downstreamErr(con, sotwRecvError(err))
+				return
+			}
+			con.bytes.record(metrics.DownstreamReceived, req.TypeUrl, req)
+			if err := p.checkNodeMetadata(req.Node); err != nil {
 				downstreamErr(con, err)
 				return
 			}
+			if err := p.checkTypeURL(req.TypeUrl); err != nil {
+				downstreamErr(con, err)
+				return
+			}
+			con.recordNode(req.Node)
 
 			// forward to istiod
 			con.sendRequest(req)
@@ -448,7 +917,20 @@ func (p *XdsProxy) handleUpstreamRequest(con *ProxyConnection) {
 		}
 	}()
 
-	defer con.upstream.CloseSend() // nolint
+	upstreamFailed := p.forwardUpstreamResponses(con, con.upstream)
+	defer func() {
+		_ = con.upstream.CloseSend()
+		con.cancelUpstream()
+	}()
+	idle := p.newUpstreamIdleTimer(con)
+	defer idle.stop()
+	var resume *sotwResumeRequests
+	if idle != nil {
+		resume = newSotwResumeRequests()
+	}
+	if !p.waitStartupJitter(con) {
+		return
+	}
 	for {
 		select {
 		case req := <-con.requestsChan.Get():
@@ -457,33 +939,83 @@ func (p *XdsProxy) handleUpstreamRequest(con *ProxyConnection) {
 				// only send healthcheck probe after LDS request has been sent
 				continue
 			}
-			proxyLog.Debugf("request for type url %s", req.TypeUrl)
+			con.logger().Debugf("request for type url %s", req.TypeUrl)
 			metrics.XdsProxyRequests.Increment()
-			if req.TypeUrl == v3.ExtensionConfigurationType {
+			p.ackNotifier.notify(req.TypeUrl, req.ResponseNonce, req.ErrorDetail)
+			if p.isECDSType(req.TypeUrl) {
 				if req.VersionInfo != "" {
 					p.ecdsLastAckVersion.Store(req.VersionInfo)
 				}
 				p.ecdsLastNonce.Store(req.ResponseNonce)
+				if req.ErrorDetail != nil {
+					p.recordECDSNack(req.ResponseNonce, req.ResourceNames, req.ErrorDetail.GetMessage())
+				}
 			}
 			if err := con.upstream.Send(req); err != nil {
 				err = fmt.Errorf("send error for type url %s: %v", req.TypeUrl, err)
 				upstreamErr(con, err)
 				return
 			}
+			con.upstreamSent()
+			con.bytes.record(metrics.UpstreamSent, req.TypeUrl, req)
+			if resume != nil {
+				resume.sent(req)
+			}
+		case err := <-upstreamFailed:
+			upstreamErr(con, err)
+			return
+		case <-idle.C():
+			err := idle.expired()
+			if err == nil {
+				continue
+			}
+			// Replace the idle upstream, keeping the stream of Envoy.
+			con.logger().Infof("%v, reconnecting to upstream XDS server", err)
+			con.cancelUpstream()
+			<-upstreamFailed
+			if err := p.resumeUpstream(ctx, con, resume.resume()); err != nil {
+				upstreamErr(con, err)
+				return
+			}
+			upstreamFailed = p.forwardUpstreamResponses(con, con.upstream)
 		case <-con.stopChan:
 			return
 		}
 	}
 }
 
+// resumeUpstream replaces the upstream of con with a stream on a new connection opened with ctx, and sends reqs on
+// it. The previous stream must be terminated.
+func (p *XdsProxy) resumeUpstream(ctx context.Context, con *ProxyConnection, reqs []*discovery.DiscoveryRequest) error {
+	upstream, cancel, err := p.redialUpstream(ctx)
+	if err != nil {
+		metrics.IstiodConnectionFailures.Increment()
+		return fmt.Errorf("failed to reconnect to upstream %s: %v", p.istiodAddress, err)
+	}
+	for _, req := range reqs {
+		if err := upstream.Send(req); err != nil {
+			cancel()
+			return fmt.Errorf("send error for type url %s: %v", req.TypeUrl, err)
+		}
+		con.upstreamSent()
+		con.bytes.record(metrics.UpstreamSent, req.TypeUrl, req)
+	}
+	con.cancelUpstream()
+	con.upstream = upstream
+	con.cancelUpstream = cancel
+	con.logger().Infof("reconnected to upstream XDS server: %s", p.activeUpstreamAddress())
+	go p.recordUpstreamHeaders(con, upstream)
+	return nil
+}
+
 func (p *XdsProxy) handleUpstreamResponse(con *ProxyConnection) {
 	forwardEnvoyCh := make(chan *discovery.DiscoveryResponse, 1)
 	for {
 		select {
 		case resp := <-con.responsesChan:
+			con.backlog.done(resp.TypeUrl)
 			// TODO: separate upstream response handling from requests sending, which are both time costly
-			proxyLog.WithLabels(
-				"id", con.conID,
+			con.logger().WithLabels(
 				"type", v3.GetShortType(resp.TypeUrl),
 				"resources", len(resp.Resources),
 			).Debugf("upstream response")
@@ -511,8 +1043,22 @@ func (p *XdsProxy) handleUpstreamResponse(con *ProxyConnection) {
 				})
 				continue
 			}
-			switch resp.TypeUrl {
-			case v3.ExtensionConfigurationType:
+			if !p.rewrites.enabled(resp.TypeUrl) {
+				// The special handling of the type is disabled, see rewritez.
+				forwardToEnvoy(con, resp)
+				continue
+			}
+			if err := p.transformSotw(resp); err != nil {
+				con.logger().WithLabels("nonce", resp.Nonce).Warnf("rejecting upstream response: %v", err)
+				con.sendRequest(&discovery.DiscoveryRequest{
+					TypeUrl:       resp.TypeUrl,
+					ResponseNonce: resp.Nonce,
+					ErrorDetail:   transformNack(err),
+				})
+				continue
+			}
+			switch {
+			case p.isECDSType(resp.TypeUrl):
 				if features.WasmRemoteLoadConversion {
 					// If Wasm remote load conversion feature is enabled, rewrite and send.
 					go p.rewriteAndForward(con, resp, func(resp *discovery.DiscoveryResponse) {
@@ -542,24 +1088,204 @@ func (p *XdsProxy) handleUpstreamResponse(con *ProxyConnection) {
 	}
 }
 
+// convertWasmExtensionConfig rewrites remote Wasm modules in ECDS resources to local files.
+// Failed conversions are retried with exponential backoff, so that transient fetch failures
+// do not immediately result in a NACK.
+func (p *XdsProxy) convertWasmExtensionConfig(con *ProxyConnection, resources []*anypb.Any) error {
+	// Reuse the previous rewrite of the resources which are unchanged, and only convert the others.
+	keys := make([]ecdsRewriteKey, 0, len(resources))
+	pending := make([]*anypb.Any, 0, len(resources))
+	var pendingIndexes []int
+	for i, resource := range resources {
+		key := ecdsRewriteKeyOf(resource)
+		if rewrite, ok := p.ecdsRewrites.get(key, p.wasmCache); ok {
+			resources[i] = rewrite.resource
+			reportWasmRewrite(con, rewrite, wasmRewriteReused)
+			p.ecdsStatuses.record(rewrite)
+			continue
+		}
+		keys = append(keys, key)
+		pending = append(pending, resource)
+		pendingIndexes = append(pendingIndexes, i)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	// The response is held, neither forwarded to Envoy nor ACKed, while all the conversion workers are busy, which
+	// holds off the upstream.
+	start := time.Now()
+	waited, ok := p.wasmConversions.WaitAvailable(con.stopChan)
+	if !ok {
+		return errors.New("connection closed while waiting for a Wasm conversion worker")
+	}
+	if waited {
+		con.logger().WithLabels("resources", len(pending)).
+			Infof("Wasm conversion workers saturated, held ECDS response for %v", time.Since(start).Round(time.Millisecond))
+	}
+	p.ecdsStatuses.pending(ecdsResourceNames(pending))
+	cache := newRecordingWasmCache(p.wasmCache, con.bytes.metricLabels())
+	cache.inline = p.inlineWasmModules
+	original := slices.Clone(pending)
+	if err := p.convertWasmExtensionConfigWithRetry(con, pending, cache); err != nil {
+		var failures []ecdsRewrite
+		for j, resource := range pending {
+			rewrite := cache.rewriteOf(resource)
+			p.ecdsStatuses.record(rewrite)
+			if resource == original[j] && rewrite.fetch != nil && rewrite.fetch.err != nil {
+				failures = append(failures, rewrite)
+				continue
+			}
+			// The resources converted despite the failure of others are only used if the response is partially
+			// acknowledged.
+			resources[pendingIndexes[j]] = resource
+		}
+		return newWasmConversionError(err, failures)
+	}
+	for j, i := range pendingIndexes {
+		resources[i] = pending[j]
+		rewrite := cache.rewriteOf(pending[j])
+		if rewrite.fetch != nil && rewrite.fetch.err != nil {
+			reportWasmRewrite(con, rewrite, wasmRewriteFailOpen)
+		} else {
+			reportWasmRewrite(con, rewrite, wasmRewriteFetched)
+		}
+		p.ecdsStatuses.record(rewrite)
+		p.ecdsRewrites.add(keys[j], rewrite)
+	}
+	return nil
+}
+
+func (p *XdsProxy) convertWasmExtensionConfigWithRetry(con *ProxyConnection, resources []*anypb.Any, cache wasm.Cache) error {
+	maxAttempts := max(p.wasmFetchMaxAttempts, 1)
+	o := backoff.DefaultOption()
+	o.InitialInterval = p.wasmFetchInitialBackoff
+	b := backoff.NewExponentialBackOff(o)
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := p.wasmConversions.Convert(resources, cache)
+		if err == nil {
+			return nil
+		}
+		next := b.NextBackOff()
+		if p.wasmFetchGracePeriod > 0 {
+			// The response stays pending, and the fetches are retried regardless of the attempts, until the grace
+			// period elapses.
+			remaining := p.wasmFetchGracePeriod - time.Since(start)
+			if remaining <= 0 {
+				return err
+			}
+			next = min(next, remaining)
+		} else if attempt >= maxAttempts {
+			return err
+		} else if p.wasmFetchMaxElapsedTime > 0 && time.Since(start)+next > p.wasmFetchMaxElapsedTime {
+			return err
+		}
+		con.logger().WithLabels("attempt", attempt).Debugf("retrying ECDS Wasm conversion in %v: %v", next, err)
+		select {
+		case <-time.After(next):
+		case <-con.stopChan:
+			return err
+		}
+	}
+}
+
+// isECDSType returns true if the resources of typeURL are extension configs, whose Wasm modules are rewritten.
+func (p *XdsProxy) isECDSType(typeURL string) bool {
+	return typeURL == v3.ExtensionConfigurationType || slices.Contains(p.ecdsTypeURLAliases, typeURL)
+}
+
+// Labels of the handlers of the type URLs specially handled by the proxy, see HandledTypeURLs.
+const (
+	// wasmRewriteHandler rewrites the remote Wasm modules of extension configs to local files.
+	wasmRewriteHandler = "wasm-rewrite"
+	// agentHandler consumes the resources in the agent, without forwarding them to Envoy.
+	agentHandler = "agent-handler"
+)
+
+// HandledTypeURLs returns the type URLs specially handled by the proxy, mapped to the label of their handler.
+// The resources of the other type URLs are passed through between Envoy and the upstream.
+func (p *XdsProxy) HandledTypeURLs() map[string]string {
+	out := map[string]string{}
+	for typeURL := range p.handlers {
+		out[typeURL] = agentHandler
+	}
+	out[v3.ExtensionConfigurationType] = wasmRewriteHandler
+	for _, alias := range p.ecdsTypeURLAliases {
+		out[alias] = wasmRewriteHandler
+	}
+	return out
+}
+
+// shouldRewriteWasm returns true if the Wasm modules of the ECDS resources sent to con are rewritten to local
+// files, rather than fetched by Envoy itself.
+func (p *XdsProxy) shouldRewriteWasm(con *ProxyConnection) bool {
+	if p.wasmRewritePredicate == nil {
+		return true
+	}
+	meta := con.nodeMetadata.Load()
+	if meta == nil {
+		meta = &model.NodeMetadata{}
+	}
+	return p.wasmRewritePredicate(meta)
+}
+
 func (p *XdsProxy) rewriteAndForward(con *ProxyConnection, resp *discovery.DiscoveryResponse, forward func(resp *discovery.DiscoveryResponse)) {
-	if err := wasm.MaybeConvertWasmExtensionConfig(resp.Resources, p.wasmCache); err != nil {
-		proxyLog.Debugf("sending NACK for ECDS resources %+v, err: %+v", resp.Resources, err)
+	if !p.shouldRewriteWasm(con) {
+		con.logger().WithLabels("resources", ecdsResourceNames(resp.Resources)).Debugf("forward ECDS without Wasm rewrite")
+		forward(resp)
+		return
+	}
+	if err := p.convertWasmExtensionConfig(con, resp.Resources); err != nil {
+		con.logger().Debugf("sending NACK for ECDS resources %+v, err: %+v", resp.Resources, err)
+		p.recordECDSNack(resp.Nonce, ecdsResourceNames(resp.Resources), err.Error())
 		con.sendRequest(&discovery.DiscoveryRequest{
 			VersionInfo:   p.ecdsLastAckVersion.Load(),
 			TypeUrl:       resp.TypeUrl,
 			ResponseNonce: resp.Nonce,
-			ErrorDetail: &google_rpc.Status{
-				Code:    int32(codes.Internal),
-				Message: err.Error(),
-			},
+			ErrorDetail:   p.wasmNackStatus(err),
 		})
 		return
 	}
-	proxyLog.Debugf("forward ECDS resources %+v", resp.Resources)
+	con.logger().WithLabels("resources", ecdsResourceNames(resp.Resources)).Debugf("forward ECDS")
 	forward(resp)
 }
 
+// ecdsNack describes an ECDS update rejected by either the agent or Envoy.
+type ecdsNack struct {
+	Nonce     string    `json:"nonce"`
+	Resources []string  `json:"resources,omitempty"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// recordECDSNack stores the reason of the last rejected ECDS update. NACKs generated by the agent
+// are recorded before they are sent upstream, so they are not overwritten by the forwarded request
+// which carries less information.
+func (p *XdsProxy) recordECDSNack(nonce string, resources []string, message string) {
+	if last := p.ecdsLastNack.Load(); last != nil && nonce != "" && last.Nonce == nonce {
+		return
+	}
+	p.ecdsLastNack.Store(&ecdsNack{
+		Nonce:     nonce,
+		Resources: resources,
+		Error:     message,
+		Time:      time.Now(),
+	})
+}
+
+// ecdsResourceNames returns the names of the given ECDS resources, skipping the ones that cannot be decoded.
+func ecdsResourceNames(resources []*anypb.Any) []string {
+	names := make([]string, 0, len(resources))
+	for _, r := range resources {
+		ec := &core.TypedExtensionConfig{}
+		if err := r.UnmarshalTo(ec); err != nil {
+			continue
+		}
+		names = append(names, ec.GetName())
+	}
+	return names
+}
+
 func (p *XdsProxy) forwardToTap(resp *discovery.DiscoveryResponse) {
 	select {
 	case p.tapResponseChannel <- resp:
@@ -570,18 +1296,23 @@ func (p *XdsProxy) forwardToTap(resp *discovery.DiscoveryResponse) {
 
 func forwardToEnvoy(con *ProxyConnection, resp *discovery.DiscoveryResponse) {
 	if !v3.IsEnvoyType(resp.TypeUrl) && resp.TypeUrl != v3.WorkloadType {
-		proxyLog.Errorf("Skipping forwarding type url %s to Envoy as is not a valid Envoy type", resp.TypeUrl)
+		con.logger().Errorf("Skipping forwarding type url %s to Envoy as is not a valid Envoy type", resp.TypeUrl)
 		return
 	}
 	if con.isClosed() {
-		proxyLog.WithLabels("id", con.conID).Errorf("downstream dropped xds push to Envoy, connection already closed")
+		con.logger().Errorf("downstream dropped xds push to Envoy, connection already closed")
 		return
 	}
-	if err := sendDownstream(con.downstream, resp); err != nil {
+	con.backlog.add(resp.TypeUrl)
+	err := sendDownstream(con.downstream, resp)
+	con.backlog.done(resp.TypeUrl)
+	if err != nil {
 		err = fmt.Errorf("send error for type url %s: %v", resp.TypeUrl, err)
 		downstreamErr(con, err)
 		return
 	}
+	con.bytes.record(metrics.DownstreamSent, resp.TypeUrl, resp)
+	con.forwarded(resp.TypeUrl)
 }
 
 // sendDownstream sends discovery response.
@@ -597,17 +1328,19 @@ func sendDownstream(downstream adsStream, response *discovery.DiscoveryResponse)
 }
 
 func (p *XdsProxy) close() {
-	close(p.stopChan)
-	p.wasmCache.Cleanup()
-	if p.httpTapServer != nil {
-		_ = p.httpTapServer.Close()
-	}
-	if p.downstreamGrpcServer != nil {
-		p.downstreamGrpcServer.Stop()
-	}
-	if p.downstreamListener != nil {
-		_ = p.downstreamListener.Close()
-	}
+	p.closeOnce.Do(func() {
+		close(p.stopChan)
+		p.wasmCache.Cleanup()
+		if p.httpTapServer != nil {
+			_ = p.httpTapServer.Close()
+		}
+		if p.downstreamGrpcServer != nil {
+			p.downstreamGrpcServer.Stop()
+		}
+		if p.downstreamListener != nil {
+			_ = p.downstreamListener.Close()
+		}
+	})
 }
 
 func (p *XdsProxy) initDownstreamServer() error {
@@ -618,6 +1351,11 @@ func (p *XdsProxy) initDownstreamServer() error {
 	// TODO: Expose keepalive options to agent cmd line flags.
 	opts := p.downstreamGrpcOptions
 	opts = append(opts, istiogrpc.ServerOptions(istiokeepalive.DefaultOption())...)
+	opts = append(opts, p.downstreamHTTP2.serverOptions()...)
+	opts = append(opts, grpc.ChainStreamInterceptor(p.rejectWhileDraining))
+	if p.maxDownstreamStreams > 0 {
+		opts = append(opts, grpc.ChainStreamInterceptor(p.limitDownstreamStreams))
+	}
 	grpcs := grpc.NewServer(opts...)
 	discovery.RegisterAggregatedDiscoveryServiceServer(grpcs, p)
 	reflection.Register(grpcs)
@@ -626,6 +1364,56 @@ func (p *XdsProxy) initDownstreamServer() error {
 	return nil
 }
 
+// DownstreamHTTP2Settings are the HTTP/2 settings of the XDS proxy gRPC server Envoy connects to. A zero value keeps
+// the default of the setting.
+type DownstreamHTTP2Settings struct {
+	// MaxConcurrentStreams is the maximum number of concurrent streams of a connection from Envoy.
+	MaxConcurrentStreams uint32
+	// InitialWindowSize is the initial flow control window of the streams, in bytes. Values below 64KiB are ignored.
+	InitialWindowSize int32
+	// InitialConnWindowSize is the initial flow control window of the connections, in bytes. Values below 64KiB
+	// are ignored.
+	InitialConnWindowSize int32
+}
+
+// serverOptions returns the gRPC server options applying the set settings, which override the defaults.
+func (s DownstreamHTTP2Settings) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if s.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(s.MaxConcurrentStreams))
+	}
+	if s.InitialWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(s.InitialWindowSize))
+	}
+	if s.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(s.InitialConnWindowSize))
+	}
+	return opts
+}
+
+// limitDownstreamStreams rejects the new streams from Envoy with ResourceExhausted while maxDownstreamStreams
+// streams are already being served, e.g. when a restart loop of Envoy leaks connections. The streams being
+// served are not affected.
+func (p *XdsProxy) limitDownstreamStreams(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := p.admitDownstreamStream(info.FullMethod); err != nil {
+		return err
+	}
+	defer p.downstreamStreams.Dec()
+	return handler(srv, ss)
+}
+
+// admitDownstreamStream counts a new stream of method in downstreamStreams, unless maxDownstreamStreams streams
+// are already being served, in which case it returns ResourceExhausted. An admitted stream must be released with
+// downstreamStreams.Dec once served.
+func (p *XdsProxy) admitDownstreamStream(method string) error {
+	if n := p.downstreamStreams.Inc(); p.maxDownstreamStreams > 0 && n > p.maxDownstreamStreams {
+		p.downstreamStreams.Dec()
+		proxyLog.Warnf("rejecting downstream stream %s: %d streams are already being served", method, n-1)
+		return status.Errorf(codes.ResourceExhausted, "too many concurrent streams, the limit is %d", p.maxDownstreamStreams)
+	}
+	return nil
+}
+
 func (p *XdsProxy) initIstiodDialOptions(agent *Agent) error {
 	opts, err := p.buildUpstreamClientDialOpts(agent)
 	if err != nil {
@@ -647,12 +1435,36 @@ func (p *XdsProxy) buildUpstreamClientDialOpts(sa *Agent) ([]grpc.DialOption, er
 	if err != nil {
 		return nil, err
 	}
+	// Overrides the keepalive set by ClientOptions, the last option wins.
+	options = append(options, grpc.WithKeepaliveParams(p.upstreamKeepaliveParams()))
+	if p.upstreamCompression {
+		options = append(options, upstreamCompressionOption())
+	}
 	if sa.secOpts.CredFetcher != nil {
 		options = append(options, grpc.WithPerRPCCredentials(caclient.NewXDSTokenProvider(sa.secOpts)))
 	}
 	return options, nil
 }
 
+// upstreamCompressionOption compresses the requests to the upstream with gzip. Istiod then compresses its
+// responses with gzip as well.
+func upstreamCompressionOption() grpc.DialOption {
+	return grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name))
+}
+
+// upstreamKeepaliveParams returns the keepalive of the connection to the upstream, which defaults to
+// the keepalive of all istio gRPC clients.
+func (p *XdsProxy) upstreamKeepaliveParams() keepalive.ClientParameters {
+	if p.upstreamKeepalive != nil {
+		return *p.upstreamKeepalive
+	}
+	defaults := istiokeepalive.DefaultOption()
+	return keepalive.ClientParameters{
+		Time:    defaults.Time,
+		Timeout: defaults.Timeout,
+	}
+}
+
 // Returns the TLS option to use when talking to Istiod
 func (p *XdsProxy) getTLSOptions(agent *Agent) (*istiogrpc.TLSOptions, error) {
 	if agent.proxyConfig.ControlPlaneAuthPolicy == meshconfig.AuthenticationPolicy_NONE {
@@ -669,6 +1481,8 @@ func (p *XdsProxy) getTLSOptions(agent *Agent) (*istiogrpc.TLSOptions, error) {
 		Cert:          cert,
 		ServerAddress: agent.proxyConfig.DiscoveryAddress,
 		SAN:           p.istiodSAN,
+		// The rotated certificates are used on the new handshakes without redialing, see upstreamCertsRotated.
+		ReloadRootCert: p.reloadRootCert,
 	}, nil
 }
 
@@ -775,6 +1589,75 @@ func (p *XdsProxy) makeTapHandler() func(w http.ResponseWriter, req *http.Reques
 	}
 }
 
+// ecdsState is the state of ECDS as reported by /debug/ecdsz.
+type ecdsState struct {
+	LastNonce string                        `json:"lastNonce"`
+	LastNack  *ecdsNack                     `json:"lastNack,omitempty"`
+	Resources map[string]ecdsResourceStatus `json:"resources,omitempty"`
+}
+
+func (p *XdsProxy) ecdsState() ecdsState {
+	return ecdsState{
+		LastNonce: p.ecdsLastNonce.Load(),
+		LastNack:  p.ecdsLastNack.Load(),
+		Resources: p.ecdsStatuses.snapshot(),
+	}
+}
+
+// ecdsz reports the last ECDS nonce seen by the agent, along with the last rejected ECDS update and the state of
+// the fetch of the Wasm module of each ECDS resource.
+func (p *XdsProxy) ecdsz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, p.ecdsState())
+}
+
+// handlerz reports the type URLs specially handled by the proxy, with the label of their handler.
+func (p *XdsProxy) handlerz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, p.HandledTypeURLs())
+}
+
+// subscriptionz reports the resource names currently subscribed to by Envoy, per type URL.
+// Only delta xDS connections track subscriptions.
+func (p *XdsProxy) subscriptionz(w http.ResponseWriter, _ *http.Request) {
+	out := map[string][]string{}
+	p.connectedMutex.RLock()
+	if p.connected != nil && p.connected.deltaSubscriptions != nil {
+		out = p.connected.deltaSubscriptions.snapshot()
+	}
+	p.connectedMutex.RUnlock()
+	writeJSON(w, out)
+}
+
+// xdsProxyz reports, per type URL, the state of the delta xDS exchange with Envoy: the nonce last ACKed,
+// the last version, the subscribed resource names and the number of resources last forwarded.
+// Only delta xDS connections track this state.
+func (p *XdsProxy) xdsProxyz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, p.deltaTypeStates())
+}
+
+func (p *XdsProxy) deltaTypeStates() map[string]deltaTypeState {
+	out := map[string]deltaTypeState{}
+	p.connectedMutex.RLock()
+	if p.connected != nil && p.connected.deltaSubscriptions != nil {
+		out = p.connected.deltaSubscriptions.debugSnapshot()
+	}
+	p.connectedMutex.RUnlock()
+	return out
+}
+
+// writeJSON writes the JSON encoding of obj to w.
+func writeJSON(w http.ResponseWriter, obj any) {
+	b, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		log.Infof("fail to write debug response: %v", err)
+	}
+}
+
 // initDebugInterface() listens on localhost:${PORT} for path /debug/...
 // forwards the paths to Istiod as xDS requests
 // waits for response from Istiod, sends it as JSON
@@ -790,8 +1673,25 @@ func (p *XdsProxy) initDebugInterface(port int) error {
 	handler := p.makeTapHandler()
 	httpMux.HandleFunc("/debug/", handler)
 	httpMux.HandleFunc("/debug", handler) // For 1.10 Istiod which uses istio.io/debug
+	// Agent local debug endpoints, these are served by the agent instead of being forwarded to Istiod.
+	// The ECDS state of the agent replaces the one of Istiod, as the agent rewrites the ECDS resources.
+	httpMux.HandleFunc("/debug/ecdsz", p.ecdsz)
+	httpMux.HandleFunc("/debug/agent/handlerz", p.handlerz)
+	httpMux.HandleFunc("/debug/agent/upstreamz", p.upstreamz)
+	httpMux.HandleFunc("/debug/agent/subscriptionz", p.subscriptionz)
+	httpMux.HandleFunc("/debug/agent/correlationz", p.correlationz)
+	httpMux.HandleFunc("/debug/agent/queuez", p.queuez)
+	httpMux.HandleFunc("/debug/agent/snapshot", p.snapshotz)
+	httpMux.HandleFunc("/debug/agent/rewritez", p.rewritez)
+	httpMux.HandleFunc("/debug/wasm/refresh", p.wasmRefresh)
+	httpMux.HandleFunc("/debug/wasm/list", p.wasmList)
+	httpMux.HandleFunc("/debug/xds-proxy", p.xdsProxyz)
 
 	mixedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.grpcWeb && isGrpcWeb(r) {
+			p.serveGrpcWeb(w, r)
+			return
+		}
 		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("content-type"), "application/grpc") {
 			tapGrpcHandler.ServeHTTP(w, r)
 			return
@@ -825,10 +1725,10 @@ func (p *XdsProxy) initDebugInterface(port int) error {
 // upstreamErr sends the error to upstreamError channel, and return immediately if the connection closed.
 func upstreamErr(con *ProxyConnection, err error) {
 	if istiogrpc.IsExpectedGRPCError(err) {
-		proxyLog.WithLabels("id", con.conID).Debugf("upstream terminated with status %v", err)
+		con.logger().Debugf("upstream terminated with status %v", err)
 		metrics.IstiodConnectionCancellations.Increment()
 	} else {
-		proxyLog.WithLabels("id", con.conID).Warnf("upstream terminated with unexpected error %v", err)
+		con.logger().Warnf("upstream terminated with unexpected error %v", err)
 		metrics.IstiodConnectionErrors.Increment()
 	}
 	select {
@@ -840,10 +1740,10 @@ func upstreamErr(con *ProxyConnection, err error) {
 // downstreamErr sends the error to downstreamError channel, and return immediately if the connection closed.
 func downstreamErr(con *ProxyConnection, err error) {
 	if istiogrpc.IsExpectedGRPCError(err) {
-		proxyLog.WithLabels("id", con.conID).Debugf("downstream terminated with status %v", err)
+		con.logger().Debugf("downstream terminated with status %v", err)
 		metrics.EnvoyConnectionCancellations.Increment()
 	} else {
-		proxyLog.WithLabels("id", con.conID).Warnf("downstream terminated with unexpected error %v", err)
+		con.logger().Warnf("downstream terminated with unexpected error %v", err)
 		metrics.EnvoyConnectionErrors.Increment()
 	}
 	select {
@@ -0,0 +1,102 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+
+	"istio.io/istio/pkg/channels"
+)
+
+// AckStatus is the outcome of a XDS response.
+type AckStatus string
+
+const (
+	Ack  AckStatus = "ACK"
+	Nack AckStatus = "NACK"
+)
+
+// AckEvent reports the outcome of a XDS response, as sent to the upstream XDS server.
+type AckEvent struct {
+	TypeURL string
+	Nonce   string
+	Status  AckStatus
+	// ErrorDetail is the reason of a NACK, nil for an ACK.
+	ErrorDetail *google_rpc.Status
+}
+
+// AckCallback observes the outcome of the XDS responses. It is invoked asynchronously from the XDS streams, in
+// the order the outcomes are sent upstream, and must not block for long as it delays the following events.
+type AckCallback func(event AckEvent)
+
+// ackNotifier dispatches the outcome of the XDS responses to the registered callbacks.
+type ackNotifier struct {
+	mu        sync.RWMutex
+	callbacks []AckCallback
+	events    *channels.Unbounded[AckEvent]
+	start     sync.Once
+}
+
+// RegisterAckCallback registers cb to be invoked with the outcome of each XDS response, of every type,
+// whether it is reported by Envoy or by the agent itself.
+func (p *XdsProxy) RegisterAckCallback(cb AckCallback) {
+	n := &p.ackNotifier
+	n.start.Do(func() {
+		n.events = channels.NewUnbounded[AckEvent]()
+		go n.run(p.stopChan)
+	})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.callbacks = append(n.callbacks, cb)
+}
+
+// notify queues the outcome of the response acknowledged by a request with the given nonce, if any callback
+// is registered. It never blocks.
+func (n *ackNotifier) notify(typeURL, nonce string, errorDetail *google_rpc.Status) {
+	if nonce == "" {
+		// Not the acknowledgement of a response.
+		return
+	}
+	n.mu.RLock()
+	registered := len(n.callbacks) > 0
+	n.mu.RUnlock()
+	if !registered {
+		return
+	}
+	status := Ack
+	if errorDetail != nil {
+		status = Nack
+	}
+	n.events.Put(AckEvent{TypeURL: typeURL, Nonce: nonce, Status: status, ErrorDetail: errorDetail})
+}
+
+func (n *ackNotifier) run(stop <-chan struct{}) {
+	for {
+		select {
+		case event := <-n.events.Get():
+			n.events.Load()
+			n.mu.RLock()
+			callbacks := n.callbacks
+			n.mu.RUnlock()
+			for _, cb := range callbacks {
+				cb(event)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xds"
+	"istio.io/istio/pkg/test/env"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+func TestXdsProxyAckCallback(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = &fakeAckCache{}
+	events := make(chan AckEvent, 10)
+	proxy.RegisterAckCallback(func(event AckEvent) {
+		events <- event
+	})
+	nextEvent := func() AckEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for the ack callback")
+			return AckEvent{}
+		}
+	}
+
+	ef, err := os.ReadFile(path.Join(env.IstioSrc, "pilot/pkg/xds/testdata/ecds.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{
+		ConfigString: string(ef),
+	})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	node := model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+		ClusterID:   "Kubernetes",
+	}
+	err = downstream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       v3.ExtensionConfigurationType,
+		ResourceNames: []string{"extension-config"},
+		Node: &core.Node{
+			Id:       "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: node.ToStruct(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The initial request does not acknowledge any response, so the first event is the ACK.
+	if err := downstream.Send(&discovery.DiscoveryRequest{
+		VersionInfo:   resp.VersionInfo,
+		TypeUrl:       v3.ExtensionConfigurationType,
+		ResourceNames: []string{"extension-config"},
+		ResponseNonce: resp.Nonce,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nextEvent(), AckEvent{TypeURL: v3.ExtensionConfigurationType, Nonce: resp.Nonce, Status: Ack})
+
+	nack := &google_rpc.Status{Message: "rejected"}
+	if err := downstream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       v3.ExtensionConfigurationType,
+		ResourceNames: []string{"extension-config"},
+		ResponseNonce: resp.Nonce,
+		ErrorDetail:   nack,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nextEvent(), AckEvent{TypeURL: v3.ExtensionConfigurationType, Nonce: resp.Nonce, Status: Nack, ErrorDetail: nack})
+}
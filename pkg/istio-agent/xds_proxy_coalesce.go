@@ -0,0 +1,40 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"time"
+)
+
+// awaitCoalesceWindow holds a new stream from Envoy for the reconnect coalescing window before it is forwarded
+// upstream, so that the initial requests of Envoy are batched, and their duplicates dropped, before the first
+// upstream send. It returns false if the stream is replaced by a newer stream or closed meanwhile, as when Envoy
+// reconnects repeatedly: the stream is then dropped without ever reaching the upstream XDS server.
+func (p *XdsProxy) awaitCoalesceWindow(ctx context.Context, con *ProxyConnection) bool {
+	if p.reconnectCoalesceWindow <= 0 {
+		return true
+	}
+	t := time.NewTimer(p.reconnectCoalesceWindow)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-con.stopChan:
+	case <-ctx.Done():
+	}
+	con.logger().Debugf("dropping the stream from Envoy closed within the reconnect coalescing window")
+	return false
+}
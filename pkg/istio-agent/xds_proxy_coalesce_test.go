@@ -0,0 +1,73 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// Validates near-simultaneous reconnects of Envoy produce a single upstream stream, with a single subscription
+// request coalescing the identical initial requests.
+func TestDeltaXdsProxyReconnectCoalescing(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.reconnectCoalesceWindow = 200 * time.Millisecond
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	subscribe := func(downstream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient) {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+				TypeUrl:                v3.ClusterType,
+				Node:                   node,
+				ResourceNamesSubscribe: []string{"outbound|80||foo.default.svc.cluster.local"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The first stream is replaced by a reconnect within the coalescing window.
+	subscribe(deltaStream(t, conn))
+	subscribe(deltaStream(t, conn))
+
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := len(recorder.streamRequests(0)); sent == 0 {
+			return fmt.Errorf("expected the subscription to be forwarded upstream")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	// Leave time for the duplicates to reach the upstream, if they are not coalesced.
+	time.Sleep(100 * time.Millisecond)
+	recorder.mu.Lock()
+	streams := len(recorder.cancels)
+	recorder.mu.Unlock()
+	assert.Equal(t, streams, 1)
+	assert.Equal(t, len(recorder.streamRequests(0)), 1)
+}
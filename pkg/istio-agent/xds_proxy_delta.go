@@ -16,28 +16,47 @@ package istioagent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
 	"time"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"go.uber.org/atomic"
 	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	anypb "google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/xds"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/backoff"
 	"istio.io/istio/pkg/channels"
 	"istio.io/istio/pkg/istio-agent/metrics"
 	"istio.io/istio/pkg/log"
+	"istio.io/istio/pkg/maps"
+	"istio.io/istio/pkg/monitoring"
 	"istio.io/istio/pkg/slices"
-	"istio.io/istio/pkg/wasm"
+	"istio.io/istio/pkg/util/sets"
 )
 
+// goDelta runs f in a new goroutine of a delta connection, counted while it runs so that leaks can be detected.
+func goDelta(f func()) {
+	metrics.DeltaGoroutineStarted()
+	go func() {
+		defer metrics.DeltaGoroutineStopped()
+		f()
+	}()
+}
+
 // sendDeltaRequest is a small wrapper around sending to con.requestsChan. This ensures that we do not
 // block forever on
 func (con *ProxyConnection) sendDeltaRequest(req *discovery.DeltaDiscoveryRequest) {
@@ -50,6 +69,14 @@ func (con *ProxyConnection) sendDeltaRequest(req *discovery.DeltaDiscoveryReques
 // as the new connection may not go to the same istiod. Vice versa case also applies.
 func (p *XdsProxy) DeltaAggregatedResources(downstream xds.DeltaDiscoveryStream) error {
 	proxyLog.Debugf("accepted delta xds connection from envoy, forwarding to upstream")
+	metrics.DeltaStreamOpened(metrics.Downstream)
+	defer metrics.DeltaStreamClosed(metrics.Downstream)
+	advertiseAPIType(downstream, deltaAPIType)
+	if p.sharedUpstream {
+		if primary := p.sharedDeltaPrimary(); primary != nil {
+			return p.serveSharedDelta(primary, downstream)
+		}
+	}
 
 	con := &ProxyConnection{
 		conID:             connectionNumber.Inc(),
@@ -57,20 +84,68 @@ func (p *XdsProxy) DeltaAggregatedResources(downstream xds.DeltaDiscoveryStream)
 		downstreamError:   make(chan error), // can be produced by recv and send
 		deltaRequestsChan: channels.NewUnbounded[*discovery.DeltaDiscoveryRequest](),
 		// Allow a buffer of 1. This ensures we queue up at most 2 (one in process, 1 pending) responses before forwarding.
-		deltaResponsesChan: make(chan *discovery.DeltaDiscoveryResponse, 1),
-		stopChan:           make(chan struct{}),
-		downstreamDeltas:   downstream,
+		deltaResponsesChan:   make(chan *discovery.DeltaDiscoveryResponse, 1),
+		stopChan:             make(chan struct{}),
+		downstreamDeltas:     downstream,
+		deltaSubscriptions:   newDeltaSubscriptions(),
+		deltaAcks:            newDeltaAckTracker(),
+		deltaSplits:          newDeltaSplitTracker(),
+		deltaCorrelations:    newDeltaCorrelations(),
+		maxDeltaResponseSize: p.maxDeltaResponseSize,
+		dryRun:               p.deltaDryRun,
+		upstreamHealth:       &p.upstreamHealth,
+		tracer:               p.tracer,
+		lastGood:             p.lastGood,
+		connectedAt:          time.Now(),
+	}
+	con.log = newConnectionLogger(downstream.Context(), con.conID)
+	p.initMetricLabels(con)
+	// gRPC-web clients cannot stream requests, and so never acknowledge the responses: they are neither held nor
+	// resent waiting for acknowledgements.
+	_, grpcWeb := downstream.(*grpcWebDeltaStream)
+	if p.maxInflightResponses > 0 && !grpcWeb {
+		con.deltaInflight = newDeltaInflightLimiter(p.maxInflightResponses)
+	}
+	if len(p.ackTimeouts) > 0 && !grpcWeb {
+		con.ackTimeouts = newDeltaAckTimeouts(p.ackTimeouts, p.ackTimeoutResends)
+	}
+	if p.circuitBreakerFailures > 0 {
+		con.breaker = newDeltaCircuitBreaker(con.logger(), p.circuitBreakerFailures, p.circuitBreakerCooldown)
+	}
+	if len(p.responsePrerequisites) > 0 && !grpcWeb {
+		con.deltaOrder = newDeltaResponseOrder(p.responsePrerequisites)
+	}
+	if p.sharedUpstream {
+		con.fanout = newDeltaFanout()
+	}
+	if p.deltaFlushTimeout > 0 {
+		con.deltaFlush = make(chan deltaFlushRequest)
+	}
+	if p.deltaResponseQueueSize > 0 {
+		con.deltaResponseQueue = newDeltaResponseQueue(p.deltaResponseQueueSize)
+		goDelta(func() { con.deltaResponseQueue.run(con.deltaResponsesChan, con.stopChan) })
+	}
+	if grpcWeb {
+		// Debugging tools connecting with gRPC-web must not replace the stream of Envoy.
+		defer close(con.stopChan)
+	} else {
+		p.registerStream(con)
+		defer p.unregisterStream(con)
+	}
+	defer con.backlog.close()
+	defer p.lastGood.forget(con.conID)
+	if !p.awaitCoalesceWindow(downstream.Context(), con) {
+		return nil
 	}
-	p.registerStream(con)
-	defer p.unregisterStream(con)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout())
 	defer cancel()
 
 	upstreamConn, err := p.buildUpstreamConn(ctx)
 	if err != nil {
-		proxyLog.Errorf("failed to connect to upstream %s: %v", p.istiodAddress, err)
+		con.logger().Errorf("failed to connect to upstream %s: %v", p.istiodAddress, err)
 		metrics.IstiodConnectionFailures.Increment()
+		p.upstreamHealth.disconnected(con.conID, err)
 		return err
 	}
 	defer upstreamConn.Close()
@@ -81,48 +156,80 @@ func (p *XdsProxy) DeltaAggregatedResources(downstream xds.DeltaDiscoveryStream)
 		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
 	}
 	// We must propagate upstream termination to Envoy. This ensures that we resume the full XDS sequence on new connection
-	return p.handleDeltaUpstream(ctx, con, xds)
+	if p.deltaToSotw {
+		err = p.handleDeltaToSotwUpstream(ctx, con, xds)
+	} else {
+		err = p.handleDeltaUpstream(ctx, con, upstreamConn)
+	}
+	p.upstreamHealth.disconnected(con.conID, err)
+	return err
 }
 
-func (p *XdsProxy) handleDeltaUpstream(ctx context.Context, con *ProxyConnection, xds discovery.AggregatedDiscoveryServiceClient) error {
-	log := proxyLog.WithLabels("id", con.conID)
-	deltaUpstream, err := xds.DeltaAggregatedResources(ctx,
+func (p *XdsProxy) handleDeltaUpstream(ctx context.Context, con *ProxyConnection, upstreamConn *grpc.ClientConn) error {
+	log := con.logger()
+	xds := discovery.NewAggregatedDiscoveryServiceClient(upstreamConn)
+	if !p.reloadRootCert {
+		con.certsRotated = make(chan struct{}, 1)
+	}
+	if p.deltaReconnect || p.holdDownstream || len(p.resubscribeCodes) > 0 ||
+		p.upstreamMaxIdle > 0 || p.upstreamRecvIdleTimeout > 0 || con.certsRotated != nil {
+		con.openDeltaUpstream = func(redial bool) (discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient, error) {
+			if redial {
+				conn, err := p.redialUpstreamConn(con, upstreamConn)
+				if err != nil {
+					return nil, err
+				}
+				upstreamConn = conn
+				xds = discovery.NewAggregatedDiscoveryServiceClient(conn)
+			}
+			streamCtx, cancel := context.WithCancel(ctx)
+			upstream, err := xds.DeltaAggregatedResources(streamCtx, grpc.MaxCallRecvMsgSize(defaultClientMaxReceiveMessageSize))
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			con.cancelUpstream()
+			con.cancelUpstream = cancel
+			return upstream, nil
+		}
+	}
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	con.cancelUpstream = cancelStream
+	deltaUpstream, err := xds.DeltaAggregatedResources(streamCtx,
 		grpc.MaxCallRecvMsgSize(defaultClientMaxReceiveMessageSize))
 	if err != nil {
 		// Envoy logs errors again, so no need to log beyond debug level
 		log.Debugf("failed to create delta upstream grpc client: %v", err)
 		// Increase metric when xds connection error, for example: forgot to restart ingressgateway or sidecar after changing root CA.
 		metrics.IstiodConnectionErrors.Increment()
-		return err
-	}
-	log.Infof("connected to delta upstream XDS server: %s", p.istiodAddress)
-	defer log.Debugf("disconnected from delta XDS server: %s", p.istiodAddress)
-
-	con.upstreamDeltas = deltaUpstream
-
-	// handle responses from istiod
-	go func() {
-		for {
-			resp, err := con.upstreamDeltas.Recv()
-			if err != nil {
-				upstreamErr(con, err)
-				return
-			}
-			select {
-			case con.deltaResponsesChan <- resp:
-			case <-con.stopChan:
-			}
+		if !p.holdDownstream {
+			return err
 		}
-	}()
+		// Keep the stream of Envoy open, and connect to the upstream in the background.
+		log.Infof("delta upstream XDS server %s is unreachable, holding the stream of Envoy: %v", p.activeUpstreamAddress(), err)
+		p.upstreamHealth.disconnected(con.conID, err)
+	} else {
+		log.Infof("connected to delta upstream XDS server: %s", p.activeUpstreamAddress())
+		p.upstreamHealth.connected(con.conID)
+		goDelta(func() { p.recordUpstreamHeaders(con, deltaUpstream) })
+		con.upstreamDeltas = deltaUpstream
+	}
+	metrics.DeltaStreamOpened(metrics.Upstream)
+	defer metrics.DeltaStreamClosed(metrics.Upstream)
+	defer log.Debugf("disconnected from delta XDS server: %s", p.activeUpstreamAddress())
 
-	go p.handleUpstreamDeltaRequest(con)
-	go p.handleUpstreamDeltaResponse(con)
+	goDelta(func() { p.handleUpstreamDeltaRequest(con, err) })
+	goDelta(func() { p.handleUpstreamDeltaResponse(con) })
 
 	for {
 		select {
 		case err := <-con.upstreamError:
 			return err
 		case err := <-con.downstreamError:
+			if err == io.EOF && con.deltaFlush != nil {
+				// Envoy gracefully closed its stream, but can still receive the responses already queued.
+				p.flushDeltaResponses(con)
+			}
 			// On downstream error, we will return. This propagates the error to downstream envoy which will trigger reconnect
 			return err
 		case <-con.stopChan:
@@ -132,19 +239,49 @@ func (p *XdsProxy) handleDeltaUpstream(ctx context.Context, con *ProxyConnection
 	}
 }
 
-func (p *XdsProxy) handleUpstreamDeltaRequest(con *ProxyConnection) {
-	log := proxyLog.WithLabels("id", con.conID)
+// handleUpstreamDeltaRequest forwards the requests of Envoy upstream. If openErr is set, the upstream stream could not
+// be opened and the stream of Envoy is held open while it is connected in the background.
+func (p *XdsProxy) handleUpstreamDeltaRequest(con *ProxyConnection, openErr error) {
+	log := con.logger()
 	initialRequestsSent := atomic.NewBool(false)
-	go func() {
+	// handle responses from istiod. The SotW translation handles upstream responses itself.
+	var upstreamFailed <-chan error
+	if con.deltaToSotw == nil && con.upstreamDeltas != nil {
+		upstreamFailed = con.forwardUpstreamDeltas(con.upstreamDeltas)
+	}
+	goDelta(func() {
 		for {
 			// recv delta xds requests from envoy
 			req, err := con.downstreamDeltas.Recv()
 			if err != nil {
+				downstreamErr(con, deltaRecvError(err))
+				return
+			}
+			if err := p.checkDownstreamDeltaRequest(con.logger(), req); err != nil {
 				downstreamErr(con, err)
 				return
 			}
+			con.bytes.record(metrics.DownstreamReceived, req.TypeUrl, req)
+			con.deltaAcks.received(req, con.bytes.metricLabels())
+			con.nacks.log(con.logger(), req)
+			if req = con.deltaSplits.received(req); req == nil {
+				// The ACK of a chunk of a split response, acknowledged upstream with the last chunk.
+				continue
+			}
+			con.deltaInflight.acked(req)
+			con.ackTimeouts.acked(req)
+			con.deltaOrder.acked(req)
+			con.lastGood.acked(con.conID, req)
+			if req = bootstrapAcked(con, req); req == nil {
+				continue
+			}
+			con.partialNacks.apply(req)
+			con.recordNode(req.Node)
+			p.serveLastGoodResources(con, req)
+			p.serveBootstrapResources(con, req)
 
 			// forward to istiod
+			con.fanout.primarySubscribe(req)
 			con.sendDeltaRequest(req)
 			if !initialRequestsSent.Load() && req.TypeUrl == v3.ListenerType {
 				// fire off an initial NDS request
@@ -170,33 +307,152 @@ func (p *XdsProxy) handleUpstreamDeltaRequest(con *ProxyConnection) {
 				p.connectedMutex.RUnlock()
 			}
 		}
-	}()
+	})
 
+	var limiter *deltaRequestLimiter
+	if p.upstreamRequestRate > 0 {
+		limiter = newDeltaRequestLimiter(p.upstreamRequestRate, p.upstreamRequestBurst)
+	}
+	defer limiter.stop()
+	breaker := con.breaker
+	defer breaker.stop()
+	// The SotW translation watches the idle upstream itself.
+	var idle *upstreamIdleTimer
+	if con.deltaToSotw == nil {
+		idle = p.newUpstreamIdleTimer(con)
+	}
+	defer idle.stop()
 	defer func() {
-		_ = con.upstreamDeltas.CloseSend()
+		if con.deltaToSotw != nil {
+			_ = con.upstream.CloseSend()
+			return
+		}
+		if con.upstreamDeltas != nil {
+			_ = con.upstreamDeltas.CloseSend()
+		}
 	}()
+	if !p.waitStartupJitter(con) {
+		return
+	}
+	if openErr != nil {
+		// The requests of Envoy are queued until the upstream is reachable.
+		upstream, err := p.reconnectDeltaUpstream(con, openErr)
+		if err != nil {
+			upstreamErr(con, err)
+			return
+		}
+		con.upstreamDeltas = upstream
+		upstreamFailed = con.forwardUpstreamDeltas(upstream)
+	}
+	// lastSent is the type URL of the last request sent upstream, to which a failure of the stream is attributed.
+	var lastSent string
+	// replaceUpstream replaces the current upstream stream after cause, keeping the stream of Envoy.
+	replaceUpstream := func(cause error) error {
+		con.cancelUpstream()
+		<-upstreamFailed
+		upstream, err := p.reconnectDeltaUpstream(con, cause)
+		if err != nil {
+			return err
+		}
+		con.upstreamDeltas = upstream
+		upstreamFailed = con.forwardUpstreamDeltas(upstream)
+		return nil
+	}
+	// send sends a request to the upstream, unless it is held.
+	send := func(req *discovery.DeltaDiscoveryRequest) error {
+		if breaker != nil && !breaker.admit(req) {
+			return nil
+		}
+		if limiter != nil && !limiter.admit(req) {
+			return nil
+		}
+		lastSent = req.TypeUrl
+		return p.forwardUpstreamDelta(con, req, upstreamFailed != nil)
+	}
+	// handle sends a request from Envoy to the upstream, unless it is dropped or held.
+	handle := func(req *discovery.DeltaDiscoveryRequest) error {
+		if req.TypeUrl == v3.HealthInfoType && !initialRequestsSent.Load() {
+			// only send healthcheck probe after LDS request has been sent
+			return nil
+		}
+		log.WithLabels(
+			"type", v3.GetShortType(req.TypeUrl),
+			"sub", len(req.ResourceNamesSubscribe),
+			"unsub", len(req.ResourceNamesUnsubscribe),
+			"nonce", req.ResponseNonce,
+			"initial", len(req.InitialResourceVersions),
+		).Debugf("delta request")
+		if !con.deltaSubscriptions.update(req) {
+			log.WithLabels("type", v3.GetShortType(req.TypeUrl)).Debugf("dropping duplicate delta subscription request")
+			return nil
+		}
+		return send(req)
+	}
+	var queue *deltaRequestQueue
+	if len(p.requestPriorities) > 0 {
+		queue = newDeltaRequestQueue(p.requestPriorities)
+	}
 	for {
 		select {
 		case req := <-con.deltaRequestsChan.Get():
 			con.deltaRequestsChan.Load()
-			if req.TypeUrl == v3.HealthInfoType && !initialRequestsSent.Load() {
-				// only send healthcheck probe after LDS request has been sent
+			if queue != nil {
+				// All the available requests are queued, and then sent by priority.
+				queue.push(req)
+				queue.drain(con.deltaRequestsChan)
 				continue
 			}
-			log.WithLabels(
-				"type", v3.GetShortType(req.TypeUrl),
-				"sub", len(req.ResourceNamesSubscribe),
-				"unsub", len(req.ResourceNamesUnsubscribe),
-				"nonce", req.ResponseNonce,
-				"initial", len(req.InitialResourceVersions),
-			).Debugf("delta request")
-			metrics.XdsProxyRequests.Increment()
-			if req.TypeUrl == v3.ExtensionConfigurationType {
-				p.ecdsLastNonce.Store(req.ResponseNonce)
+			if err := handle(req); err != nil {
+				upstreamErr(con, err)
+				return
 			}
-
-			if err := con.upstreamDeltas.Send(req); err != nil {
-				err = fmt.Errorf("send error for type url %s: %v", req.TypeUrl, err)
+		case <-queue.ready():
+			if err := handle(queue.pop()); err != nil {
+				upstreamErr(con, err)
+				return
+			}
+		case <-breaker.pending():
+			breaker.applyReported()
+		case <-breaker.ready():
+			for _, req := range breaker.release() {
+				if err := send(req); err != nil {
+					upstreamErr(con, err)
+					return
+				}
+			}
+		case <-limiter.ready():
+			for _, req := range limiter.release() {
+				lastSent = req.TypeUrl
+				if err := p.forwardUpstreamDelta(con, req, upstreamFailed != nil); err != nil {
+					upstreamErr(con, err)
+					return
+				}
+			}
+		case err := <-upstreamFailed:
+			if breaker != nil && lastSent != "" {
+				breaker.record(lastSent, true)
+			}
+			upstream, rerr := p.reconnectDeltaUpstream(con, err)
+			if rerr != nil {
+				upstreamErr(con, rerr)
+				return
+			}
+			con.upstreamDeltas = upstream
+			upstreamFailed = con.forwardUpstreamDeltas(upstream)
+		case <-idle.C():
+			err := idle.expired()
+			if err == nil || upstreamFailed == nil {
+				continue
+			}
+			if err := replaceUpstream(err); err != nil {
+				upstreamErr(con, err)
+				return
+			}
+		case <-con.certsRotated:
+			if upstreamFailed == nil {
+				continue
+			}
+			if err := replaceUpstream(errUpstreamCertsRotated); err != nil {
 				upstreamErr(con, err)
 				return
 			}
@@ -206,88 +462,388 @@ func (p *XdsProxy) handleUpstreamDeltaRequest(con *ProxyConnection) {
 	}
 }
 
+// forwardUpstreamDelta sends a request from Envoy to the upstream. If reconnecting is true, a terminated
+// upstream stream is not an error, as the reason is reported by the upstream receiver.
+func (p *XdsProxy) forwardUpstreamDelta(con *ProxyConnection, req *discovery.DeltaDiscoveryRequest, reconnecting bool) error {
+	metrics.XdsProxyRequests.Increment()
+	p.ackNotifier.notify(req.TypeUrl, req.ResponseNonce, req.ErrorDetail)
+	if p.isECDSType(req.TypeUrl) {
+		p.ecdsLastNonce.Store(req.ResponseNonce)
+		if req.ErrorDetail != nil {
+			p.recordECDSNack(req.ResponseNonce, req.ResourceNamesSubscribe, req.ErrorDetail.GetMessage())
+		}
+	}
+	if err := con.sendUpstreamDelta(req); err != nil {
+		if err == io.EOF && reconnecting {
+			return nil
+		}
+		return fmt.Errorf("send error for type url %s: %v", req.TypeUrl, err)
+	}
+	return nil
+}
+
+// forwardUpstreamDeltas forwards the responses of the upstream stream to Envoy, until the stream fails.
+// The failure is reported on the returned channel.
+func (con *ProxyConnection) forwardUpstreamDeltas(upstream xds.DeltaDiscoveryClient) <-chan error {
+	failed := make(chan error, 1)
+	goDelta(func() {
+		for {
+			resp, err := upstream.Recv()
+			if err != nil {
+				failed <- err
+				return
+			}
+			con.upstreamReceived()
+			con.bytes.record(metrics.UpstreamReceived, resp.TypeUrl, resp)
+			con.sendDeltaResponse(resp)
+		}
+	})
+	return failed
+}
+
+// sendDeltaResponse passes a response from the upstream to handleUpstreamDeltaResponse. This blocks while
+// a previous response is being handled, unless responses are queued.
+func (con *ProxyConnection) sendDeltaResponse(resp *discovery.DeltaDiscoveryResponse) {
+	con.backlog.add(resp.TypeUrl)
+	if con.deltaResponseQueue != nil {
+		if con.deltaResponseQueue.put(resp) {
+			// Merged into a queued response.
+			con.backlog.done(resp.TypeUrl)
+		}
+		return
+	}
+	select {
+	case con.deltaResponsesChan <- resp:
+	case <-con.stopChan:
+	}
+}
+
+// reconnectDeltaUpstream opens a new delta stream to the upstream after the previous one failed with cause,
+// and resumes the subscriptions and resource versions known by Envoy on it, so Envoy does not need to
+// reconnect and rebuild its state. The cause is returned if the failure is not transient, reconnection is
+// disabled, or the upstream cannot be reached within deltaReconnectMaxElapsedTime. If the stream of Envoy is held
+// on upstream loss, it reconnects on any failure until the connection stops. If the status code of cause is
+// one of resubscribeCodes, the subscriptions are resumed without the resource versions known by Envoy. An idle
+// upstream is always reconnected, and the upstream is always redialed once the certificates rotated.
+func (p *XdsProxy) reconnectDeltaUpstream(con *ProxyConnection, cause error) (xds.DeltaDiscoveryClient, error) {
+	resubscribe := p.resubscribeOn(cause)
+	redial := errors.Is(cause, errUpstreamCertsRotated)
+	reconnect := p.holdDownstream || resubscribe || redial || errors.Is(cause, errUpstreamIdle) ||
+		(p.deltaReconnect && isTransientUpstreamError(cause))
+	if con.openDeltaUpstream == nil || !reconnect {
+		return nil, cause
+	}
+	log := con.logger()
+	p.upstreamHealth.disconnected(con.conID, cause)
+	o := backoff.DefaultOption()
+	o.InitialInterval = p.deltaReconnectBackoff
+	o.MaxInterval = deltaReconnectMaxInterval
+	b := backoff.NewExponentialBackOff(o)
+	start := time.Now()
+	for {
+		next := b.NextBackOff()
+		if !p.holdDownstream && time.Since(start)+next > deltaReconnectMaxElapsedTime {
+			return nil, cause
+		}
+		if resubscribe {
+			log.Infof("delta upstream terminated with %v, resubscribing in %v", cause, next)
+		} else {
+			log.Infof("delta upstream terminated with %v, reconnecting in %v", cause, next)
+		}
+		select {
+		case <-time.After(next):
+		case <-con.stopChan:
+			return nil, cause
+		}
+		upstream, err := con.openDeltaUpstream(redial)
+		if err == nil {
+			if err = p.resumeDeltaUpstream(con, upstream, resubscribe); err == nil {
+				log.Infof("reconnected to delta upstream XDS server: %s", p.activeUpstreamAddress())
+				p.upstreamHealth.connected(con.conID)
+				goDelta(func() { p.recordUpstreamHeaders(con, upstream) })
+				return upstream, nil
+			}
+			_ = upstream.CloseSend()
+		}
+		metrics.IstiodConnectionErrors.Increment()
+		cause = err
+	}
+}
+
+// resumeDeltaUpstream sends the requests resuming the state of Envoy to a new upstream stream. If resubscribe is
+// true, the resources are subscribed to again without the versions known by Envoy.
+func (p *XdsProxy) resumeDeltaUpstream(con *ProxyConnection, upstream xds.DeltaDiscoveryClient, resubscribe bool) error {
+	reqs := con.deltaSubscriptions.resumeRequests()
+	if resubscribe {
+		reqs = resubscribeRequests(reqs)
+	}
+	p.connectedMutex.RLock()
+	if p.initialDeltaHealthRequest != nil {
+		reqs = append(reqs, p.initialDeltaHealthRequest)
+	}
+	p.connectedMutex.RUnlock()
+	for _, req := range reqs {
+		if err := upstream.Send(req); err != nil {
+			return err
+		}
+		con.upstreamSent()
+		con.bytes.record(metrics.UpstreamSent, req.TypeUrl, req)
+	}
+	return nil
+}
+
+// isTransientUpstreamError returns true if the upstream stream failed with an error which may be resolved
+// by reconnecting, such as the upstream restarting or closing the stream.
+func isTransientUpstreamError(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkDownstreamDeltaRequest validates a delta request received from Envoy, and applies the defaults and mutations
+// of its node. An error rejects the stream of Envoy. It applies to every stream served by the proxy, including the
+// streams sharing the upstream stream of another Envoy.
+func (p *XdsProxy) checkDownstreamDeltaRequest(log *log.Scope, req *discovery.DeltaDiscoveryRequest) error {
+	if err := checkDeltaRequest(req); err != nil {
+		return err
+	}
+	if req.Node != nil && p.defaultNodeMetadata != nil {
+		p.applyNodeMetadataDefaults(log, req.Node)
+	}
+	if req.Node != nil {
+		if err := p.mutateNode(req.Node); err != nil {
+			return err
+		}
+	}
+	if err := p.checkNodeMetadata(req.Node); err != nil {
+		return err
+	}
+	return p.checkTypeURL(req.TypeUrl)
+}
+
+// applyNodeMetadataDefaults sets the default metadata absent from the metadata of node. The namespace of the
+// identity parsed from the node ID takes precedence over the configured defaults.
+func (p *XdsProxy) applyNodeMetadataDefaults(log *log.Scope, node *core.Node) {
+	identity, err := p.nodeIDParser.Parse(node.Id)
+	if err != nil {
+		log.Debugf("failed to parse node ID: %v", err)
+	} else if identity.Namespace != "" {
+		mergeDefaultNodeMetadata(node, model.NodeMetadata{Namespace: identity.Namespace}.ToStruct())
+	}
+	mergeDefaultNodeMetadata(node, p.defaultNodeMetadata)
+}
+
+// mergeDefaultNodeMetadata sets the fields of defaults which are absent from the metadata of node.
+// The fields sent by Envoy are never overwritten.
+func mergeDefaultNodeMetadata(node *core.Node, defaults *structpb.Struct) {
+	if node.Metadata == nil {
+		node.Metadata = &structpb.Struct{}
+	}
+	if node.Metadata.Fields == nil {
+		node.Metadata.Fields = make(map[string]*structpb.Value, len(defaults.GetFields()))
+	}
+	for k, v := range defaults.GetFields() {
+		if _, f := node.Metadata.Fields[k]; !f {
+			node.Metadata.Fields[k] = v
+		}
+	}
+}
+
+// sendUpstreamDelta sends the request to the upstream, translating it to SotW if needed.
+func (con *ProxyConnection) sendUpstreamDelta(req *discovery.DeltaDiscoveryRequest) error {
+	if con.deltaToSotw != nil {
+		sotwReq := con.deltaToSotw.toSotwRequest(req)
+		if err := con.upstream.Send(sotwReq); err != nil {
+			return err
+		}
+		con.upstreamSent()
+		con.bytes.record(metrics.UpstreamSent, req.TypeUrl, sotwReq)
+		return nil
+	}
+	if err := con.upstreamDeltas.Send(req); err != nil {
+		return err
+	}
+	con.upstreamSent()
+	con.bytes.record(metrics.UpstreamSent, req.TypeUrl, req)
+	return nil
+}
+
 func (p *XdsProxy) handleUpstreamDeltaResponse(con *ProxyConnection) {
 	forwardEnvoyCh := make(chan *discovery.DeltaDiscoveryResponse, 1)
+	defer con.ackTimeouts.stop()
 	for {
 		select {
 		case resp := <-con.deltaResponsesChan:
-			// TODO: separate upstream response handling from requests sending, which are both time costly
-			proxyLog.WithLabels(
-				"id", con.conID,
-				"type", v3.GetShortType(resp.TypeUrl),
-				"nonce", resp.Nonce,
-				"resources", len(resp.Resources),
-				"removes", len(resp.RemovedResources),
-			).Debugf("upstream response")
-			metrics.XdsProxyResponses.Increment()
-			if h, f := p.handlers[resp.TypeUrl]; f {
-				if len(resp.Resources) == 0 {
-					// Empty response, nothing to do
-					// This assumes internal types are always singleton
-					break
-				}
-				err := h(resp.Resources[0].Resource)
-				var errorResp *google_rpc.Status
-				if err != nil {
-					errorResp = &google_rpc.Status{
-						Code:    int32(codes.Internal),
-						Message: err.Error(),
-					}
-				}
-				// Send ACK/NACK
-				con.sendDeltaRequest(&discovery.DeltaDiscoveryRequest{
-					TypeUrl:       resp.TypeUrl,
-					ResponseNonce: resp.Nonce,
-					ErrorDetail:   errorResp,
-				})
-				continue
+			con.deltaResponseQueue.received()
+			con.backlog.done(resp.TypeUrl)
+			p.handleDeltaResponse(con, resp, forwardEnvoyCh)
+		case resp := <-forwardEnvoyCh:
+			forwardDeltaToEnvoy(con, resp)
+		case <-con.deltaInflight.ready():
+			for _, resp := range con.deltaInflight.release() {
+				con.backlog.done(resp.TypeUrl)
+				sendDeltaToEnvoy(con, resp)
 			}
-			switch resp.TypeUrl {
-			case v3.ExtensionConfigurationType:
-				if features.WasmRemoteLoadConversion {
-					// If Wasm remote load conversion feature is enabled, rewrite and send.
-					go p.deltaRewriteAndForward(con, resp, func(resp *discovery.DeltaDiscoveryResponse) {
-						// Forward the response using the thread of `handleUpstreamResponse`
-						// to prevent concurrent access to forwardToEnvoy
-						select {
-						case forwardEnvoyCh <- resp:
-						case <-con.stopChan:
-						}
-					})
-				} else {
-					// Otherwise, forward ECDS resource update directly to Envoy.
-					forwardDeltaToEnvoy(con, resp)
-				}
-			default:
-				if strings.HasPrefix(resp.TypeUrl, v3.DebugType) {
-					p.forwardDeltaToTap(resp)
-				} else {
-					forwardDeltaToEnvoy(con, resp)
+		case <-con.deltaOrder.ready():
+			for _, resp := range con.deltaOrder.release() {
+				con.backlog.done(resp.TypeUrl)
+				if admitDeltaInflight(con, resp) {
+					sendDeltaToEnvoy(con, resp)
 				}
 			}
-		case resp := <-forwardEnvoyCh:
-			forwardDeltaToEnvoy(con, resp)
+		case <-con.ackTimeouts.ready():
+			resendUnackedDeltas(con)
+		case flush := <-con.deltaFlush:
+			p.drainDeltaResponses(con, forwardEnvoyCh, flush)
 		case <-con.stopChan:
 			return
 		}
 	}
 }
 
+// handleDeltaResponse handles a response from the upstream. The rewritten ECDS responses are passed to
+// forwardEnvoyCh, to be forwarded to Envoy from the goroutine of handleUpstreamDeltaResponse.
+func (p *XdsProxy) handleDeltaResponse(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse,
+	forwardEnvoyCh chan *discovery.DeltaDiscoveryResponse,
+) {
+	// TODO: separate upstream response handling from requests sending, which are both time costly
+	if isLocalNonce(resp.Nonce) {
+		forwardDeltaToEnvoy(con, resp)
+		return
+	}
+	if p.bootstrapResources != nil || p.lastGood != nil {
+		con.bootstrap.supersede(resp)
+	}
+	p.recordControlPlane(con, resp.ControlPlane)
+	span := con.startDeltaSpan(spanReceiveUpstream, resp)
+	defer span.End()
+	correlation := deltaCorrelationID(con.conID, resp.Nonce)
+	con.deltaCorrelations.received(correlation, v3.GetShortType(resp.TypeUrl), resp.Nonce)
+	if proxyLog.DebugEnabled() {
+		con.logger().WithLabels(
+			"type", v3.GetShortType(resp.TypeUrl),
+			"nonce", resp.Nonce,
+			"correlation", correlation,
+			"resources", len(resp.Resources),
+			"removes", len(resp.RemovedResources),
+		).Debugf("upstream response")
+	}
+	if responseLog.DebugEnabled() {
+		responseLog.WithLabels("id", con.conID, "correlation", correlation).Debugf("upstream response: %s",
+			formatDeltaResponse(resp, p.redactLoggedResponses))
+	}
+	metrics.XdsProxyResponses.Increment()
+	if !p.rewrites.enabled(resp.TypeUrl) {
+		// The special handling of the type is disabled, see rewritez.
+		con.breaker.reportResponse(resp.TypeUrl, false)
+		forwardDeltaToEnvoy(con, resp)
+		return
+	}
+	err := p.transformDelta(resp)
+	con.breaker.reportResponse(resp.TypeUrl, err != nil)
+	if err != nil {
+		con.logger().WithLabels("nonce", resp.Nonce).Warnf("rejecting upstream response: %v", err)
+		if con.dryRun {
+			reportDryRunVerdict(con, resp, err)
+		}
+		con.sendDeltaRequest(&discovery.DeltaDiscoveryRequest{
+			TypeUrl:       resp.TypeUrl,
+			ResponseNonce: resp.Nonce,
+			ErrorDetail:   transformNack(err),
+		})
+		return
+	}
+	if p.passThroughDelta(resp.TypeUrl) {
+		// Fast path for the high volume types, such as EDS, which are forwarded as is.
+		if resp.TypeUrl == v3.EndpointType {
+			forwardEDSDeltaToEnvoy(con, resp, correlation)
+			return
+		}
+		forwardDeltaToEnvoy(con, resp)
+		return
+	}
+	if h, f := p.handlers[resp.TypeUrl]; f {
+		if len(resp.Resources) == 0 {
+			// Empty response, nothing to do
+			// This assumes internal types are always singleton
+			return
+		}
+		err := h(resp.Resources[0].Resource)
+		var errorResp *google_rpc.Status
+		if err != nil {
+			errorResp = &google_rpc.Status{
+				Code:    int32(codes.Internal),
+				Message: err.Error(),
+			}
+		}
+		// Send ACK/NACK
+		con.sendDeltaRequest(&discovery.DeltaDiscoveryRequest{
+			TypeUrl:       resp.TypeUrl,
+			ResponseNonce: resp.Nonce,
+			ErrorDetail:   errorResp,
+		})
+		return
+	}
+	switch {
+	case p.isECDSType(resp.TypeUrl):
+		if features.WasmRemoteLoadConversion {
+			// If Wasm remote load conversion feature is enabled, rewrite and send.
+			goDelta(func() {
+				p.deltaRewriteAndForward(con, resp, func(resp *discovery.DeltaDiscoveryResponse) {
+					// Forward the response using the thread of `handleUpstreamResponse`
+					// to prevent concurrent access to forwardToEnvoy
+					select {
+					case forwardEnvoyCh <- resp:
+					case <-con.stopChan:
+					}
+				})
+			})
+		} else {
+			// Otherwise, forward ECDS resource update directly to Envoy.
+			forwardDeltaToEnvoy(con, resp)
+		}
+	default:
+		if strings.HasPrefix(resp.TypeUrl, v3.DebugType) {
+			p.forwardDeltaToTap(resp)
+		} else {
+			forwardDeltaToEnvoy(con, resp)
+		}
+	}
+}
+
 func (p *XdsProxy) deltaRewriteAndForward(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse, forward func(resp *discovery.DeltaDiscoveryResponse)) {
+	if !p.shouldRewriteWasm(con) {
+		con.logger().WithLabels("resources", slices.Map(resp.Resources, (*discovery.Resource).GetName)).Debugf("forward ECDS without Wasm rewrite")
+		forward(resp)
+		return
+	}
 	resources := make([]*anypb.Any, 0, len(resp.Resources))
 	for i := range resp.Resources {
 		resources = append(resources, resp.Resources[i].Resource)
 	}
 
-	if err := wasm.MaybeConvertWasmExtensionConfig(resources, p.wasmCache); err != nil {
-		proxyLog.Debugf("sending NACK for ECDS resources %+v, err: %+v", resp.Resources, err)
+	span := con.startDeltaSpan(spanWasmRewrite, resp)
+	err := p.convertWasmExtensionConfig(con, resources)
+	endSpan(span, err)
+	if err != nil {
+		if p.forwardPartialECDS(con, resp, resources, err, forward) {
+			return
+		}
+		con.logger().Debugf("sending NACK for ECDS resources %+v, err: %+v", resp.Resources, err)
+		p.recordECDSNack(resp.Nonce, slices.Map(resp.Resources, (*discovery.Resource).GetName), err.Error())
+		if con.dryRun {
+			reportDryRunVerdict(con, resp, err)
+		}
 		con.sendDeltaRequest(&discovery.DeltaDiscoveryRequest{
 			TypeUrl:       resp.TypeUrl,
 			ResponseNonce: resp.Nonce,
-			ErrorDetail: &google_rpc.Status{
-				Code:    int32(codes.Internal),
-				Message: err.Error(),
-			},
+			ErrorDetail:   p.wasmNackStatus(err),
 		})
 		return
 	}
@@ -296,24 +852,152 @@ func (p *XdsProxy) deltaRewriteAndForward(con *ProxyConnection, resp *discovery.
 		resp.Resources[i].Resource = resources[i]
 	}
 
-	proxyLog.WithLabels("resources", slices.Map(resp.Resources, (*discovery.Resource).GetName), "removes", resp.RemovedResources).Debugf("forward ECDS")
+	con.logger().WithLabels("resources", slices.Map(resp.Resources, (*discovery.Resource).GetName), "removes", resp.RemovedResources).Debugf("forward ECDS")
 	forward(resp)
 }
 
+// passThroughDelta returns true if the delta responses of typeURL are forwarded to Envoy as is, without being
+// inspected for the agent handlers, the ECDS rewrite or the tap. The handlers and the tap only serve non Envoy types.
+func (p *XdsProxy) passThroughDelta(typeURL string) bool {
+	return v3.IsEnvoyType(typeURL) && !p.isECDSType(typeURL)
+}
+
 func forwardDeltaToEnvoy(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse) {
 	if !v3.IsEnvoyType(resp.TypeUrl) && resp.TypeUrl != v3.WorkloadType {
-		proxyLog.Errorf("Skipping forwarding type url %s to Envoy as is not a valid Envoy type", resp.TypeUrl)
+		con.logger().Errorf("Skipping forwarding type url %s to Envoy as is not a valid Envoy type", resp.TypeUrl)
 		return
 	}
 	if con.isClosed() {
-		proxyLog.WithLabels("id", con.conID).Errorf("downstream dropped delta xds push to Envoy, connection already closed")
+		con.logger().Errorf("downstream dropped delta xds push to Envoy, connection already closed")
+		return
+	}
+	if con.dryRun {
+		// The response would be forwarded to Envoy. ACK it on behalf of Envoy, so the upstream keeps pushing.
+		reportDryRunVerdict(con, resp, nil)
+		con.sendDeltaRequest(&discovery.DeltaDiscoveryRequest{
+			TypeUrl:       resp.TypeUrl,
+			ResponseNonce: resp.Nonce,
+		})
+		return
+	}
+	if !admitDeltaToEnvoy(con, resp) {
 		return
 	}
-	if err := sendDownstreamDelta(con.downstreamDeltas, resp); err != nil {
-		err = fmt.Errorf("send error for type url %s: %v", resp.TypeUrl, err)
+	sendDeltaToEnvoy(con, resp)
+}
+
+// admitDeltaToEnvoy returns true if resp can be sent to Envoy now. Otherwise resp is held until Envoy acknowledges
+// the responses of its prerequisite types, or the previous responses of its type beyond the cap of unacknowledged
+// responses.
+func admitDeltaToEnvoy(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse) bool {
+	if !con.deltaOrder.admit(resp) {
+		con.logger().WithLabels("type", v3.GetShortType(resp.TypeUrl), "nonce", resp.Nonce).
+			Debugf("holding response until Envoy acknowledges its prerequisites")
+		con.backlog.add(resp.TypeUrl)
+		return false
+	}
+	return admitDeltaInflight(con, resp)
+}
+
+// admitDeltaInflight returns true if resp can be sent to Envoy now. Otherwise resp is held until Envoy acknowledges
+// the previous responses of its type.
+func admitDeltaInflight(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse) bool {
+	if !con.deltaInflight.admit(resp) {
+		con.logger().WithLabels("type", v3.GetShortType(resp.TypeUrl), "nonce", resp.Nonce).
+			Debugf("holding response until Envoy acknowledges the previous ones")
+		con.backlog.add(resp.TypeUrl)
+		return false
+	}
+	return true
+}
+
+// sendDeltaToEnvoy sends resp to Envoy, split if needed.
+func sendDeltaToEnvoy(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse) {
+	if con.isClosed() {
+		con.logger().Errorf("downstream dropped delta xds push to Envoy, connection already closed")
+		return
+	}
+	span := con.startDeltaSpan(spanForwardDownstream, resp)
+	if err := sendDeltaChunks(con, resp); err != nil {
+		endSpan(span, err)
 		downstreamErr(con, err)
 		return
 	}
+	endSpan(span, nil)
+	con.ackTimeouts.sent(resp)
+	con.forwarded(resp.TypeUrl)
+	con.lastGood.sent(con.conID, resp)
+	con.fanout.publish(resp)
+	correlation := deltaCorrelationID(con.conID, resp.Nonce)
+	con.deltaCorrelations.forwarded(correlation)
+	if proxyLog.DebugEnabled() {
+		con.logger().WithLabels(
+			"type", v3.GetShortType(resp.TypeUrl),
+			"nonce", resp.Nonce,
+			"correlation", correlation,
+		).Debugf("forwarded response to Envoy")
+	}
+}
+
+// sendDeltaChunks sends resp to Envoy, split if needed.
+func sendDeltaChunks(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse) error {
+	chunks := splitDeltaResponse(resp, con.maxDeltaResponseSize)
+	if len(chunks) > 1 {
+		con.logger().WithLabels("type", v3.GetShortType(resp.TypeUrl), "nonce", resp.Nonce, "chunks", len(chunks)).
+			Debugf("splitting oversized delta response")
+		con.deltaSplits.sent(chunks)
+	}
+	for _, chunk := range chunks {
+		con.backlog.add(chunk.TypeUrl)
+		err := sendDownstreamDelta(con.downstreamDeltas, chunk)
+		con.backlog.done(chunk.TypeUrl)
+		if err != nil {
+			return fmt.Errorf("send error for type url %s: %v", chunk.TypeUrl, err)
+		}
+		con.bytes.record(metrics.DownstreamSent, chunk.TypeUrl, chunk)
+		con.deltaSubscriptions.observe(chunk)
+		con.deltaAcks.sent(chunk)
+	}
+	return nil
+}
+
+// resendUnackedDeltas resends to Envoy the responses it did not acknowledge within the ACK timeout of their type,
+// and gives up on the ones already resent as many times as configured.
+func resendUnackedDeltas(con *ProxyConnection) {
+	resend, abandoned := con.ackTimeouts.release()
+	for _, resp := range abandoned {
+		con.logger().WithLabels("type", v3.GetShortType(resp.TypeUrl), "nonce", resp.Nonce).
+			Warnf("Envoy did not acknowledge the response after resending it, giving up")
+		metrics.RecordAckTimeout(v3.GetShortType(resp.TypeUrl), false)
+	}
+	for _, resp := range resend {
+		if con.isClosed() {
+			return
+		}
+		con.logger().WithLabels("type", v3.GetShortType(resp.TypeUrl), "nonce", resp.Nonce).
+			Warnf("Envoy did not acknowledge the response in time, resending it")
+		metrics.RecordAckTimeout(v3.GetShortType(resp.TypeUrl), true)
+		if err := sendDeltaChunks(con, resp); err != nil {
+			downstreamErr(con, err)
+			return
+		}
+	}
+}
+
+// reportDryRunVerdict reports whether a response processed in dry run mode would be ACKed, or NACKed with err.
+func reportDryRunVerdict(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse, err error) {
+	log := con.logger().WithLabels(
+		"type", v3.GetShortType(resp.TypeUrl),
+		"nonce", resp.Nonce,
+		"resources", len(resp.Resources),
+		"removes", len(resp.RemovedResources),
+	)
+	if err != nil {
+		log.Warnf("dry run: response would be NACKed: %v", err)
+	} else {
+		log.Infof("dry run: response would be ACKed")
+	}
+	metrics.RecordDryRunVerdict(v3.GetShortType(resp.TypeUrl), err == nil)
 }
 
 func sendDownstreamDelta(deltaDownstream xds.DeltaDiscoveryStream, res *discovery.DeltaDiscoveryResponse) error {
@@ -327,6 +1011,225 @@ func sendDownstreamDelta(deltaDownstream xds.DeltaDiscoveryStream, res *discover
 	return deltaDownstream.Send(res)
 }
 
+// deltaSubscriptions tracks the resource names a delta xDS stream from Envoy is currently subscribed to, per type URL,
+// along with the versions of the resources sent to Envoy. This allows resuming the stream on a new upstream.
+type deltaSubscriptions struct {
+	mu    sync.RWMutex
+	types map[string]sets.String
+	// wildcard is the set of type URLs initially requested without resource names.
+	wildcard sets.String
+	// versions is the version of each resource sent to Envoy, per type URL.
+	versions map[string]map[string]string
+	// states is the state of the exchange with Envoy, per type URL.
+	states map[string]*deltaTypeState
+	// node is the node sent by Envoy on the stream.
+	node *core.Node
+}
+
+// deltaTypeState is the state of the delta xDS exchange with Envoy for a type URL, as reported on the debug endpoint.
+type deltaTypeState struct {
+	// LastAckedNonce is the nonce of the last response ACKed by Envoy.
+	LastAckedNonce string `json:"lastAckedNonce"`
+	// LastVersion is the system version of the last response forwarded to Envoy.
+	LastVersion string `json:"lastVersion"`
+	// Subscribed are the resource names Envoy is subscribed to, empty for wildcard subscriptions.
+	Subscribed []string `json:"subscribed"`
+	// LastForwarded is the number of resources of the last response forwarded to Envoy.
+	LastForwarded int `json:"lastForwarded"`
+}
+
+func newDeltaSubscriptions() *deltaSubscriptions {
+	return &deltaSubscriptions{
+		types:    map[string]sets.String{},
+		wildcard: sets.New[string](),
+		versions: map[string]map[string]string{},
+		states:   map[string]*deltaTypeState{},
+	}
+}
+
+// state returns the state of typeURL, creating it if needed. The caller must hold s.mu.
+func (s *deltaSubscriptions) state(typeURL string) *deltaTypeState {
+	st, f := s.states[typeURL]
+	if !f {
+		st = &deltaTypeState{}
+		s.states[typeURL] = st
+	}
+	return st
+}
+
+// update applies the subscription changes of req. The resource names of req are normalized to the changes
+// it makes, sorted and without duplicates: names already subscribed to are removed from the subscribed names,
+// and names not subscribed to from the unsubscribed names. It returns false if req is then a duplicate which
+// does not need to be forwarded upstream: a request that is not an ACK/NACK and makes no changes.
+func (s *deltaSubscriptions) update(req *discovery.DeltaDiscoveryRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.node == nil {
+		s.node = req.Node
+	}
+	if req.ResponseNonce != "" && req.ErrorDetail == nil {
+		s.state(req.TypeUrl).LastAckedNonce = req.ResponseNonce
+	}
+	names, f := s.types[req.TypeUrl]
+	if !f {
+		names = sets.New[string]()
+		s.types[req.TypeUrl] = names
+		if len(req.ResourceNamesSubscribe) == 0 {
+			s.wildcard.Insert(req.TypeUrl)
+		}
+	}
+	requested := len(req.ResourceNamesSubscribe) > 0 || len(req.ResourceNamesUnsubscribe) > 0
+	var subscribe, unsubscribe []string
+	for _, name := range req.ResourceNamesSubscribe {
+		if !names.InsertContains(name) {
+			subscribe = append(subscribe, name)
+		}
+	}
+	for _, name := range req.ResourceNamesUnsubscribe {
+		switch {
+		case names.Contains(name):
+			names.Delete(name)
+		case name == "*" && s.wildcard.Contains(req.TypeUrl):
+			// Leaving the wildcard subscription.
+			s.wildcard.Delete(req.TypeUrl)
+		default:
+			continue
+		}
+		unsubscribe = append(unsubscribe, name)
+	}
+	slices.Sort(subscribe)
+	slices.Sort(unsubscribe)
+	req.ResourceNamesSubscribe = subscribe
+	req.ResourceNamesUnsubscribe = unsubscribe
+	changed := len(subscribe) > 0 || len(unsubscribe) > 0
+	if changed || !f || req.ResponseNonce != "" || req.ErrorDetail != nil || len(req.InitialResourceVersions) > 0 {
+		return true
+	}
+	return !requested
+}
+
+// observe records the versions of the resources of a response sent to Envoy.
+func (s *deltaSubscriptions) observe(resp *discovery.DeltaDiscoveryResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions, f := s.versions[resp.TypeUrl]
+	if !f {
+		versions = map[string]string{}
+		s.versions[resp.TypeUrl] = versions
+	}
+	for _, r := range resp.Resources {
+		versions[r.Name] = r.Version
+	}
+	for _, name := range resp.RemovedResources {
+		delete(versions, name)
+	}
+	st := s.state(resp.TypeUrl)
+	st.LastVersion = resp.SystemVersionInfo
+	st.LastForwarded = len(resp.Resources)
+}
+
+// resumeRequests returns the requests resuming the subscriptions of the stream on a new upstream stream.
+// The versions of the resources already sent to Envoy are included, so the upstream can remove the
+// resources which no longer exist. The node is sent on the first request, as required by the upstream.
+func (s *deltaSubscriptions) resumeRequests() []*discovery.DeltaDiscoveryRequest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	typeURLs := maps.Keys(s.types)
+	slices.Sort(typeURLs)
+	reqs := make([]*discovery.DeltaDiscoveryRequest, 0, len(typeURLs))
+	for _, typeURL := range typeURLs {
+		names := s.types[typeURL]
+		// Health requests report the health of the proxy and are not a subscription, they are sent separately.
+		// Types which are no longer subscribed to must not be resumed as a wildcard subscription.
+		if typeURL == v3.HealthInfoType || (names.IsEmpty() && !s.wildcard.Contains(typeURL)) {
+			continue
+		}
+		reqs = append(reqs, &discovery.DeltaDiscoveryRequest{
+			TypeUrl:                 typeURL,
+			ResourceNamesSubscribe:  sets.SortedList(names),
+			InitialResourceVersions: maps.Clone(s.versions[typeURL]),
+		})
+	}
+	if len(reqs) > 0 {
+		reqs[0].Node = s.node
+	}
+	return reqs
+}
+
+// snapshot returns the sorted subscribed resource names of each type URL.
+func (s *deltaSubscriptions) snapshot() map[string][]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string][]string, len(s.types))
+	for typeURL, names := range s.types {
+		out[typeURL] = sets.SortedList(names)
+	}
+	return out
+}
+
+// debugSnapshot returns the state of the exchange with Envoy of each type URL.
+func (s *deltaSubscriptions) debugSnapshot() map[string]deltaTypeState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]deltaTypeState, len(s.types))
+	for typeURL, names := range s.types {
+		st := deltaTypeState{}
+		if cur, f := s.states[typeURL]; f {
+			st = *cur
+		}
+		st.Subscribed = sets.SortedList(names)
+		out[typeURL] = st
+	}
+	return out
+}
+
+// deltaAckTracker tracks the last response forwarded to Envoy per type URL, to record the latency of its ACK.
+type deltaAckTracker struct {
+	mu      sync.Mutex
+	pending map[string]pendingAck
+}
+
+type pendingAck struct {
+	nonce string
+	sent  time.Time
+}
+
+func newDeltaAckTracker() *deltaAckTracker {
+	return &deltaAckTracker{pending: map[string]pendingAck{}}
+}
+
+// sent records a response forwarded to Envoy. A previous response of the same type which was not acknowledged yet
+// is superseded, as Envoy only acknowledges the latest nonce.
+func (a *deltaAckTracker) sent(resp *discovery.DeltaDiscoveryResponse) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[resp.TypeUrl] = pendingAck{nonce: resp.Nonce, sent: time.Now()}
+}
+
+// received records the ACK latency, with the given labels, if req acknowledges the last response of its type.
+func (a *deltaAckTracker) received(req *discovery.DeltaDiscoveryRequest, labels []monitoring.LabelValue) {
+	if req.ResponseNonce == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending, f := a.pending[req.TypeUrl]
+	if !f || pending.nonce != req.ResponseNonce {
+		return
+	}
+	delete(a.pending, req.TypeUrl)
+	if req.ErrorDetail == nil {
+		metrics.RecordAckLatency(v3.GetShortType(req.TypeUrl), time.Since(pending.sent), labels...)
+	}
+}
+
+// settled returns true if all the responses forwarded to Envoy were acknowledged.
+func (a *deltaAckTracker) settled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending) == 0
+}
+
 func (p *XdsProxy) sendDeltaHealthRequest(req *discovery.DeltaDiscoveryRequest) {
 	p.connectedMutex.Lock()
 	// Immediately send if we are currently connected.
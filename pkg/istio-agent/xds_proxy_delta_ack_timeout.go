@@ -0,0 +1,170 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// ParseAckTimeouts parses a comma separated list of type=timeout pairs, by the short name of the type such as
+// CDS=10s or its type URL, into the ACK timeout of each type URL.
+func ParseAckTimeouts(s string) map[string]time.Duration {
+	out := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		typ, timeout, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		d, err := time.ParseDuration(strings.TrimSpace(timeout))
+		if !ok || err != nil || d <= 0 {
+			proxyLog.Warnf("ignoring invalid ACK timeout %q, expected type=timeout", pair)
+			continue
+		}
+		out[v3.GetResourceType(strings.TrimSpace(typ))] = d
+	}
+	return out
+}
+
+// deltaAckTimeouts watches the responses forwarded to Envoy, so that the last response of a type Envoy does not
+// acknowledge within the ACK timeout of the type, because it was lost or Envoy misbehaves, is resent up to
+// maxResends times instead of stalling the convergence silently. Only the last response of each type is watched, as
+// Envoy only acknowledges the latest nonce. A nil watchdog watches nothing.
+type deltaAckTimeouts struct {
+	timeouts   map[string]time.Duration
+	maxResends int
+
+	mu sync.Mutex
+	// pending are the responses not acknowledged yet, by type URL.
+	pending map[string]*unackedResponse
+	// expired are the responses whose ACK timed out.
+	expired []*unackedResponse
+	// expiredCh receives once responses expired.
+	expiredCh chan struct{}
+}
+
+// unackedResponse is a response forwarded to Envoy and not acknowledged yet.
+type unackedResponse struct {
+	resp    *discovery.DeltaDiscoveryResponse
+	timeout time.Duration
+	resends int
+	timer   *time.Timer
+}
+
+func newDeltaAckTimeouts(timeouts map[string]time.Duration, maxResends int) *deltaAckTimeouts {
+	return &deltaAckTimeouts{
+		timeouts:   timeouts,
+		maxResends: maxResends,
+		pending:    map[string]*unackedResponse{},
+		expiredCh:  make(chan struct{}, 1),
+	}
+}
+
+// sent starts watching resp, forwarded to Envoy, if its type has an ACK timeout. A previous response of the type is
+// superseded.
+func (a *deltaAckTimeouts) sent(resp *discovery.DeltaDiscoveryResponse) {
+	if a == nil {
+		return
+	}
+	timeout := a.timeouts[resp.TypeUrl]
+	if timeout <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if previous := a.pending[resp.TypeUrl]; previous != nil {
+		previous.timer.Stop()
+	}
+	a.watch(&unackedResponse{resp: resp, timeout: timeout})
+}
+
+// watch arms the ACK timeout of u. The caller must hold a.mu.
+func (a *deltaAckTimeouts) watch(u *unackedResponse) {
+	a.pending[u.resp.TypeUrl] = u
+	u.timer = time.AfterFunc(u.timeout, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.pending[u.resp.TypeUrl] != u {
+			// Acknowledged or superseded meanwhile.
+			return
+		}
+		delete(a.pending, u.resp.TypeUrl)
+		a.expired = append(a.expired, u)
+		select {
+		case a.expiredCh <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// acked stops watching the response req acknowledges, or rejects.
+func (a *deltaAckTimeouts) acked(req *discovery.DeltaDiscoveryRequest) {
+	if a == nil || req.ResponseNonce == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if u := a.pending[req.TypeUrl]; u != nil && u.resp.Nonce == req.ResponseNonce {
+		u.timer.Stop()
+		delete(a.pending, req.TypeUrl)
+	}
+}
+
+// ready returns a channel receiving once the ACK of responses timed out. It is nil for a nil watchdog, so it can
+// always be selected on.
+func (a *deltaAckTimeouts) ready() <-chan struct{} {
+	if a == nil {
+		return nil
+	}
+	return a.expiredCh
+}
+
+// release returns the responses whose ACK timed out: the ones to resend, which are watched again, and the ones
+// already resent maxResends times, which are given up on.
+func (a *deltaAckTimeouts) release() (resend, abandoned []*discovery.DeltaDiscoveryResponse) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, u := range a.expired {
+		if a.pending[u.resp.TypeUrl] != nil {
+			// Superseded by a newer response of the type since it expired.
+			continue
+		}
+		if u.resends >= a.maxResends {
+			abandoned = append(abandoned, u.resp)
+			continue
+		}
+		u.resends++
+		a.watch(u)
+		resend = append(resend, u.resp)
+	}
+	a.expired = nil
+	return resend, abandoned
+}
+
+// stop stops watching the responses.
+func (a *deltaAckTimeouts) stop() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, u := range a.pending {
+		u.timer.Stop()
+	}
+	a.pending = map[string]*unackedResponse{}
+	a.expired = nil
+}
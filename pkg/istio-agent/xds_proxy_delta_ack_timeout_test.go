@@ -0,0 +1,122 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+func TestParseAckTimeouts(t *testing.T) {
+	assert.Equal(t, ParseAckTimeouts("CDS=10s, LDS = 1m,"+v3.SecretType+"=500ms,ECDS,RDS=soon,EDS=0s"), map[string]time.Duration{
+		v3.ClusterType:  10 * time.Second,
+		v3.ListenerType: time.Minute,
+		v3.SecretType:   500 * time.Millisecond,
+	})
+}
+
+func TestDeltaAckTimeouts(t *testing.T) {
+	a := newDeltaAckTimeouts(map[string]time.Duration{v3.ClusterType: 10 * time.Millisecond}, 1)
+	defer a.stop()
+	expire := func() ([]*discovery.DeltaDiscoveryResponse, []*discovery.DeltaDiscoveryResponse) {
+		t.Helper()
+		select {
+		case <-a.ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the ACK to time out")
+		}
+		return a.release()
+	}
+
+	// Types without a timeout are not watched.
+	a.sent(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.EndpointType, Nonce: "0"})
+	a.sent(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1"})
+	resend, abandoned := expire()
+	assert.Equal(t, len(resend), 1)
+	assert.Equal(t, resend[0].Nonce, "1")
+	assert.Equal(t, len(abandoned), 0)
+	// Resent once already, so it is given up on the next time.
+	resend, abandoned = expire()
+	assert.Equal(t, len(resend), 0)
+	assert.Equal(t, len(abandoned), 1)
+	assert.Equal(t, abandoned[0].Nonce, "1")
+
+	// An ACK of the latest response stops the watch.
+	a.sent(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "2"})
+	a.acked(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "2"})
+	select {
+	case <-a.ready():
+		t.Fatal("expected the acknowledged response not to time out")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A nil watchdog is never ready.
+	assert.Equal(t, (*deltaAckTimeouts)(nil).ready() == nil, true)
+}
+
+// Validates a response Envoy does not acknowledge is resent exactly once within the ACK timeout of its type.
+func TestDeltaXdsProxyAckTimeoutResend(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.ackTimeouts = map[string]time.Duration{v3.ClusterType: 100 * time.Millisecond}
+	proxy.ackTimeoutResends = 1
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1"})
+
+	received := make(chan *discovery.DeltaDiscoveryResponse)
+	go func() {
+		for {
+			resp, err := downstream.Recv()
+			if err != nil {
+				return
+			}
+			received <- resp
+		}
+	}()
+	resp := <-received
+	assert.Equal(t, resp.Nonce, "1")
+	sent := time.Now()
+
+	// The ACK is withheld, so the response is resent once the timeout elapses.
+	select {
+	case resp := <-received:
+		assert.Equal(t, resp.Nonce, "1")
+		if elapsed := time.Since(sent); elapsed < 100*time.Millisecond {
+			t.Fatalf("expected the response to be resent after the timeout, got %v", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the unacknowledged response to be resent")
+	}
+	// Resent once only.
+	select {
+	case resp := <-received:
+		t.Fatalf("expected the response %q to be resent once", resp.Nonce)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/util/protomarshal"
+	"istio.io/istio/pkg/util/sets"
+)
+
+const (
+	// bootstrapNoncePrefix prefixes the nonces of the responses serving the bootstrap resources, which are never
+	// acknowledged upstream.
+	bootstrapNoncePrefix = "bootstrap/"
+	// bootstrapVersion is the version of the bootstrap resources.
+	bootstrapVersion = "bootstrap"
+)
+
+// loadBootstrapResources reads the clusters and listeners served to Envoy before the upstream XDS server responds,
+// by type URL, from the static resources of the Envoy bootstrap, in YAML or JSON, at path.
+func loadBootstrapResources(path string) (map[string][]*discovery.Resource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bs := &bootstrap.Bootstrap{}
+	if err := protomarshal.ApplyYAML(string(b), bs); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	resources := map[string][]*discovery.Resource{}
+	for _, c := range bs.GetStaticResources().GetClusters() {
+		resources[v3.ClusterType] = append(resources[v3.ClusterType], &discovery.Resource{
+			Name:     c.Name,
+			Version:  bootstrapVersion,
+			Resource: protoconv.MessageToAny(c),
+		})
+	}
+	for _, l := range bs.GetStaticResources().GetListeners() {
+		resources[v3.ListenerType] = append(resources[v3.ListenerType], &discovery.Resource{
+			Name:     l.Name,
+			Version:  bootstrapVersion,
+			Resource: protoconv.MessageToAny(l),
+		})
+	}
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("no static clusters or listeners in %s", path)
+	}
+	return resources, nil
+}
+
+// deltaBootstrapState tracks the bootstrap resources served to Envoy on a delta stream, by type URL, until the
+// first upstream response of their type supersedes them. The zero value is ready to use.
+type deltaBootstrapState struct {
+	mu     sync.Mutex
+	served map[string]sets.String
+}
+
+// serve records that the resources of typeURL are served, and returns false if they already were.
+func (s *deltaBootstrapState) serve(typeURL string, resources []*discovery.Resource) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, f := s.served[typeURL]; f {
+		return false
+	}
+	if s.served == nil {
+		s.served = map[string]sets.String{}
+	}
+	names := sets.New[string]()
+	for _, r := range resources {
+		names.Insert(r.Name)
+	}
+	s.served[typeURL] = names
+	return true
+}
+
+// supersede removes from Envoy the bootstrap resources of the type of resp that the first upstream response of the
+// type does not update, so that Envoy ends up with the resources of the upstream only.
+func (s *deltaBootstrapState) supersede(resp *discovery.DeltaDiscoveryResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := s.served[resp.TypeUrl]
+	if names == nil {
+		return
+	}
+	// Keep the type, so its bootstrap resources are not served again.
+	s.served[resp.TypeUrl] = sets.New[string]()
+	for _, r := range resp.Resources {
+		names.Delete(r.Name)
+	}
+	for _, name := range resp.RemovedResources {
+		names.Delete(name)
+	}
+	resp.RemovedResources = append(resp.RemovedResources, sets.SortedList(names)...)
+}
+
+// isLocalNonce returns true if nonce is the nonce of a response served by the agent rather than the upstream: the
+// bootstrap resources or the last good resources.
+func isLocalNonce(nonce string) bool {
+	return strings.HasPrefix(nonce, bootstrapNoncePrefix) || strings.HasPrefix(nonce, lastGoodNoncePrefix)
+}
+
+// serveBootstrapResources serves the bootstrap resources of the type of req to Envoy, if req is the initial request
+// of the type on a new stream. They are queued before req is forwarded upstream, so Envoy receives them before
+// the first upstream response of the type.
+func (p *XdsProxy) serveBootstrapResources(con *ProxyConnection, req *discovery.DeltaDiscoveryRequest) {
+	resources := p.bootstrapResources[req.TypeUrl]
+	if len(resources) == 0 || con.dryRun || req.ResponseNonce != "" || len(req.InitialResourceVersions) > 0 {
+		// Envoy resuming a stream already has its resources.
+		return
+	}
+	if !con.bootstrap.serve(req.TypeUrl, resources) {
+		return
+	}
+	con.logger().WithLabels("type", v3.GetShortType(req.TypeUrl), "resources", len(resources)).
+		Infof("serving bootstrap resources until the upstream responds")
+	con.sendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:           req.TypeUrl,
+		SystemVersionInfo: bootstrapVersion,
+		Nonce:             bootstrapNoncePrefix + v3.GetShortType(req.TypeUrl),
+		Resources:         resources,
+	})
+}
+
+// bootstrapAcked handles the acknowledgement of a response serving the bootstrap or last good resources, which the
+// upstream never sent. It returns nil if req only acknowledges it, otherwise req without the acknowledgement.
+func bootstrapAcked(con *ProxyConnection, req *discovery.DeltaDiscoveryRequest) *discovery.DeltaDiscoveryRequest {
+	if !isLocalNonce(req.ResponseNonce) {
+		return req
+	}
+	if req.ErrorDetail != nil {
+		con.logger().WithLabels("type", v3.GetShortType(req.TypeUrl), "nonce", req.ResponseNonce).
+			Warnf("Envoy rejected the resources served by the agent: %v", req.ErrorDetail.GetMessage())
+	}
+	if len(req.ResourceNamesSubscribe) == 0 && len(req.ResourceNamesUnsubscribe) == 0 {
+		return nil
+	}
+	req.ResponseNonce = ""
+	req.ErrorDetail = nil
+	return req
+}
@@ -0,0 +1,115 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+const bootstrapResourcesYAML = `
+static_resources:
+  clusters:
+  - name: bootstrap-cluster
+    type: STATIC
+    connect_timeout: 1s
+`
+
+// Validates the bootstrap resources are served to Envoy before any upstream response, and superseded by the first
+// upstream response of their type.
+func TestDeltaXdsProxyBootstrapResources(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	path := filepath.Join(t.TempDir(), "bootstrap.yaml")
+	if err := os.WriteFile(path, []byte(bootstrapResourcesYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resources, err := loadBootstrapResources(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.bootstrapResources = resources
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.TypeUrl, v3.ClusterType)
+	assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"bootstrap-cluster"})
+
+	// The ACK of the bootstrap resources is not forwarded upstream, which never sent them.
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: resp.Nonce}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := len(recorder.streamRequests(0)); sent == 0 {
+			return fmt.Errorf("expected the subscription to be forwarded upstream")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, len(recorder.streamRequests(0)), 1)
+
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ClusterType,
+		Nonce:   "upstream",
+		Resources: []*discovery.Resource{{
+			Name:     "outbound|80||foo.default.svc.cluster.local",
+			Resource: protoconv.MessageToAny(&cluster.Cluster{Name: "outbound|80||foo.default.svc.cluster.local"}),
+		}},
+	})
+	resp, err = downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "upstream")
+	assert.Equal(t, resp.RemovedResources, []string{"bootstrap-cluster"})
+}
+
+func TestLoadBootstrapResourcesWithoutResources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap.yaml")
+	if err := os.WriteFile(path, []byte("node:\n  id: foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBootstrapResources(path); err == nil {
+		t.Fatal("expected an error for a bootstrap without static resources")
+	}
+}
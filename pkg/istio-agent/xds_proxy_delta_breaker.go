@@ -0,0 +1,245 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/istio-agent/metrics"
+	"istio.io/istio/pkg/log"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// deltaCircuitBreaker stops the churn of a type URL whose responses from the upstream keep failing. A failure is
+// a response of the type rejected by the agent, or the upstream stream failing after a request of the type was
+// sent. After threshold consecutive failures of a type URL, the breaker of the type opens: the requests of the
+// type which neither acknowledge a response nor change the subscriptions, such as the NACKs of Envoy, are held
+// for the cooldown. The breaker then half-opens, releasing the latest held request as a probe; the next response
+// of the type accepted by the agent closes it, while the next failure opens it again.
+// It is only used by the goroutine sending the requests to the upstream, except for the outcomes of the responses,
+// which are reported by the goroutine handling them.
+type deltaCircuitBreaker struct {
+	log       *log.Scope
+	threshold int
+	cooldown  time.Duration
+	types     map[string]*typeBreaker
+	// order is the type URLs of types, in the order they were first seen, so held requests are released in
+	// a stable order.
+	order []string
+	// timer fires once the cooldown of the earliest open breaker ended. It is nil if no breaker is open.
+	timer *time.Timer
+
+	// mu guards outcomes, the outcomes of the responses reported since they were last applied. reported receives
+	// once outcomes are pending.
+	mu       sync.Mutex
+	outcomes []breakerOutcome
+	reported chan struct{}
+}
+
+// breakerOutcome is the outcome of a response of a type URL.
+type breakerOutcome struct {
+	typeURL string
+	failed  bool
+}
+
+// typeBreaker is the circuit breaker of a single type URL.
+type typeBreaker struct {
+	state    breakerState
+	failures int
+	// openUntil is the end of the cooldown of an open breaker.
+	openUntil time.Time
+	// held is the latest request held while the breaker is open. The earlier ones are superseded by it, as they
+	// carry no subscription change.
+	held *discovery.DeltaDiscoveryRequest
+}
+
+func newDeltaCircuitBreaker(log *log.Scope, threshold int, cooldown time.Duration) *deltaCircuitBreaker {
+	return &deltaCircuitBreaker{
+		log:       log,
+		threshold: threshold,
+		cooldown:  cooldown,
+		types:     map[string]*typeBreaker{},
+		reported:  make(chan struct{}, 1),
+	}
+}
+
+func (b *deltaCircuitBreaker) typeBreaker(typeURL string) *typeBreaker {
+	tb, f := b.types[typeURL]
+	if !f {
+		tb = &typeBreaker{}
+		b.types[typeURL] = tb
+		b.order = append(b.order, typeURL)
+	}
+	return tb
+}
+
+// admit returns true if req can be sent now. Otherwise, req is held until release returns it.
+func (b *deltaCircuitBreaker) admit(req *discovery.DeltaDiscoveryRequest) bool {
+	tb := b.typeBreaker(req.TypeUrl)
+	if tb.state != breakerOpen || !breakerHolds(req) {
+		return true
+	}
+	tb.held = req
+	return false
+}
+
+// breakerHolds returns true if req is held by an open breaker: ACKs and subscription changes are always sent,
+// so that Envoy and the upstream keep in sync.
+func breakerHolds(req *discovery.DeltaDiscoveryRequest) bool {
+	if len(req.ResourceNamesSubscribe) > 0 || len(req.ResourceNamesUnsubscribe) > 0 {
+		return false
+	}
+	return req.ResponseNonce == "" || req.ErrorDetail != nil
+}
+
+// reportResponse reports that a response of typeURL was accepted by the agent, or rejected if failed is true.
+// It is safe to call from any goroutine; the outcome is applied once reported fires.
+func (b *deltaCircuitBreaker) reportResponse(typeURL string, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.outcomes = append(b.outcomes, breakerOutcome{typeURL: typeURL, failed: failed})
+	b.mu.Unlock()
+	select {
+	case b.reported <- struct{}{}:
+	default:
+	}
+}
+
+// pending returns a channel receiving once outcomes were reported. It is nil for a nil breaker, so it can always
+// be selected on.
+func (b *deltaCircuitBreaker) pending() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.reported
+}
+
+// applyReported applies the outcomes reported since the last call.
+func (b *deltaCircuitBreaker) applyReported() {
+	b.mu.Lock()
+	outcomes := b.outcomes
+	b.outcomes = nil
+	b.mu.Unlock()
+	for _, o := range outcomes {
+		b.record(o.typeURL, o.failed)
+	}
+}
+
+// record applies the outcome of an exchange of typeURL with the upstream. The outcomes are ignored while the
+// breaker is open, until the cooldown ended.
+func (b *deltaCircuitBreaker) record(typeURL string, failed bool) {
+	tb := b.typeBreaker(typeURL)
+	switch {
+	case tb.state == breakerOpen:
+	case failed:
+		tb.failures++
+		if tb.state == breakerHalfOpen || tb.failures >= b.threshold {
+			b.open(typeURL, tb)
+		}
+	default:
+		if tb.state == breakerHalfOpen {
+			b.log.WithLabels("type", v3.GetShortType(typeURL)).Infof("circuit breaker closed")
+			metrics.RecordCircuitBreakerOpen(v3.GetShortType(typeURL), false)
+		}
+		tb.state = breakerClosed
+		tb.failures = 0
+	}
+}
+
+func (b *deltaCircuitBreaker) open(typeURL string, tb *typeBreaker) {
+	b.log.WithLabels("type", v3.GetShortType(typeURL), "failures", tb.failures).
+		Warnf("circuit breaker opened, holding requests for %v", b.cooldown)
+	if tb.state == breakerClosed {
+		metrics.RecordCircuitBreakerOpen(v3.GetShortType(typeURL), true)
+	}
+	tb.state = breakerOpen
+	tb.openUntil = time.Now().Add(b.cooldown)
+	b.schedule()
+}
+
+// ready returns a channel receiving once the cooldown of an open breaker ended. It is nil if no breaker is open,
+// including for a nil breaker, so it can always be selected on.
+func (b *deltaCircuitBreaker) ready() <-chan time.Time {
+	if b == nil || b.timer == nil {
+		return nil
+	}
+	return b.timer.C
+}
+
+// release half-opens the breakers whose cooldown ended after ready fired, and returns their held requests
+// in order, at most one per type. The requests must be admitted again before being sent.
+func (b *deltaCircuitBreaker) release() []*discovery.DeltaDiscoveryRequest {
+	b.timer = nil
+	now := time.Now()
+	var released []*discovery.DeltaDiscoveryRequest
+	for _, typeURL := range b.order {
+		tb := b.types[typeURL]
+		if tb.state != breakerOpen || now.Before(tb.openUntil) {
+			continue
+		}
+		b.log.WithLabels("type", v3.GetShortType(typeURL), "held", tb.held != nil).
+			Infof("circuit breaker half-open, probing the upstream")
+		tb.state = breakerHalfOpen
+		if tb.held != nil {
+			released = append(released, tb.held)
+			tb.held = nil
+		}
+	}
+	b.schedule()
+	return released
+}
+
+// schedule arms the timer for the earliest end of cooldown of the open breakers, if it is not armed yet.
+func (b *deltaCircuitBreaker) schedule() {
+	if b.timer != nil {
+		return
+	}
+	var next time.Time
+	for _, tb := range b.types {
+		if tb.state == breakerOpen && (next.IsZero() || tb.openUntil.Before(next)) {
+			next = tb.openUntil
+		}
+	}
+	if !next.IsZero() {
+		b.timer = time.NewTimer(time.Until(next))
+	}
+}
+
+func (b *deltaCircuitBreaker) stop() {
+	if b == nil {
+		return
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	for typeURL, tb := range b.types {
+		if tb.state != breakerClosed {
+			metrics.RecordCircuitBreakerOpen(v3.GetShortType(typeURL), false)
+		}
+	}
+}
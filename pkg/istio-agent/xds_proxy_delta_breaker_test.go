@@ -0,0 +1,175 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/monitoring/monitortest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func deltaNack(typeURL, nonce string) *discovery.DeltaDiscoveryRequest {
+	return &discovery.DeltaDiscoveryRequest{
+		TypeUrl:       typeURL,
+		ResponseNonce: nonce,
+		ErrorDetail:   &google_rpc.Status{Message: "rejected"},
+	}
+}
+
+func TestDeltaCircuitBreaker(t *testing.T) {
+	b := newDeltaCircuitBreaker(proxyLog, 2, time.Millisecond*50)
+	defer b.stop()
+
+	// The NACKs of Envoy are not failures of the upstream.
+	assert.Equal(t, b.admit(deltaNack(v3.ClusterType, "1")), true)
+	assert.Equal(t, b.admit(deltaNack(v3.ClusterType, "2")), true)
+	b.record(v3.ClusterType, true)
+	b.reportResponse(v3.ClusterType, true)
+	<-b.pending()
+	b.applyReported()
+	assert.Equal(t, b.ready() != nil, true)
+
+	// While open, ACKs and subscription changes are still sent, and only the latest other request is held.
+	assert.Equal(t, b.admit(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "3"}), true)
+	assert.Equal(t, b.admit(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResourceNamesSubscribe: []string{"a"}}), true)
+	assert.Equal(t, b.admit(deltaNack(v3.ClusterType, "3")), false)
+	held := &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType}
+	assert.Equal(t, b.admit(held), false)
+	// Other types are not affected.
+	assert.Equal(t, b.admit(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ListenerType}), true)
+
+	// After the cooldown, the held request is released as a probe, whose failure opens the breaker again.
+	<-b.ready()
+	assert.Equal(t, b.release(), []*discovery.DeltaDiscoveryRequest{held})
+	assert.Equal(t, b.admit(held), true)
+	b.record(v3.ClusterType, true)
+	assert.Equal(t, b.admit(held), false)
+
+	// An accepted response after the probe closes the breaker.
+	<-b.ready()
+	assert.Equal(t, b.release(), []*discovery.DeltaDiscoveryRequest{held})
+	b.record(v3.ClusterType, false)
+	b.record(v3.ClusterType, true)
+	assert.Equal(t, b.admit(held), true)
+	assert.Equal(t, b.ready() == nil, true)
+}
+
+// Validates the requests of a type are held once its responses are repeatedly rejected, and flow again
+// once the breaker recovered.
+func TestDeltaXdsProxyCircuitBreaker(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxy(t)
+	proxy.circuitBreakerFailures = 3
+	proxy.circuitBreakerCooldown = time.Second
+	proxy.resourceTransformers = map[string]ResourceTransformer{
+		v3.ClusterType: ResourceTransformerFunc(func(typeURL string, resource *anypb.Any) (*anypb.Any, error) {
+			c := &cluster.Cluster{}
+			if err := resource.UnmarshalTo(c); err != nil {
+				return nil, err
+			}
+			if c.Name == "bad" {
+				return nil, fmt.Errorf("bad cluster")
+			}
+			return resource, nil
+		}),
+	}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	clusterResponse := func(name, nonce string) *discovery.DeltaDiscoveryResponse {
+		return &discovery.DeltaDiscoveryResponse{
+			TypeUrl: v3.ClusterType,
+			Nonce:   nonce,
+			Resources: []*discovery.Resource{{
+				Name:     name,
+				Resource: protoconv.MessageToAny(&cluster.Cluster{Name: name}),
+			}},
+		}
+	}
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	// The NACKs of Envoy do not open the breaker.
+	for i := 0; i < 3; i++ {
+		if err := downstream.Send(deltaNack(v3.ClusterType, fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := recorder.streamRequests(0); len(sent) != 4 {
+			return fmt.Errorf("expected the NACKs to be forwarded, got %d requests", len(sent))
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+
+	// The responses rejected by the agent do.
+	for i := 0; i < 3; i++ {
+		f.SendDeltaResponse(clusterResponse("bad", fmt.Sprint("bad", i)))
+	}
+	mt.Assert("xds_proxy_circuit_breakers_open", map[string]string{"type": "CDS"}, monitortest.Exactly(1))
+	// The NACKs of the agent handled once the breaker opened are held.
+	sent := len(recorder.streamRequests(0))
+
+	// While the breaker is open, ACKs and subscription changes are sent, while the NACKs of Envoy are held.
+	for _, req := range []*discovery.DeltaDiscoveryRequest{
+		{TypeUrl: v3.ClusterType, ResponseNonce: "ack"},
+		deltaNack(v3.ClusterType, "nack"),
+		{TypeUrl: v3.ClusterType, ResourceNamesSubscribe: []string{"a"}},
+	} {
+		if err := downstream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := len(recorder.streamRequests(0)); got != sent+2 {
+			return fmt.Errorf("expected the ACK and the subscription to be forwarded, got %d requests", got-sent)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, recorder.streamRequests(0)[sent].ResponseNonce, "ack")
+	assert.Equal(t, recorder.streamRequests(0)[sent+1].ResourceNamesSubscribe, []string{"a"})
+
+	// Once the cooldown ended, only the latest held request is released.
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := len(recorder.streamRequests(0)); got != sent+3 {
+			return fmt.Errorf("expected the held request to be released, got %d requests", got-sent)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, recorder.streamRequests(0)[sent+2].ResponseNonce, "nack")
+
+	// A response accepted after the probe closes the breaker.
+	f.SendDeltaResponse(clusterResponse("good", "good"))
+	mt.Assert("xds_proxy_circuit_breakers_open", map[string]string{"type": "CDS"}, monitortest.Exactly(0))
+}
@@ -0,0 +1,104 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxDeltaCorrelations is the number of recent responses of a connection reported by correlationz.
+const maxDeltaCorrelations = 100
+
+// deltaCorrelationID returns the ID correlating a response received from the upstream with the response forwarded
+// to Envoy in the logs. It is derived from the nonce of the upstream, which Istiod logs for its pushes as well, and
+// the ID of the connection, as nonces are only unique per connection.
+func deltaCorrelationID(conID uint32, nonce string) string {
+	return fmt.Sprintf("%d-%s", conID, nonce)
+}
+
+// deltaCorrelation is the mapping of a correlation ID to the response it identifies.
+type deltaCorrelation struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Nonce     string     `json:"nonce"`
+	Received  time.Time  `json:"received"`
+	Forwarded *time.Time `json:"forwarded,omitempty"`
+}
+
+// deltaCorrelations records the most recent responses received from the upstream on a connection, and when they
+// were forwarded to Envoy.
+type deltaCorrelations struct {
+	mu sync.Mutex
+	// recent are the most recent responses, oldest first.
+	recent []*deltaCorrelation
+}
+
+func newDeltaCorrelations() *deltaCorrelations {
+	return &deltaCorrelations{}
+}
+
+// received records a response received from the upstream.
+func (c *deltaCorrelations) received(id, typ, nonce string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.recent) == maxDeltaCorrelations {
+		c.recent = c.recent[1:]
+	}
+	c.recent = append(c.recent, &deltaCorrelation{ID: id, Type: typ, Nonce: nonce, Received: time.Now()})
+}
+
+// forwarded records that the response with the given correlation ID was forwarded to Envoy.
+func (c *deltaCorrelations) forwarded(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.recent) - 1; i >= 0; i-- {
+		if c.recent[i].ID == id {
+			now := time.Now()
+			c.recent[i].Forwarded = &now
+			return
+		}
+	}
+}
+
+func (c *deltaCorrelations) snapshot() []deltaCorrelation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]deltaCorrelation, 0, len(c.recent))
+	for _, r := range c.recent {
+		out = append(out, *r)
+	}
+	return out
+}
+
+// correlationz reports the correlation IDs of the most recent delta responses received from the upstream, with the
+// type and nonce of the response and when it was forwarded to Envoy.
+func (p *XdsProxy) correlationz(w http.ResponseWriter, _ *http.Request) {
+	out := []deltaCorrelation{}
+	p.connectedMutex.RLock()
+	if p.connected != nil && p.connected.deltaCorrelations != nil {
+		out = p.connected.deltaCorrelations.snapshot()
+	}
+	p.connectedMutex.RUnlock()
+	writeJSON(w, out)
+}
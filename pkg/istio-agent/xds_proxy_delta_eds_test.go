@@ -0,0 +1,142 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/proto"
+
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	"istio.io/istio/pilot/pkg/xds"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// capturingDeltaStream is a downstream delta stream. If keep is set, it records the responses sent on it as
+// marshaled by gRPC, otherwise it discards them so the benchmarks only measure the forwarding.
+type capturingDeltaStream struct {
+	xds.DeltaDiscoveryStream
+	sent [][]byte
+	keep bool
+}
+
+func (s *capturingDeltaStream) Send(resp *discovery.DeltaDiscoveryResponse) error {
+	if !s.keep {
+		return nil
+	}
+	b, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	s.sent = append(s.sent, b)
+	return nil
+}
+
+func edsDeltaConnection(stream *capturingDeltaStream) *ProxyConnection {
+	return &ProxyConnection{
+		conID:              1,
+		stopChan:           make(chan struct{}),
+		downstreamDeltas:   stream,
+		deltaSubscriptions: newDeltaSubscriptions(),
+		deltaAcks:          newDeltaAckTracker(),
+		deltaSplits:        newDeltaSplitTracker(),
+		deltaCorrelations:  newDeltaCorrelations(),
+	}
+}
+
+func edsDeltaResponse(clusters, endpoints int) *discovery.DeltaDiscoveryResponse {
+	resp := &discovery.DeltaDiscoveryResponse{
+		TypeUrl:           v3.EndpointType,
+		SystemVersionInfo: "2023-01-01T00:00:00Z/1",
+		Nonce:             "nonce",
+		RemovedResources:  []string{"outbound|80||removed.default.svc.cluster.local"},
+	}
+	for c := 0; c < clusters; c++ {
+		name := fmt.Sprintf("outbound|80||svc-%d.default.svc.cluster.local", c)
+		cla := &endpoint.ClusterLoadAssignment{ClusterName: name}
+		lb := &endpoint.LocalityLbEndpoints{}
+		for e := 0; e < endpoints; e++ {
+			lb.LbEndpoints = append(lb.LbEndpoints, &endpoint.LbEndpoint{
+				HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{
+					Hostname: fmt.Sprintf("10.0.%d.%d", c, e),
+				}},
+			})
+		}
+		cla.Endpoints = append(cla.Endpoints, lb)
+		resp.Resources = append(resp.Resources, &discovery.Resource{
+			Name:     name,
+			Version:  "1",
+			Resource: protoconv.MessageToAny(cla),
+		})
+	}
+	return resp
+}
+
+func TestForwardEDSDeltaIdenticalOutput(t *testing.T) {
+	for _, maxSize := range []int{0, 1 << 20, 2048} {
+		t.Run(fmt.Sprint(maxSize), func(t *testing.T) {
+			resp := edsDeltaResponse(20, 5)
+
+			generic := &capturingDeltaStream{keep: true}
+			genericCon := edsDeltaConnection(generic)
+			genericCon.maxDeltaResponseSize = maxSize
+			forwardDeltaToEnvoy(genericCon, resp)
+
+			fast := &capturingDeltaStream{keep: true}
+			fastCon := edsDeltaConnection(fast)
+			fastCon.maxDeltaResponseSize = maxSize
+			forwardEDSDeltaToEnvoy(fastCon, resp, deltaCorrelationID(fastCon.conID, resp.Nonce))
+
+			if len(generic.sent) == 0 || len(generic.sent) != len(fast.sent) {
+				t.Fatalf("expected the same number of responses, got %d and %d", len(generic.sent), len(fast.sent))
+			}
+			for i := range generic.sent {
+				if !bytes.Equal(generic.sent[i], fast.sent[i]) {
+					t.Fatalf("response %d differs between the generic and the EDS paths", i)
+				}
+			}
+			if genericCon.bytes.downstreamSent.Load() != fastCon.bytes.downstreamSent.Load() {
+				t.Fatalf("expected the same bytes to be accounted, got %d and %d",
+					genericCon.bytes.downstreamSent.Load(), fastCon.bytes.downstreamSent.Load())
+			}
+		})
+	}
+}
+
+func BenchmarkForwardEDSDelta(b *testing.B) {
+	resp := edsDeltaResponse(50, 10)
+	b.Run("generic", func(b *testing.B) {
+		con := edsDeltaConnection(&capturingDeltaStream{})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			con.bytes.record(metrics.UpstreamReceived, resp.TypeUrl, resp)
+			_ = deltaCorrelationID(con.conID, resp.Nonce)
+			forwardDeltaToEnvoy(con, resp)
+		}
+	})
+	b.Run("eds", func(b *testing.B) {
+		con := edsDeltaConnection(&capturingDeltaStream{})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			con.bytes.record(metrics.UpstreamReceived, resp.TypeUrl, resp)
+			forwardEDSDeltaToEnvoy(con, resp, deltaCorrelationID(con.conID, resp.Nonce))
+		}
+	})
+}
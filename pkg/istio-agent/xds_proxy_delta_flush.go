@@ -0,0 +1,99 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// deltaFlushRequest asks the goroutine handling the upstream responses of a connection to forward the
+// responses already queued to Envoy, before the connection is torn down.
+type deltaFlushRequest struct {
+	deadline time.Time
+	// done is closed once the queued responses are forwarded, or the deadline passed.
+	done chan struct{}
+}
+
+// flushDeltaResponses forwards the responses from the upstream queued on con to Envoy, on a best effort basis.
+// It never blocks for more than deltaFlushTimeout, even if Envoy does not read the responses; the pending sends
+// are then aborted when the connection is torn down.
+func (p *XdsProxy) flushDeltaResponses(con *ProxyConnection) {
+	log := con.logger()
+	timer := time.NewTimer(p.deltaFlushTimeout)
+	defer timer.Stop()
+	flush := deltaFlushRequest{
+		deadline: time.Now().Add(p.deltaFlushTimeout),
+		done:     make(chan struct{}),
+	}
+	select {
+	case con.deltaFlush <- flush:
+	case <-timer.C:
+		log.Warnf("timed out flushing delta responses to Envoy after %v", p.deltaFlushTimeout)
+		return
+	case <-con.stopChan:
+		return
+	}
+	select {
+	case <-flush.done:
+	case <-timer.C:
+		log.Warnf("timed out flushing delta responses to Envoy after %v", p.deltaFlushTimeout)
+	}
+}
+
+// drainDeltaResponses handles the responses queued on con until none is left or the deadline of flush passed.
+// It runs on the goroutine of handleUpstreamDeltaResponse, so the responses are forwarded in order.
+func (p *XdsProxy) drainDeltaResponses(con *ProxyConnection, forwardEnvoyCh chan *discovery.DeltaDiscoveryResponse,
+	flush deltaFlushRequest,
+) {
+	defer close(flush.done)
+	timer := time.NewTimer(time.Until(flush.deadline))
+	defer timer.Stop()
+	flushed := 0
+	defer func() {
+		con.logger().WithLabels("responses", flushed).Debugf("flushed delta responses to Envoy")
+	}()
+	for !con.isClosed() && time.Now().Before(flush.deadline) {
+		select {
+		case resp := <-con.deltaResponsesChan:
+			con.deltaResponseQueue.received()
+			con.backlog.done(resp.TypeUrl)
+			p.handleDeltaResponse(con, resp, forwardEnvoyCh)
+			flushed++
+			continue
+		case resp := <-forwardEnvoyCh:
+			forwardDeltaToEnvoy(con, resp)
+			flushed++
+			continue
+		default:
+		}
+		if con.deltaResponseQueue.pending() == 0 {
+			return
+		}
+		// The queue is passing a response on.
+		select {
+		case resp := <-con.deltaResponsesChan:
+			con.deltaResponseQueue.received()
+			con.backlog.done(resp.TypeUrl)
+			p.handleDeltaResponse(con, resp, forwardEnvoyCh)
+			flushed++
+		case <-timer.C:
+			return
+		case <-con.stopChan:
+			return
+		}
+	}
+}
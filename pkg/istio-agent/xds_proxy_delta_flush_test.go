@@ -0,0 +1,99 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+const blockingType = "type.googleapis.com/istio.test.Blocking"
+
+// Validates the responses queued when Envoy gracefully closes its stream are forwarded within the flush timeout.
+func TestDeltaXdsProxyFlushOnClose(t *testing.T) {
+	flushTimeout := time.Second * 5
+	proxy := setupXdsProxy(t)
+	proxy.deltaFlushTimeout = flushTimeout
+	proxy.deltaResponseQueueSize = 10
+	// Block the handling of the upstream responses, so the following responses are queued.
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	proxy.handlers[blockingType] = func(*anypb.Any) error {
+		close(handling)
+		<-release
+		return nil
+	}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithoutResponse(t, downstream)
+
+	var queue *deltaResponseQueue
+	retry.UntilSuccessOrFail(t, func() error {
+		proxy.connectedMutex.RLock()
+		defer proxy.connectedMutex.RUnlock()
+		if proxy.connected == nil {
+			return fmt.Errorf("not connected")
+		}
+		queue = proxy.connected.deltaResponseQueue
+		return nil
+	})
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:   blockingType,
+		Resources: []*discovery.Resource{{Resource: &anypb.Any{}}},
+	})
+	select {
+	case <-handling:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the blocking response was not handled")
+	}
+	for i := 0; i < 3; i++ {
+		f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: fmt.Sprint(i)})
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if p := queue.pending(); p != 3 {
+			return fmt.Errorf("expected 3 pending responses, got %d", p)
+		}
+		return nil
+	})
+
+	if err := downstream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	closed := time.Now()
+	// Let the proxy observe the close before the queued responses can be handled.
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+	for i := 0; i < 3; i++ {
+		resp, err := downstream.Recv()
+		if err != nil {
+			t.Fatalf("queued response %d was not flushed: %v", i, err)
+		}
+		assert.Equal(t, resp.Nonce, fmt.Sprint(i))
+	}
+	if elapsed := time.Since(closed); elapsed >= flushTimeout {
+		t.Fatalf("flushing took %v, longer than the timeout %v", elapsed, flushTimeout)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// deltaInflightLimiter caps the number of responses forwarded to Envoy and not acknowledged yet, per type URL.
+// The responses beyond the cap are held, in order, until Envoy acknowledges an outstanding response of their type.
+// The other types are not held meanwhile, as Envoy may wait for them before acknowledging, such as CDS for EDS.
+// A nil limiter admits every response.
+type deltaInflightLimiter struct {
+	max int
+
+	mu sync.Mutex
+	// outstanding are the nonces of the responses not acknowledged yet, by type URL, in the order they were sent.
+	outstanding map[string][]string
+	held        map[string][]*discovery.DeltaDiscoveryResponse
+	// releasable receives once a held response may be sent.
+	releasable chan struct{}
+}
+
+func newDeltaInflightLimiter(max int) *deltaInflightLimiter {
+	return &deltaInflightLimiter{
+		max:         max,
+		outstanding: map[string][]string{},
+		held:        map[string][]*discovery.DeltaDiscoveryResponse{},
+		releasable:  make(chan struct{}, 1),
+	}
+}
+
+// admit returns true if resp can be sent to Envoy now, recording it as outstanding. Otherwise resp is held.
+func (l *deltaInflightLimiter) admit(resp *discovery.DeltaDiscoveryResponse) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.held[resp.TypeUrl]) > 0 || len(l.outstanding[resp.TypeUrl]) >= l.max {
+		l.held[resp.TypeUrl] = append(l.held[resp.TypeUrl], resp)
+		return false
+	}
+	l.outstanding[resp.TypeUrl] = append(l.outstanding[resp.TypeUrl], resp.Nonce)
+	return true
+}
+
+// acked records the ACK or NACK of a response by req. The responses of the type sent before it are settled as
+// well, as Envoy may only acknowledge the latest one.
+func (l *deltaInflightLimiter) acked(req *discovery.DeltaDiscoveryRequest) {
+	if l == nil || req.ResponseNonce == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nonces := l.outstanding[req.TypeUrl]
+	for i, nonce := range nonces {
+		if nonce != req.ResponseNonce {
+			continue
+		}
+		l.outstanding[req.TypeUrl] = nonces[i+1:]
+		if len(l.held[req.TypeUrl]) > 0 {
+			select {
+			case l.releasable <- struct{}{}:
+			default:
+			}
+		}
+		return
+	}
+}
+
+// ready returns a channel receiving once held responses may be sent. It is nil for a nil limiter, so it can
+// always be selected on.
+func (l *deltaInflightLimiter) ready() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.releasable
+}
+
+// release returns the held responses which can be sent now, in order, recording them as outstanding.
+func (l *deltaInflightLimiter) release() []*discovery.DeltaDiscoveryResponse {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []*discovery.DeltaDiscoveryResponse
+	for typeURL, held := range l.held {
+		for len(held) > 0 && len(l.outstanding[typeURL]) < l.max {
+			l.outstanding[typeURL] = append(l.outstanding[typeURL], held[0].Nonce)
+			out = append(out, held[0])
+			held = held[1:]
+		}
+		if len(held) == 0 {
+			delete(l.held, typeURL)
+		} else {
+			l.held[typeURL] = held
+		}
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+// Validates the responses beyond the cap of unacknowledged responses of a type are held until Envoy acknowledges.
+func TestDeltaXdsProxyMaxInflightResponses(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.maxInflightResponses = 1
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1"})
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "2"})
+
+	received := make(chan *discovery.DeltaDiscoveryResponse)
+	go func() {
+		for {
+			resp, err := downstream.Recv()
+			if err != nil {
+				return
+			}
+			received <- resp
+		}
+	}()
+	resp := <-received
+	assert.Equal(t, resp.Nonce, "1")
+	select {
+	case resp := <-received:
+		t.Fatalf("expected the response %q to be held until the ACK", resp.Nonce)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-received:
+		assert.Equal(t, resp.Nonce, "2")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the held response to be sent once acknowledged")
+	}
+}
+
+func TestDeltaInflightLimiter(t *testing.T) {
+	l := newDeltaInflightLimiter(2)
+	send := func(typeURL, nonce string) bool {
+		return l.admit(&discovery.DeltaDiscoveryResponse{TypeUrl: typeURL, Nonce: nonce})
+	}
+	assert.Equal(t, send(v3.ClusterType, "1"), true)
+	assert.Equal(t, send(v3.ClusterType, "2"), true)
+	assert.Equal(t, send(v3.ClusterType, "3"), false)
+	// Other types are not held.
+	assert.Equal(t, send(v3.EndpointType, "4"), true)
+	assert.Equal(t, send(v3.ClusterType, "5"), false)
+
+	// Acknowledging the latest response settles the previous ones as well.
+	l.acked(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "2"})
+	<-l.ready()
+	released := l.release()
+	assert.Equal(t, len(released), 2)
+	assert.Equal(t, released[0].Nonce, "3")
+	assert.Equal(t, released[1].Nonce, "5")
+	assert.Equal(t, send(v3.ClusterType, "6"), false)
+}
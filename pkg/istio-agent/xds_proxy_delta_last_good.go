@@ -0,0 +1,141 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/maps"
+	"istio.io/istio/pkg/slices"
+)
+
+const (
+	// lastGoodNoncePrefix prefixes the nonces of the responses serving the last good resources, which are never
+	// acknowledged upstream.
+	lastGoodNoncePrefix = "last-good/"
+	// lastGoodVersion is the system version of the responses serving the last good resources.
+	lastGoodVersion = "last-good"
+)
+
+// deltaLastGood is the in-memory snapshot of the resources last acknowledged by Envoy, by type URL, which is served
+// to a reconnecting Envoy while the upstream XDS server is unreachable.
+type deltaLastGood struct {
+	mu        sync.Mutex
+	resources map[string]map[string]*discovery.Resource
+	// pending are the responses sent to Envoy and not acknowledged yet, by connection and nonce.
+	pending map[uint32]map[string]*discovery.DeltaDiscoveryResponse
+}
+
+func newDeltaLastGood() *deltaLastGood {
+	return &deltaLastGood{
+		resources: map[string]map[string]*discovery.Resource{},
+		pending:   map[uint32]map[string]*discovery.DeltaDiscoveryResponse{},
+	}
+}
+
+// sent records resp sent to Envoy on the connection conID. It is applied to the snapshot once Envoy acknowledges it.
+func (s *deltaLastGood) sent(conID uint32, resp *discovery.DeltaDiscoveryResponse) {
+	if s == nil || isLocalNonce(resp.Nonce) || !v3.IsEnvoyType(resp.TypeUrl) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[conID] == nil {
+		s.pending[conID] = map[string]*discovery.DeltaDiscoveryResponse{}
+	}
+	s.pending[conID][resp.Nonce] = resp
+}
+
+// acked applies the response req acknowledges on the connection conID to the snapshot. A rejected response is
+// dropped.
+func (s *deltaLastGood) acked(conID uint32, req *discovery.DeltaDiscoveryRequest) {
+	if s == nil || req.ResponseNonce == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp, f := s.pending[conID][req.ResponseNonce]
+	if !f {
+		return
+	}
+	delete(s.pending[conID], req.ResponseNonce)
+	if req.ErrorDetail != nil {
+		return
+	}
+	resources := s.resources[resp.TypeUrl]
+	if resources == nil {
+		resources = map[string]*discovery.Resource{}
+		s.resources[resp.TypeUrl] = resources
+	}
+	for _, r := range resp.Resources {
+		resources[r.Name] = r
+	}
+	for _, name := range resp.RemovedResources {
+		delete(resources, name)
+	}
+}
+
+// forget drops the responses of the connection conID that Envoy did not acknowledge before the connection closed.
+func (s *deltaLastGood) forget(conID uint32) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, conID)
+}
+
+// typeURLs returns the sorted type URLs of the last good resources.
+func (s *deltaLastGood) typeURLs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sort(maps.Keys(s.resources))
+}
+
+// get returns the last good resources of typeURL, sorted by name.
+func (s *deltaLastGood) get(typeURL string) []*discovery.Resource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resources := s.resources[typeURL]
+	return slices.Map(slices.Sort(maps.Keys(resources)), func(name string) *discovery.Resource { return resources[name] })
+}
+
+// serveLastGoodResources serves the last good resources of the type of req to Envoy, if req is the initial request
+// of the type on a new stream while the upstream is unreachable. Like the bootstrap resources, they are superseded
+// by the first upstream response of the type.
+func (p *XdsProxy) serveLastGoodResources(con *ProxyConnection, req *discovery.DeltaDiscoveryRequest) {
+	if p.lastGood == nil || con.dryRun || req.ResponseNonce != "" || len(req.InitialResourceVersions) > 0 {
+		// Envoy resuming a stream already has its resources.
+		return
+	}
+	if p.upstreamHealth.get().Connected {
+		return
+	}
+	resources := p.lastGood.get(req.TypeUrl)
+	if len(resources) == 0 || !con.bootstrap.serve(req.TypeUrl, resources) {
+		return
+	}
+	con.logger().WithLabels("type", v3.GetShortType(req.TypeUrl), "resources", len(resources)).
+		Infof("serving the last good resources while the upstream is unreachable")
+	con.sendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:           req.TypeUrl,
+		SystemVersionInfo: lastGoodVersion,
+		Nonce:             lastGoodNoncePrefix + v3.GetShortType(req.TypeUrl),
+		Resources:         resources,
+	})
+}
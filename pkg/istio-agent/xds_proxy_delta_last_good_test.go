@@ -0,0 +1,136 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+// Validates the stream of Envoy is held open while the upstream is lost, and a reconnecting Envoy is served the
+// resources last acknowledged by Envoy.
+func TestDeltaXdsProxyServesLastGoodResources(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.holdDownstream = true
+	proxy.deltaReconnectBackoff = time.Millisecond
+	proxy.lastGood = newDeltaLastGood()
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	// While down, no stream to the upstream can be opened.
+	var down atomic.Bool
+	outage := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		if down.Load() {
+			return nil, status.Error(codes.Unavailable, "upstream down")
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	killer := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithChainStreamInterceptor(outage, killer.interceptor()))
+
+	subscribe := func(downstream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient) {
+		t.Helper()
+		if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+			TypeUrl: v3.ClusterType,
+			Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	subscribe(downstream)
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ClusterType,
+		Nonce:   "upstream",
+		Resources: []*discovery.Resource{{
+			Name:     "outbound|80||foo.default.svc.cluster.local",
+			Resource: protoconv.MessageToAny(&cluster.Cluster{Name: "outbound|80||foo.default.svc.cluster.local"}),
+		}},
+	})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: resp.Nonce}); err != nil {
+		t.Fatal(err)
+	}
+
+	down.Store(true)
+	killer.kill()
+	// The stream of Envoy outlives the default reconnect backoff.
+	time.Sleep(200 * time.Millisecond)
+	if err := downstream.Context().Err(); err != nil {
+		t.Fatalf("the stream of Envoy should be held open, got %v", err)
+	}
+
+	// Envoy restarts, and is served its last good clusters while the upstream is still down.
+	conn.Close()
+	conn = setupDownstreamConnection(t, proxy)
+	downstream = deltaStream(t, conn)
+	subscribe(downstream)
+	resp, err = downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.TypeUrl, v3.ClusterType)
+	assert.Equal(t, resp.Nonce, lastGoodNoncePrefix+"CDS")
+	assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"outbound|80||foo.default.svc.cluster.local"})
+}
+
+func TestDeltaLastGoodSnapshot(t *testing.T) {
+	s := newDeltaLastGood()
+	resource := func(name string) *discovery.Resource {
+		return &discovery.Resource{Name: name}
+	}
+	names := func() []string {
+		return slices.Map(s.get(v3.ClusterType), (*discovery.Resource).GetName)
+	}
+	s.sent(1, &discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1", Resources: []*discovery.Resource{resource("b"), resource("a")}})
+	assert.Equal(t, len(names()), 0)
+	s.acked(1, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "1"})
+	assert.Equal(t, names(), []string{"a", "b"})
+
+	// A rejected response is not applied.
+	s.sent(1, &discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "2", Resources: []*discovery.Resource{resource("c")}})
+	s.acked(1, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "2", ErrorDetail: status.New(codes.Internal, "").Proto()})
+	assert.Equal(t, names(), []string{"a", "b"})
+
+	s.sent(1, &discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "3", RemovedResources: []string{"a"}})
+	s.acked(1, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "3"})
+	assert.Equal(t, names(), []string{"b"})
+
+	// The responses of a closed connection are never applied.
+	s.sent(2, &discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "4", Resources: []*discovery.Resource{resource("d")}})
+	s.forget(2)
+	s.acked(2, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "4"})
+	assert.Equal(t, names(), []string{"b"})
+}
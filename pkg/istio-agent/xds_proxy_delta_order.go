@@ -0,0 +1,159 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"strings"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// ParseResponsePrerequisites parses a comma separated list of prerequisite>dependent pairs of types, by their
+// short name such as CDS>EDS or their type URL, into the prerequisites of each dependent type URL.
+func ParseResponsePrerequisites(s string) map[string][]string {
+	out := map[string][]string{}
+	for _, pair := range strings.Split(s, ",") {
+		prerequisite, dependent, ok := strings.Cut(strings.TrimSpace(pair), ">")
+		if !ok {
+			proxyLog.Warnf("ignoring invalid response order %q, expected prerequisite>dependent", pair)
+			continue
+		}
+		dependent = v3.GetResourceType(strings.TrimSpace(dependent))
+		out[dependent] = append(out[dependent], v3.GetResourceType(strings.TrimSpace(prerequisite)))
+	}
+	return out
+}
+
+// deltaResponseOrder holds the delta responses of a type forwarded to Envoy while a response of one of its
+// prerequisite types is not acknowledged yet, such as EDS until CDS is ACKed, so that Envoy warms the dependent
+// resources against the prerequisites they reference. The held responses are released, in order, once Envoy
+// acknowledges the outstanding prerequisites. A nil order admits every response.
+type deltaResponseOrder struct {
+	// prerequisites are the prerequisite type URLs of each dependent type URL.
+	prerequisites map[string][]string
+	// tracked are the prerequisite type URLs, whose outstanding responses are recorded.
+	tracked map[string]bool
+
+	mu sync.Mutex
+	// outstanding are the nonces of the prerequisite responses not acknowledged yet, by type URL, in the order
+	// they were sent.
+	outstanding map[string][]string
+	held        map[string][]*discovery.DeltaDiscoveryResponse
+	// releasable receives once held responses may be sent.
+	releasable chan struct{}
+}
+
+func newDeltaResponseOrder(prerequisites map[string][]string) *deltaResponseOrder {
+	o := &deltaResponseOrder{
+		prerequisites: prerequisites,
+		tracked:       map[string]bool{},
+		outstanding:   map[string][]string{},
+		held:          map[string][]*discovery.DeltaDiscoveryResponse{},
+		releasable:    make(chan struct{}, 1),
+	}
+	for _, types := range prerequisites {
+		for _, t := range types {
+			o.tracked[t] = true
+		}
+	}
+	return o
+}
+
+// admit returns true if resp can be sent to Envoy now, recording it as outstanding if it is a prerequisite.
+// Otherwise resp is held until its prerequisites are acknowledged.
+func (o *deltaResponseOrder) admit(resp *discovery.DeltaDiscoveryResponse) bool {
+	if o == nil {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.held[resp.TypeUrl]) > 0 || o.blockedLocked(resp.TypeUrl) {
+		o.held[resp.TypeUrl] = append(o.held[resp.TypeUrl], resp)
+		return false
+	}
+	o.sentLocked(resp)
+	return true
+}
+
+// blockedLocked returns true if a prerequisite of typeURL is not acknowledged yet, or is itself held.
+func (o *deltaResponseOrder) blockedLocked(typeURL string) bool {
+	for _, t := range o.prerequisites[typeURL] {
+		if len(o.outstanding[t]) > 0 || len(o.held[t]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *deltaResponseOrder) sentLocked(resp *discovery.DeltaDiscoveryResponse) {
+	if o.tracked[resp.TypeUrl] {
+		o.outstanding[resp.TypeUrl] = append(o.outstanding[resp.TypeUrl], resp.Nonce)
+	}
+}
+
+// acked records the ACK or NACK of a response by req. The responses of the type sent before it are settled as
+// well, as Envoy may only acknowledge the latest one.
+func (o *deltaResponseOrder) acked(req *discovery.DeltaDiscoveryRequest) {
+	if o == nil || req.ResponseNonce == "" || !o.tracked[req.TypeUrl] {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	nonces := o.outstanding[req.TypeUrl]
+	for i, nonce := range nonces {
+		if nonce != req.ResponseNonce {
+			continue
+		}
+		o.outstanding[req.TypeUrl] = nonces[i+1:]
+		if len(o.held) > 0 {
+			select {
+			case o.releasable <- struct{}{}:
+			default:
+			}
+		}
+		return
+	}
+}
+
+// ready returns a channel receiving once held responses may be sent. It is nil for a nil order, so it can
+// always be selected on.
+func (o *deltaResponseOrder) ready() <-chan struct{} {
+	if o == nil {
+		return nil
+	}
+	return o.releasable
+}
+
+// release returns the held responses whose prerequisites are acknowledged, in order for each type, recording
+// them as outstanding if they are prerequisites themselves.
+func (o *deltaResponseOrder) release() []*discovery.DeltaDiscoveryResponse {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var out []*discovery.DeltaDiscoveryResponse
+	for typeURL, held := range o.held {
+		if o.blockedLocked(typeURL) {
+			continue
+		}
+		for _, resp := range held {
+			o.sentLocked(resp)
+		}
+		out = append(out, held...)
+		delete(o.held, typeURL)
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+// Validates the EDS responses are held until Envoy acknowledges the CDS response sent before them.
+func TestDeltaXdsProxyResponseOrder(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.responsePrerequisites = ParseResponsePrerequisites("CDS>EDS")
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType}); err != nil {
+		t.Fatal(err)
+	}
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "cds"})
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.EndpointType, Nonce: "eds"})
+
+	received := make(chan *discovery.DeltaDiscoveryResponse)
+	go func() {
+		for {
+			resp, err := downstream.Recv()
+			if err != nil {
+				return
+			}
+			received <- resp
+		}
+	}()
+	resp := <-received
+	assert.Equal(t, resp.Nonce, "cds")
+	select {
+	case resp := <-received:
+		t.Fatalf("expected the response %q to be held until CDS is acknowledged", resp.Nonce)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "cds"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-received:
+		assert.Equal(t, resp.Nonce, "eds")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the held response to be sent once CDS is acknowledged")
+	}
+}
+
+func TestDeltaResponseOrder(t *testing.T) {
+	o := newDeltaResponseOrder(ParseResponsePrerequisites("CDS>EDS, LDS>RDS"))
+	send := func(typeURL, nonce string) bool {
+		return o.admit(&discovery.DeltaDiscoveryResponse{TypeUrl: typeURL, Nonce: nonce})
+	}
+	// Without an outstanding prerequisite, the dependent types are not held.
+	assert.Equal(t, send(v3.EndpointType, "1"), true)
+	assert.Equal(t, send(v3.ClusterType, "2"), true)
+	assert.Equal(t, send(v3.EndpointType, "3"), false)
+	assert.Equal(t, send(v3.ListenerType, "4"), true)
+	assert.Equal(t, send(v3.RouteType, "5"), false)
+	// The following responses of a held type are held too, in order.
+	assert.Equal(t, send(v3.ClusterType, "6"), true)
+	assert.Equal(t, send(v3.EndpointType, "7"), false)
+
+	// Acknowledging the latest CDS response settles the previous ones as well, releasing EDS but not RDS.
+	o.acked(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "6"})
+	<-o.ready()
+	released := o.release()
+	assert.Equal(t, len(released), 2)
+	assert.Equal(t, released[0].Nonce, "3")
+	assert.Equal(t, released[1].Nonce, "7")
+
+	// A NACK settles the prerequisite too.
+	o.acked(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ListenerType, ResponseNonce: "4", ErrorDetail: &google_rpc.Status{Message: "rejected"}})
+	<-o.ready()
+	released = o.release()
+	assert.Equal(t, len(released), 1)
+	assert.Equal(t, released[0].Nonce, "5")
+	assert.Equal(t, send(v3.RouteType, "8"), true)
+}
@@ -0,0 +1,112 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"strconv"
+	"strings"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/channels"
+)
+
+// ParseRequestPriorities parses a comma separated list of type=priority pairs, by the short name of the type such
+// as CDS=2 or its type URL, into the priority of each type URL.
+func ParseRequestPriorities(s string) map[string]int {
+	out := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		typ, priority, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		p, err := strconv.Atoi(strings.TrimSpace(priority))
+		if !ok || err != nil {
+			proxyLog.Warnf("ignoring invalid request priority %q, expected type=priority", pair)
+			continue
+		}
+		out[v3.GetResourceType(strings.TrimSpace(typ))] = p
+	}
+	return out
+}
+
+// deltaRequestQueue orders the delta requests from Envoy waiting to be sent to the upstream by the priority of their
+// type URL, so that the critical types such as CDS and LDS go out first when many requests are pending, for instance
+// after a reconnect. Requests of the same priority are sent in the order they were queued, and the types without a
+// priority have priority 0. A nil queue sends the requests in order.
+// It is only used by the goroutine sending the requests to the upstream.
+type deltaRequestQueue struct {
+	priorities map[string]int
+	pending    []*discovery.DeltaDiscoveryRequest
+	// readyCh receives while requests are pending.
+	readyCh chan struct{}
+}
+
+func newDeltaRequestQueue(priorities map[string]int) *deltaRequestQueue {
+	return &deltaRequestQueue{
+		priorities: priorities,
+		readyCh:    make(chan struct{}, 1),
+	}
+}
+
+// push queues req, after the pending requests of the same or a higher priority.
+func (q *deltaRequestQueue) push(req *discovery.DeltaDiscoveryRequest) {
+	priority := q.priorities[req.TypeUrl]
+	i := len(q.pending)
+	for i > 0 && q.priorities[q.pending[i-1].TypeUrl] < priority {
+		i--
+	}
+	q.pending = append(q.pending, nil)
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = req
+	q.signal()
+}
+
+// drain queues all the requests available from in, so they are ordered along with the pending ones.
+func (q *deltaRequestQueue) drain(in *channels.Unbounded[*discovery.DeltaDiscoveryRequest]) {
+	for {
+		select {
+		case req := <-in.Get():
+			in.Load()
+			q.push(req)
+		default:
+			return
+		}
+	}
+}
+
+// pop returns the pending request of the highest priority.
+func (q *deltaRequestQueue) pop() *discovery.DeltaDiscoveryRequest {
+	req := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	if len(q.pending) > 0 {
+		q.signal()
+	}
+	return req
+}
+
+// ready returns a channel receiving while requests are pending, to pop them.
+func (q *deltaRequestQueue) ready() <-chan struct{} {
+	if q == nil {
+		return nil
+	}
+	return q.readyCh
+}
+
+func (q *deltaRequestQueue) signal() {
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+	}
+}
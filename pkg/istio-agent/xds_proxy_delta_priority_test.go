@@ -0,0 +1,152 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/channels"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestParseRequestPriorities(t *testing.T) {
+	assert.Equal(t, ParseRequestPriorities("CDS=2, LDS = 2,"+v3.SecretType+"=1,ECDS,RDS=high"), map[string]int{
+		v3.ClusterType:  2,
+		v3.ListenerType: 2,
+		v3.SecretType:   1,
+	})
+}
+
+func TestDeltaRequestQueue(t *testing.T) {
+	q := newDeltaRequestQueue(map[string]int{v3.ClusterType: 2, v3.ListenerType: 2, v3.SecretType: 1})
+	in := channels.NewUnbounded[*discovery.DeltaDiscoveryRequest]()
+	for i, typeURL := range []string{v3.ExtensionConfigurationType, v3.SecretType, v3.ListenerType, v3.RouteType, v3.ClusterType} {
+		in.Put(&discovery.DeltaDiscoveryRequest{TypeUrl: typeURL, ResponseNonce: fmt.Sprint(i)})
+	}
+	q.drain(in)
+
+	var popped []string
+	for {
+		select {
+		case <-q.ready():
+			req := q.pop()
+			popped = append(popped, v3.GetShortType(req.TypeUrl)+"/"+req.ResponseNonce)
+			continue
+		default:
+		}
+		break
+	}
+	// Higher priorities first, then in the order the requests were queued.
+	assert.Equal(t, popped, []string{"LDS/2", "CDS/4", "SDS/1", "ECDS/0", "RDS/3"})
+
+	// A nil queue is never ready.
+	assert.Equal(t, (*deltaRequestQueue)(nil).ready() == nil, true)
+}
+
+// pausingUpstream holds the first request sent to the upstream until resumed, and records the type URLs of the
+// requests in the order they are sent.
+type pausingUpstream struct {
+	paused chan struct{}
+	resume chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	sent   []string
+}
+
+type pausingClientStream struct {
+	grpc.ClientStream
+	u *pausingUpstream
+}
+
+func (s *pausingClientStream) SendMsg(m any) error {
+	if req, ok := m.(*discovery.DeltaDiscoveryRequest); ok {
+		s.u.once.Do(func() {
+			close(s.u.paused)
+			<-s.u.resume
+		})
+		s.u.mu.Lock()
+		s.u.sent = append(s.u.sent, v3.GetShortType(req.TypeUrl))
+		s.u.mu.Unlock()
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (u *pausingUpstream) interceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		clientStream, err := streamer(ctx, desc, cc, method, opts...)
+		return &pausingClientStream{ClientStream: clientStream, u: u}, err
+	}
+}
+
+func (u *pausingUpstream) requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return slices.Clone(u.sent)
+}
+
+// Validates the requests queued while the upstream is paused are sent by priority of their type.
+func TestDeltaXdsProxyRequestPriorities(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.requestPriorities = map[string]int{v3.ClusterType: 1}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	upstream := &pausingUpstream{paused: make(chan struct{}), resume: make(chan struct{})}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(upstream.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	send := func(req *discovery.DeltaDiscoveryRequest) {
+		t.Helper()
+		if err := downstream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ListenerType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	})
+	select {
+	case <-upstream.paused:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the first request was not sent upstream")
+	}
+	// The upstream is paused on the first request, so the following ones are queued, ECDS first.
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ExtensionConfigurationType, ResourceNamesSubscribe: []string{"extension-config"}})
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType})
+	time.Sleep(time.Millisecond * 100)
+	close(upstream.resume)
+
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := upstream.requests(); len(sent) != 3 {
+			return fmt.Errorf("expected 3 requests to be sent upstream, got %v", sent)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, upstream.requests(), []string{"LDS", "CDS", "ECDS"})
+}
@@ -0,0 +1,175 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"istio.io/istio/pkg/util/sets"
+)
+
+// deltaResponseQueue queues the delta responses from the upstream until they are handled, without blocking the upstream.
+// Once the queue is full, a new response is coalesced with the oldest queued response of the same type URL: the
+// queued response is dropped and its changes are merged into the new one, which is queued last. Coalescing is done
+// per type URL, so a backed up type does not starve the others; the queue can only grow beyond its capacity by one
+// response per type URL.
+type deltaResponseQueue struct {
+	mu        sync.Mutex
+	responses []*discovery.DeltaDiscoveryResponse
+	capacity  int
+	// inFlight counts the responses popped by run which were not yet received from its output.
+	inFlight int
+	// notify has a pending notification while the queue is not empty.
+	notify chan struct{}
+}
+
+func newDeltaResponseQueue(capacity int) *deltaResponseQueue {
+	return &deltaResponseQueue{
+		capacity: capacity,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// put queues resp, coalescing it with a queued response of the same type URL if the queue is full. It returns
+// true if resp was coalesced, leaving the number of queued responses unchanged.
+func (q *deltaResponseQueue) put(resp *discovery.DeltaDiscoveryResponse) (coalesced bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.responses) >= q.capacity {
+		for i, queued := range q.responses {
+			if queued.TypeUrl == resp.TypeUrl {
+				q.responses = append(q.responses[:i], q.responses[i+1:]...)
+				resp = mergeDeltaResponses(queued, resp)
+				coalesced = true
+				break
+			}
+		}
+	}
+	q.responses = append(q.responses, resp)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return coalesced
+}
+
+// pop returns the oldest queued response, or nil if the queue is empty.
+func (q *deltaResponseQueue) pop() *discovery.DeltaDiscoveryResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.popLocked()
+}
+
+func (q *deltaResponseQueue) popLocked() *discovery.DeltaDiscoveryResponse {
+	if len(q.responses) == 0 {
+		return nil
+	}
+	resp := q.responses[0]
+	q.responses[0] = nil
+	q.responses = q.responses[1:]
+	if len(q.responses) > 0 {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	return resp
+}
+
+func (q *deltaResponseQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.responses)
+}
+
+// pending returns the number of responses not yet received from the output of run, including the ones popped
+// by run.
+func (q *deltaResponseQueue) pending() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.responses) + q.inFlight
+}
+
+// received records that a response was received from the output of run.
+func (q *deltaResponseQueue) received() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inFlight > 0 {
+		q.inFlight--
+	}
+}
+
+// run forwards the queued responses to out, until stop is closed.
+func (q *deltaResponseQueue) run(out chan<- *discovery.DeltaDiscoveryResponse, stop <-chan struct{}) {
+	for {
+		select {
+		case <-q.notify:
+		case <-stop:
+			return
+		}
+		q.mu.Lock()
+		resp := q.popLocked()
+		if resp != nil {
+			q.inFlight++
+		}
+		q.mu.Unlock()
+		if resp == nil {
+			continue
+		}
+		select {
+		case out <- resp:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// mergeDeltaResponses returns a response with the changes of older followed by the changes of newer.
+// The nonce and versions of newer are used, so the ACK of the merged response acknowledges both.
+func mergeDeltaResponses(older, newer *discovery.DeltaDiscoveryResponse) *discovery.DeltaDiscoveryResponse {
+	updated := sets.NewWithLength[string](len(newer.Resources))
+	for _, r := range newer.Resources {
+		updated.Insert(r.Name)
+	}
+	removed := sets.New(newer.RemovedResources...)
+	merged := &discovery.DeltaDiscoveryResponse{
+		SystemVersionInfo: newer.SystemVersionInfo,
+		TypeUrl:           newer.TypeUrl,
+		Nonce:             newer.Nonce,
+		ControlPlane:      newer.ControlPlane,
+		Resources:         make([]*discovery.Resource, 0, len(older.Resources)+len(newer.Resources)),
+		RemovedResources:  append([]string{}, newer.RemovedResources...),
+	}
+	for _, r := range older.Resources {
+		if !updated.Contains(r.Name) && !removed.Contains(r.Name) {
+			merged.Resources = append(merged.Resources, r)
+		}
+	}
+	merged.Resources = append(merged.Resources, newer.Resources...)
+	for _, name := range older.RemovedResources {
+		if !updated.Contains(name) && !removed.Contains(name) {
+			merged.RemovedResources = append(merged.RemovedResources, name)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,91 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func deltaResponse(typeURL, nonce string, resources []string, removed ...string) *discovery.DeltaDiscoveryResponse {
+	return &discovery.DeltaDiscoveryResponse{
+		TypeUrl: typeURL,
+		Nonce:   nonce,
+		Resources: slices.Map(resources, func(name string) *discovery.Resource {
+			return &discovery.Resource{Name: name, Version: nonce}
+		}),
+		RemovedResources: removed,
+	}
+}
+
+func TestDeltaResponseQueue(t *testing.T) {
+	q := newDeltaResponseQueue(2)
+	q.put(deltaResponse(v3.ClusterType, "1", []string{"a", "b", "c"}, "x"))
+	q.put(deltaResponse(v3.EndpointType, "2", []string{"a"}))
+	// The queue is full, so the CDS responses are coalesced and the EDS response is not dropped.
+	q.put(deltaResponse(v3.ClusterType, "3", []string{"a", "x"}, "b"))
+	q.put(deltaResponse(v3.ListenerType, "4", []string{"l"}))
+	assert.Equal(t, q.len(), 3)
+
+	eds := q.pop()
+	assert.Equal(t, eds.TypeUrl, v3.EndpointType)
+	cds := q.pop()
+	assert.Equal(t, cds.Nonce, "3")
+	assert.Equal(t, slices.Map(cds.Resources, func(r *discovery.Resource) string {
+		return r.Name + "@" + r.Version
+	}), []string{"c@1", "a@3", "x@3"})
+	assert.Equal(t, cds.RemovedResources, []string{"b"})
+	assert.Equal(t, q.pop().TypeUrl, v3.ListenerType)
+	assert.Equal(t, q.pop() == nil, true)
+}
+
+// Validates the responses queued for a stalled Envoy stay bounded.
+func TestDeltaXdsResponseQueueBounded(t *testing.T) {
+	proxy := setupXdsProxyWithDownstreamOptions(t, []grpc.ServerOption{grpc.StreamInterceptor(xdstest.SlowServerInterceptor(time.Second, time.Second))})
+	proxy.deltaResponseQueueSize = 5
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithoutResponse(t, downstream)
+
+	var queue *deltaResponseQueue
+	retry.UntilSuccessOrFail(t, func() error {
+		proxy.connectedMutex.RLock()
+		defer proxy.connectedMutex.RUnlock()
+		if proxy.connected == nil {
+			return fmt.Errorf("not connected")
+		}
+		queue = proxy.connected.deltaResponseQueue
+		return nil
+	})
+	for i := 0; i < 50; i++ {
+		// These do not block, as the responses are queued and coalesced while Envoy is stalled.
+		f.SendDeltaResponse(deltaResponse(v3.ClusterType, fmt.Sprint(i), []string{"a", fmt.Sprintf("cluster-%d", i)}))
+		if l := queue.len(); l > proxy.deltaResponseQueueSize {
+			t.Fatalf("expected at most %d queued responses, got %d", proxy.deltaResponseQueueSize, l)
+		}
+	}
+}
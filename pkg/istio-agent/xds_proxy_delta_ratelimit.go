@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// deltaRequestLimiter throttles the delta requests sent to the upstream with a token bucket, so that a flapping
+// Envoy, for instance spamming NACKs, does not amplify the load on the upstream. Requests exceeding the rate are
+// held in order until tokens are available. A request identical to a held request of the same type URL is
+// coalesced with it, as sending it again would not change the state of the upstream.
+// It is only used by the goroutine sending the requests to the upstream.
+type deltaRequestLimiter struct {
+	limiter *rate.Limiter
+	pending []*discovery.DeltaDiscoveryRequest
+	// timer fires once a token is available for the oldest pending request. It is nil if nothing is pending.
+	timer *time.Timer
+}
+
+// newDeltaRequestLimiter returns a limiter allowing limit requests per second, with bursts of burst requests.
+// The burst defaults to the rate if it is not positive.
+func newDeltaRequestLimiter(limit float64, burst int) *deltaRequestLimiter {
+	if burst <= 0 {
+		burst = max(int(limit), 1)
+	}
+	return &deltaRequestLimiter{limiter: rate.NewLimiter(rate.Limit(limit), burst)}
+}
+
+// admit returns true if req can be sent now. Otherwise, req is held until release returns it, or dropped
+// if it is a duplicate of a held request.
+func (l *deltaRequestLimiter) admit(req *discovery.DeltaDiscoveryRequest) bool {
+	if len(l.pending) == 0 && l.limiter.Allow() {
+		return true
+	}
+	typ := v3.GetShortType(req.TypeUrl)
+	for _, held := range l.pending {
+		if held.TypeUrl == req.TypeUrl && proto.Equal(held, req) {
+			metrics.RecordRateLimitedRequest(typ, true)
+			return false
+		}
+	}
+	metrics.RecordRateLimitedRequest(typ, false)
+	l.pending = append(l.pending, req)
+	l.schedule()
+	return false
+}
+
+// ready returns a channel receiving once held requests can be released. It is nil if nothing is held,
+// including for a nil limiter, so it can always be selected on.
+func (l *deltaRequestLimiter) ready() <-chan time.Time {
+	if l == nil || l.timer == nil {
+		return nil
+	}
+	return l.timer.C
+}
+
+// release returns the held requests which can be sent now, in order, after ready fired.
+func (l *deltaRequestLimiter) release() []*discovery.DeltaDiscoveryRequest {
+	l.timer = nil
+	n := 0
+	for n < len(l.pending) && l.limiter.Allow() {
+		n++
+	}
+	released := l.pending[:n:n]
+	l.pending = l.pending[n:]
+	if len(l.pending) > 0 {
+		l.schedule()
+	}
+	return released
+}
+
+// schedule arms the timer for the next token, if it is not armed yet.
+func (l *deltaRequestLimiter) schedule() {
+	if l.timer != nil {
+		return
+	}
+	r := l.limiter.Reserve()
+	delay := r.Delay()
+	// The token is taken by release, once available.
+	r.Cancel()
+	l.timer = time.NewTimer(delay)
+}
+
+func (l *deltaRequestLimiter) stop() {
+	if l != nil && l.timer != nil {
+		l.timer.Stop()
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/monitoring/monitortest"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// Validates a burst of identical requests from Envoy is throttled and coalesced before reaching the upstream.
+func TestDeltaXdsProxyRateLimit(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxy(t)
+	proxy.upstreamRequestRate = 10
+	proxy.upstreamRequestBurst = 5
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	for i := 0; i < 100; i++ {
+		if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The burst is sent at once, then the delayed requests are released at the configured rate.
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := len(recorder.streamRequests(0)); sent <= 5 {
+			return fmt.Errorf("expected delayed requests to be released, got %d requests", sent)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	mt.Assert("xds_proxy_rate_limited_requests", map[string]string{"type": "CDS", "outcome": "coalesced"}, monitortest.AtLeast(50))
+	if sent := len(recorder.streamRequests(0)); sent > 20 {
+		t.Fatalf("expected the burst of 100 requests to be throttled, got %d requests upstream", sent)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"strconv"
+	"strings"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ParseResubscribeCodes parses a comma separated list of gRPC status codes, by name such as UNAVAILABLE or by number.
+func ParseResubscribeCodes(s string) []codes.Code {
+	var out []codes.Code
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		var c codes.Code
+		if c.UnmarshalJSON([]byte(strconv.Quote(name))) != nil && c.UnmarshalJSON([]byte(name)) != nil {
+			proxyLog.Warnf("ignoring invalid resubscribe gRPC status code %q", name)
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// resubscribeOn returns true if a failure of the upstream delta stream with err resubscribes to the resources tracked by
+// the proxy on a new stream.
+func (p *XdsProxy) resubscribeOn(err error) bool {
+	return p.resubscribeCodes.Contains(status.Code(err))
+}
+
+// resubscribeRequests turns the requests resuming the state of Envoy into a clean resubscription: the versions of the
+// resources known by Envoy are dropped, so the upstream sends all the subscribed resources again.
+func resubscribeRequests(reqs []*discovery.DeltaDiscoveryRequest) []*discovery.DeltaDiscoveryRequest {
+	for _, req := range reqs {
+		req.InitialResourceVersions = nil
+	}
+	return reqs
+}
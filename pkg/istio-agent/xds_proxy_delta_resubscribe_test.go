@@ -0,0 +1,103 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xds"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+	"istio.io/istio/pkg/util/sets"
+)
+
+func TestParseResubscribeCodes(t *testing.T) {
+	assert.Equal(t, ParseResubscribeCodes("UNAVAILABLE, aborted,13,unknown-code,99"),
+		[]codes.Code{codes.Unavailable, codes.Aborted, codes.Internal})
+}
+
+// Validates the delta xds proxy cleanly resubscribes to the resources of Envoy on a new upstream stream when the
+// upstream fails with one of the resubscribe codes, and forwards the other failures to Envoy.
+func TestDeltaXdsProxyResubscribe(t *testing.T) {
+	setup := func(t *testing.T, resubscribe ...codes.Code) (*upstreamKiller, discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient) {
+		proxy := setupXdsProxy(t)
+		proxy.resubscribeCodes = sets.New(resubscribe...)
+		proxy.deltaReconnectBackoff = time.Millisecond
+		f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+		setDialOptions(proxy, f.BufListener)
+		killer := &upstreamKiller{}
+		proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(killer.interceptor()))
+		conn := setupDownstreamConnection(t, proxy)
+		downstream := deltaStream(t, conn)
+		sendDeltaDownstreamWithNode(t, downstream, model.NodeMetadata{
+			Namespace:   "default",
+			InstanceIPs: []string{"1.1.1.1"},
+		})
+		return killer, downstream
+	}
+
+	t.Run("resubscribe", func(t *testing.T) {
+		killer, downstream := setup(t, codes.Unavailable)
+
+		// The upstream fails with Unavailable once.
+		killer.kill()
+
+		var resubscribed []*discovery.DeltaDiscoveryRequest
+		retry.UntilSuccessOrFail(t, func() error {
+			resubscribed = killer.streamRequests(1)
+			if len(resubscribed) < 2 {
+				return fmt.Errorf("expected the cluster and listener subscriptions to be resubscribed, got %v", resubscribed)
+			}
+			return nil
+		}, retry.Timeout(time.Second*5))
+		assert.Equal(t, resubscribed[0].TypeUrl, v3.ClusterType)
+		assert.Equal(t, resubscribed[0].Node.GetId(), "sidecar~1.1.1.1~debug~cluster.local")
+		assert.Equal(t, resubscribed[1].TypeUrl, v3.ListenerType)
+		for _, req := range resubscribed {
+			if len(req.InitialResourceVersions) != 0 {
+				t.Fatalf("expected a clean resubscription of %v, got versions %v", req.TypeUrl, req.InitialResourceVersions)
+			}
+		}
+
+		// The stream from Envoy is kept open, and receives the resources again from the new upstream.
+		res, err := downstream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, res.TypeUrl, v3.ClusterType)
+		if len(res.Resources) == 0 {
+			t.Fatalf("expected the clusters to be sent again")
+		}
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		killer, downstream := setup(t, codes.Aborted)
+
+		killer.kill()
+
+		if _, err := downstream.Recv(); err == nil {
+			t.Fatal("expected the upstream failure to be forwarded to Envoy")
+		}
+		assert.Equal(t, len(killer.streamRequests(1)), 0)
+	})
+}
@@ -0,0 +1,347 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/xds"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/channels"
+	"istio.io/istio/pkg/maps"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/util/sets"
+)
+
+// deltaFanout shares the upstream delta stream of a connection from Envoy, the primary, with the delta streams of
+// the other Envoys connecting meanwhile, the subscribers. The responses forwarded to the primary are fanned out to
+// each subscriber, filtered by the resources it subscribed to, and the latest resources of each type are kept so
+// subscribers joining late receive the current state. The subscriptions of the subscribers are added to the
+// upstream stream. The resource names are reference counted across the primary and the subscribers, so that a
+// name is only unsubscribed from upstream once none of them is subscribed to it anymore.
+type deltaFanout struct {
+	mu sync.Mutex
+	// resources are the latest resources forwarded to the primary, by type URL and name.
+	resources   map[string]map[string]*discovery.Resource
+	subscribers map[*deltaSubscriber]struct{}
+	// primary are the resource names the primary is subscribed to, by type URL.
+	primary map[string]sets.String
+	// refs are the numbers of streams, the primary and the subscribers, subscribed to each resource name, by
+	// type URL.
+	refs map[string]map[string]int
+}
+
+func newDeltaFanout() *deltaFanout {
+	return &deltaFanout{
+		resources:   map[string]map[string]*discovery.Resource{},
+		subscribers: map[*deltaSubscriber]struct{}{},
+		primary:     map[string]sets.String{},
+		refs:        map[string]map[string]int{},
+	}
+}
+
+// hold records a stream subscribing to name, and returns true if it is the first one. The caller must hold f.mu.
+func (f *deltaFanout) hold(typeURL, name string) bool {
+	refs := f.refs[typeURL]
+	if refs == nil {
+		refs = map[string]int{}
+		f.refs[typeURL] = refs
+	}
+	refs[name]++
+	return refs[name] == 1
+}
+
+// release records a stream unsubscribing from name, and returns true if it was the last one. The caller must
+// hold f.mu.
+func (f *deltaFanout) release(typeURL, name string) bool {
+	refs := f.refs[typeURL]
+	if refs[name] > 1 {
+		refs[name]--
+		return false
+	}
+	delete(refs, name)
+	return true
+}
+
+// deltaSubscriber is a delta stream from Envoy served by the upstream stream of another connection.
+type deltaSubscriber struct {
+	id uint32
+	// subscriptions are the resource names the subscriber is subscribed to, by type URL.
+	subscriptions map[string]sets.String
+	// wildcard is the set of type URLs the subscriber is subscribed to without resource names.
+	wildcard  sets.String
+	responses *channels.Unbounded[*discovery.DeltaDiscoveryResponse]
+	snapshots int
+}
+
+// wants returns true if the subscriber is subscribed to the resource of the given type and name.
+func (s *deltaSubscriber) wants(typeURL, name string) bool {
+	return s.wildcard.Contains(typeURL) || s.subscriptions[typeURL].Contains(name)
+}
+
+// filter returns the part of resp the subscriber is subscribed to, nil if none.
+func (s *deltaSubscriber) filter(resp *discovery.DeltaDiscoveryResponse) *discovery.DeltaDiscoveryResponse {
+	if _, f := s.subscriptions[resp.TypeUrl]; !f {
+		return nil
+	}
+	out := &discovery.DeltaDiscoveryResponse{
+		SystemVersionInfo: resp.SystemVersionInfo,
+		TypeUrl:           resp.TypeUrl,
+		Nonce:             resp.Nonce,
+		ControlPlane:      resp.ControlPlane,
+	}
+	for _, r := range resp.Resources {
+		if s.wants(resp.TypeUrl, r.Name) {
+			out.Resources = append(out.Resources, r)
+		}
+	}
+	for _, name := range resp.RemovedResources {
+		if s.wants(resp.TypeUrl, name) {
+			out.RemovedResources = append(out.RemovedResources, name)
+		}
+	}
+	if len(out.Resources) == 0 && len(out.RemovedResources) == 0 {
+		return nil
+	}
+	return out
+}
+
+func (f *deltaFanout) join(id uint32) *deltaSubscriber {
+	s := &deltaSubscriber{
+		id:            id,
+		subscriptions: map[string]sets.String{},
+		wildcard:      sets.New[string](),
+		responses:     channels.NewUnbounded[*discovery.DeltaDiscoveryResponse](),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers[s] = struct{}{}
+	return s
+}
+
+// leave removes s, and returns the requests unsubscribing upstream from the names no other stream is subscribed to.
+func (f *deltaFanout) leave(s *deltaSubscriber) []*discovery.DeltaDiscoveryRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, s)
+	var out []*discovery.DeltaDiscoveryRequest
+	typeURLs := maps.Keys(s.subscriptions)
+	slices.Sort(typeURLs)
+	for _, typeURL := range typeURLs {
+		var released []string
+		for name := range s.subscriptions[typeURL] {
+			if f.release(typeURL, name) {
+				released = append(released, name)
+			}
+		}
+		if len(released) > 0 {
+			slices.Sort(released)
+			out = append(out, &discovery.DeltaDiscoveryRequest{TypeUrl: typeURL, ResourceNamesUnsubscribe: released})
+		}
+	}
+	return out
+}
+
+// primarySubscribe applies the subscription changes of req, sent by the primary, to the reference counts. The
+// names the subscribers are still subscribed to are removed from the unsubscribed names of req, so that they keep
+// being received from upstream.
+func (f *deltaFanout) primarySubscribe(req *discovery.DeltaDiscoveryRequest) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := f.primary[req.TypeUrl]
+	if names == nil {
+		names = sets.New[string]()
+		f.primary[req.TypeUrl] = names
+	}
+	for _, name := range req.ResourceNamesSubscribe {
+		if name != "*" && !names.InsertContains(name) {
+			f.hold(req.TypeUrl, name)
+		}
+	}
+	if len(req.ResourceNamesUnsubscribe) == 0 {
+		return
+	}
+	unsubscribe := make([]string, 0, len(req.ResourceNamesUnsubscribe))
+	for _, name := range req.ResourceNamesUnsubscribe {
+		if name != "*" && names.Contains(name) {
+			names.Delete(name)
+			if !f.release(req.TypeUrl, name) {
+				continue
+			}
+		}
+		unsubscribe = append(unsubscribe, name)
+	}
+	req.ResourceNamesUnsubscribe = unsubscribe
+}
+
+// publish records resp, as forwarded to the primary, and fans it out to the subscribers.
+func (f *deltaFanout) publish(resp *discovery.DeltaDiscoveryResponse) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resources := f.resources[resp.TypeUrl]
+	if resources == nil {
+		resources = map[string]*discovery.Resource{}
+		f.resources[resp.TypeUrl] = resources
+	}
+	for _, r := range resp.Resources {
+		resources[r.Name] = r
+	}
+	for _, name := range resp.RemovedResources {
+		delete(resources, name)
+	}
+	for s := range f.subscribers {
+		if out := s.filter(resp); out != nil {
+			s.responses.Put(out)
+		}
+	}
+}
+
+// subscribe applies the subscription changes of req to s, and queues the known resources it newly subscribed to.
+// It returns the request changing the subscriptions of the upstream stream, nil if there are none: the names no
+// other stream was subscribed to are subscribed to, and the names no other stream is still subscribed to are
+// unsubscribed from.
+func (f *deltaFanout) subscribe(s *deltaSubscriber, req *discovery.DeltaDiscoveryRequest) *discovery.DeltaDiscoveryRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names, known := s.subscriptions[req.TypeUrl]
+	if !known {
+		names = sets.New[string]()
+		s.subscriptions[req.TypeUrl] = names
+	}
+	wildcard := !known && len(req.ResourceNamesSubscribe) == 0
+	added := sets.New[string]()
+	var subscribe, unsubscribe []string
+	for _, name := range req.ResourceNamesSubscribe {
+		if name == "*" {
+			wildcard = true
+		} else if !names.InsertContains(name) {
+			added.Insert(name)
+			if f.hold(req.TypeUrl, name) {
+				subscribe = append(subscribe, name)
+			}
+		}
+	}
+	for _, name := range req.ResourceNamesUnsubscribe {
+		if name == "*" {
+			s.wildcard.Delete(req.TypeUrl)
+		} else if names.Contains(name) {
+			names.Delete(name)
+			if f.release(req.TypeUrl, name) {
+				unsubscribe = append(unsubscribe, name)
+			}
+		}
+	}
+	slices.Sort(subscribe)
+	slices.Sort(unsubscribe)
+	// Only a new wildcard subscription changes what the subscriber receives.
+	wildcard = wildcard && !s.wildcard.InsertContains(req.TypeUrl)
+	if wildcard || added.Len() > 0 {
+		snapshot := &discovery.DeltaDiscoveryResponse{TypeUrl: req.TypeUrl}
+		for name, r := range f.resources[req.TypeUrl] {
+			if wildcard || added.Contains(name) {
+				snapshot.Resources = append(snapshot.Resources, r)
+			}
+		}
+		if len(snapshot.Resources) > 0 {
+			s.snapshots++
+			snapshot.Nonce = fmt.Sprintf("shared/%d/%d", s.id, s.snapshots)
+			s.responses.Put(snapshot)
+		}
+	}
+	if !wildcard && len(subscribe) == 0 && len(unsubscribe) == 0 {
+		return nil
+	}
+	// A request without resource names is a wildcard subscription if the upstream stream is not subscribed to the
+	// type yet, and a duplicate dropped by the primary otherwise.
+	return &discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  req.TypeUrl,
+		ResourceNamesSubscribe:   subscribe,
+		ResourceNamesUnsubscribe: unsubscribe,
+	}
+}
+
+// sharedDeltaPrimary returns the delta connection from Envoy whose upstream stream can be shared, if any.
+func (p *XdsProxy) sharedDeltaPrimary() *ProxyConnection {
+	p.connectedMutex.RLock()
+	defer p.connectedMutex.RUnlock()
+	if p.connected == nil || p.connected.fanout == nil || p.connected.isClosed() {
+		return nil
+	}
+	return p.connected
+}
+
+// serveSharedDelta serves the delta stream of an Envoy from the upstream stream of primary, until either the
+// stream or primary is closed. Envoy then reconnects, and is served by a new upstream stream if primary is gone.
+func (p *XdsProxy) serveSharedDelta(primary *ProxyConnection, downstream xds.DeltaDiscoveryStream) error {
+	s := primary.fanout.join(connectionNumber.Inc())
+	defer func() {
+		for _, req := range primary.fanout.leave(s) {
+			primary.sendDeltaRequest(req)
+		}
+	}()
+	log := newConnectionLogger(downstream.Context(), s.id).WithLabels("primary", primary.conID)
+	log.Infof("sharing the delta upstream stream of another Envoy")
+
+	failed := make(chan error, 2)
+	goDelta(func() {
+		for {
+			req, err := downstream.Recv()
+			if err != nil {
+				failed <- deltaRecvError(err)
+				return
+			}
+			// The subscribers are subject to the same policies as the primary.
+			if err := p.checkDownstreamDeltaRequest(log, req); err != nil {
+				failed <- err
+				return
+			}
+			if req.ResponseNonce != "" && req.ErrorDetail != nil {
+				log.WithLabels("type", v3.GetShortType(req.TypeUrl), "nonce", req.ResponseNonce).
+					Warnf("shared response rejected: %v", req.ErrorDetail.GetMessage())
+			}
+			if req.ResponseNonce != "" && len(req.ResourceNamesSubscribe) == 0 && len(req.ResourceNamesUnsubscribe) == 0 {
+				// The acknowledgements are sent upstream by the primary only.
+				continue
+			}
+			if upstream := primary.fanout.subscribe(s, req); upstream != nil {
+				primary.sendDeltaRequest(upstream)
+			}
+		}
+	})
+	for {
+		select {
+		case resp := <-s.responses.Get():
+			s.responses.Load()
+			if err := sendDownstreamDelta(downstream, resp); err != nil {
+				return err
+			}
+		case err := <-failed:
+			return err
+		case <-primary.stopChan:
+			return status.Error(codes.Unavailable, "shared upstream stream closed")
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+	"istio.io/istio/pkg/util/sets"
+)
+
+// Validates two Envoys share a single upstream stream, each receiving the pushes on it.
+func TestDeltaXdsProxySharedUpstream(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.sharedUpstream = true
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	first := deltaStream(t, conn)
+	if err := first.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := len(recorder.streamRequests(0)); sent == 0 {
+			return fmt.Errorf("expected the subscription to be forwarded upstream")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	second := deltaStream(t, conn)
+	if err := second.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	// Leave time for the second stream to join the first one.
+	time.Sleep(100 * time.Millisecond)
+
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ClusterType,
+		Nonce:   "nonce",
+		Resources: []*discovery.Resource{{
+			Name:     "outbound|80||foo.default.svc.cluster.local",
+			Resource: protoconv.MessageToAny(&cluster.Cluster{Name: "outbound|80||foo.default.svc.cluster.local"}),
+		}},
+	})
+	for _, downstream := range []discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient{first, second} {
+		resp, err := downstream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"outbound|80||foo.default.svc.cluster.local"})
+	}
+	recorder.mu.Lock()
+	streams := len(recorder.cancels)
+	recorder.mu.Unlock()
+	assert.Equal(t, streams, 1)
+}
+
+// Validates a resource the primary unsubscribes from is kept upstream while the other Envoy is subscribed to it.
+func TestDeltaXdsProxySharedUpstreamUnsubscribe(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.sharedUpstream = true
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	expectSent := func(n int) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			if sent := len(recorder.streamRequests(0)); sent != n {
+				return fmt.Errorf("expected %d requests upstream, got %d", n, sent)
+			}
+			return nil
+		}, retry.Timeout(time.Second*5))
+	}
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	primary := deltaStream(t, conn)
+	if err := primary.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		Node:                   node,
+		ResourceNamesSubscribe: []string{"a", "b"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(1)
+	subscriber := deltaStream(t, conn)
+	if err := subscriber.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		Node:                   node,
+		ResourceNamesSubscribe: []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Leave time for the subscriber to join, without adding any subscription upstream.
+	time.Sleep(100 * time.Millisecond)
+	expectSent(1)
+
+	// The primary unsubscribes from both resources, but only the one the subscriber does not hold is unsubscribed.
+	if err := primary.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.EndpointType,
+		ResourceNamesUnsubscribe: []string{"a", "b"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(2)
+	assert.Equal(t, recorder.streamRequests(0)[1].ResourceNamesUnsubscribe, []string{"b"})
+
+	// The subscriber keeps receiving the resource.
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.EndpointType,
+		Nonce:     "nonce",
+		Resources: []*discovery.Resource{{Name: "a"}},
+	})
+	resp, err := subscriber.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"a"})
+
+	// Once the subscriber unsubscribes too, the resource is unsubscribed from upstream.
+	if err := subscriber.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.EndpointType,
+		ResourceNamesUnsubscribe: []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		sent := recorder.streamRequests(0)
+		for _, req := range sent[2:] {
+			if slices.Equal(req.ResourceNamesUnsubscribe, []string{"a"}) {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected the resource to be unsubscribed from upstream, got %v", sent[2:])
+	}, retry.Timeout(time.Second*5))
+}
+
+func TestDeltaFanoutReferenceCounts(t *testing.T) {
+	f := newDeltaFanout()
+	primary := &discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType, ResourceNamesSubscribe: []string{"a", "b"}}
+	f.primarySubscribe(primary)
+	assert.Equal(t, primary.ResourceNamesSubscribe, []string{"a", "b"})
+	s := f.join(1)
+
+	// Only the names no other stream is subscribed to are subscribed to upstream.
+	upstream := f.subscribe(s, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType, ResourceNamesSubscribe: []string{"a", "c"}})
+	assert.Equal(t, upstream.ResourceNamesSubscribe, []string{"c"})
+
+	// The names a subscriber still holds are not unsubscribed from upstream.
+	unsubscribe := &discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType, ResourceNamesUnsubscribe: []string{"a", "b", "*"}}
+	f.primarySubscribe(unsubscribe)
+	assert.Equal(t, unsubscribe.ResourceNamesUnsubscribe, []string{"b", "*"})
+
+	// Once the subscriber leaves, the names no other stream holds are unsubscribed from upstream.
+	upstream = f.subscribe(s, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType, ResourceNamesUnsubscribe: []string{"c"}})
+	assert.Equal(t, upstream.ResourceNamesSubscribe, nil)
+	assert.Equal(t, upstream.ResourceNamesUnsubscribe, []string{"c"})
+	left := f.leave(s)
+	assert.Equal(t, len(left), 1)
+	assert.Equal(t, left[0].ResourceNamesUnsubscribe, []string{"a"})
+}
+
+func TestDeltaFanoutSubscriptions(t *testing.T) {
+	f := newDeltaFanout()
+	resource := func(name string) *discovery.Resource {
+		return &discovery.Resource{Name: name}
+	}
+	f.publish(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.EndpointType,
+		Resources: []*discovery.Resource{resource("a"), resource("b")},
+	})
+	s := f.join(1)
+	names := func() sets.String {
+		resp := <-s.responses.Get()
+		s.responses.Load()
+		return sets.New(slices.Map(resp.Resources, (*discovery.Resource).GetName)...)
+	}
+
+	// The known resources newly subscribed to are sent at once, and the new subscriptions added upstream.
+	upstream := f.subscribe(s, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType, ResourceNamesSubscribe: []string{"a", "c"}})
+	assert.Equal(t, upstream.ResourceNamesSubscribe, []string{"a", "c"})
+	assert.Equal(t, names(), sets.New("a"))
+	if upstream := f.subscribe(s, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType, ResourceNamesSubscribe: []string{"a"}}); upstream != nil {
+		t.Fatalf("expected no upstream request for known subscriptions, got %v", upstream)
+	}
+
+	// The pushes are filtered by the subscriptions.
+	f.publish(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:          v3.EndpointType,
+		Resources:        []*discovery.Resource{resource("b"), resource("c")},
+		RemovedResources: []string{"a"},
+	})
+	resp := <-s.responses.Get()
+	s.responses.Load()
+	assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"c"})
+	assert.Equal(t, resp.RemovedResources, []string{"a"})
+}
@@ -0,0 +1,238 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	"istio.io/istio/pkg/istio-agent/metrics"
+	"istio.io/istio/pkg/util/sets"
+)
+
+// deltaToSotwTranslator allows serving a delta xDS stream from Envoy with a state of the world upstream.
+// Delta requests are converted to SotW requests carrying the full set of subscribed resources, and
+// SotW responses are converted to delta responses, computing the removed resources from the
+// resources previously sent downstream.
+type deltaToSotwTranslator struct {
+	mu    sync.Mutex
+	types map[string]*sotwTypeState
+}
+
+// sotwTypeState is the translation state of a single type URL.
+type sotwTypeState struct {
+	// subscribed is the set of resource names requested by Envoy, besides the wildcard subscription.
+	subscribed sets.String
+	// wildcard is true while Envoy is subscribed to all the resources of the type, as tracked by deltaSubscriptions.
+	// requested is set once the first request of the type is received.
+	wildcard  bool
+	requested bool
+	// resources is the set of resource names most recently sent to Envoy.
+	resources sets.String
+	// ackedVersion is the version of the last response accepted by Envoy.
+	ackedVersion string
+	// lastNonce and lastVersion identify the last response sent to Envoy.
+	lastNonce   string
+	lastVersion string
+}
+
+func newDeltaToSotwTranslator() *deltaToSotwTranslator {
+	return &deltaToSotwTranslator{types: map[string]*sotwTypeState{}}
+}
+
+func (t *deltaToSotwTranslator) state(typeURL string) *sotwTypeState {
+	st, f := t.types[typeURL]
+	if !f {
+		st = &sotwTypeState{
+			subscribed: sets.New[string](),
+			resources:  sets.New[string](),
+		}
+		t.types[typeURL] = st
+	}
+	return st
+}
+
+// toSotwRequest converts a delta request from Envoy into the equivalent SotW request.
+func (t *deltaToSotwTranslator) toSotwRequest(req *discovery.DeltaDiscoveryRequest) *discovery.DiscoveryRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.state(req.TypeUrl)
+	// On reconnection, Envoy reports the resources it already has. Track them so they are removed
+	// if they are no longer present upstream.
+	for name := range req.InitialResourceVersions {
+		st.resources.Insert(name)
+	}
+	if !st.requested {
+		// The first request of a type without resource names is a wildcard subscription.
+		st.requested = true
+		st.wildcard = len(req.ResourceNamesSubscribe) == 0
+	}
+	for _, name := range req.ResourceNamesSubscribe {
+		if name == "*" {
+			st.wildcard = true
+		} else {
+			st.subscribed.Insert(name)
+		}
+	}
+	for _, name := range req.ResourceNamesUnsubscribe {
+		if name == "*" {
+			st.wildcard = false
+		} else {
+			st.subscribed.Delete(name)
+		}
+	}
+	if req.ResponseNonce != "" && req.ResponseNonce == st.lastNonce && req.ErrorDetail == nil {
+		st.ackedVersion = st.lastVersion
+	}
+	return &discovery.DiscoveryRequest{
+		Node:          req.Node,
+		TypeUrl:       req.TypeUrl,
+		VersionInfo:   st.ackedVersion,
+		ResourceNames: st.resourceNames(),
+		ResponseNonce: req.ResponseNonce,
+		ErrorDetail:   req.ErrorDetail,
+	}
+}
+
+// resourceNames returns the resource names of the SotW requests. The wildcard subscription is explicit, so that it
+// is kept along with resource names, and so that a request without resource names after the first one is an
+// explicit subscription to no resources rather than a wildcard subscription.
+func (st *sotwTypeState) resourceNames() []string {
+	names := sets.SortedList(st.subscribed)
+	if st.wildcard {
+		names = append([]string{"*"}, names...)
+	}
+	return names
+}
+
+// toDeltaResponse converts a SotW response from the upstream into the equivalent delta response.
+func (t *deltaToSotwTranslator) toDeltaResponse(resp *discovery.DiscoveryResponse) *discovery.DeltaDiscoveryResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.state(resp.TypeUrl)
+	current := sets.NewWithLength[string](len(resp.Resources))
+	resources := make([]*discovery.Resource, 0, len(resp.Resources))
+	for _, r := range resp.Resources {
+		name := xdsResourceName(r)
+		current.Insert(name)
+		resources = append(resources, &discovery.Resource{
+			Name:     name,
+			Version:  resp.VersionInfo,
+			Resource: r,
+		})
+	}
+	removed := sets.SortedList(st.resources.Difference(current))
+	st.resources = current
+	st.lastNonce = resp.Nonce
+	st.lastVersion = resp.VersionInfo
+	return &discovery.DeltaDiscoveryResponse{
+		SystemVersionInfo: resp.VersionInfo,
+		Resources:         resources,
+		TypeUrl:           resp.TypeUrl,
+		RemovedResources:  removed,
+		Nonce:             resp.Nonce,
+		ControlPlane:      resp.ControlPlane,
+	}
+}
+
+// xdsResourceName returns the name of a xDS resource, or an empty string if it has no name.
+func xdsResourceName(r *anypb.Any) string {
+	msg, err := r.UnmarshalNew()
+	if err != nil {
+		proxyLog.Debugf("failed to decode resource of type %s: %v", r.TypeUrl, err)
+		return ""
+	}
+	switch m := msg.(type) {
+	case *endpoint.ClusterLoadAssignment:
+		return m.GetClusterName()
+	case interface{ GetName() string }:
+		return m.GetName()
+	default:
+		return ""
+	}
+}
+
+// handleDeltaToSotwUpstream serves the delta stream from Envoy with a SotW stream to the upstream.
+// Requests and responses are translated on the way, so the rest of the delta proxy is unchanged.
+func (p *XdsProxy) handleDeltaToSotwUpstream(ctx context.Context, con *ProxyConnection, xds discovery.AggregatedDiscoveryServiceClient) error {
+	log := con.logger()
+	upstream, err := xds.StreamAggregatedResources(ctx,
+		grpc.MaxCallRecvMsgSize(defaultClientMaxReceiveMessageSize))
+	if err != nil {
+		// Envoy logs errors again, so no need to log beyond debug level
+		log.Debugf("failed to create upstream grpc client: %v", err)
+		metrics.IstiodConnectionErrors.Increment()
+		return err
+	}
+	log.Infof("connected to upstream XDS server, translating delta to SotW: %s", p.activeUpstreamAddress())
+	p.upstreamHealth.connected(con.conID)
+	goDelta(func() { p.recordUpstreamHeaders(con, upstream) })
+	metrics.DeltaStreamOpened(metrics.Upstream)
+	defer metrics.DeltaStreamClosed(metrics.Upstream)
+	defer log.Debugf("disconnected from XDS server: %s", p.activeUpstreamAddress())
+
+	con.upstream = upstream
+	con.deltaToSotw = newDeltaToSotwTranslator()
+
+	// handle responses from upstream
+	goDelta(func() {
+		for {
+			resp, err := con.upstream.Recv()
+			if err != nil {
+				upstreamErr(con, err)
+				return
+			}
+			con.upstreamReceived()
+			p.recordControlPlane(con, resp.ControlPlane)
+			con.bytes.record(metrics.UpstreamReceived, resp.TypeUrl, resp)
+			con.sendDeltaResponse(con.deltaToSotw.toDeltaResponse(resp))
+		}
+	})
+
+	goDelta(func() { p.handleUpstreamDeltaRequest(con, nil) })
+	goDelta(func() { p.handleUpstreamDeltaResponse(con) })
+
+	// The translation is not resumed on a new upstream stream, so the stream of Envoy is closed once the upstream
+	// is idle, for Envoy to reconnect.
+	idle := p.newUpstreamIdleTimer(con)
+	defer idle.stop()
+	for {
+		select {
+		case err := <-con.upstreamError:
+			return err
+		case <-idle.C():
+			if err := idle.expired(); err != nil {
+				log.Infof("%v", err)
+				return err
+			}
+		case err := <-con.downstreamError:
+			if err == io.EOF && con.deltaFlush != nil {
+				// Envoy gracefully closed its stream, but can still receive the responses already queued.
+				p.flushDeltaResponses(con)
+			}
+			// On downstream error, we will return. This propagates the error to downstream envoy which will trigger reconnect
+			return err
+		case <-con.stopChan:
+			log.Debugf("upstream stopped")
+			return nil
+		}
+	}
+}
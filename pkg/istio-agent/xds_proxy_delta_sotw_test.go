@@ -0,0 +1,174 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xds"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+func clusterResources(names ...string) []*anypb.Any {
+	return slices.Map(names, func(name string) *anypb.Any {
+		return protoconv.MessageToAny(&cluster.Cluster{Name: name})
+	})
+}
+
+func TestDeltaToSotwTranslator(t *testing.T) {
+	tr := newDeltaToSotwTranslator()
+
+	// Initial wildcard request
+	req := tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType})
+	assert.Equal(t, req.TypeUrl, v3.ClusterType)
+	assert.Equal(t, req.VersionInfo, "")
+	assert.Equal(t, req.ResourceNames, []string{"*"})
+
+	// Clusters are added
+	resp := tr.toDeltaResponse(&discovery.DiscoveryResponse{
+		TypeUrl:     v3.ClusterType,
+		VersionInfo: "v1",
+		Nonce:       "n1",
+		Resources:   clusterResources("a", "b"),
+	})
+	assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"a", "b"})
+	assert.Equal(t, len(resp.RemovedResources), 0)
+	assert.Equal(t, resp.Nonce, "n1")
+
+	// ACK carries the accepted version
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "n1"})
+	assert.Equal(t, req.VersionInfo, "v1")
+	assert.Equal(t, req.ResponseNonce, "n1")
+
+	// A cluster is removed
+	resp = tr.toDeltaResponse(&discovery.DiscoveryResponse{
+		TypeUrl:     v3.ClusterType,
+		VersionInfo: "v2",
+		Nonce:       "n2",
+		Resources:   clusterResources("a"),
+	})
+	assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"a"})
+	assert.Equal(t, resp.RemovedResources, []string{"b"})
+
+	// NACK keeps the previously accepted version
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:       v3.ClusterType,
+		ResponseNonce: "n2",
+		ErrorDetail:   &google_rpc.Status{Message: "rejected"},
+	})
+	assert.Equal(t, req.VersionInfo, "v1")
+	assert.Equal(t, req.ErrorDetail.GetMessage(), "rejected")
+
+	// The cluster is added back
+	resp = tr.toDeltaResponse(&discovery.DiscoveryResponse{
+		TypeUrl:     v3.ClusterType,
+		VersionInfo: "v3",
+		Nonce:       "n3",
+		Resources:   clusterResources("a", "b"),
+	})
+	assert.Equal(t, slices.Map(resp.Resources, (*discovery.Resource).GetName), []string{"a", "b"})
+	assert.Equal(t, len(resp.RemovedResources), 0)
+}
+
+func TestDeltaToSotwTranslatorSubscriptions(t *testing.T) {
+	tr := newDeltaToSotwTranslator()
+	req := tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		ResourceNamesSubscribe: []string{"b", "a"},
+	})
+	assert.Equal(t, req.ResourceNames, []string{"a", "b"})
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.EndpointType,
+		ResourceNamesSubscribe:   []string{"c"},
+		ResourceNamesUnsubscribe: []string{"a"},
+	})
+	assert.Equal(t, req.ResourceNames, []string{"b", "c"})
+
+	// Resources Envoy already has on reconnection are removed if they are gone upstream.
+	tr = newDeltaToSotwTranslator()
+	tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                 v3.ClusterType,
+		InitialResourceVersions: map[string]string{"a": "v1", "stale": "v1"},
+	})
+	resp := tr.toDeltaResponse(&discovery.DiscoveryResponse{
+		TypeUrl:     v3.ClusterType,
+		VersionInfo: "v2",
+		Nonce:       "n1",
+		Resources:   clusterResources("a"),
+	})
+	assert.Equal(t, resp.RemovedResources, []string{"stale"})
+}
+
+func TestDeltaToSotwTranslatorWildcard(t *testing.T) {
+	// The wildcard subscription is kept along with an explicit name, until it is unsubscribed from.
+	tr := newDeltaToSotwTranslator()
+	req := tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType})
+	assert.Equal(t, req.ResourceNames, []string{"*"})
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.ClusterType,
+		ResourceNamesSubscribe: []string{"a"},
+	})
+	assert.Equal(t, req.ResourceNames, []string{"*", "a"})
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.ClusterType,
+		ResourceNamesUnsubscribe: []string{"*"},
+	})
+	assert.Equal(t, req.ResourceNames, []string{"a"})
+
+	// Unsubscribing from all the names is not a wildcard subscription.
+	tr = newDeltaToSotwTranslator()
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		ResourceNamesSubscribe: []string{"a"},
+	})
+	assert.Equal(t, req.ResourceNames, []string{"a"})
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.EndpointType,
+		ResourceNamesUnsubscribe: []string{"a"},
+	})
+	assert.Equal(t, len(req.ResourceNames), 0)
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType})
+	assert.Equal(t, len(req.ResourceNames), 0)
+
+	// The wildcard subscription may also be requested explicitly.
+	req = tr.toSotwRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		ResourceNamesSubscribe: []string{"*"},
+	})
+	assert.Equal(t, req.ResourceNames, []string{"*"})
+}
+
+// Validates the delta xds proxy flow when the upstream is only used with SotW.
+func TestDeltaToSotwXdsProxyBasicFlow(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.deltaToSotw = true
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Field numbers of the repeated fields of DeltaDiscoveryResponse, to compute the size of their elements.
+const (
+	deltaResourcesField        = 2
+	deltaRemovedResourcesField = 6
+)
+
+// splitDeltaResponse splits resp into responses whose size does not exceed maxSize, unless a single resource is
+// larger. The resources and removed resources are spread over the chunks in order, and each chunk carries the type
+// and the system version of resp. The last chunk keeps the nonce of resp, so that the upstream only sees its ACK;
+// the other chunks get a nonce derived from it. If resp fits, or maxSize is not positive, it is returned as is.
+func splitDeltaResponse(resp *discovery.DeltaDiscoveryResponse, maxSize int) []*discovery.DeltaDiscoveryResponse {
+	if maxSize <= 0 || proto.Size(resp) <= maxSize {
+		return []*discovery.DeltaDiscoveryResponse{resp}
+	}
+	newChunk := func() *discovery.DeltaDiscoveryResponse {
+		return &discovery.DeltaDiscoveryResponse{
+			SystemVersionInfo: resp.SystemVersionInfo,
+			TypeUrl:           resp.TypeUrl,
+			ControlPlane:      resp.ControlPlane,
+		}
+	}
+	// Reserve room for the nonce, which is only known once all chunks are built.
+	overhead := proto.Size(newChunk()) + protowire.SizeTag(5) + protowire.SizeBytes(len(resp.Nonce)+8)
+
+	var chunks []*discovery.DeltaDiscoveryResponse
+	cur, size := newChunk(), overhead
+	add := func(s int) {
+		if size+s > maxSize && size > overhead {
+			chunks = append(chunks, cur)
+			cur, size = newChunk(), overhead
+		}
+		size += s
+	}
+	for _, r := range resp.Resources {
+		add(protowire.SizeTag(deltaResourcesField) + protowire.SizeBytes(proto.Size(r)))
+		cur.Resources = append(cur.Resources, r)
+	}
+	for _, name := range resp.RemovedResources {
+		add(protowire.SizeTag(deltaRemovedResourcesField) + protowire.SizeBytes(len(name)))
+		cur.RemovedResources = append(cur.RemovedResources, name)
+	}
+	chunks = append(chunks, cur)
+
+	for i, chunk := range chunks {
+		if i == len(chunks)-1 {
+			chunk.Nonce = resp.Nonce
+		} else {
+			chunk.Nonce = fmt.Sprintf("%s/%d", resp.Nonce, i)
+		}
+	}
+	return chunks
+}
+
+// deltaSplitTracker tracks the responses split into chunks before being forwarded to Envoy, so that the ACKs of
+// the chunks are merged into a single ACK or NACK of the original response for the upstream.
+type deltaSplitTracker struct {
+	mu sync.Mutex
+	// splits are the split responses not acknowledged yet, by the nonce of each of their chunks.
+	splits map[string]*splitResponse
+}
+
+type splitResponse struct {
+	// nonce is the nonce of the original response, kept by its last chunk.
+	nonce  string
+	chunks []string
+	// nack is the error of the first NACKed chunk, if any.
+	nack *google_rpc.Status
+}
+
+func newDeltaSplitTracker() *deltaSplitTracker {
+	return &deltaSplitTracker{splits: map[string]*splitResponse{}}
+}
+
+// sent records the chunks of a response forwarded to Envoy.
+func (t *deltaSplitTracker) sent(chunks []*discovery.DeltaDiscoveryResponse) {
+	if len(chunks) < 2 {
+		return
+	}
+	s := &splitResponse{nonce: chunks[len(chunks)-1].Nonce}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, chunk := range chunks {
+		s.chunks = append(s.chunks, chunk.Nonce)
+		t.splits[chunk.Nonce] = s
+	}
+}
+
+// received returns the request to forward upstream for req. The ACKs of the chunks preceding the last one are
+// dropped, while their NACKs are reported on the ACK of the last chunk, which acknowledges the original response.
+// If the ACK of a chunk also changes the subscriptions, it is forwarded as a plain subscription request.
+// nil is returned if there is nothing to forward.
+func (t *deltaSplitTracker) received(req *discovery.DeltaDiscoveryRequest) *discovery.DeltaDiscoveryRequest {
+	if req.ResponseNonce == "" {
+		return req
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, f := t.splits[req.ResponseNonce]
+	if !f {
+		return req
+	}
+	if req.ResponseNonce != s.nonce {
+		delete(t.splits, req.ResponseNonce)
+		if req.ErrorDetail != nil && s.nack == nil {
+			s.nack = req.ErrorDetail
+		}
+		if len(req.ResourceNamesSubscribe) == 0 && len(req.ResourceNamesUnsubscribe) == 0 {
+			return nil
+		}
+		req = proto.Clone(req).(*discovery.DeltaDiscoveryRequest)
+		req.ResponseNonce = ""
+		req.ErrorDetail = nil
+		return req
+	}
+	for _, nonce := range s.chunks {
+		delete(t.splits, nonce)
+	}
+	if req.ErrorDetail == nil && s.nack != nil {
+		req = proto.Clone(req).(*discovery.DeltaDiscoveryRequest)
+		req.ErrorDetail = s.nack
+	}
+	return req
+}
@@ -0,0 +1,169 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func largeClusterResponse(n int) *discovery.DeltaDiscoveryResponse {
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		names = append(names, fmt.Sprintf("outbound|80||service-%d.default.svc.cluster.local", i))
+	}
+	return &discovery.DeltaDiscoveryResponse{
+		TypeUrl:           v3.ClusterType,
+		SystemVersionInfo: "v1",
+		Nonce:             "n1",
+		Resources: slices.Map(clusterResources(names...), func(r *anypb.Any) *discovery.Resource {
+			return &discovery.Resource{Name: xdsResourceName(r), Version: "v1", Resource: r}
+		}),
+		RemovedResources: []string{"removed-1", "removed-2"},
+	}
+}
+
+func TestSplitDeltaResponse(t *testing.T) {
+	resp := largeClusterResponse(100)
+	assert.Equal(t, splitDeltaResponse(resp, 0), []*discovery.DeltaDiscoveryResponse{resp})
+	assert.Equal(t, splitDeltaResponse(resp, proto.Size(resp)), []*discovery.DeltaDiscoveryResponse{resp})
+
+	maxSize := proto.Size(resp) / 4
+	chunks := splitDeltaResponse(resp, maxSize)
+	if len(chunks) < 4 {
+		t.Fatalf("expected at least 4 chunks, got %d", len(chunks))
+	}
+	var resources []*discovery.Resource
+	var removed []string
+	nonces := map[string]bool{}
+	for i, chunk := range chunks {
+		if size := proto.Size(chunk); size > maxSize {
+			t.Errorf("chunk %d has size %d, above %d", i, size, maxSize)
+		}
+		assert.Equal(t, chunk.TypeUrl, resp.TypeUrl)
+		assert.Equal(t, chunk.SystemVersionInfo, resp.SystemVersionInfo)
+		nonces[chunk.Nonce] = true
+		resources = append(resources, chunk.Resources...)
+		removed = append(removed, chunk.RemovedResources...)
+	}
+	assert.Equal(t, len(nonces), len(chunks))
+	assert.Equal(t, chunks[len(chunks)-1].Nonce, resp.Nonce)
+	assert.Equal(t, resources, resp.Resources)
+	assert.Equal(t, removed, resp.RemovedResources)
+
+	// A single resource above the limit is sent in its own chunk.
+	chunks = splitDeltaResponse(resp, 1)
+	assert.Equal(t, len(chunks), len(resp.Resources)+len(resp.RemovedResources))
+}
+
+func TestDeltaSplitTracker(t *testing.T) {
+	chunks := splitDeltaResponse(largeClusterResponse(10), 1)
+	last := chunks[len(chunks)-1]
+	nack := &google_rpc.Status{Message: "rejected"}
+
+	tr := newDeltaSplitTracker()
+	tr.sent(chunks)
+	if got := tr.received(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: chunks[0].Nonce}); got != nil {
+		t.Fatalf("expected the ACK of a chunk to be dropped, got %v", got)
+	}
+	if got := tr.received(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: chunks[1].Nonce, ErrorDetail: nack}); got != nil {
+		t.Fatalf("expected the NACK of a chunk to be dropped, got %v", got)
+	}
+	sub := tr.received(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.ClusterType,
+		ResponseNonce:          chunks[2].Nonce,
+		ResourceNamesSubscribe: []string{"a"},
+	})
+	assert.Equal(t, sub, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResourceNamesSubscribe: []string{"a"}})
+	// The NACK of a chunk is reported with the ACK of the last chunk.
+	got := tr.received(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: last.Nonce})
+	assert.Equal(t, got, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: last.Nonce, ErrorDetail: nack})
+	assert.Equal(t, len(tr.splits), 0)
+
+	// Requests unrelated to a split response are forwarded as is.
+	req := &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "other"}
+	assert.Equal(t, tr.received(req), req)
+}
+
+// Validates an oversized response from the upstream reaches Envoy as several chunks under the size limit, and the
+// upstream only receives the ACK of the original response.
+func TestDeltaXdsProxySplitsResponses(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	resp := largeClusterResponse(100)
+	proxy.maxDeltaResponseSize = proto.Size(resp) / 3
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.SendDeltaResponse(resp)
+	var resources []*discovery.Resource
+	var removed []string
+	for {
+		chunk, err := downstream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := proto.Size(chunk); size > proxy.maxDeltaResponseSize {
+			t.Fatalf("got chunk of size %d, above %d", size, proxy.maxDeltaResponseSize)
+		}
+		resources = append(resources, chunk.Resources...)
+		removed = append(removed, chunk.RemovedResources...)
+		if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: chunk.Nonce}); err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Nonce == resp.Nonce {
+			break
+		}
+	}
+	assert.Equal(t, len(resources), len(resp.Resources))
+	for i := range resources {
+		assert.Equal(t, resources[i].Name, resp.Resources[i].Name)
+	}
+	assert.Equal(t, removed, resp.RemovedResources)
+
+	retry.UntilSuccessOrFail(t, func() error {
+		var acks []string
+		for _, req := range recorder.streamRequests(0) {
+			if req.ResponseNonce != "" {
+				acks = append(acks, req.ResponseNonce)
+			}
+		}
+		if len(acks) != 1 || acks[0] != resp.Nonce {
+			return fmt.Errorf("expected a single ACK of %q upstream, got %v", resp.Nonce, acks)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+}
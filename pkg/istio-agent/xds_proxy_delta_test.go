@@ -15,9 +15,17 @@
 package istioagent
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
 	"os"
 	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,17 +33,29 @@ import (
 	wasm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
 	wasmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/wasm/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/atomic"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/util/protoconv"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pilot/test/xds"
 	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/log"
+	"istio.io/istio/pkg/monitoring/monitortest"
+	"istio.io/istio/pkg/slices"
 	"istio.io/istio/pkg/test/env"
 	"istio.io/istio/pkg/test/util/assert"
 	"istio.io/istio/pkg/test/util/retry"
+	"istio.io/istio/pkg/util/sets"
+	wasmcache "istio.io/istio/pkg/wasm"
 )
 
 // TestXdsLeak is a regression test for https://github.com/istio/istio/issues/34097
@@ -132,6 +152,7 @@ func TestDeltaECDSWasmConversion(t *testing.T) {
 	// Reset wasm cache to a fake ACK cache.
 	proxy.wasmCache.Cleanup()
 	proxy.wasmCache = &fakeAckCache{}
+	logs := captureJSONLogs(t)
 
 	// Initialize discovery server with an ECDS resource.
 	ef, err := os.ReadFile(path.Join(env.IstioSrc, "pilot/pkg/xds/testdata/ecds.yaml"))
@@ -195,6 +216,20 @@ func TestDeltaECDSWasmConversion(t *testing.T) {
 	if !proto.Equal(gotEcdsConfig, wantEcdsConfig) {
 		t.Errorf("xds proxy wasm config conversion got %v want %v", gotEcdsConfig, wantEcdsConfig)
 	}
+	// The rewrite is reported as a structured event.
+	var rewrites []map[string]any
+	for _, entry := range logs() {
+		if entry["scope"] == wasmRewriteLog.Name() {
+			rewrites = append(rewrites, entry)
+		}
+	}
+	if len(rewrites) != 1 {
+		t.Fatalf("expected one wasm rewrite event, got %v", rewrites)
+	}
+	assert.Equal(t, rewrites[0]["extension"], "extension-config")
+	assert.Equal(t, rewrites[0]["url"], "https://test-url")
+	assert.Equal(t, rewrites[0]["path"], "test")
+	assert.Equal(t, rewrites[0]["result"], wasmRewriteFetched)
 	n1 := proxy.ecdsLastNonce
 
 	// reset wasm cache to a NACK cache, and recreate xds server as well to simulate a version bump
@@ -226,4 +261,1229 @@ func TestDeltaECDSWasmConversion(t *testing.T) {
 		}
 		return nil
 	}, retry.Timeout(time.Second), retry.Delay(time.Millisecond))
+
+	// The reason of the NACK is exposed on the debug endpoint.
+	nack := proxy.ecdsLastNack.Load()
+	if nack == nil {
+		t.Fatal("expected the ecds nack to be recorded")
+	}
+	assert.Equal(t, nack.Resources, []string{"extension-config"})
+	assert.Equal(t, nack.Nonce, proxy.ecdsLastNonce.Load())
+	rec := httptest.NewRecorder()
+	proxy.ecdsz(rec, nil)
+	if !strings.Contains(rec.Body.String(), "extension-config") || !strings.Contains(rec.Body.String(), "cannot fetch Wasm module https://test-url") {
+		t.Errorf("ecdsz output %v does not contain the last nack %+v", rec.Body.String(), nack)
+	}
+}
+
+func TestDeltaECDSWasmConversionRetry(t *testing.T) {
+	node := model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+		ClusterID:   "Kubernetes",
+	}
+	proxy := setupXdsProxy(t)
+	// Reset wasm cache to a cache which fails twice before succeeding.
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = &fakeFlakyCache{failures: atomic.NewInt32(2)}
+	proxy.wasmFetchMaxAttempts = 3
+	proxy.wasmFetchInitialBackoff = time.Millisecond
+
+	ef, err := os.ReadFile(path.Join(env.IstioSrc, "pilot/pkg/xds/testdata/ecds.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{
+		ConfigString: string(ef),
+	})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	err = downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.ExtensionConfigurationType,
+		ResourceNamesSubscribe: []string{"extension-config"},
+		Node: &core.Node{
+			Id:       "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: node.ToStruct(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response is held back while retrying, and forwarded once the fetch succeeds instead of being NACKed.
+	gotResp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotResp.Resources) != 1 {
+		t.Fatalf("xds proxy ecds wasm conversion number of received resource got %v want 1", len(gotResp.Resources))
+	}
+	gotEcdsConfig := &core.TypedExtensionConfig{}
+	if err := gotResp.Resources[0].Resource.UnmarshalTo(gotEcdsConfig); err != nil {
+		t.Fatalf("wasm config conversion output %v failed to unmarshal", gotResp.Resources[0])
+	}
+	gotWasm := &wasm.Wasm{}
+	if err := gotEcdsConfig.TypedConfig.UnmarshalTo(gotWasm); err != nil {
+		t.Fatalf("wasm config conversion output %v failed to unmarshal", gotEcdsConfig)
+	}
+	assert.Equal(t, gotWasm.GetConfig().GetVmConfig().GetCode().GetLocal().GetFilename(), "test")
+	assert.Equal(t, proxy.ecdsLastNonce.Load(), "")
+}
+
+// unexpectedWasmCache fails the test if a Wasm module is fetched.
+type unexpectedWasmCache struct {
+	t *testing.T
+}
+
+func (c unexpectedWasmCache) Get(url string, _ wasmcache.GetOptions) (string, error) {
+	c.t.Errorf("unexpected fetch of Wasm module %v", url)
+	return "", fmt.Errorf("unexpected fetch of Wasm module %v", url)
+}
+func (c unexpectedWasmCache) Cleanup() {}
+
+// Validates the responses of types not inspected by the proxy, such as EDS, are passed through as is.
+func TestDeltaXdsProxyPassThrough(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.ecdsTypeURLAliases = []string{"type.googleapis.com/envoy.config.core.v3.ExtensionConfigDiscovery"}
+	for typeURL, want := range map[string]bool{
+		v3.EndpointType:               true,
+		v3.ClusterType:                true,
+		v3.ExtensionConfigurationType: false,
+		proxy.ecdsTypeURLAliases[0]:   false,
+		v3.NameTableType:              false,
+		v3.DebugType + "/syncz":       false,
+	} {
+		assert.Equal(t, proxy.passThroughDelta(typeURL), want)
+	}
+
+	// Even resources which would be rewritten as ECDS are not inspected.
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = unexpectedWasmCache{t}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.EndpointType,
+		Node: &core.Node{
+			Id: "sidecar~1.1.1.1~debug~cluster.local",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sent := &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.EndpointType,
+		Nonce:     "n1",
+		Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+	}
+	f.SendDeltaResponse(proto.Clone(sent).(*discovery.DeltaDiscoveryResponse))
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(resp.Resources[0], sent.Resources[0]) {
+		t.Errorf("passed through resource got %v want %v", resp.Resources[0], sent.Resources[0])
+	}
+}
+
+// Validates the Wasm modules of ECDS resources are rewritten for the configured alias type URLs.
+func TestDeltaECDSTypeURLAlias(t *testing.T) {
+	const aliasType = "type.googleapis.com/envoy.config.core.v3.ExtensionConfigDiscovery"
+	proxy := setupXdsProxy(t)
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = &fakeAckCache{}
+	proxy.ecdsTypeURLAliases = []string{aliasType}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                aliasType,
+		ResourceNamesSubscribe: []string{"extension-config"},
+		Node: &core.Node{
+			Id: "sidecar~1.1.1.1~debug~cluster.local",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:   aliasType,
+		Nonce:     "n1",
+		Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+	})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.TypeUrl, aliasType)
+	ec := &core.TypedExtensionConfig{}
+	if err := resp.Resources[0].Resource.UnmarshalTo(ec); err != nil {
+		t.Fatal(err)
+	}
+	w := &wasm.Wasm{}
+	if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, w.GetConfig().GetVmConfig().GetCode().GetLocal().GetFilename(), "test")
+}
+
+func TestDeltaSubscriptions(t *testing.T) {
+	subs := newDeltaSubscriptions()
+	subscribe := &discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.ExtensionConfigurationType,
+		ResourceNamesSubscribe: []string{"extension-config"},
+	}
+	assert.Equal(t, subs.update(subscribe), true)
+	assert.Equal(t, subs.snapshot(), map[string][]string{v3.ExtensionConfigurationType: {"extension-config"}})
+
+	// Subscribing again to the same resource is a duplicate and is not forwarded, unless it is an ACK.
+	assert.Equal(t, subs.update(subscribe), false)
+	assert.Equal(t, subs.update(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.ExtensionConfigurationType,
+		ResourceNamesSubscribe: []string{"extension-config"},
+		ResponseNonce:          "nonce",
+	}), true)
+
+	unsubscribe := &discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.ExtensionConfigurationType,
+		ResourceNamesUnsubscribe: []string{"extension-config"},
+	}
+	assert.Equal(t, subs.update(unsubscribe), true)
+	assert.Equal(t, subs.update(unsubscribe), false)
+	assert.Equal(t, subs.snapshot(), map[string][]string{v3.ExtensionConfigurationType: {}})
+
+	// Requests without subscription changes, such as wildcard requests, are always forwarded.
+	assert.Equal(t, subs.update(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType}), true)
+	assert.Equal(t, subs.update(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType}), true)
+
+	// The resource names are normalized to the changes of the request.
+	overlapping := &discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.ExtensionConfigurationType,
+		ResourceNamesSubscribe:   []string{"c", "b", "c"},
+		ResourceNamesUnsubscribe: []string{"extension-config"},
+	}
+	assert.Equal(t, subs.update(overlapping), true)
+	assert.Equal(t, overlapping.ResourceNamesSubscribe, []string{"b", "c"})
+	assert.Equal(t, overlapping.ResourceNamesUnsubscribe, nil)
+	overlapping = &discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.ExtensionConfigurationType,
+		ResourceNamesSubscribe:   []string{"c", "a"},
+		ResourceNamesUnsubscribe: []string{"b", "b"},
+		ResponseNonce:            "nonce",
+	}
+	assert.Equal(t, subs.update(overlapping), true)
+	assert.Equal(t, overlapping.ResourceNamesSubscribe, []string{"a"})
+	assert.Equal(t, overlapping.ResourceNamesUnsubscribe, []string{"b"})
+
+	// Leaving a wildcard subscription is a change.
+	assert.Equal(t, subs.update(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.ClusterType,
+		ResourceNamesUnsubscribe: []string{"*"},
+	}), true)
+	assert.Equal(t, subs.update(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.ClusterType,
+		ResourceNamesUnsubscribe: []string{"*"},
+	}), false)
+}
+
+// Validates only the subscription changes of the delta requests from Envoy are forwarded upstream.
+func TestDeltaXdsProxyDedupSubscriptions(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	reqs := []*discovery.DeltaDiscoveryRequest{
+		{
+			TypeUrl:                v3.EndpointType,
+			Node:                   &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+			ResourceNamesSubscribe: []string{"b", "a", "a"},
+		},
+		// Already subscribed to, not forwarded.
+		{TypeUrl: v3.EndpointType, ResourceNamesSubscribe: []string{"a"}},
+		{TypeUrl: v3.EndpointType, ResourceNamesSubscribe: []string{"a", "c"}},
+		{TypeUrl: v3.EndpointType, ResourceNamesUnsubscribe: []string{"c", "x", "c"}},
+	}
+	for _, req := range reqs {
+		if err := downstream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := recorder.streamRequests(0); len(sent) != 3 {
+			return fmt.Errorf("expected 3 requests to be forwarded, got %d", len(sent))
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	sent := recorder.streamRequests(0)
+	assert.Equal(t, sent[0].ResourceNamesSubscribe, []string{"a", "b"})
+	assert.Equal(t, sent[1].ResourceNamesSubscribe, []string{"c"})
+	assert.Equal(t, sent[2].ResourceNamesUnsubscribe, []string{"c"})
+}
+
+// Validates a subscribe to resources Envoy is already subscribed to is coalesced, and not sent upstream.
+func TestDeltaXdsProxyCoalescedSubscribe(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		Node:                   &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+		ResourceNamesSubscribe: []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := len(f.DeltaRequests(v3.EndpointType)); got != 1 {
+			return fmt.Errorf("expected the subscribe to be sent upstream, got %d requests", got)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		ResourceNamesSubscribe: []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.ExpectNoDeltaRequest(t, v3.EndpointType, time.Millisecond*200)
+}
+
+func TestDeltaSubscriptionsDebug(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+
+	err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.EndpointType,
+		ResourceNamesSubscribe: []string{"outbound|80||foo.default.svc.cluster.local"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		rec := httptest.NewRecorder()
+		proxy.subscriptionz(rec, nil)
+		if !strings.Contains(rec.Body.String(), "outbound|80||foo.default.svc.cluster.local") {
+			return fmt.Errorf("subscriptionz output %v does not contain the subscribed resource", rec.Body.String())
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+}
+
+func TestDeltaXdsProxyDebugState(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	node := &core.Node{
+		Id: "sidecar~1.1.1.1~debug~cluster.local",
+		Metadata: (&model.NodeMetadata{
+			Namespace:   "default",
+			InstanceIPs: []string{"1.1.1.1"},
+		}).ToStruct(),
+	}
+
+	// Exchange CDS and LDS, ACKing both responses.
+	responses := map[string]*discovery.DeltaDiscoveryResponse{}
+	for _, typeURL := range []string{v3.ClusterType, v3.ListenerType} {
+		if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeURL, Node: node}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := downstream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resp.TypeUrl, typeURL)
+		responses[typeURL] = resp
+		if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeURL, ResponseNonce: resp.Nonce}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]deltaTypeState{}
+	for typeURL, resp := range responses {
+		want[typeURL] = deltaTypeState{
+			LastAckedNonce: resp.Nonce,
+			LastVersion:    resp.SystemVersionInfo,
+			Subscribed:     []string{},
+			LastForwarded:  len(resp.Resources),
+		}
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		rec := httptest.NewRecorder()
+		proxy.xdsProxyz(rec, nil)
+		got := map[string]deltaTypeState{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			return fmt.Errorf("invalid debug output %v: %v", rec.Body.String(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("debug state got %+v want %+v", got, want)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+}
+
+// upstreamKiller is a client interceptor which allows terminating the active upstream streams with an
+// Unavailable error, as if the upstream restarted. It records the requests sent on each stream.
+type upstreamKiller struct {
+	mu       sync.Mutex
+	cancels  []context.CancelFunc
+	killed   []*atomic.Bool
+	requests [][]*discovery.DeltaDiscoveryRequest
+}
+
+type killableClientStream struct {
+	grpc.ClientStream
+	killed *atomic.Bool
+	record func(req *discovery.DeltaDiscoveryRequest)
+}
+
+func (s *killableClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && s.killed.Load() {
+		return status.Error(codes.Unavailable, "upstream killed")
+	}
+	return err
+}
+
+func (s *killableClientStream) SendMsg(m any) error {
+	if s.killed.Load() {
+		return io.EOF
+	}
+	if req, ok := m.(*discovery.DeltaDiscoveryRequest); ok {
+		s.record(req)
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (k *upstreamKiller) interceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		k.mu.Lock()
+		idx := len(k.cancels)
+		killed := atomic.NewBool(false)
+		k.cancels = append(k.cancels, cancel)
+		k.killed = append(k.killed, killed)
+		k.requests = append(k.requests, nil)
+		k.mu.Unlock()
+		clientStream, err := streamer(ctx, desc, cc, method, opts...)
+		return &killableClientStream{ClientStream: clientStream, killed: killed, record: func(req *discovery.DeltaDiscoveryRequest) {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			k.requests[idx] = append(k.requests[idx], req)
+		}}, err
+	}
+}
+
+// kill terminates all the streams opened so far.
+func (k *upstreamKiller) kill() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, cancel := range k.cancels {
+		k.killed[i].Store(true)
+		cancel()
+	}
+}
+
+// streamRequests returns the requests sent on the stream opened at the given index.
+func (k *upstreamKiller) streamRequests(idx int) []*discovery.DeltaDiscoveryRequest {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if idx >= len(k.requests) {
+		return nil
+	}
+	return append([]*discovery.DeltaDiscoveryRequest{}, k.requests[idx]...)
+}
+
+// Validates the delta xds proxy replaces an idle upstream stream, without closing the stream from Envoy.
+func TestDeltaXdsProxyUpstreamMaxIdle(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.upstreamMaxIdle = time.Millisecond * 200
+	proxy.deltaReconnectBackoff = time.Millisecond
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+
+	// No more messages are exchanged, so the subscriptions of Envoy are resumed on a new upstream stream.
+	retry.UntilSuccessOrFail(t, func() error {
+		if resumed := recorder.streamRequests(1); len(resumed) < 2 {
+			return fmt.Errorf("expected the subscriptions to be resumed, got %v", resumed)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	res, err := downstream.Recv()
+	if err != nil {
+		t.Fatalf("expected the stream of Envoy to be kept, got %v", err)
+	}
+	assert.Equal(t, res.TypeUrl, v3.ClusterType)
+}
+
+// Validates the delta xds proxy resumes the state of Envoy on a new upstream stream, without closing
+// the stream from Envoy, when the upstream fails.
+func TestDeltaXdsProxyReconnectsUpstream(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.deltaReconnect = true
+	proxy.deltaReconnectBackoff = time.Millisecond
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	killer := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(killer.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+
+	killer.kill()
+
+	// The clusters and listeners known by Envoy are resumed on a new upstream stream.
+	var resumed []*discovery.DeltaDiscoveryRequest
+	retry.UntilSuccessOrFail(t, func() error {
+		resumed = killer.streamRequests(1)
+		if len(resumed) < 2 {
+			return fmt.Errorf("expected the cluster and listener subscriptions to be resumed, got %v", resumed)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, resumed[0].TypeUrl, v3.ClusterType)
+	assert.Equal(t, resumed[0].Node.GetId(), "sidecar~1.1.1.1~debug~cluster.local")
+	if len(resumed[0].InitialResourceVersions) == 0 {
+		t.Fatalf("expected the versions of the clusters known by Envoy to be resumed")
+	}
+	assert.Equal(t, resumed[1].TypeUrl, v3.ListenerType)
+	assert.Equal(t, resumed[1].Node == nil, true)
+
+	// The stream from Envoy is kept open, and receives the responses of the new upstream.
+	res, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.TypeUrl, v3.ClusterType)
+}
+
+// Validates the delta xds proxy replaces an upstream stream without responses, without closing the stream from Envoy.
+func TestDeltaXdsProxyUpstreamRecvIdleTimeout(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.upstreamRecvIdleTimeout = time.Millisecond * 300
+	proxy.deltaReconnectBackoff = time.Millisecond
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1"})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "1")
+
+	// No more responses are received, so the subscriptions of Envoy are resumed on a new upstream stream.
+	retry.UntilSuccessOrFail(t, func() error {
+		if resumed := recorder.streamRequests(1); len(resumed) == 0 {
+			return fmt.Errorf("expected the subscriptions to be resumed")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, recorder.streamRequests(1)[0].TypeUrl, v3.ClusterType)
+
+	// The stream of Envoy is kept, and receives the next push.
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "2"})
+	resp, err = downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "2")
+}
+
+// Validates the delta xds proxy moves the upstream stream to a connection with the rotated certificates, resuming
+// the state of Envoy rather than resetting it.
+func TestDeltaXdsProxyCertRotation(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.deltaReconnectBackoff = time.Millisecond
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ClusterType,
+		Nonce:   "1",
+		Resources: slices.Map(clusterResources("a", "b"), func(r *anypb.Any) *discovery.Resource {
+			return &discovery.Resource{Name: xdsResourceName(r), Version: "v1", Resource: r}
+		}),
+	})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "1")
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client certificate is swapped mid-stream: the dial options are rebuilt with it, as by initIstiodDialOptions.
+	rotated := atomic.NewInt32(0)
+	proxy.optsMutex.Lock()
+	proxy.dialOptions = append(slices.Clone(proxy.dialOptions), grpc.WithChainStreamInterceptor(
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+			streamer grpc.Streamer, opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			rotated.Inc()
+			return streamer(ctx, desc, cc, method, opts...)
+		}))
+	proxy.optsMutex.Unlock()
+	proxy.upstreamCertsRotated()
+
+	// The subscriptions and versions known by Envoy are resumed on a connection dialed with the new certificate.
+	retry.UntilSuccessOrFail(t, func() error {
+		if resumed := recorder.streamRequests(1); len(resumed) == 0 {
+			return fmt.Errorf("expected the subscriptions to be resumed")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, rotated.Load(), int32(1))
+	resumed := recorder.streamRequests(1)[0]
+	assert.Equal(t, resumed.TypeUrl, v3.ClusterType)
+	assert.Equal(t, resumed.Node.GetId(), "sidecar~1.1.1.1~debug~cluster.local")
+	assert.Equal(t, resumed.InitialResourceVersions, map[string]string{"a": "v1", "b": "v1"})
+
+	// The stream of Envoy is kept, and its next response is the next push rather than a full state of the world.
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "2"})
+	resp, err = downstream.Recv()
+	if err != nil {
+		t.Fatalf("expected the stream of Envoy to be kept, got %v", err)
+	}
+	assert.Equal(t, resp.Nonce, "2")
+}
+
+func TestDeltaXdsProxyAckLatency(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	node := &core.Node{
+		Id: "sidecar~1.1.1.1~debug~cluster.local",
+		Metadata: model.NodeMetadata{
+			Namespace:   "default",
+			InstanceIPs: []string{"1.1.1.1"},
+		}.ToStruct(),
+	}
+	for _, typeURL := range []string{v3.ClusterType, v3.ListenerType} {
+		if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeURL, Node: node}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := downstream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, res.TypeUrl, typeURL)
+		if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeURL, ResponseNonce: res.Nonce}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	observed := func(got any) error {
+		if h := got.(*dto.Histogram); h.GetSampleCount() < 1 {
+			return fmt.Errorf("want at least one sample, got %v", h.GetSampleCount())
+		}
+		return nil
+	}
+	mt.Assert("xds_proxy_ack_latency", map[string]string{"type": "CDS"}, observed)
+	mt.Assert("xds_proxy_ack_latency", map[string]string{"type": "LDS"}, observed)
+}
+
+func TestDeltaXdsProxyTimeToFirstConfig(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node: &core.Node{
+			Id:       "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: model.NodeMetadata{Namespace: "default", InstanceIPs: []string{"1.1.1.1"}}.ToStruct(),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.TypeUrl, v3.ClusterType)
+
+	mt.Assert("xds_proxy_time_to_first_config", map[string]string{"type": "CDS"}, func(got any) error {
+		if h := got.(*dto.Histogram); h.GetSampleCount() != 1 {
+			return fmt.Errorf("want one sample, got %v", h.GetSampleCount())
+		}
+		return nil
+	})
+}
+
+func TestDeltaXdsProxyDryRun(t *testing.T) {
+	cases := []struct {
+		name    string
+		cache   wasmcache.Cache
+		verdict string
+	}{
+		{
+			name:    "ack",
+			cache:   &fakeAckCache{},
+			verdict: "ack",
+		},
+		{
+			name:    "nack",
+			cache:   &fakeNackCache{},
+			verdict: "nack",
+		},
+	}
+	ef, err := os.ReadFile(path.Join(env.IstioSrc, "pilot/pkg/xds/testdata/ecds.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := monitortest.New(t)
+			proxy := setupXdsProxy(t)
+			proxy.deltaDryRun = true
+			proxy.wasmCache.Cleanup()
+			proxy.wasmCache = tt.cache
+			f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{
+				ConfigString: string(ef),
+			})
+			setDialOptions(proxy, f.BufListener)
+			conn := setupDownstreamConnection(t, proxy)
+			downstream := deltaStream(t, conn)
+
+			err = downstream.Send(&discovery.DeltaDiscoveryRequest{
+				TypeUrl:                v3.ExtensionConfigurationType,
+				ResourceNamesSubscribe: []string{"extension-config"},
+				Node: &core.Node{
+					Id: "sidecar~1.1.1.1~debug~cluster.local",
+					Metadata: model.NodeMetadata{
+						Namespace:   "default",
+						InstanceIPs: []string{"1.1.1.1"},
+						ClusterID:   "Kubernetes",
+					}.ToStruct(),
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The verdict is reported instead of forwarding the response to Envoy.
+			mt.Assert("xds_proxy_dry_run_verdicts", map[string]string{"type": "ECDS", "verdict": tt.verdict}, monitortest.Exactly(1))
+			received := make(chan *discovery.DeltaDiscoveryResponse, 1)
+			go func() {
+				if resp, err := downstream.Recv(); err == nil {
+					received <- resp
+				}
+			}()
+			select {
+			case resp := <-received:
+				t.Fatalf("unexpected response forwarded to Envoy in dry run mode: %v", resp)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestDeltaXdsProxyBytes(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithoutResponse(t, downstream)
+
+	resp := &discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ClusterType,
+		Nonce:   "n1",
+		Resources: slices.Map(clusterResources("a", "b"), func(r *anypb.Any) *discovery.Resource {
+			return &discovery.Resource{Name: xdsResourceName(r), Resource: r}
+		}),
+	}
+	size := proto.Size(resp)
+	f.SendDeltaResponse(resp)
+	if _, err := downstream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	retry.UntilSuccessOrFail(t, func() error {
+		proxy.connectedMutex.RLock()
+		defer proxy.connectedMutex.RUnlock()
+		if proxy.connected == nil {
+			return fmt.Errorf("not connected")
+		}
+		if got := proxy.connected.bytes.downstreamSent.Load(); got != int64(size) {
+			return fmt.Errorf("got %v bytes sent downstream, want %v", got, size)
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+	mt.Assert("xds_proxy_bytes", map[string]string{"type": "CDS", "direction": "upstream_received"}, monitortest.Exactly(float64(size)))
+	mt.Assert("xds_proxy_bytes", map[string]string{"type": "CDS", "direction": "downstream_sent"}, monitortest.Exactly(float64(size)))
+}
+
+// Validates the delta stream and goroutine gauges go back to zero once Envoy disconnects.
+func TestDeltaXdsProxyStreamGauges(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithoutResponse(t, downstream)
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "n1"})
+	if _, err := downstream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	mt.Assert("xds_proxy_delta_streams", map[string]string{"direction": "downstream"}, monitortest.Exactly(1))
+	mt.Assert("xds_proxy_delta_streams", map[string]string{"direction": "upstream"}, monitortest.Exactly(1))
+	mt.Assert("xds_proxy_delta_goroutines", nil, monitortest.AtLeast(1))
+
+	conn.Close()
+	mt.Assert("xds_proxy_delta_streams", map[string]string{"direction": "downstream"}, monitortest.Exactly(0))
+	mt.Assert("xds_proxy_delta_streams", map[string]string{"direction": "upstream"}, monitortest.Exactly(0))
+	mt.Assert("xds_proxy_delta_goroutines", nil, monitortest.Exactly(0))
+}
+
+// Validates the NACKs of a flapping Envoy are logged once per rate window.
+func TestDeltaXdsProxyNackLogs(t *testing.T) {
+	logs := captureJSONLogs(t)
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	for i := 0; i < 3; i++ {
+		err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+			TypeUrl:       v3.ClusterType,
+			Node:          node,
+			ResponseNonce: fmt.Sprintf("n%d", i),
+			ErrorDetail:   &google_rpc.Status{Message: "cluster rejected"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := len(recorder.streamRequests(0)); sent < 3 {
+			return fmt.Errorf("expected NACKs to be forwarded upstream, got %d requests", sent)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+
+	var nacks []map[string]any
+	for _, entry := range logs() {
+		if msg, _ := entry["msg"].(string); strings.HasPrefix(msg, "Envoy rejected config") {
+			nacks = append(nacks, entry)
+		}
+	}
+	if len(nacks) != 1 {
+		t.Fatalf("expected one NACK log entry, got %v", nacks)
+	}
+	assert.Equal(t, nacks[0]["level"], "warn")
+	assert.Equal(t, nacks[0]["msg"], "Envoy rejected config: cluster rejected")
+	assert.Equal(t, nacks[0]["type"], "CDS")
+	assert.Equal(t, nacks[0]["nonce"], "n0")
+}
+
+// Validates the same correlation ID is logged when a response is received from the upstream and forwarded to Envoy.
+func TestDeltaXdsProxyCorrelationID(t *testing.T) {
+	logs := captureJSONLogs(t)
+	level := proxyLog.GetOutputLevel()
+	proxyLog.SetOutputLevel(log.DebugLevel)
+	t.Cleanup(func() {
+		proxyLog.SetOutputLevel(level)
+	})
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithoutResponse(t, downstream)
+
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "n1"})
+	if _, err := downstream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.connectedMutex.RLock()
+	want := deltaCorrelationID(proxy.connected.conID, "n1")
+	proxy.connectedMutex.RUnlock()
+	retry.UntilSuccessOrFail(t, func() error {
+		var msgs []string
+		for _, entry := range logs() {
+			if entry["correlation"] == want {
+				msgs = append(msgs, entry["msg"].(string))
+			}
+		}
+		if !reflect.DeepEqual(msgs, []string{"upstream response", "forwarded response to Envoy"}) {
+			return fmt.Errorf("got log entries %v with correlation ID %v", msgs, want)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+
+	// The debug endpoint maps the correlation ID to the response.
+	rec := httptest.NewRecorder()
+	proxy.correlationz(rec, nil)
+	var correlations []deltaCorrelation
+	if err := json.Unmarshal(rec.Body.Bytes(), &correlations); err != nil {
+		t.Fatal(err)
+	}
+	if len(correlations) != 1 || correlations[0].Forwarded == nil {
+		t.Fatalf("expected one forwarded response, got %v", rec.Body.String())
+	}
+	assert.Equal(t, correlations[0].ID, want)
+	assert.Equal(t, correlations[0].Type, "CDS")
+	assert.Equal(t, correlations[0].Nonce, "n1")
+}
+
+func TestMergeDefaultNodeMetadata(t *testing.T) {
+	defaults := model.NodeMetadata{
+		Namespace: "default",
+		ClusterID: "Kubernetes",
+		MeshID:    "mesh",
+	}.ToStruct()
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	mergeDefaultNodeMetadata(node, defaults)
+	assert.Equal(t, node.Metadata, defaults)
+
+	// Fields sent by Envoy are not overwritten.
+	node = &core.Node{
+		Id: "sidecar~1.1.1.1~debug~cluster.local",
+		Metadata: model.NodeMetadata{
+			Namespace: "envoy",
+		}.ToStruct(),
+	}
+	mergeDefaultNodeMetadata(node, defaults)
+	assert.Equal(t, node.Metadata, model.NodeMetadata{
+		Namespace: "envoy",
+		ClusterID: "Kubernetes",
+		MeshID:    "mesh",
+	}.ToStruct())
+}
+
+func TestDeltaXdsProxyDefaultNodeMetadata(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.defaultNodeMetadata = model.NodeMetadata{
+		Namespace: "default",
+		ClusterID: "Kubernetes",
+		MeshID:    "mesh",
+	}.ToStruct()
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node: &core.Node{
+			Id:       "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: &structpb.Struct{},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []*discovery.DeltaDiscoveryRequest
+	retry.UntilSuccessOrFail(t, func() error {
+		sent = recorder.streamRequests(0)
+		if len(sent) == 0 {
+			return fmt.Errorf("no request sent upstream")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, sent[0].Node.Id, "sidecar~1.1.1.1~debug~cluster.local")
+	assert.Equal(t, sent[0].Node.Metadata, model.NodeMetadata{
+		Namespace: "default",
+		ClusterID: "Kubernetes",
+		MeshID:    "mesh",
+	}.ToStruct())
+}
+
+// pipeNodeIDParser parses node IDs of the form type|namespace|name.
+type pipeNodeIDParser struct{}
+
+func (pipeNodeIDParser) Parse(nodeID string) (*NodeIdentity, error) {
+	parts := strings.Split(nodeID, "|")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid node ID %q", nodeID)
+	}
+	return &NodeIdentity{Type: model.NodeType(parts[0]), Namespace: parts[1], ID: parts[2]}, nil
+}
+
+// Validates the node ID of the requests from Envoy is parsed with a custom parser to set the metadata defaults.
+func TestDeltaXdsProxyCustomNodeIDParser(t *testing.T) {
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{NodeIDParser: pipeNodeIDParser{}})
+	proxy.defaultNodeMetadata = model.NodeMetadata{
+		Namespace: "default",
+		ClusterID: "Kubernetes",
+	}.ToStruct()
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "router|istio-ingress|gateway-1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []*discovery.DeltaDiscoveryRequest
+	retry.UntilSuccessOrFail(t, func() error {
+		sent = recorder.streamRequests(0)
+		if len(sent) == 0 {
+			return fmt.Errorf("no request sent upstream")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	// The namespace parsed from the node ID takes precedence over the default one.
+	assert.Equal(t, sent[0].Node.Metadata, model.NodeMetadata{
+		Namespace: "istio-ingress",
+		ClusterID: "Kubernetes",
+	}.ToStruct())
+}
+
+type recordingServerStream struct {
+	grpc.ServerStream
+	received chan<- string
+}
+
+func (s *recordingServerStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if req, ok := m.(*discovery.DeltaDiscoveryRequest); ok && err == nil {
+		s.received <- req.TypeUrl
+	}
+	return err
+}
+
+// Validates the interceptors set in the agent options observe the delta requests, both from Envoy and to the upstream.
+func TestDeltaXdsProxyCustomInterceptors(t *testing.T) {
+	received := make(chan string, 10)
+	downstreamInterceptor := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &recordingServerStream{ServerStream: ss, received: received})
+	}
+	upstream := &upstreamKiller{}
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		DownstreamGrpcOptions: []grpc.ServerOption{grpc.StreamInterceptor(downstreamInterceptor)},
+		UpstreamGrpcOptions:   []grpc.DialOption{grpc.WithStreamInterceptor(upstream.interceptor())},
+	})
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case typeURL := <-received:
+		assert.Equal(t, typeURL, v3.ClusterType)
+	case <-time.After(time.Second * 5):
+		t.Fatal("the downstream interceptor did not observe the request")
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		sent := upstream.streamRequests(0)
+		if len(sent) == 0 {
+			return fmt.Errorf("the upstream interceptor did not observe the request")
+		}
+		assert.Equal(t, sent[0].TypeUrl, v3.ClusterType)
+		return nil
+	}, retry.Timeout(time.Second*5))
+}
+
+// Validates the logs of a connection carry the same connection ID and downstream peer address.
+func TestDeltaXdsProxyConnectionLogs(t *testing.T) {
+	logs := captureJSONLogs(t)
+	level := proxyLog.GetOutputLevel()
+	proxyLog.SetOutputLevel(log.DebugLevel)
+	t.Cleanup(func() {
+		proxyLog.SetOutputLevel(level)
+	})
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithoutResponse(t, downstream)
+
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "n1"})
+	if _, err := downstream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.connectedMutex.RLock()
+	id := float64(proxy.connected.conID)
+	proxy.connectedMutex.RUnlock()
+	retry.UntilSuccessOrFail(t, func() error {
+		msgs := sets.New[string]()
+		peers := sets.New[any]()
+		for _, entry := range logs() {
+			if entry["scope"] != proxyLog.Name() {
+				continue
+			}
+			msg, _ := entry["msg"].(string)
+			if msg == "upstream response" || msg == "forwarded response to Envoy" {
+				if entry["id"] != id {
+					return fmt.Errorf("log %q has connection ID %v, expected %v", msg, entry["id"], id)
+				}
+			}
+			if entry["id"] == id {
+				msgs.Insert(msg)
+				peers.Insert(entry["peer"])
+			}
+		}
+		if !msgs.Contains("upstream response") || !msgs.Contains("forwarded response to Envoy") {
+			return fmt.Errorf("expected the response to be logged for the connection, got %v", sets.SortedList(msgs))
+		}
+		if peers.Len() != 1 || peers.Contains(nil) || peers.Contains("") {
+			return fmt.Errorf("expected a single peer address for the connection, got %v", peers.UnsortedList())
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+}
+
+// captureJSONLogs redirects the logs to a file for the duration of the test, returning a function to read
+// the entries logged so far.
+func captureJSONLogs(t *testing.T) func() []map[string]any {
+	file := path.Join(t.TempDir(), "log")
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{file}
+	o.JSONEncoding = true
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = log.Configure(log.DefaultOptions())
+	})
+	return func() []map[string]any {
+		_ = log.Sync()
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			entry := map[string]any{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid log entry %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+}
+
+func TestDeltaXdsProxyDrain(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	node := &core.Node{
+		Id: "sidecar~1.1.1.1~debug~cluster.local",
+		Metadata: model.NodeMetadata{
+			Namespace:   "default",
+			InstanceIPs: []string{"1.1.1.1"},
+		}.ToStruct(),
+	}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response is not acknowledged yet, so the drain waits for the stream.
+	drained := make(chan error, 1)
+	go func() {
+		drained <- proxy.Drain(context.Background())
+	}()
+	retry.UntilOrFail(t, proxy.draining.Load, retry.Timeout(time.Second*5))
+
+	// New streams are refused while draining.
+	refused := deltaStream(t, conn)
+	if _, err := refused.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected a new stream to be refused with Unavailable, got %v", err)
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("expected the drain to wait for the in-flight stream, got %v", err)
+	case <-time.After(drainPollInterval * 3):
+	}
+
+	// Once Envoy acknowledges the in-flight response, the proxy is torn down.
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: res.Nonce}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-drained:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected the drain to complete once the in-flight stream settled")
+	}
+	if _, err := downstream.Recv(); err == nil {
+		t.Fatal("expected the stream to be closed once drained")
+	}
 }
@@ -0,0 +1,148 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+
+	"istio.io/istio/pkg/slices"
+)
+
+const (
+	// cachedDNSScheme is the scheme of the upstream targets resolved through the upstream DNS cache.
+	cachedDNSScheme = "istio-agent-cached-dns"
+	// dnsLookupTimeout bounds each lookup of the upstream host.
+	dnsLookupTimeout = 10 * time.Second
+)
+
+// upstreamDNSCache caches the addresses of the upstream XDS server for a TTL, so that they are reused across the
+// reconnects instead of being resolved again. The addresses are resolved again when gRPC fails to connect to them,
+// and the expired addresses are still used if they fail to be resolved again, which rides out DNS blips.
+type upstreamDNSCache struct {
+	ttl        time.Duration
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newUpstreamDNSCache(ttl time.Duration) *upstreamDNSCache {
+	return &upstreamDNSCache{
+		ttl:        ttl,
+		lookupHost: net.DefaultResolver.LookupHost,
+		entries:    map[string]dnsCacheEntry{},
+	}
+}
+
+// lookup returns the addresses of host, from the cache unless they expired or refresh is set.
+func (c *upstreamDNSCache) lookup(host string, refresh bool) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	c.mu.Lock()
+	cached, found := c.entries[host]
+	c.mu.Unlock()
+	if found && !refresh && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		if found {
+			proxyLog.Warnf("failed to resolve upstream %s, using the previously resolved addresses %v: %v", host, cached.addrs, err)
+			return cached.addrs, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	return addrs, nil
+}
+
+// dialTarget returns the target dialing addr through the cache, and the option resolving it.
+func (c *upstreamDNSCache) dialTarget(addr string) (string, grpc.DialOption) {
+	return cachedDNSScheme + ":///" + addr, grpc.WithResolvers(&cachedDNSBuilder{cache: c})
+}
+
+// dialUpstream dials the upstream at addr, resolving its host through the DNS cache if it is enabled.
+func (p *XdsProxy) dialUpstream(ctx context.Context, addr string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if p.upstreamDNS == nil || strings.HasPrefix(addr, unixAddressPrefix) || strings.Contains(addr, "://") {
+		return dialUpstream(ctx, addr, opts...)
+	}
+	target, resolverOption := p.upstreamDNS.dialTarget(addr)
+	return grpc.DialContext(ctx, target, append(slices.Clone(opts), resolverOption)...)
+}
+
+// cachedDNSBuilder builds the resolvers of the upstream targets, resolving them through the cache.
+type cachedDNSBuilder struct {
+	cache *upstreamDNSCache
+}
+
+func (b *cachedDNSBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	host, port, err := net.SplitHostPort(target.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	r := &cachedDNSResolver{cache: b.cache, host: host, port: port, cc: cc}
+	r.resolve(false)
+	return r, nil
+}
+
+func (b *cachedDNSBuilder) Scheme() string {
+	return cachedDNSScheme
+}
+
+type cachedDNSResolver struct {
+	cache *upstreamDNSCache
+	host  string
+	port  string
+	cc    resolver.ClientConn
+}
+
+// ResolveNow is called by gRPC when it fails to connect to the addresses, which are then resolved again.
+func (r *cachedDNSResolver) ResolveNow(resolver.ResolveNowOptions) {
+	go r.resolve(true)
+}
+
+func (r *cachedDNSResolver) Close() {}
+
+func (r *cachedDNSResolver) resolve(refresh bool) {
+	addrs, err := r.cache.lookup(r.host, refresh)
+	if err != nil {
+		r.cc.ReportError(err)
+		return
+	}
+	state := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: net.JoinHostPort(addr, r.port)})
+	}
+	if err := r.cc.UpdateState(state); err != nil {
+		proxyLog.Debugf("failed to update the addresses of upstream %s: %v", r.host, err)
+	}
+}
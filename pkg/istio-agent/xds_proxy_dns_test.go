@@ -0,0 +1,116 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// stubResolver resolves every host to its address, counting the lookups, or fails once failing is set.
+type stubResolver struct {
+	addr    string
+	lookups *atomic.Int32
+	failing *atomic.Bool
+}
+
+func (r stubResolver) lookupHost(context.Context, string) ([]string, error) {
+	r.lookups.Inc()
+	if r.failing.Load() {
+		return nil, errors.New("dns blip")
+	}
+	return []string{r.addr}, nil
+}
+
+func TestXdsProxyUpstreamDNSCache(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	var mu sync.Mutex
+	var dialed []string
+	proxy.istiodAddress = "istiod.test:15012"
+	proxy.dialOptions = []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(_ context.Context, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			return f.Listener.Dial()
+		}),
+	}
+	resolver := stubResolver{addr: "10.0.0.1", lookups: atomic.NewInt32(0), failing: atomic.NewBool(false)}
+	proxy.upstreamDNS = newUpstreamDNSCache(time.Hour)
+	proxy.upstreamDNS.lookupHost = resolver.lookupHost
+	conn := setupDownstreamConnection(t, proxy)
+
+	// Every reconnect within the TTL dials the cached address, resolved once.
+	for i := 1; i <= 3; i++ {
+		sendDownstreamWithoutResponse(t, stream(t, conn))
+		retry.UntilSuccessOrFail(t, func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(dialed) < i {
+				return fmt.Errorf("expected %d upstream dials, got %v", i, dialed)
+			}
+			return nil
+		}, retry.Timeout(time.Second*5))
+	}
+	mu.Lock()
+	assert.Equal(t, dialed, []string{"10.0.0.1:15012", "10.0.0.1:15012", "10.0.0.1:15012"})
+	mu.Unlock()
+	assert.Equal(t, resolver.lookups.Load(), int32(1))
+}
+
+func TestUpstreamDNSCacheExpiry(t *testing.T) {
+	resolver := stubResolver{addr: "10.0.0.1", lookups: atomic.NewInt32(0), failing: atomic.NewBool(false)}
+	cache := newUpstreamDNSCache(time.Millisecond)
+	cache.lookupHost = resolver.lookupHost
+
+	lookup := func(refresh bool) []string {
+		t.Helper()
+		addrs, err := cache.lookup("istiod.test", refresh)
+		assert.NoError(t, err)
+		return addrs
+	}
+	assert.Equal(t, lookup(false), []string{"10.0.0.1"})
+	time.Sleep(10 * time.Millisecond)
+	// The expired addresses are resolved again.
+	assert.Equal(t, lookup(false), []string{"10.0.0.1"})
+	assert.Equal(t, resolver.lookups.Load(), int32(2))
+
+	// The previous addresses are still used while they fail to be resolved again.
+	resolver.failing.Store(true)
+	assert.Equal(t, lookup(true), []string{"10.0.0.1"})
+	assert.Equal(t, resolver.lookups.Load(), int32(3))
+
+	// IP addresses are never looked up.
+	addrs, err := cache.lookup("10.0.0.2", false)
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"10.0.0.2"})
+	assert.Equal(t, resolver.lookups.Load(), int32(3))
+}
@@ -0,0 +1,103 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"net/http"
+	"sync"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// downstreamBacklog counts, by type URL, the responses from the upstream queued toward Envoy: received from the
+// upstream but not handled yet, held until Envoy acknowledges the previous ones, or being sent to Envoy. A growing
+// backlog tells Envoy is falling behind. Its zero value is ready to use.
+type downstreamBacklog struct {
+	mu     sync.Mutex
+	queued map[string]int
+	// closed is set once the connection ended, after which the responses left behind are no longer counted.
+	closed bool
+}
+
+// add records a response of typeURL queued toward Envoy.
+func (b *downstreamBacklog) add(typeURL string) {
+	b.record(typeURL, 1)
+}
+
+// done records a queued response of typeURL was sent to Envoy, or dropped.
+func (b *downstreamBacklog) done(typeURL string) {
+	b.record(typeURL, -1)
+}
+
+func (b *downstreamBacklog) record(typeURL string, delta int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	if b.queued == nil {
+		b.queued = map[string]int{}
+	}
+	b.queued[typeURL] += delta
+	if b.queued[typeURL] <= 0 {
+		delete(b.queued, typeURL)
+	}
+	metrics.RecordQueuedResponses(v3.GetShortType(typeURL), delta)
+}
+
+// close stops counting the responses of the connection, which ended, and removes the ones left from the metric.
+func (b *downstreamBacklog) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for typeURL, n := range b.queued {
+		metrics.RecordQueuedResponses(v3.GetShortType(typeURL), -n)
+	}
+	b.queued = nil
+	b.closed = true
+}
+
+// snapshot returns the number of queued responses, by type URL.
+func (b *downstreamBacklog) snapshot() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]int, len(b.queued))
+	for typeURL, n := range b.queued {
+		out[typeURL] = n
+	}
+	return out
+}
+
+// downstreamQueue is the backlog of responses toward an Envoy connection, as reported by /debug/agent/queuez.
+type downstreamQueue struct {
+	ID     uint32         `json:"id"`
+	Queued int            `json:"queued"`
+	Types  map[string]int `json:"types"`
+}
+
+// queuez reports the responses from the upstream queued toward the connected Envoy, in total and by type URL.
+func (p *XdsProxy) queuez(w http.ResponseWriter, _ *http.Request) {
+	out := []downstreamQueue{}
+	p.connectedMutex.RLock()
+	if p.connected != nil {
+		q := downstreamQueue{ID: p.connected.conID, Types: p.connected.backlog.snapshot()}
+		for _, n := range q.Types {
+			q.Queued += n
+		}
+		out = append(out, q)
+	}
+	p.connectedMutex.RUnlock()
+	writeJSON(w, out)
+}
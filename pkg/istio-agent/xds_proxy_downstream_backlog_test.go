@@ -0,0 +1,60 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/monitoring/monitortest"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// Validates the responses queued toward a stalled Envoy are reported by /debug/agent/queuez and the metric.
+func TestXdsProxyDownstreamBacklog(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxyWithDownstreamOptions(t, []grpc.ServerOption{grpc.StreamInterceptor(xdstest.SlowServerInterceptor(0, time.Second*2))})
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithoutResponse(t, downstream)
+	for i := 0; i < 3; i++ {
+		f.SendResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType})
+	}
+
+	// One response is being sent to Envoy, one is buffered and one is waiting for the buffer.
+	retry.UntilSuccessOrFail(t, func() error {
+		rec := httptest.NewRecorder()
+		proxy.queuez(rec, httptest.NewRequest("GET", "/debug/agent/queuez", nil))
+		var queues []downstreamQueue
+		if err := json.Unmarshal(rec.Body.Bytes(), &queues); err != nil {
+			return err
+		}
+		if len(queues) != 1 || queues[0].Queued != 3 || queues[0].Types[v3.ClusterType] != 3 {
+			return fmt.Errorf("expected 3 queued CDS responses, got %+v", queues)
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+	mt.Assert("xds_proxy_downstream_queued_responses", map[string]string{"type": "CDS"}, monitortest.Exactly(3))
+}
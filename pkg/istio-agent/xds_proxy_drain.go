@@ -0,0 +1,77 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// drainPollInterval is the interval at which Drain checks whether the streams from Envoy settled.
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain gracefully shuts down the proxy, e.g. while the node is drained. New streams from Envoy are rejected
+// right away, while the stream being served keeps flowing until it is closed or, for a delta stream, until Envoy
+// acknowledged all the responses forwarded to it. The proxy is then torn down. If ctx is done before the stream
+// settled, the proxy is torn down anyway and the error of ctx is returned.
+func (p *XdsProxy) Drain(ctx context.Context) error {
+	p.draining.Store(true)
+	proxyLog.Infof("draining XDS proxy, new streams from Envoy are rejected")
+	err := p.waitStreamsSettled(ctx)
+	if err != nil {
+		proxyLog.Warnf("XDS proxy streams did not settle before the drain deadline: %v", err)
+	}
+	p.close()
+	return err
+}
+
+// waitStreamsSettled waits until the stream from Envoy settled, or until ctx is done.
+func (p *XdsProxy) waitStreamsSettled(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for !p.streamsSettled() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// streamsSettled returns true if no stream from Envoy is served, or if the delta stream being served has no
+// response waiting for its ACK. The ACKs of SotW streams are not tracked, so they only settle once closed.
+func (p *XdsProxy) streamsSettled() bool {
+	p.connectedMutex.RLock()
+	con := p.connected
+	p.connectedMutex.RUnlock()
+	if con == nil {
+		return true
+	}
+	return con.deltaAcks != nil && con.deltaAcks.settled()
+}
+
+// rejectWhileDraining rejects the new streams from Envoy with Unavailable once the proxy is draining.
+func (p *XdsProxy) rejectWhileDraining(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.draining.Load() {
+		proxyLog.Debugf("rejecting downstream stream %s: the proxy is draining", info.FullMethod)
+		return status.Error(codes.Unavailable, "the XDS proxy is draining")
+	}
+	return handler(srv, ss)
+}
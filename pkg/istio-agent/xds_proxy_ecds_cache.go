@@ -0,0 +1,201 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	"istio.io/istio/pkg/log"
+	"istio.io/istio/pkg/monitoring"
+	"istio.io/istio/pkg/wasm"
+)
+
+// ecdsRewriteCacheSize is the number of rewritten ECDS resources remembered by the proxy.
+const ecdsRewriteCacheSize = 128
+
+// Results of the rewrite of a remote Wasm module reference, as reported by reportWasmRewrite.
+const (
+	wasmRewriteFetched  = "fetched"
+	wasmRewriteReused   = "reused"
+	wasmRewriteFailOpen = "fail_open"
+)
+
+var wasmRewriteLog = log.RegisterScope("wasmrewrite", "Wasm module rewrites of ECDS resources by the XDS Proxy")
+
+type ecdsRewriteKey [sha256.Size]byte
+
+// ecdsRewrite is the result of the Wasm rewrite of an ECDS resource.
+type ecdsRewrite struct {
+	name     string
+	resource *anypb.Any
+	// cache is the Wasm module cache the resource was rewritten with.
+	cache wasm.Cache
+	// fetch is the fetch of the Wasm module referenced by the resource, if it references a remote one.
+	fetch *wasmModuleFetch
+}
+
+// ecdsRewriteCache remembers the Wasm rewrite of ECDS resources, keyed by the hash of the resource received
+// from the upstream, so that unchanged resources are not rewritten again on every push.
+type ecdsRewriteCache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU[ecdsRewriteKey, ecdsRewrite]
+}
+
+func newECDSRewriteCache() *ecdsRewriteCache {
+	l, err := simplelru.NewLRU[ecdsRewriteKey, ecdsRewrite](ecdsRewriteCacheSize, nil)
+	if err != nil {
+		panic(fmt.Errorf("invalid lru configuration: %v", err))
+	}
+	return &ecdsRewriteCache{lru: l}
+}
+
+func ecdsRewriteKeyOf(resource *anypb.Any) ecdsRewriteKey {
+	h := sha256.New()
+	h.Write([]byte(resource.GetTypeUrl()))
+	h.Write(resource.GetValue())
+	var key ecdsRewriteKey
+	h.Sum(key[:0])
+	return key
+}
+
+// get returns the previous rewrite of the resource with the given key, as long as it was made with cache and
+// the Wasm module it references is still cached.
+func (c *ecdsRewriteCache) get(key ecdsRewriteKey, cache wasm.Cache) (ecdsRewrite, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rewrite, ok := c.lru.Get(key)
+	if !ok {
+		return ecdsRewrite{}, false
+	}
+	if rewrite.cache != cache {
+		c.lru.Remove(key)
+		return ecdsRewrite{}, false
+	}
+	if rewrite.fetch != nil {
+		if _, err := os.Stat(rewrite.fetch.module); err != nil {
+			// The module was purged from the cache.
+			c.lru.Remove(key)
+			return ecdsRewrite{}, false
+		}
+	}
+	return rewrite, true
+}
+
+// add remembers the rewrite of the resource with the given key. Rewrites falling open because the Wasm module
+// failed to be fetched are not remembered, so that the fetch is retried.
+func (c *ecdsRewriteCache) add(key ecdsRewriteKey, rewrite ecdsRewrite) {
+	if rewrite.fetch != nil && rewrite.fetch.err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Add(key, rewrite)
+}
+
+// forget drops the rewrites of the resource with the given name, returning their number.
+func (c *ecdsRewriteCache) forget(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	forgotten := 0
+	for _, key := range c.lru.Keys() {
+		if rewrite, ok := c.lru.Peek(key); ok && rewrite.name == name {
+			c.lru.Remove(key)
+			forgotten++
+		}
+	}
+	return forgotten
+}
+
+// wasmModuleFetch is the fetch of a Wasm module from the cache while rewriting an ECDS resource.
+type wasmModuleFetch struct {
+	url    string
+	module string
+	err    error
+}
+
+// recordingWasmCache records the fetches of the Wasm modules from the wrapped cache, by the name of
+// the resource they are fetched for. The metrics of the fetches are recorded with the given labels.
+type recordingWasmCache struct {
+	wasm.Cache
+	labels []monitoring.LabelValue
+	// inline if true returns the data URIs inlining the fetched modules, instead of the paths of their files.
+	inline  bool
+	mu      sync.Mutex
+	fetches map[string]wasmModuleFetch
+}
+
+func newRecordingWasmCache(cache wasm.Cache, labels []monitoring.LabelValue) *recordingWasmCache {
+	return &recordingWasmCache{
+		Cache:   cache,
+		labels:  labels,
+		fetches: map[string]wasmModuleFetch{},
+	}
+}
+
+func (c *recordingWasmCache) Get(url string, opts wasm.GetOptions) (string, error) {
+	opts.MetricLabels = c.labels
+	module, err := c.Cache.Get(url, opts)
+	location := module
+	if err == nil && c.inline {
+		// The module file is still recorded, so the rewrite is dropped once the module is purged from the cache.
+		location, err = wasm.InlineModuleFile(module)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetches[opts.ResourceName] = wasmModuleFetch{url: url, module: module, err: err}
+	return location, err
+}
+
+// rewriteOf returns the rewrite of the given resource, along with the last fetch of its Wasm module if any.
+func (c *recordingWasmCache) rewriteOf(resource *anypb.Any) ecdsRewrite {
+	rewrite := ecdsRewrite{resource: resource, cache: c.Cache}
+	ec := &core.TypedExtensionConfig{}
+	if err := resource.UnmarshalTo(ec); err != nil {
+		return rewrite
+	}
+	rewrite.name = ec.GetName()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fetch, f := c.fetches[ec.GetName()]; f {
+		rewrite.fetch = &fetch
+	}
+	return rewrite
+}
+
+// reportWasmRewrite emits an event for the rewrite of a remote Wasm module reference of an ECDS resource.
+func reportWasmRewrite(con *ProxyConnection, rewrite ecdsRewrite, result string) {
+	if rewrite.fetch == nil {
+		return
+	}
+	log := wasmRewriteLog.WithLabels(
+		"id", con.conID,
+		"extension", rewrite.name,
+		"url", rewrite.fetch.url,
+		"path", rewrite.fetch.module,
+		"result", result,
+	)
+	if rewrite.fetch.err != nil {
+		log.Warnf("rewrote remote Wasm module to fail open: %v", rewrite.fetch.err)
+		return
+	}
+	log.Infof("rewrote remote Wasm module to local file")
+}
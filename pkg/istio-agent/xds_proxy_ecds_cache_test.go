@@ -0,0 +1,548 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	wasm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
+	wasmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/wasm/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.uber.org/atomic"
+	"google.golang.org/protobuf/proto"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/channels"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/util/sets"
+	wasmcache "istio.io/istio/pkg/wasm"
+)
+
+// countingWasmCache returns the configured module, counting how many times it is fetched.
+type countingWasmCache struct {
+	module string
+	gets   *atomic.Int32
+}
+
+func (c *countingWasmCache) Get(string, wasmcache.GetOptions) (string, error) {
+	c.gets.Inc()
+	return c.module, nil
+}
+func (c *countingWasmCache) Cleanup() {}
+
+func remoteWasmExtensionConfig(name string) *discovery.Resource {
+	return remoteWasmExtensionConfigWithURL(name, "http://test/plugin.wasm")
+}
+
+// remoteWasmExtensionConfigWithURL returns an ECDS resource loading the Wasm module at uri.
+func remoteWasmExtensionConfigWithURL(name, uri string) *discovery.Resource {
+	return &discovery.Resource{
+		Name: name,
+		Resource: protoconv.MessageToAny(&core.TypedExtensionConfig{
+			Name: name,
+			TypedConfig: protoconv.MessageToAny(&wasm.Wasm{
+				Config: &wasmv3.PluginConfig{
+					Vm: &wasmv3.PluginConfig_VmConfig{
+						VmConfig: &wasmv3.VmConfig{
+							Runtime: "envoy.wasm.runtime.v8",
+							Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Remote{
+								Remote: &core.RemoteDataSource{
+									HttpUri: &core.HttpUri{
+										Uri:     uri,
+										Timeout: durationpb.New(time.Second),
+									},
+								},
+							}},
+						},
+					},
+				},
+			}),
+		}),
+	}
+}
+
+func TestECDSRewriteCache(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	module := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(module, []byte("module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := &countingWasmCache{module: module, gets: atomic.NewInt32(0)}
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = cache
+	con := &ProxyConnection{stopChan: make(chan struct{})}
+
+	resp := &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+	}
+	push := func() *discovery.DeltaDiscoveryResponse {
+		var forwarded *discovery.DeltaDiscoveryResponse
+		proxy.deltaRewriteAndForward(con, proto.Clone(resp).(*discovery.DeltaDiscoveryResponse), func(resp *discovery.DeltaDiscoveryResponse) {
+			forwarded = resp
+		})
+		if forwarded == nil {
+			t.Fatal("expected the response to be forwarded")
+		}
+		return forwarded
+	}
+
+	// Two identical pushes only fetch the module once, and are rewritten the same way.
+	first := push()
+	second := push()
+	assert.Equal(t, cache.gets.Load(), int32(1))
+	assert.Equal(t, second, first)
+
+	// A changed resource is rewritten again.
+	resp.Resources = append(resp.Resources, remoteWasmExtensionConfig("other-extension-config"))
+	push()
+	assert.Equal(t, cache.gets.Load(), int32(2))
+
+	// The rewrite is not reused once the module is purged from the cache.
+	if err := os.Remove(module); err != nil {
+		t.Fatal(err)
+	}
+	push()
+	assert.Equal(t, cache.gets.Load(), int32(4))
+}
+
+// Validates the fetched Wasm modules are inlined in the rewritten ECDS resources when enabled.
+func TestECDSRewriteInlinesModule(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	module := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(module, []byte("module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := &countingWasmCache{module: module, gets: atomic.NewInt32(0)}
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = cache
+	proxy.inlineWasmModules = true
+	con := &ProxyConnection{stopChan: make(chan struct{})}
+
+	resp := &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+	}
+	push := func() *core.DataSource {
+		var forwarded *discovery.DeltaDiscoveryResponse
+		proxy.deltaRewriteAndForward(con, proto.Clone(resp).(*discovery.DeltaDiscoveryResponse), func(resp *discovery.DeltaDiscoveryResponse) {
+			forwarded = resp
+		})
+		if forwarded == nil {
+			t.Fatal("expected the response to be forwarded")
+		}
+		ec := &core.TypedExtensionConfig{}
+		if err := forwarded.Resources[0].Resource.UnmarshalTo(ec); err != nil {
+			t.Fatal(err)
+		}
+		w := &wasm.Wasm{}
+		if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+			t.Fatal(err)
+		}
+		return w.GetConfig().GetVmConfig().GetCode().GetLocal()
+	}
+
+	local := push()
+	assert.Equal(t, local.GetInlineBytes(), []byte("module"))
+	assert.Equal(t, local.GetFilename(), "")
+
+	// The inlined rewrite is reused, as the module file is still in the cache.
+	assert.Equal(t, push(), local)
+	assert.Equal(t, cache.gets.Load(), int32(1))
+}
+
+// Validates a cached Wasm module whose file is deleted, for instance by an external cleanup, is fetched again
+// instead of handing Envoy a dangling path.
+func TestECDSRewriteRefetchesDeletedModule(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Inc()
+		// A minimal valid Wasm binary: the magic number and version.
+		w.Write([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+	}))
+	defer ts.Close()
+	proxy := setupXdsProxy(t)
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = wasmcache.NewLocalFileCache(t.TempDir(), wasmcache.Options{})
+	con := &ProxyConnection{stopChan: make(chan struct{})}
+
+	resp := &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Resources: []*discovery.Resource{remoteWasmExtensionConfigWithURL("extension-config", ts.URL+"/plugin.wasm")},
+	}
+	push := func() string {
+		var forwarded *discovery.DeltaDiscoveryResponse
+		proxy.deltaRewriteAndForward(con, proto.Clone(resp).(*discovery.DeltaDiscoveryResponse), func(resp *discovery.DeltaDiscoveryResponse) {
+			forwarded = resp
+		})
+		if forwarded == nil {
+			t.Fatal("expected the response to be forwarded")
+		}
+		ec := &core.TypedExtensionConfig{}
+		if err := forwarded.Resources[0].Resource.UnmarshalTo(ec); err != nil {
+			t.Fatal(err)
+		}
+		w := &wasm.Wasm{}
+		if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+			t.Fatal(err)
+		}
+		return w.Config.GetVmConfig().Code.GetLocal().GetFilename()
+	}
+
+	module := push()
+	assert.Equal(t, requests.Load(), int32(1))
+	if err := os.Remove(module); err != nil {
+		t.Fatal(err)
+	}
+	// The second push is a cache miss, the module is fetched again to the same path.
+	assert.Equal(t, push(), module)
+	assert.Equal(t, requests.Load(), int32(2))
+	if _, err := os.Stat(module); err != nil {
+		t.Fatalf("expected the module to be fetched again: %v", err)
+	}
+}
+
+// Validates ECDS referencing a Wasm module at a host which is not allowed is NACKed without fetching the module.
+func TestECDSRewriteRejectsDisallowedHost(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Inc()
+		w.Write([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		allowedHosts sets.String
+		wantNack     bool
+	}{
+		{name: "allowed", allowedHosts: sets.New(u.Hostname())},
+		{name: "disallowed", allowedHosts: sets.New("example.com"), wantNack: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests.Store(0)
+			proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+				WASMCache: wasmcache.NewLocalFileCache(t.TempDir(), wasmcache.Options{AllowedHosts: c.allowedHosts}),
+			})
+			con := &ProxyConnection{
+				stopChan:          make(chan struct{}),
+				deltaRequestsChan: channels.NewUnbounded[*discovery.DeltaDiscoveryRequest](),
+			}
+
+			var forwarded *discovery.DeltaDiscoveryResponse
+			proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+				TypeUrl:   v3.ExtensionConfigurationType,
+				Nonce:     "n1",
+				Resources: []*discovery.Resource{remoteWasmExtensionConfigWithURL("extension-config", ts.URL+"/plugin.wasm")},
+			}, func(resp *discovery.DeltaDiscoveryResponse) {
+				forwarded = resp
+			})
+			if !c.wantNack {
+				if forwarded == nil {
+					t.Fatal("expected the response to be forwarded")
+				}
+				assert.Equal(t, requests.Load(), int32(1))
+				return
+			}
+			if forwarded != nil {
+				t.Fatalf("unexpected response forwarded to Envoy: %v", forwarded)
+			}
+			select {
+			case nack := <-con.deltaRequestsChan.Get():
+				assert.Equal(t, nack.ResponseNonce, "n1")
+				if !strings.Contains(nack.ErrorDetail.GetMessage(), "is not allowed") {
+					t.Fatalf("unexpected NACK: %v", nack.ErrorDetail)
+				}
+			default:
+				t.Fatal("expected the response to be NACKed")
+			}
+			assert.Equal(t, requests.Load(), int32(0))
+		})
+	}
+}
+
+// Validates a custom Wasm cache set in the agent options is used to rewrite ECDS.
+func TestCustomWasmCache(t *testing.T) {
+	module := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(module, []byte("module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := &countingWasmCache{module: module, gets: atomic.NewInt32(0)}
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{WASMCache: cache})
+	con := &ProxyConnection{stopChan: make(chan struct{})}
+
+	var forwarded *discovery.DeltaDiscoveryResponse
+	proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+	}, func(resp *discovery.DeltaDiscoveryResponse) {
+		forwarded = resp
+	})
+	if forwarded == nil {
+		t.Fatal("expected the response to be forwarded")
+	}
+	assert.Equal(t, cache.gets.Load(), int32(1))
+	ec := &core.TypedExtensionConfig{}
+	if err := forwarded.Resources[0].Resource.UnmarshalTo(ec); err != nil {
+		t.Fatal(err)
+	}
+	w := &wasm.Wasm{}
+	if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, w.Config.GetVmConfig().Code.GetLocal().GetFilename(), module)
+}
+
+// Validates the Wasm modules prewarmed when the proxy is initialized are used by the first ECDS push,
+// which is ACKed without fetching the module.
+func TestECDSRewritePrewarmedModule(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Inc()
+		w.Write([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+	}))
+	defer ts.Close()
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		WASMCache:   wasmcache.NewLocalFileCache(t.TempDir(), wasmcache.Options{}),
+		WASMOptions: wasmcache.Options{PrewarmURLs: []string{ts.URL + "/plugin.wasm"}},
+	})
+	// The module is fetched while the proxy is initialized, before Envoy connects.
+	assert.Equal(t, requests.Load(), int32(1))
+
+	con := &ProxyConnection{
+		stopChan:          make(chan struct{}),
+		deltaRequestsChan: channels.NewUnbounded[*discovery.DeltaDiscoveryRequest](),
+	}
+	var forwarded *discovery.DeltaDiscoveryResponse
+	proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Nonce:     "n1",
+		Resources: []*discovery.Resource{remoteWasmExtensionConfigWithURL("extension-config", ts.URL+"/plugin.wasm")},
+	}, func(resp *discovery.DeltaDiscoveryResponse) {
+		forwarded = resp
+	})
+	if forwarded == nil {
+		select {
+		case nack := <-con.deltaRequestsChan.Get():
+			t.Fatalf("expected the response to be forwarded, got NACK: %v", nack.ErrorDetail)
+		default:
+			t.Fatal("expected the response to be forwarded")
+		}
+	}
+	assert.Equal(t, requests.Load(), int32(1))
+}
+
+// Validates a local override of the Wasm module of an extension config is used instead of the module pushed by
+// the upstream, which is not fetched.
+func TestECDSRewriteLocalOverride(t *testing.T) {
+	override := filepath.Join(t.TempDir(), "known-good.wasm")
+	if err := os.WriteFile(override, []byte("module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := &countingWasmCache{module: filepath.Join(t.TempDir(), "pushed.wasm"), gets: atomic.NewInt32(0)}
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		WASMCache:   cache,
+		WASMOptions: wasmcache.Options{LocalOverrides: map[string]string{"extension-config": override}},
+	})
+	con := &ProxyConnection{stopChan: make(chan struct{})}
+
+	var forwarded *discovery.DeltaDiscoveryResponse
+	proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ExtensionConfigurationType,
+		Resources: []*discovery.Resource{
+			remoteWasmExtensionConfig("extension-config"),
+			remoteWasmExtensionConfig("other-extension-config"),
+		},
+	}, func(resp *discovery.DeltaDiscoveryResponse) {
+		forwarded = resp
+	})
+	if forwarded == nil {
+		t.Fatal("expected the response to be forwarded")
+	}
+	modules := map[string]string{}
+	for _, r := range forwarded.Resources {
+		ec := &core.TypedExtensionConfig{}
+		if err := r.Resource.UnmarshalTo(ec); err != nil {
+			t.Fatal(err)
+		}
+		w := &wasm.Wasm{}
+		if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+			t.Fatal(err)
+		}
+		modules[ec.Name] = w.GetConfig().GetVmConfig().GetCode().GetLocal().GetFilename()
+	}
+	assert.Equal(t, modules, map[string]string{
+		"extension-config":       override,
+		"other-extension-config": cache.module,
+	})
+	// Only the module of the extension config without override is fetched.
+	assert.Equal(t, cache.gets.Load(), int32(1))
+}
+
+// Validates the Wasm modules held in memory are inlined in the rewritten extension configs.
+func TestECDSRewriteInMemoryCache(t *testing.T) {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(module)
+	}))
+	defer ts.Close()
+	// The cache is created from the options, without any writable directory.
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		WASMOptions: wasmcache.Options{InMemory: true},
+	})
+	con := &ProxyConnection{
+		stopChan:          make(chan struct{}),
+		deltaRequestsChan: channels.NewUnbounded[*discovery.DeltaDiscoveryRequest](),
+	}
+	var forwarded *discovery.DeltaDiscoveryResponse
+	proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Nonce:     "n1",
+		Resources: []*discovery.Resource{remoteWasmExtensionConfigWithURL("extension-config", ts.URL+"/plugin.wasm")},
+	}, func(resp *discovery.DeltaDiscoveryResponse) {
+		forwarded = resp
+	})
+	if forwarded == nil {
+		select {
+		case nack := <-con.deltaRequestsChan.Get():
+			t.Fatalf("expected the response to be forwarded, got NACK: %v", nack.ErrorDetail)
+		default:
+			t.Fatal("expected the response to be forwarded")
+		}
+	}
+	ec := &core.TypedExtensionConfig{}
+	if err := forwarded.Resources[0].Resource.UnmarshalTo(ec); err != nil {
+		t.Fatal(err)
+	}
+	w := &wasm.Wasm{}
+	if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, w.GetConfig().GetVmConfig().GetCode().GetLocal().GetInlineBytes(), module)
+}
+
+func TestECDSRewriteNodeMetadataPredicate(t *testing.T) {
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		WasmRewritePredicate: func(meta *model.NodeMetadata) bool {
+			return meta.Labels["wasm-rewrite"] == "enabled"
+		},
+	})
+	module := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(module, []byte("module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := &countingWasmCache{module: module, gets: atomic.NewInt32(0)}
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = cache
+
+	codeOf := func(labels map[string]string) *core.AsyncDataSource {
+		con := &ProxyConnection{stopChan: make(chan struct{})}
+		con.recordNode(&core.Node{Metadata: model.NodeMetadata{Labels: labels}.ToStruct()})
+		var forwarded *discovery.DiscoveryResponse
+		proxy.rewriteAndForward(con, &discovery.DiscoveryResponse{
+			TypeUrl:   v3.ExtensionConfigurationType,
+			Resources: []*anypb.Any{remoteWasmExtensionConfig("extension-config").Resource},
+		}, func(resp *discovery.DiscoveryResponse) {
+			forwarded = resp
+		})
+		if forwarded == nil {
+			t.Fatal("expected the response to be forwarded")
+		}
+		ec := &core.TypedExtensionConfig{}
+		if err := forwarded.Resources[0].UnmarshalTo(ec); err != nil {
+			t.Fatal(err)
+		}
+		w := &wasm.Wasm{}
+		if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+			t.Fatal(err)
+		}
+		return w.GetConfig().GetVmConfig().GetCode()
+	}
+
+	// The node without the label fetches the module itself.
+	disabled := codeOf(map[string]string{"app": "fetches-itself"})
+	assert.Equal(t, disabled.GetRemote().GetHttpUri().GetUri(), "http://test/plugin.wasm")
+	assert.Equal(t, cache.gets.Load(), int32(0))
+
+	// The node with the label loads the module rewritten to a local file.
+	enabled := codeOf(map[string]string{"wasm-rewrite": "enabled"})
+	assert.Equal(t, enabled.GetLocal().GetFilename(), module)
+	assert.Equal(t, cache.gets.Load(), int32(1))
+}
+
+// routingWasmCache fetches each Wasm module from the cache configured for its URL.
+type routingWasmCache map[string]wasmcache.Cache
+
+func (c routingWasmCache) Get(url string, opts wasmcache.GetOptions) (string, error) {
+	return c[url].Get(url, opts)
+}
+func (c routingWasmCache) Cleanup() {}
+
+func TestECDSResourceStatuses(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = routingWasmCache{
+		"http://test/ok.wasm":  &fakeAckCache{},
+		"http://test/bad.wasm": &fakeNackCache{},
+	}
+	con := &ProxyConnection{
+		stopChan:     make(chan struct{}),
+		requestsChan: channels.NewUnbounded[*discovery.DiscoveryRequest](),
+	}
+	proxy.rewriteAndForward(con, &discovery.DiscoveryResponse{
+		TypeUrl: v3.ExtensionConfigurationType,
+		Nonce:   "nonce",
+		Resources: []*anypb.Any{
+			remoteWasmExtensionConfigWithURL("ok-extension", "http://test/ok.wasm").Resource,
+			remoteWasmExtensionConfigWithURL("bad-extension", "http://test/bad.wasm").Resource,
+		},
+	}, func(*discovery.DiscoveryResponse) {
+		t.Fatal("expected the response to be rejected")
+	})
+
+	rec := httptest.NewRecorder()
+	proxy.ecdsz(rec, nil)
+	var out struct {
+		Resources map[string]ecdsResourceStatus `json:"resources"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	ok, bad := out.Resources["ok-extension"], out.Resources["bad-extension"]
+	assert.Equal(t, ok.Status, ecdsFetchFetched)
+	assert.Equal(t, ok.URL, "http://test/ok.wasm")
+	assert.Equal(t, ok.Error, "")
+	assert.Equal(t, bad.Status, ecdsFetchFailed)
+	assert.Equal(t, bad.URL, "http://test/bad.wasm")
+	assert.Equal(t, bad.Error, "error")
+}
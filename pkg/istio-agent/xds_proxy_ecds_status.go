@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pkg/maps"
+)
+
+// States of the fetch of the Wasm module of an ECDS resource, as reported by /debug/ecdsz.
+const (
+	ecdsFetchPending = "pending"
+	ecdsFetchFetched = "fetched"
+	ecdsFetchFailed  = "failed"
+)
+
+// ecdsResourceStatus is the state of the last fetch of the Wasm module of an ECDS resource.
+type ecdsResourceStatus struct {
+	Status string    `json:"status"`
+	URL    string    `json:"url,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// ecdsResourceStatuses tracks the state of the fetch of the Wasm modules of the ECDS resources, by resource name.
+// Resources which do not reference a remote Wasm module are not tracked.
+type ecdsResourceStatuses struct {
+	mu       sync.Mutex
+	statuses map[string]ecdsResourceStatus
+}
+
+// pending records that the Wasm modules of the named resources, if any, are being fetched.
+func (s *ecdsResourceStatuses) pending(names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statuses == nil {
+		s.statuses = map[string]ecdsResourceStatus{}
+	}
+	now := time.Now()
+	for _, name := range names {
+		st := s.statuses[name]
+		st.Status = ecdsFetchPending
+		st.Error = ""
+		st.Time = now
+		s.statuses[name] = st
+	}
+}
+
+// record records the outcome of the fetch of the Wasm module of a rewritten resource.
+func (s *ecdsResourceStatuses) record(rewrite ecdsRewrite) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rewrite.fetch == nil {
+		// No remote Wasm module was fetched for the resource.
+		delete(s.statuses, rewrite.name)
+		return
+	}
+	if s.statuses == nil {
+		s.statuses = map[string]ecdsResourceStatus{}
+	}
+	st := ecdsResourceStatus{Status: ecdsFetchFetched, URL: rewrite.fetch.url, Time: time.Now()}
+	if rewrite.fetch.err != nil {
+		st.Status = ecdsFetchFailed
+		st.Error = rewrite.fetch.err.Error()
+	}
+	s.statuses[rewrite.name] = st
+}
+
+func (s *ecdsResourceStatuses) snapshot() map[string]ecdsResourceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.statuses)
+}
@@ -0,0 +1,81 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"istio.io/istio/pkg/backoff"
+)
+
+const (
+	// upstreamFailoverDialTimeout bounds the time spent connecting to each upstream address when failing over,
+	// so that the following addresses can be tried before the connection attempt times out.
+	upstreamFailoverDialTimeout = 2 * time.Second
+	upstreamFailoverBackoff     = 100 * time.Millisecond
+	upstreamFailoverMaxBackoff  = time.Second
+)
+
+// upstreamAddresses returns the addresses of the upstream XDS servers, in order of preference.
+func (p *XdsProxy) upstreamAddresses() []string {
+	return append([]string{p.istiodAddress}, p.failoverAddresses...)
+}
+
+// activeUpstreamAddress returns the address of the upstream XDS server the proxy last connected to.
+func (p *XdsProxy) activeUpstreamAddress() string {
+	if addr := p.activeAddress.Load(); addr != "" {
+		return addr
+	}
+	return p.istiodAddress
+}
+
+// dialWithFailover connects to the first reachable upstream address, in order of preference, backing off
+// between the attempts. The same dial options, and so TLS settings, are used for all the addresses.
+func (p *XdsProxy) dialWithFailover(ctx context.Context, opts []grpc.DialOption) (*grpc.ClientConn, error) {
+	// Block until connected, so that unreachable addresses are detected here rather than by the stream.
+	opts = append(append([]grpc.DialOption{}, opts...), grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+	b := backoff.NewExponentialBackOff(backoff.Option{
+		InitialInterval: upstreamFailoverBackoff,
+		MaxInterval:     upstreamFailoverMaxBackoff,
+	})
+	var errs []error
+	for i, addr := range p.upstreamAddresses() {
+		if i > 0 {
+			select {
+			case <-time.After(b.NextBackOff()):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("failed to connect to any upstream address: %w", errors.Join(append(errs, ctx.Err())...))
+			}
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, upstreamFailoverDialTimeout)
+		conn, err := p.dialUpstream(dialCtx, addr, opts...)
+		cancel()
+		if err == nil {
+			if prev := p.activeUpstreamAddress(); prev != addr {
+				proxyLog.Infof("switched upstream XDS server from %s to %s", prev, addr)
+			}
+			p.activeAddress.Store(addr)
+			return conn, nil
+		}
+		proxyLog.Warnf("failed to connect to upstream %s: %v", addr, err)
+		errs = append(errs, fmt.Errorf("%s: %v", addr, err))
+	}
+	return nil, fmt.Errorf("failed to connect to any upstream address: %w", errors.Join(errs...))
+}
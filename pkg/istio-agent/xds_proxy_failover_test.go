@@ -0,0 +1,69 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/test/xds"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+// Validates the proxy fails over to the next upstream address when the first one refuses connections.
+func TestXdsProxyUpstreamFailover(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.istiodAddress = "primary:15012"
+	proxy.failoverAddresses = []string{"secondary:15012"}
+
+	// The primary is down and refuses connections.
+	primary := xdstest.NewMockServer(t)
+	primary.Listener.Close()
+	secondary := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	primaryDials := atomic.NewInt32(0)
+	proxy.dialOptions = []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(_ context.Context, addr string) (net.Conn, error) {
+			if addr == "primary:15012" {
+				primaryDials.Inc()
+				conn, err := primary.Listener.Dial()
+				if err != nil {
+					return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+				}
+				return conn, nil
+			}
+			return secondary.BufListener.Dial()
+		}),
+	}
+
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+	if primaryDials.Load() == 0 {
+		t.Fatal("expected the primary address to be tried first")
+	}
+	assert.Equal(t, proxy.UpstreamHealth().Address, "secondary:15012")
+}
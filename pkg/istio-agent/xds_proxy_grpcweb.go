@@ -0,0 +1,220 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// grpcWebDeltaPath is the path of the delta XDS method requested by gRPC-web clients.
+	grpcWebDeltaPath = "/envoy.service.discovery.v3.AggregatedDiscoveryService/DeltaAggregatedResources"
+	// grpcWebMaxRequestSize bounds the size of the body of the gRPC-web requests.
+	grpcWebMaxRequestSize = 4 * 1024 * 1024
+
+	grpcWebDataFrame    byte = 0x00
+	grpcWebTrailerFrame byte = 0x80
+)
+
+// isGrpcWeb returns true if r is a gRPC-web request, either binary or base64 encoded.
+func isGrpcWeb(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("content-type"), "application/grpc-web")
+}
+
+// serveGrpcWeb serves the delta XDS streams of gRPC-web clients, such as browser based debugging tools, with
+// DeltaAggregatedResources. gRPC-web clients cannot stream requests: the requests are all read from the body of
+// the HTTP request, after which the stream stays open to receive the responses until the client goes away.
+// These streams are served alongside the stream of Envoy, without replacing it.
+func (p *XdsProxy) serveGrpcWeb(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != grpcWebDeltaPath {
+		http.Error(w, fmt.Sprintf("unsupported gRPC-web method %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+		return
+	}
+	contentType := r.Header.Get("content-type")
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+	var body io.Reader = http.MaxBytesReader(w, r.Body, grpcWebMaxRequestSize)
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	requests, err := readGrpcWebRequests(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid gRPC-web request: %v", err), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The gRPC-web streams are limited along with the streams of Envoy, as each opens a stream to the upstream.
+	admitErr := p.admitDownstreamStream(r.URL.Path)
+	if admitErr == nil {
+		defer p.downstreamStreams.Dec()
+	}
+	w.Header().Set("content-type", contentType)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	stream := &grpcWebDeltaStream{
+		ctx:      r.Context(),
+		requests: requests,
+		w:        w,
+		flusher:  flusher,
+		text:     text,
+	}
+	if admitErr != nil {
+		stream.close(admitErr)
+		return
+	}
+	proxyLog.Infof("accepted gRPC-web delta xds connection from %s", r.RemoteAddr)
+	stream.close(p.DeltaAggregatedResources(stream))
+}
+
+// readGrpcWebRequests reads the length prefixed delta requests of a gRPC-web request body.
+func readGrpcWebRequests(body io.Reader) ([]*discovery.DeltaDiscoveryRequest, error) {
+	var requests []*discovery.DeltaDiscoveryRequest
+	r := bufio.NewReader(body)
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return requests, nil
+			}
+			return nil, err
+		}
+		if header[0] != grpcWebDataFrame {
+			return nil, fmt.Errorf("unsupported frame flags %x", header[0])
+		}
+		// The length is checked before allocating the message, as the body is only bounded as it is read.
+		size := binary.BigEndian.Uint32(header[1:])
+		if size > grpcWebMaxRequestSize {
+			return nil, fmt.Errorf("message of %d bytes exceeds the maximum request size of %d bytes", size, grpcWebMaxRequestSize)
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		req := &discovery.DeltaDiscoveryRequest{}
+		if err := proto.Unmarshal(msg, req); err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+}
+
+// grpcWebDeltaStream adapts a gRPC-web request to a delta XDS stream.
+type grpcWebDeltaStream struct {
+	ctx      context.Context
+	requests []*discovery.DeltaDiscoveryRequest
+	text     bool
+
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+	// closed is set once the trailers are written, as the response can no longer be written to after that.
+	closed bool
+}
+
+var _ discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer = &grpcWebDeltaStream{}
+
+// Recv returns the requests read from the body of the gRPC-web request, then blocks until the client goes away.
+func (s *grpcWebDeltaStream) Recv() (*discovery.DeltaDiscoveryRequest, error) {
+	if len(s.requests) > 0 {
+		req := s.requests[0]
+		s.requests = s.requests[1:]
+		return req, nil
+	}
+	<-s.ctx.Done()
+	return nil, status.FromContextError(s.ctx.Err()).Err()
+}
+
+func (s *grpcWebDeltaStream) Send(resp *discovery.DeltaDiscoveryResponse) error {
+	b, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.writeFrame(grpcWebDataFrame, b)
+}
+
+// close writes the trailers reporting the status of the stream.
+func (s *grpcWebDeltaStream) close(err error) {
+	st := status.Convert(err)
+	_ = s.writeFrame(grpcWebTrailerFrame,
+		[]byte(fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", st.Code(), url.PathEscape(st.Message()))))
+}
+
+func (s *grpcWebDeltaStream) writeFrame(flags byte, b []byte) error {
+	frame := make([]byte, 5, 5+len(b))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	frame = append(frame, b...)
+	if s.text {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return status.Error(codes.Canceled, "gRPC-web stream closed")
+	}
+	s.closed = flags == grpcWebTrailerFrame
+	if _, err := s.w.Write(frame); err != nil {
+		return status.Errorf(codes.Unavailable, "failed to write gRPC-web frame: %v", err)
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *grpcWebDeltaStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *grpcWebDeltaStream) SendMsg(m any) error {
+	return s.Send(m.(*discovery.DeltaDiscoveryResponse))
+}
+
+func (s *grpcWebDeltaStream) RecvMsg(m any) error {
+	req, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m.(*discovery.DeltaDiscoveryRequest), req)
+	return nil
+}
+
+func (s *grpcWebDeltaStream) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *grpcWebDeltaStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *grpcWebDeltaStream) SetTrailer(metadata.MD) {}
@@ -0,0 +1,268 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/slices"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+// grpcWebFrame encodes msg as a gRPC-web data frame.
+func grpcWebFrame(t *testing.T, msg proto.Message, text bool) []byte {
+	t.Helper()
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := binary.BigEndian.AppendUint32([]byte{grpcWebDataFrame}, uint32(len(b)))
+	frame = append(frame, b...)
+	if text {
+		return []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	return frame
+}
+
+// readGrpcWebFrame reads the next gRPC-web frame of r, returning its flags and message.
+func readGrpcWebFrame(t *testing.T, r io.Reader, text bool) (byte, []byte) {
+	t.Helper()
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if !text {
+		header := read(5)
+		return header[0], read(int(binary.BigEndian.Uint32(header[1:])))
+	}
+	// Each frame is base64 encoded on its own. 8 characters decode to 6 bytes, which cover the header.
+	start := read(8)
+	header, err := base64.StdEncoding.DecodeString(string(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := base64.StdEncoding.EncodedLen(5 + int(binary.BigEndian.Uint32(header[1:5])))
+	frame, err := base64.StdEncoding.DecodeString(string(append(start, read(size-8)...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame[0], frame[5:]
+}
+
+// Validates a gRPC-web client can open a delta stream through the proxy, without replacing the stream of Envoy.
+func TestDeltaXdsProxyGrpcWeb(t *testing.T) {
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text"} {
+		t.Run(contentType, func(t *testing.T) {
+			text := contentType == "application/grpc-web-text"
+			proxy := setupXdsProxy(t)
+			f := xdstest.NewMockServer(t)
+			setDialOptions(proxy, f.Listener)
+			ts := httptest.NewServer(http.HandlerFunc(proxy.serveGrpcWeb))
+			defer ts.Close()
+
+			body := grpcWebFrame(t, &discovery.DeltaDiscoveryRequest{
+				TypeUrl: v3.ClusterType,
+				Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+			}, text)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.URL+grpcWebDeltaPath, bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("content-type", contentType)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			assert.Equal(t, resp.Header.Get("content-type"), contentType)
+
+			want := &discovery.DeltaDiscoveryResponse{
+				TypeUrl: v3.ClusterType,
+				Nonce:   "n1",
+				Resources: slices.Map(clusterResources("a", "b"), func(r *anypb.Any) *discovery.Resource {
+					return &discovery.Resource{Name: xdsResourceName(r), Resource: r}
+				}),
+			}
+			f.SendDeltaResponse(want)
+			flags, msg := readGrpcWebFrame(t, resp.Body, text)
+			assert.Equal(t, flags, grpcWebDataFrame)
+			got := &discovery.DeltaDiscoveryResponse{}
+			if err := proto.Unmarshal(msg, got); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, got, want)
+
+			proxy.connectedMutex.RLock()
+			defer proxy.connectedMutex.RUnlock()
+			if proxy.connected != nil {
+				t.Fatal("expected the gRPC-web stream not to be registered as the stream of Envoy")
+			}
+		})
+	}
+}
+
+func TestDeltaXdsProxyGrpcWebInvalidRequest(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	ts := httptest.NewServer(http.HandlerFunc(proxy.serveGrpcWeb))
+	defer ts.Close()
+
+	cases := []struct {
+		name string
+		path string
+		body []byte
+		want int
+	}{
+		{name: "unknown method", path: "/envoy.service.discovery.v3.AggregatedDiscoveryService/StreamAggregatedResources", want: http.StatusNotFound},
+		{name: "truncated frame", path: grpcWebDeltaPath, body: []byte{grpcWebDataFrame, 0, 0, 0, 10, 1}, want: http.StatusBadRequest},
+		{name: "trailer frame", path: grpcWebDeltaPath, body: []byte{grpcWebTrailerFrame, 0, 0, 0, 0}, want: http.StatusBadRequest},
+		// The length prefix claims about 4GiB, which must not be allocated.
+		{name: "oversized length prefix", path: grpcWebDeltaPath, body: []byte{grpcWebDataFrame, 0xff, 0xff, 0xff, 0xff}, want: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+c.path, "application/grpc-web+proto", bytes.NewReader(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, c.want)
+		})
+	}
+}
+
+// openGrpcWebStream opens a binary gRPC-web delta stream to the server at url, sending reqs.
+func openGrpcWebStream(t *testing.T, url string, reqs ...*discovery.DeltaDiscoveryRequest) *http.Response {
+	t.Helper()
+	var body []byte
+	for _, req := range reqs {
+		body = append(body, grpcWebFrame(t, req, false)...)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+grpcWebDeltaPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("content-type", "application/grpc-web+proto")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	return resp
+}
+
+// Validates the gRPC-web streams count against the limit of concurrent downstream streams.
+func TestDeltaXdsProxyGrpcWebStreamLimit(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.maxDownstreamStreams = 1
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	ts := httptest.NewServer(http.HandlerFunc(proxy.serveGrpcWeb))
+	// Registered first, so the streams are closed before the server waits for them.
+	t.Cleanup(ts.Close)
+
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	openGrpcWebStream(t, ts.URL, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node})
+	rejected := openGrpcWebStream(t, ts.URL, &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node})
+	flags, msg := readGrpcWebFrame(t, rejected.Body, false)
+	assert.Equal(t, flags, grpcWebTrailerFrame)
+	if !strings.Contains(string(msg), fmt.Sprintf("grpc-status: %d", codes.ResourceExhausted)) {
+		t.Fatalf("expected the stream to be rejected with ResourceExhausted, got %q", msg)
+	}
+}
+
+// Validates the responses to a gRPC-web client, which cannot acknowledge them, are neither held nor resent.
+func TestDeltaXdsProxyGrpcWebWithoutAcks(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.maxInflightResponses = 1
+	proxy.ackTimeouts = map[string]time.Duration{v3.ClusterType: time.Millisecond * 50}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	ts := httptest.NewServer(http.HandlerFunc(proxy.serveGrpcWeb))
+	// Registered first, so the streams are closed before the server waits for them.
+	t.Cleanup(ts.Close)
+
+	resp := openGrpcWebStream(t, ts.URL, &discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	})
+	frames := make(chan string, 10)
+	go func() {
+		for {
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(resp.Body, b); err != nil {
+				close(frames)
+				return
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(b[1:]))
+			if _, err := io.ReadFull(resp.Body, msg); err != nil {
+				close(frames)
+				return
+			}
+			got := &discovery.DeltaDiscoveryResponse{}
+			_ = proto.Unmarshal(msg, got)
+			frames <- got.Nonce
+		}
+	}()
+	for _, nonce := range []string{"1", "2"} {
+		f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+			TypeUrl: v3.ClusterType,
+			Nonce:   nonce,
+			Resources: slices.Map(clusterResources("a"), func(r *anypb.Any) *discovery.Resource {
+				return &discovery.Resource{Name: xdsResourceName(r), Resource: r}
+			}),
+		})
+		select {
+		case got := <-frames:
+			assert.Equal(t, got, nonce)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("expected response %s not to wait for the acknowledgement of the previous one", nonce)
+		}
+	}
+	// Nothing is resent once the ACK timeout elapsed.
+	select {
+	case got, ok := <-frames:
+		if ok {
+			t.Fatalf("unexpected resent response %s", got)
+		}
+	case <-time.After(time.Millisecond * 200):
+	}
+}
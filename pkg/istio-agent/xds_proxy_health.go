@@ -0,0 +1,103 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// UpstreamHealth reports the state of the connection of the XDS proxy to the upstream XDS server.
+type UpstreamHealth struct {
+	// Connected is true while a stream to the upstream is established.
+	Connected bool `json:"connected"`
+	// LastResponse is the last time a response was received from the upstream.
+	LastResponse time.Time `json:"lastResponse,omitempty"`
+	// LastError is the error which terminated the last stream to the upstream.
+	LastError string `json:"lastError,omitempty"`
+	// DisconnectedSince is the time the last stream to the upstream terminated, if not Connected.
+	DisconnectedSince time.Time `json:"disconnectedSince,omitempty"`
+	// Address is the address of the upstream last connected to.
+	Address string `json:"address"`
+}
+
+// check returns an error if the upstream has been disconnected for longer than threshold.
+// The upstream is considered healthy until a stream terminates or fails to be established.
+func (h UpstreamHealth) check(threshold time.Duration) error {
+	if h.Connected || h.DisconnectedSince.IsZero() {
+		return nil
+	}
+	if d := time.Since(h.DisconnectedSince); d > threshold {
+		return fmt.Errorf("disconnected from the XDS server for %v: %v", d.Round(time.Second), h.LastError)
+	}
+	return nil
+}
+
+// upstreamHealthTracker tracks the health of the stream of the current connection to the upstream.
+// Updates from connections other than the current one, which are being replaced, are ignored.
+type upstreamHealthTracker struct {
+	mu     sync.RWMutex
+	conID  uint32
+	health UpstreamHealth
+}
+
+// connected records that the stream of the connection conID to the upstream is established.
+func (t *upstreamHealthTracker) connected(conID uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conID = conID
+	t.health.Connected = true
+	t.health.DisconnectedSince = time.Time{}
+}
+
+// received records that a response was received on the stream of the connection conID.
+func (t *upstreamHealthTracker) received(conID uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conID == conID {
+		t.health.LastResponse = time.Now()
+	}
+}
+
+// disconnected records that the stream of the connection conID to the upstream terminated with err.
+func (t *upstreamHealthTracker) disconnected(conID uint32, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conID != conID && t.health.Connected {
+		return
+	}
+	if t.health.Connected || t.health.DisconnectedSince.IsZero() {
+		t.health.DisconnectedSince = time.Now()
+	}
+	t.conID = conID
+	t.health.Connected = false
+	if err != nil {
+		t.health.LastError = err.Error()
+	}
+}
+
+func (t *upstreamHealthTracker) get() UpstreamHealth {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.health
+}
+
+// UpstreamHealth returns the state of the connection to the upstream XDS server.
+func (p *XdsProxy) UpstreamHealth() UpstreamHealth {
+	h := p.upstreamHealth.get()
+	h.Address = p.activeUpstreamAddress()
+	return h
+}
@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/test/xds"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestUpstreamHealthTracker(t *testing.T) {
+	var tracker upstreamHealthTracker
+	// Healthy until a stream terminates.
+	assert.NoError(t, tracker.get().check(0))
+
+	tracker.connected(1)
+	tracker.received(1)
+	h := tracker.get()
+	assert.Equal(t, h.Connected, true)
+	assert.Equal(t, h.LastResponse.IsZero(), false)
+
+	// A previous connection being replaced does not affect the current one.
+	tracker.disconnected(0, errors.New("replaced"))
+	assert.Equal(t, tracker.get().Connected, true)
+
+	tracker.disconnected(1, errors.New("upstream terminated"))
+	h = tracker.get()
+	assert.Equal(t, h.Connected, false)
+	assert.Equal(t, h.LastError, "upstream terminated")
+	assert.NoError(t, h.check(time.Hour))
+	assert.Error(t, h.check(0))
+
+	// Failing to reconnect does not reset the time since the upstream is disconnected.
+	tracker.disconnected(2, errors.New("connection refused"))
+	assert.Equal(t, tracker.get().DisconnectedSince, h.DisconnectedSince)
+
+	tracker.connected(2)
+	assert.NoError(t, tracker.get().check(0))
+}
+
+func TestXdsProxyUpstreamHealth(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	killer := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(killer.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	sendDeltaDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+
+	h := proxy.UpstreamHealth()
+	assert.Equal(t, h.Connected, true)
+	assert.Equal(t, h.LastResponse.IsZero(), false)
+
+	proxy.ia.cfg.UpstreamDisconnectedThreshold = time.Millisecond
+	assert.NoError(t, proxy.ia.Check())
+
+	killer.kill()
+	retry.UntilSuccessOrFail(t, func() error {
+		if h := proxy.UpstreamHealth(); h.Connected || h.LastError == "" {
+			return fmt.Errorf("expected the upstream to be disconnected, got %+v", h)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	retry.UntilSuccessOrFail(t, func() error {
+		if err := proxy.ia.Check(); err == nil {
+			return fmt.Errorf("expected the agent to be not ready")
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+}
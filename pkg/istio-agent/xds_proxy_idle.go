@@ -0,0 +1,184 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"istio.io/istio/pilot/pkg/xds"
+)
+
+// errUpstreamIdle is the cause of the reconnection of an idle upstream.
+var errUpstreamIdle = errors.New("upstream XDS server idle")
+
+// upstreamIdleWatch is a kind of activity of the upstream, and the time without it after which the upstream is
+// reconnected.
+type upstreamIdleWatch struct {
+	timeout time.Duration
+	// last returns the last time of the activity.
+	last func() time.Time
+	// what describes the activity, for the logs.
+	what string
+}
+
+// upstreamIdleTimer fires once the upstream of a connection was idle for the timeout of one of its watches. It is
+// selected on by the loop sending the requests upstream, so that the upstream is replaced without closing the
+// stream of Envoy. A nil timer never fires.
+type upstreamIdleTimer struct {
+	watches []upstreamIdleWatch
+	timer   *time.Timer
+	// since is the time the timer started or last fired. The upstream is not idle before it.
+	since time.Time
+}
+
+// newUpstreamIdleTimer returns the timer watching the upstream of con, or nil if the upstream is not watched.
+func (p *XdsProxy) newUpstreamIdleTimer(con *ProxyConnection) *upstreamIdleTimer {
+	return newUpstreamIdleTimer(upstreamIdleWatch{
+		timeout: p.upstreamMaxIdle,
+		last:    con.upstreamActivity.Load,
+		what:    "message exchanged",
+	}, upstreamIdleWatch{
+		timeout: p.upstreamRecvIdleTimeout,
+		last:    con.upstreamResponse.Load,
+		what:    "response received",
+	})
+}
+
+func newUpstreamIdleTimer(watches ...upstreamIdleWatch) *upstreamIdleTimer {
+	t := &upstreamIdleTimer{since: time.Now()}
+	for _, w := range watches {
+		if w.timeout > 0 {
+			t.watches = append(t.watches, w)
+		}
+	}
+	if len(t.watches) == 0 {
+		return nil
+	}
+	t.timer = time.NewTimer(t.shortestTimeout())
+	return t
+}
+
+// C returns the channel receiving once the upstream may be idle, see expired.
+func (t *upstreamIdleTimer) C() <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// expired returns an error wrapping errUpstreamIdle if the upstream was idle for the timeout of a watch, in which
+// case the timer restarts. Otherwise, the timer is rearmed for the earliest remaining timeout. It must be called
+// once C receives.
+func (t *upstreamIdleTimer) expired() error {
+	now := time.Now()
+	next := time.Duration(0)
+	for _, w := range t.watches {
+		last := w.last()
+		if last.Before(t.since) {
+			last = t.since
+		}
+		idleFor := now.Sub(last)
+		if idleFor >= w.timeout {
+			t.since = now
+			t.timer.Reset(t.shortestTimeout())
+			return fmt.Errorf("no %s for %v: %w", w.what, idleFor.Round(time.Millisecond), errUpstreamIdle)
+		}
+		if remaining := w.timeout - idleFor; next == 0 || remaining < next {
+			next = remaining
+		}
+	}
+	t.timer.Reset(next)
+	return nil
+}
+
+func (t *upstreamIdleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *upstreamIdleTimer) shortestTimeout() time.Duration {
+	shortest := t.watches[0].timeout
+	for _, w := range t.watches[1:] {
+		shortest = min(shortest, w.timeout)
+	}
+	return shortest
+}
+
+// sotwResumeRequests tracks the latest request of each type sent upstream on a SotW stream, so that they are
+// resent on a new upstream stream replacing an idle one.
+type sotwResumeRequests struct {
+	node     *core.Node
+	types    []string
+	requests map[string]*discovery.DiscoveryRequest
+}
+
+func newSotwResumeRequests() *sotwResumeRequests {
+	return &sotwResumeRequests{requests: map[string]*discovery.DiscoveryRequest{}}
+}
+
+// sent records req, sent upstream.
+func (r *sotwResumeRequests) sent(req *discovery.DiscoveryRequest) {
+	if r.node == nil && req.Node != nil {
+		r.node = req.Node
+	}
+	if _, f := r.requests[req.TypeUrl]; !f {
+		r.types = append(r.types, req.TypeUrl)
+	}
+	r.requests[req.TypeUrl] = req
+}
+
+// resume returns the requests resuming the latest ones on a new upstream stream, in the order their types were
+// first requested. The nonces of the previous stream are dropped, and the first request carries the node.
+func (r *sotwResumeRequests) resume() []*discovery.DiscoveryRequest {
+	out := make([]*discovery.DiscoveryRequest, 0, len(r.types))
+	for _, typeURL := range r.types {
+		req := proto.Clone(r.requests[typeURL]).(*discovery.DiscoveryRequest)
+		req.ResponseNonce = ""
+		req.ErrorDetail = nil
+		req.Node = nil
+		if len(out) == 0 {
+			req.Node = r.node
+		}
+		out = append(out, req)
+	}
+	return out
+}
+
+// redialUpstream opens a SotW stream to the upstream on a new connection, replacing an idle upstream. The returned
+// cancel function closes the connection.
+func (p *XdsProxy) redialUpstream(ctx context.Context) (xds.DiscoveryClient, context.CancelFunc, error) {
+	dialCtx, cancel := context.WithTimeout(context.Background(), p.dialTimeout())
+	defer cancel()
+	conn, err := p.buildUpstreamConn(dialCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+	upstream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx,
+		grpc.MaxCallRecvMsgSize(defaultClientMaxReceiveMessageSize))
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return upstream, func() { _ = conn.Close() }, nil
+}
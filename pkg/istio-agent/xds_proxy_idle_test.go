@@ -0,0 +1,91 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+func TestUpstreamIdleTimer(t *testing.T) {
+	// A timer without timeouts is nil, and never fires.
+	assert.Equal(t, newUpstreamIdleTimer(upstreamIdleWatch{}) == nil, true)
+	assert.Equal(t, (*upstreamIdleTimer)(nil).C() == nil, true)
+
+	var last time.Time
+	timer := newUpstreamIdleTimer(upstreamIdleWatch{
+		timeout: 50 * time.Millisecond,
+		last:    func() time.Time { return last },
+		what:    "message exchanged",
+	})
+	defer timer.stop()
+	expire := func() error {
+		t.Helper()
+		select {
+		case <-timer.C():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the timer to fire")
+		}
+		return timer.expired()
+	}
+
+	// Activity since the timer started postpones it.
+	time.Sleep(25 * time.Millisecond)
+	last = time.Now()
+	assert.NoError(t, expire())
+	err := expire()
+	if !errors.Is(err, errUpstreamIdle) {
+		t.Fatalf("expected the upstream to be idle, got %v", err)
+	}
+	// The timer restarts once it fired.
+	if err := expire(); !errors.Is(err, errUpstreamIdle) {
+		t.Fatalf("expected the upstream to be idle again, got %v", err)
+	}
+}
+
+func TestSotwResumeRequests(t *testing.T) {
+	r := newSotwResumeRequests()
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	r.sent(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: node})
+	r.sent(&discovery.DiscoveryRequest{TypeUrl: v3.ListenerType, ResourceNames: []string{"a"}})
+	r.sent(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "n1"})
+	r.sent(&discovery.DiscoveryRequest{
+		TypeUrl:       v3.ListenerType,
+		ResourceNames: []string{"a", "b"},
+		ResponseNonce: "n2",
+		ErrorDetail:   &google_rpc.Status{Message: "rejected"},
+	})
+
+	resumed := r.resume()
+	assert.Equal(t, len(resumed), 2)
+	// The latest request of each type, in the order the types were requested, without the nonces.
+	assert.Equal(t, resumed[0].TypeUrl, v3.ClusterType)
+	assert.Equal(t, resumed[0].VersionInfo, "1")
+	assert.Equal(t, resumed[0].ResponseNonce, "")
+	assert.Equal(t, resumed[0].Node.GetId(), node.Id)
+	assert.Equal(t, resumed[1].TypeUrl, v3.ListenerType)
+	assert.Equal(t, resumed[1].ResourceNames, []string{"a", "b"})
+	assert.Equal(t, resumed[1].ResponseNonce, "")
+	assert.Equal(t, resumed[1].ErrorDetail == nil, true)
+	assert.Equal(t, resumed[1].Node == nil, true)
+}
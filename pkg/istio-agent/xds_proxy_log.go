@@ -0,0 +1,40 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+
+	"google.golang.org/grpc/peer"
+
+	"istio.io/istio/pkg/log"
+)
+
+// newConnectionLogger returns the logger of a connection from Envoy. Its logs are labeled with the connection ID
+// and the address of the downstream peer, so the logs of a single connection can be filtered.
+func newConnectionLogger(ctx context.Context, conID uint32) *log.Scope {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return proxyLog.WithLabels("id", conID, "peer", p.Addr.String())
+	}
+	return proxyLog.WithLabels("id", conID)
+}
+
+// logger returns the logger of the connection, labeled with the connection ID.
+func (con *ProxyConnection) logger() *log.Scope {
+	if con.log == nil {
+		return proxyLog.WithLabels("id", con.conID)
+	}
+	return con.log
+}
@@ -0,0 +1,65 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/monitoring/monitortest"
+)
+
+// Validates the metrics of a delta exchange are labeled with the cluster and mesh IDs of the node of Envoy.
+func TestDeltaXdsProxyMeshMetricLabels(t *testing.T) {
+	mt := monitortest.New(t)
+	proxy := setupXdsProxy(t)
+	proxy.meshMetricLabels = true
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	node := &core.Node{
+		Id:       "sidecar~1.1.1.1~debug~cluster.local",
+		Metadata: model.NodeMetadata{ClusterID: "cluster-1", MeshID: "mesh-1"}.ToStruct(),
+	}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ClusterType,
+		Nonce:   "nonce",
+		Resources: []*discovery.Resource{{
+			Name:     "outbound|80||foo.default.svc.cluster.local",
+			Resource: protoconv.MessageToAny(&cluster.Cluster{Name: "outbound|80||foo.default.svc.cluster.local"}),
+		}},
+	})
+	if _, err := downstream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	mt.Assert("xds_proxy_bytes", map[string]string{
+		"direction":  "downstream_sent",
+		"type":       "CDS",
+		"cluster_id": "cluster-1",
+		"mesh_id":    "mesh-1",
+	}, monitortest.AtLeast(1))
+}
@@ -0,0 +1,62 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"golang.org/x/time/rate"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/log"
+)
+
+// nackLogInterval is the minimum interval between two logs of the NACKs of a type on a connection.
+var nackLogInterval = 10 * time.Second
+
+// nackLogger logs the error details of the requests NACKing a response, so that the reason Envoy rejected
+// the config is visible in the agent logs. Logs are rate limited per type, as a flapping Envoy may NACK
+// the same config over and over; the number of NACKs suppressed since the last log is reported instead.
+// It is only used by the goroutine receiving the requests of a connection.
+type nackLogger struct {
+	limiters   map[string]*rate.Limiter
+	suppressed map[string]int
+}
+
+func (n *nackLogger) log(scope *log.Scope, req *discovery.DeltaDiscoveryRequest) {
+	if req.ErrorDetail == nil {
+		return
+	}
+	if n.limiters == nil {
+		n.limiters = map[string]*rate.Limiter{}
+		n.suppressed = map[string]int{}
+	}
+	limiter, f := n.limiters[req.TypeUrl]
+	if !f {
+		limiter = rate.NewLimiter(rate.Every(nackLogInterval), 1)
+		n.limiters[req.TypeUrl] = limiter
+	}
+	if !limiter.Allow() {
+		n.suppressed[req.TypeUrl]++
+		return
+	}
+	scope.WithLabels(
+		"type", v3.GetShortType(req.TypeUrl),
+		"nonce", req.ResponseNonce,
+		"suppressed", n.suppressed[req.TypeUrl],
+	).Warnf("Envoy rejected config: %s", req.ErrorDetail.GetMessage())
+	n.suppressed[req.TypeUrl] = 0
+}
@@ -0,0 +1,56 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// checkNodeMetadata returns an InvalidArgument error naming the required fields absent from the metadata of node,
+// if any. Otherwise, the upstream may compute an empty configuration for the node without Envoy knowing why.
+func (p *XdsProxy) checkNodeMetadata(node *core.Node) error {
+	if node == nil || len(p.requiredNodeMetadata) == 0 {
+		return nil
+	}
+	var missing []string
+	for _, field := range p.requiredNodeMetadata {
+		if isEmptyMetadataValue(node.GetMetadata().GetFields()[field]) {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return status.Errorf(codes.InvalidArgument, "the metadata of node %q is missing the required fields %v", node.GetId(), missing)
+	}
+	return nil
+}
+
+// isEmptyMetadataValue returns true if v is absent, null, or an empty string, list or struct.
+func isEmptyMetadataValue(v *structpb.Value) bool {
+	switch k := v.GetKind().(type) {
+	case nil, *structpb.Value_NullValue:
+		return true
+	case *structpb.Value_StringValue:
+		return k.StringValue == ""
+	case *structpb.Value_ListValue:
+		return len(k.ListValue.GetValues()) == 0
+	case *structpb.Value_StructValue:
+		return len(k.StructValue.GetFields()) == 0
+	default:
+		return false
+	}
+}
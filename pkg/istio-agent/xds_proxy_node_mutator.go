@@ -0,0 +1,81 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// NodeMetadataMutator transforms the node sent by Envoy on a delta XDS stream before it is forwarded to the upstream
+// XDS server, once the default metadata is applied. meta is the parsed metadata of node: its changes are written back
+// to the metadata of node once all the mutators ran, without altering the fields unknown to model.NodeMetadata,
+// while the other fields of node can be changed directly. An error rejects the stream of Envoy.
+type NodeMetadataMutator func(node *core.Node, meta *model.NodeMetadata) error
+
+// RegisterNodeMetadataMutator registers m to transform the nodes sent by Envoy. The mutators run in the order they
+// are registered, each seeing the changes of the previous ones.
+func (p *XdsProxy) RegisterNodeMetadataMutator(m NodeMetadataMutator) {
+	p.nodeMutatorsMu.Lock()
+	defer p.nodeMutatorsMu.Unlock()
+	p.nodeMutators = append(p.nodeMutators, m)
+}
+
+// mutateNode runs the registered mutators on node.
+func (p *XdsProxy) mutateNode(node *core.Node) error {
+	p.nodeMutatorsMu.RLock()
+	mutators := p.nodeMutators
+	p.nodeMutatorsMu.RUnlock()
+	if len(mutators) == 0 {
+		return nil
+	}
+	meta, err := model.ParseMetadata(node.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to parse node metadata: %v", err)
+	}
+	before := meta.ToStruct()
+	for _, m := range mutators {
+		if err := m(node, meta); err != nil {
+			return fmt.Errorf("failed to mutate node metadata: %v", err)
+		}
+	}
+	applyNodeMetadataChanges(node, before, meta.ToStruct())
+	return nil
+}
+
+// applyNodeMetadataChanges writes the fields changed between before and after to the metadata of node.
+func applyNodeMetadataChanges(node *core.Node, before, after *structpb.Struct) {
+	if node.Metadata == nil {
+		node.Metadata = &structpb.Struct{}
+	}
+	if node.Metadata.Fields == nil {
+		node.Metadata.Fields = map[string]*structpb.Value{}
+	}
+	for k, v := range after.GetFields() {
+		if !proto.Equal(v, before.GetFields()[k]) {
+			node.Metadata.Fields[k] = v
+		}
+	}
+	for k := range before.GetFields() {
+		if _, f := after.GetFields()[k]; !f {
+			delete(node.Metadata.Fields, k)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// Validates the registered mutators transform, in order, the node forwarded upstream.
+func TestDeltaXdsProxyNodeMetadataMutators(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.RegisterNodeMetadataMutator(func(_ *core.Node, meta *model.NodeMetadata) error {
+		if meta.Labels == nil {
+			meta.Labels = map[string]string{}
+		}
+		meta.Labels["topology.istio.io/zone"] = "zone-a"
+		return nil
+	})
+	proxy.RegisterNodeMetadataMutator(func(_ *core.Node, meta *model.NodeMetadata) error {
+		// Runs after the first mutator.
+		meta.Labels["topology.istio.io/subzone"] = meta.Labels["topology.istio.io/zone"] + "-1"
+		return nil
+	})
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	metadata := model.NodeMetadata{Labels: map[string]string{"app": "foo"}}.ToStruct()
+	metadata.Fields["CUSTOM"] = structpb.NewStringValue("kept")
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local", Metadata: metadata},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if sent := len(recorder.streamRequests(0)); sent == 0 {
+			return fmt.Errorf("expected the request to be forwarded upstream")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+
+	node := recorder.streamRequests(0)[0].Node
+	meta, err := model.ParseMetadata(node.Metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, meta.Labels, map[string]string{
+		"app":                       "foo",
+		"topology.istio.io/zone":    "zone-a",
+		"topology.istio.io/subzone": "zone-a-1",
+	})
+	assert.Equal(t, node.Metadata.Fields["CUSTOM"].GetStringValue(), "kept")
+}
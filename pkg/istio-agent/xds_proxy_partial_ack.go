@@ -0,0 +1,98 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"istio.io/istio/pkg/slices"
+)
+
+// partialECDSNacks holds the NACKs of the ECDS responses partially forwarded to Envoy, by nonce, until Envoy
+// acknowledges them. The zero value is ready to use.
+type partialECDSNacks struct {
+	mu    sync.Mutex
+	nacks map[string]*google_rpc.Status
+}
+
+func (n *partialECDSNacks) add(nonce string, nack *google_rpc.Status) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nacks == nil {
+		n.nacks = map[string]*google_rpc.Status{}
+	}
+	n.nacks[nonce] = nack
+}
+
+// apply turns the ACK of a partially forwarded response into the NACK of the resources left out. A NACK from
+// Envoy is kept as is, as it rejects the response anyway.
+func (n *partialECDSNacks) apply(req *discovery.DeltaDiscoveryRequest) {
+	if req.ResponseNonce == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	nack, f := n.nacks[req.ResponseNonce]
+	if !f {
+		return
+	}
+	delete(n.nacks, req.ResponseNonce)
+	if req.ErrorDetail == nil {
+		req.ErrorDetail = nack
+	}
+}
+
+// forwardPartialECDS forwards to Envoy the resources of an ECDS response which were rewritten, when only some of
+// them failed, with the given rewritten resources. The resources which failed are left out, so that Envoy keeps
+// their previous version, and the ACK of Envoy is sent upstream as a NACK naming them. It returns false if the
+// response cannot be partially forwarded, and must be NACKed as a whole.
+func (p *XdsProxy) forwardPartialECDS(con *ProxyConnection, resp *discovery.DeltaDiscoveryResponse, resources []*anypb.Any,
+	err error, forward func(resp *discovery.DeltaDiscoveryResponse),
+) bool {
+	var cerr *wasmConversionError
+	if !p.partialECDSAck || con.dryRun || !errors.As(err, &cerr) || !cerr.identified ||
+		len(cerr.failures) == 0 || len(cerr.failures) == len(resp.Resources) {
+		return false
+	}
+	failed := make(map[*anypb.Any]bool, len(cerr.failures))
+	for _, failure := range cerr.failures {
+		failed[failure.resource] = true
+	}
+	applied := make([]*discovery.Resource, 0, len(resp.Resources)-len(cerr.failures))
+	var rejected []string
+	for i, r := range resp.Resources {
+		if failed[resources[i]] {
+			rejected = append(rejected, r.Name)
+			continue
+		}
+		r.Resource = resources[i]
+		applied = append(applied, r)
+	}
+	nack := p.wasmNackStatus(err)
+	nack.Message = fmt.Sprintf("partially applied, rejected %v: %s", rejected, nack.Message)
+	p.recordECDSNack(resp.Nonce, rejected, nack.Message)
+	con.partialNacks.add(resp.Nonce, nack)
+	resp.Resources = applied
+	con.logger().WithLabels("nonce", resp.Nonce, "resources", slices.Map(applied, (*discovery.Resource).GetName),
+		"rejected", rejected).Warnf("forward ECDS partially: %v", err)
+	forward(resp)
+	return true
+}
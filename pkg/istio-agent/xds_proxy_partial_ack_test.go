@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	wasm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// Validates the resource whose Wasm module is fetched is applied by Envoy, while the one whose module fails is
+// left out and NACKed upstream.
+func TestDeltaXdsProxyPartialECDSAck(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.partialECDSAck = true
+	module := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(module, []byte("module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = routingWasmCache{
+		"http://test/good.wasm": &countingWasmCache{module: module, gets: atomic.NewInt32(0)},
+		"http://test/bad.wasm":  &fakeNackCache{},
+	}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ExtensionConfigurationType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ExtensionConfigurationType,
+		Nonce:   "nonce",
+		Resources: []*discovery.Resource{
+			remoteWasmExtensionConfigWithURL("good", "http://test/good.wasm"),
+			remoteWasmExtensionConfigWithURL("bad", "http://test/bad.wasm"),
+		},
+	})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "nonce")
+	assert.Equal(t, len(resp.Resources), 1)
+	assert.Equal(t, resp.Resources[0].Name, "good")
+	ec := &core.TypedExtensionConfig{}
+	if err := resp.Resources[0].Resource.UnmarshalTo(ec); err != nil {
+		t.Fatal(err)
+	}
+	w := &wasm.Wasm{}
+	if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, w.GetConfig().GetVmConfig().GetCode().GetLocal().GetFilename(), module)
+
+	// Envoy ACKs the resource it applied, the upstream is told the other one was rejected.
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:       v3.ExtensionConfigurationType,
+		ResponseNonce: "nonce",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		for _, req := range recorder.streamRequests(0) {
+			if req.ResponseNonce != "nonce" {
+				continue
+			}
+			if req.ErrorDetail == nil || !strings.Contains(req.ErrorDetail.Message, "rejected [bad]") {
+				return fmt.Errorf("expected the response to be NACKed naming the rejected resource, got %v", req.ErrorDetail)
+			}
+			return nil
+		}
+		return fmt.Errorf("expected the response to be acknowledged upstream")
+	}, retry.Timeout(time.Second*5))
+}
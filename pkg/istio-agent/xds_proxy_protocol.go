@@ -0,0 +1,93 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"strings"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// apiTypeHeader is the header sent by the proxy as soon as it accepts a XDS stream from Envoy, with the api_type
+// of the protocol variant served on the stream. A client probing for delta XDS support reads it to confirm the
+// stream is served as delta, without waiting for a response, which depends on the upstream XDS server.
+const apiTypeHeader = "x-istio-xds-api-type"
+
+const (
+	sotwAPIType  = "GRPC"
+	deltaAPIType = "DELTA_GRPC"
+)
+
+// advertiseAPIType sends the headers of stream, advertising the api_type served on it.
+func advertiseAPIType(stream grpc.ServerStream, apiType string) {
+	if err := stream.SendHeader(metadata.Pairs(apiTypeHeader, apiType)); err != nil {
+		proxyLog.Debugf("failed to advertise the %s api_type: %v", apiType, err)
+	}
+}
+
+// Envoy picks the gRPC method of its XDS stream from the api_type of its bootstrap, so a request sent with the
+// other protocol variant than the one of the method usually comes from a misconfigured bootstrap or client.
+// Such requests either fail to decode, or decode into a request that makes no sense; they are rejected with
+// a status explaining which protocol is expected.
+
+// sotwRecvError returns err, or a descriptive status if err is the failure to decode a request from Envoy
+// on a SotW stream.
+func sotwRecvError(err error) error {
+	if s, ok := undecodableRequest(err); ok {
+		return status.Errorf(codes.InvalidArgument, "invalid request on the state of the world XDS stream "+
+			"(StreamAggregatedResources), it may be a delta XDS request: check the client uses the GRPC api_type for "+
+			"this stream, or DELTA_GRPC with DeltaAggregatedResources: %s", s.Message())
+	}
+	return err
+}
+
+// deltaRecvError returns err, or a descriptive status if err is the failure to decode a request from Envoy
+// on a delta stream.
+func deltaRecvError(err error) error {
+	if s, ok := undecodableRequest(err); ok {
+		return status.Errorf(codes.InvalidArgument, "invalid request on the delta XDS stream "+
+			"(DeltaAggregatedResources), it may be a state of the world XDS request: check the client uses the "+
+			"DELTA_GRPC api_type for this stream, or GRPC with StreamAggregatedResources: %s", s.Message())
+	}
+	return err
+}
+
+// checkDeltaRequest returns an error if req is a SotW request decoded as a delta request. The type URL of a
+// SotW request is then decoded as a resource unsubscribed from, and its node, if any, as the type URL.
+func checkDeltaRequest(req *discovery.DeltaDiscoveryRequest) error {
+	if strings.HasPrefix(req.TypeUrl, resource.APITypePrefix) || len(req.ResourceNamesUnsubscribe) != 1 {
+		return nil
+	}
+	if typeURL := req.ResourceNamesUnsubscribe[0]; strings.HasPrefix(typeURL, resource.APITypePrefix) {
+		return status.Errorf(codes.InvalidArgument, "received a state of the world XDS request for %s on the delta "+
+			"XDS stream (DeltaAggregatedResources): check the client uses the DELTA_GRPC api_type for this stream, "+
+			"or GRPC with StreamAggregatedResources", typeURL)
+	}
+	return nil
+}
+
+// undecodableRequest returns the status of err if it is the failure of gRPC to unmarshal a received message.
+func undecodableRequest(err error) (*status.Status, bool) {
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.Internal || !strings.Contains(s.Message(), "failed to unmarshal") {
+		return nil, false
+	}
+	return s, true
+}
@@ -0,0 +1,106 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+// Validates a request of the wrong XDS protocol variant is rejected with a status describing the mismatch.
+func TestXdsProxyProtocolMismatch(t *testing.T) {
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	cases := []struct {
+		name    string
+		method  string
+		req     proto.Message
+		resp    proto.Message
+		wantMsg string
+	}{
+		{
+			name:    "sotw request on delta stream",
+			method:  "DeltaAggregatedResources",
+			req:     &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: node},
+			resp:    &discovery.DeltaDiscoveryResponse{},
+			wantMsg: "received a state of the world XDS request for " + v3.ClusterType + " on the delta XDS stream",
+		},
+		{
+			name:    "delta request on sotw stream",
+			method:  "StreamAggregatedResources",
+			req:     &discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node},
+			resp:    &discovery.DiscoveryResponse{},
+			wantMsg: "it may be a delta XDS request",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := setupXdsProxy(t)
+			f := xdstest.NewMockServer(t)
+			setDialOptions(proxy, f.Listener)
+			conn := setupDownstreamConnection(t, proxy)
+			method := "/envoy.service.discovery.v3.AggregatedDiscoveryService/" + c.method
+			stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.SendMsg(c.req); err != nil {
+				t.Fatal(err)
+			}
+			err = stream.RecvMsg(c.resp)
+			assert.Equal(t, status.Code(err), codes.InvalidArgument)
+			if !strings.Contains(status.Convert(err).Message(), c.wantMsg) {
+				t.Fatalf("expected an error containing %q, got %v", c.wantMsg, err)
+			}
+		})
+	}
+}
+
+// Validates a client probing for delta XDS support learns the stream is served as delta from the headers, before
+// the upstream XDS server sends any response.
+func TestXdsProxyAdvertisesDeltaAPIType(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+
+	// The upstream never responds: the headers are all the probe gets.
+	delta := deltaStream(t, conn)
+	if err := delta.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	header, err := delta.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, header.Get(apiTypeHeader), []string{deltaAPIType})
+
+	sotw := stream(t, conn)
+	if err := sotw.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	header, err = sotw.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, header.Get(apiTypeHeader), []string{sotwAPIType})
+}
@@ -0,0 +1,135 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"istio.io/istio/pkg/log"
+	"istio.io/istio/pkg/util/protomarshal"
+)
+
+var responseLog = log.RegisterScope("xdsresponses", "Content of the delta XDS responses received by the XDS Proxy")
+
+// redactedFields are the fields whose content is redacted from the logged responses, along with the content
+// of the fields named as one of sensitiveFieldNames: the inline content of the data sources holds Wasm modules,
+// private keys and secrets, and the configuration of the Wasm plugins commonly holds credentials.
+var redactedFields = map[protoreflect.FullName]bool{
+	"envoy.config.core.v3.DataSource.inline_bytes":        true,
+	"envoy.config.core.v3.DataSource.inline_string":       true,
+	"envoy.extensions.wasm.v3.PluginConfig.configuration": true,
+}
+
+var sensitiveFieldNames = map[protoreflect.Name]bool{
+	"api_key":     true,
+	"credentials": true,
+	"password":    true,
+	"private_key": true,
+	"secret":      true,
+	"token":       true,
+}
+
+// formatDeltaResponse returns the JSON of resp to be logged, with the content of its sensitive fields replaced
+// by their hash if redact is set. The names of the resources and the nonce are kept as is.
+func formatDeltaResponse(resp *discovery.DeltaDiscoveryResponse, redact bool) string {
+	if redact {
+		resp = proto.Clone(resp).(*discovery.DeltaDiscoveryResponse)
+		redactMessage(resp.ProtoReflect(), false)
+	}
+	js, err := protomarshal.ToJSON(resp)
+	if err != nil {
+		return fmt.Sprintf("<failed to marshal the response: %v>", err)
+	}
+	return js
+}
+
+// redactMessage replaces in place the content of the sensitive fields of m, or of all its string and bytes
+// fields if all is set, including within the resources packed in Any.
+func redactMessage(m protoreflect.Message, all bool) {
+	if m.Descriptor().FullName() == "google.protobuf.Any" {
+		redactAny(m.Interface().(*anypb.Any), all)
+		return
+	}
+	// Collect the fields first, as setting a field while ranging over them is not allowed.
+	var fields []protoreflect.FieldDescriptor
+	m.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		fields = append(fields, fd)
+		return true
+	})
+	for _, fd := range fields {
+		redactField(m, fd, all || redactedFields[fd.FullName()] || sensitiveFieldNames[fd.Name()])
+	}
+}
+
+func redactField(m protoreflect.Message, fd protoreflect.FieldDescriptor, all bool) {
+	switch {
+	case fd.IsMap():
+		mp := m.Mutable(fd).Map()
+		mp.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			mp.Set(k, redactValue(fd.MapValue(), v, all))
+			return true
+		})
+	case fd.IsList():
+		l := m.Mutable(fd).List()
+		for i := 0; i < l.Len(); i++ {
+			l.Set(i, redactValue(fd, l.Get(i), all))
+		}
+	default:
+		m.Set(fd, redactValue(fd, m.Get(fd), all))
+	}
+}
+
+func redactValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, all bool) protoreflect.Value {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		redactMessage(v.Message(), all)
+	case protoreflect.StringKind:
+		if all {
+			return protoreflect.ValueOfString(redactedContent([]byte(v.String())))
+		}
+	case protoreflect.BytesKind:
+		if all {
+			return protoreflect.ValueOfBytes([]byte(redactedContent(v.Bytes())))
+		}
+	}
+	return v
+}
+
+// redactAny redacts the message packed in a. It is cleared if its type is unknown, as it cannot be inspected.
+func redactAny(a *anypb.Any, all bool) {
+	m, err := a.UnmarshalNew()
+	if err != nil {
+		a.Value = nil
+		return
+	}
+	redactMessage(m.ProtoReflect(), all)
+	if err := a.MarshalFrom(m); err != nil {
+		a.Value = nil
+	}
+}
+
+// redactedContent returns the replacement of a redacted content, identifying it by its hash to tell whether
+// it changed between responses.
+func redactedContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "redacted:sha256:" + hex.EncodeToString(sum[:8])
+}
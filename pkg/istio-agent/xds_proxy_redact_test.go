@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	wasm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
+	wasmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/wasm/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// Validates the logged responses have the Wasm module bytes and the plugin configuration redacted, but keep the
+// resource names and the nonce.
+func TestFormatDeltaResponseRedaction(t *testing.T) {
+	module := []byte("\x00asm-module-bytes")
+	apiKey := "s3cr3t-api-key"
+	w := &wasm.Wasm{
+		Config: &wasmv3.PluginConfig{
+			Name: "plugin",
+			Vm: &wasmv3.PluginConfig_VmConfig{
+				VmConfig: &wasmv3.VmConfig{
+					Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Local{
+						Local: &core.DataSource{
+							Specifier: &core.DataSource_InlineBytes{InlineBytes: module},
+						},
+					}},
+				},
+			},
+			Configuration: protoconv.MessageToAny(wrapperspb.String(`{"api_key": "` + apiKey + `"}`)),
+		},
+	}
+	resp := &discovery.DeltaDiscoveryResponse{
+		TypeUrl: v3.ExtensionConfigurationType,
+		Nonce:   "nonce-1",
+		Resources: []*discovery.Resource{{
+			Name: "extension-config",
+			Resource: protoconv.MessageToAny(&core.TypedExtensionConfig{
+				Name:        "extension-config",
+				TypedConfig: protoconv.MessageToAny(w),
+			}),
+		}},
+	}
+	encodedModule := base64.StdEncoding.EncodeToString(module)
+
+	logged := formatDeltaResponse(resp, false)
+	for _, want := range []string{encodedModule, apiKey} {
+		if !strings.Contains(logged, want) {
+			t.Fatalf("expected the unredacted response to contain %q, got %s", want, logged)
+		}
+	}
+
+	logged = formatDeltaResponse(resp, true)
+	for _, leaked := range []string{encodedModule, apiKey} {
+		if strings.Contains(logged, leaked) {
+			t.Fatalf("expected %q to be redacted, got %s", leaked, logged)
+		}
+	}
+	for _, want := range []string{"extension-config", "nonce-1", "plugin", "redacted:sha256:"} {
+		if !strings.Contains(logged, want) {
+			t.Fatalf("expected the redacted response to contain %q, got %s", want, logged)
+		}
+	}
+	// The response is redacted in a copy, the one forwarded to Envoy is left as is.
+	if !strings.Contains(formatDeltaResponse(resp, false), encodedModule) {
+		t.Fatal("expected the original response to be left unredacted")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/util/sets"
+)
+
+// rewriteToggles are the type URLs whose special handling is disabled at runtime, to tell whether the proxy corrupts
+// their config: their upstream responses skip the resource transformers and the ECDS Wasm rewrite, and are
+// forwarded to Envoy as is. The special handling of every type is enabled by default.
+type rewriteToggles struct {
+	mu       sync.RWMutex
+	disabled sets.String
+}
+
+// enabled returns true if the special handling of typeURL is enabled.
+func (t *rewriteToggles) enabled(typeURL string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return !t.disabled.Contains(typeURL)
+}
+
+func (t *rewriteToggles) set(typeURL string, enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if enabled {
+		t.disabled.Delete(typeURL)
+		return
+	}
+	if t.disabled == nil {
+		t.disabled = sets.New[string]()
+	}
+	t.disabled.Insert(typeURL)
+}
+
+func (t *rewriteToggles) snapshot() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return sets.SortedList(t.disabled)
+}
+
+// rewritez reports the type URLs whose special handling is disabled. A POST with the type query parameter, by the
+// short name of the type such as ECDS or its type URL, and the enabled query parameter enables or disables the
+// special handling of the type until the agent restarts. Only the Envoy types can be forwarded as is.
+func (p *XdsProxy) rewritez(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		typ := r.URL.Query().Get("type")
+		if typ == "" {
+			http.Error(w, "missing the type to enable or disable the rewrite of", http.StatusBadRequest)
+			return
+		}
+		typeURL := v3.GetResourceType(typ)
+		if !v3.IsEnvoyType(typeURL) {
+			http.Error(w, fmt.Sprintf("%s is not an Envoy type", typ), http.StatusBadRequest)
+			return
+		}
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid enabled parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		p.rewrites.set(typeURL, enabled)
+		proxyLog.Infof("set the rewrite of %s enabled: %v", typeURL, enabled)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported method %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	out := struct {
+		Disabled []string `json:"disabled"`
+	}{
+		Disabled: p.rewrites.snapshot(),
+	}
+	writeJSON(w, out)
+}
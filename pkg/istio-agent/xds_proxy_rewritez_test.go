@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	wasm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/proto"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+// rewritez calls /debug/agent/rewritez with method and query, and returns the status code and the disabled types.
+func rewritez(t *testing.T, proxy *XdsProxy, method, query string) (int, []string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	proxy.rewritez(rec, httptest.NewRequest(method, "/debug/agent/rewritez"+query, nil))
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+	var out struct {
+		Disabled []string `json:"disabled"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, out.Disabled
+}
+
+func TestRewritez(t *testing.T) {
+	proxy := &XdsProxy{}
+	code, disabled := rewritez(t, proxy, http.MethodGet, "")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, disabled, nil)
+
+	code, disabled = rewritez(t, proxy, http.MethodPost, "?type=ECDS&enabled=false")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, disabled, []string{v3.ExtensionConfigurationType})
+	code, disabled = rewritez(t, proxy, http.MethodPost, "?type="+v3.ClusterType+"&enabled=false")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, disabled, []string{v3.ClusterType, v3.ExtensionConfigurationType})
+	assert.Equal(t, proxy.rewrites.enabled(v3.ExtensionConfigurationType), false)
+	assert.Equal(t, proxy.rewrites.enabled(v3.ListenerType), true)
+
+	code, disabled = rewritez(t, proxy, http.MethodPost, "?type=ECDS&enabled=true")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, disabled, []string{v3.ClusterType})
+
+	for _, query := range []string{"?enabled=false", "?type=NDS&enabled=false", "?type=ECDS&enabled=maybe"} {
+		code, _ := rewritez(t, proxy, http.MethodPost, query)
+		assert.Equal(t, code, http.StatusBadRequest)
+	}
+	code, _ = rewritez(t, proxy, http.MethodDelete, "")
+	assert.Equal(t, code, http.StatusMethodNotAllowed)
+}
+
+// Validates the remote Wasm configs are forwarded to Envoy unmodified while the ECDS rewrite is disabled.
+func TestDeltaXdsProxyRewriteDisabled(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = &fakeAckCache{}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.ExtensionConfigurationType,
+		ResourceNamesSubscribe: []string{"extension-config"},
+		Node: &core.Node{
+			Id: "sidecar~1.1.1.1~debug~cluster.local",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := rewritez(t, proxy, http.MethodPost, "?type=ECDS&enabled=false")
+	assert.Equal(t, code, http.StatusOK)
+
+	remote := remoteWasmExtensionConfig("extension-config")
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Nonce:     "n1",
+		Resources: []*discovery.Resource{proto.Clone(remote).(*discovery.Resource)},
+	})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(resp.Resources[0], remote) {
+		t.Fatalf("expected the remote Wasm config to be forwarded unmodified, got %v", resp.Resources[0])
+	}
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:       v3.ExtensionConfigurationType,
+		ResponseNonce: resp.Nonce,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once enabled again, the remote Wasm configs are rewritten.
+	code, _ = rewritez(t, proxy, http.MethodPost, "?type=ECDS&enabled=true")
+	assert.Equal(t, code, http.StatusOK)
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Nonce:     "n2",
+		Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+	})
+	resp, err = downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := &core.TypedExtensionConfig{}
+	if err := resp.Resources[0].Resource.UnmarshalTo(ec); err != nil {
+		t.Fatal(err)
+	}
+	w := &wasm.Wasm{}
+	if err := ec.TypedConfig.UnmarshalTo(w); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, w.GetConfig().GetVmConfig().GetCode().GetLocal().GetFilename(), "test")
+}
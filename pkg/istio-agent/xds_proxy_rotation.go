@@ -0,0 +1,60 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+)
+
+// errUpstreamCertsRotated is the cause of the reconnection of the upstream after its certificates rotated.
+var errUpstreamCertsRotated = errors.New("upstream TLS certificates rotated")
+
+// upstreamCertsRotated moves the delta stream of the connected Envoy to a new connection to the upstream, once the
+// dial options were rebuilt with the rotated certificates. The subscriptions and resource versions known by Envoy
+// are resumed on it, so Envoy is not reset. Nothing is done if the rotated certificates are reloaded by the
+// established connection.
+func (p *XdsProxy) upstreamCertsRotated() {
+	p.connectedMutex.RLock()
+	con := p.connected
+	p.connectedMutex.RUnlock()
+	if con == nil || con.certsRotated == nil {
+		return
+	}
+	select {
+	case con.certsRotated <- struct{}{}:
+	default:
+		// A rotation is already pending.
+	}
+}
+
+// redialUpstreamConn opens a new connection to the upstream with the current dial options, replacing previous
+// for the delta stream of con. The previous connection is closed, and the new one once the stream of Envoy stops.
+func (p *XdsProxy) redialUpstreamConn(con *ProxyConnection, previous *grpc.ClientConn) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout())
+	defer cancel()
+	conn, err := p.buildUpstreamConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_ = previous.Close()
+	goDelta(func() {
+		<-con.stopChan
+		_ = conn.Close()
+	})
+	return conn, nil
+}
@@ -0,0 +1,118 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/wasm"
+)
+
+// snapshotFile is a file of the snapshot of the proxy.
+type snapshotFile struct {
+	name    string
+	content []byte
+}
+
+// snapshotz writes a gzipped tarball of the state held by the proxy, to be attached to a support case: the state
+// of the delta xDS exchange with Envoy, with the subscriptions, versions and nonces per type, the upstream, the
+// ECDS state and the Wasm module cache. The resources last acknowledged by Envoy are included per type when the
+// proxy keeps them, see ServeLastGoodResources, with the content of their sensitive fields, such as the secrets
+// and the Wasm modules, redacted.
+func (p *XdsProxy) snapshotz(w http.ResponseWriter, _ *http.Request) {
+	files, err := p.snapshotFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, files, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="xds-proxy-snapshot.tar.gz"`)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		proxyLog.Infof("fail to write debug response: %v", err)
+	}
+}
+
+func (p *XdsProxy) snapshotFiles() ([]snapshotFile, error) {
+	var files []snapshotFile
+	add := func(name string, obj any) error {
+		b, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %v", name, err)
+		}
+		files = append(files, snapshotFile{name: name, content: b})
+		return nil
+	}
+	if err := add("xds.json", p.deltaTypeStates()); err != nil {
+		return nil, err
+	}
+	if err := add("upstream.json", p.upstreamState()); err != nil {
+		return nil, err
+	}
+	if err := add("ecds.json", p.ecdsState()); err != nil {
+		return nil, err
+	}
+	if lister, ok := p.wasmCache.(wasm.Lister); ok {
+		if err := add("wasm.json", p.wasmModules(lister)); err != nil {
+			return nil, err
+		}
+	}
+	if p.lastGood != nil {
+		for _, typeURL := range p.lastGood.typeURLs() {
+			js := formatDeltaResponse(&discovery.DeltaDiscoveryResponse{
+				TypeUrl:   typeURL,
+				Resources: p.lastGood.get(typeURL),
+			}, true)
+			files = append(files, snapshotFile{name: "resources/" + v3.GetShortType(typeURL) + ".json", content: []byte(js)})
+		}
+	}
+	return files, nil
+}
+
+// writeSnapshot writes files as a gzipped tarball to buf.
+func writeSnapshot(buf *bytes.Buffer, files []snapshotFile, now time.Time) error {
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0o644,
+			Size:    int64(len(f.content)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
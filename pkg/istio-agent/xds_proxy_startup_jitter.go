@@ -0,0 +1,45 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// startupJitterDelay returns a random delay in [0, jitter), or 0 if jitter is not positive.
+func startupJitterDelay(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return rand.N(jitter)
+}
+
+// waitStartupJitter delays the first upstream subscription of the agent by its startup delay, so that a fleet of
+// agents restarting together does not subscribe to the upstream XDS server at once. Only the first upstream stream
+// is delayed. The requests of Envoy are queued meanwhile, and the static bootstrap resources still served.
+// It returns false if con is stopped while waiting.
+func (p *XdsProxy) waitStartupJitter(con *ProxyConnection) bool {
+	if p.startupDelay <= 0 || !p.startupDelayed.CompareAndSwap(false, true) {
+		return true
+	}
+	con.logger().Infof("delaying the initial upstream subscription by %v", p.startupDelay)
+	select {
+	case <-time.After(p.startupDelay):
+		return true
+	case <-con.stopChan:
+		return false
+	}
+}
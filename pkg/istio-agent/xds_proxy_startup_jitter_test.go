@@ -0,0 +1,71 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestStartupJitterDelay(t *testing.T) {
+	if d := startupJitterDelay(0); d != 0 {
+		t.Fatalf("expected no delay without jitter, got %v", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := startupJitterDelay(time.Second); d < 0 || d >= time.Second {
+			t.Fatalf("delay %v out of the jitter bound", d)
+		}
+	}
+}
+
+func TestDeltaXdsProxyStartupJitter(t *testing.T) {
+	jitter := 500 * time.Millisecond
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{UpstreamStartupJitter: jitter})
+	if proxy.startupDelay < 0 || proxy.startupDelay >= jitter {
+		t.Fatalf("startup delay %v out of the jitter bound %v", proxy.startupDelay, jitter)
+	}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	start := time.Now()
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if len(recorder.streamRequests(0)) == 0 {
+			return fmt.Errorf("expected the subscription to be forwarded upstream")
+		}
+		return nil
+	}, retry.Timeout(jitter+5*time.Second), retry.Delay(time.Millisecond))
+	if elapsed := time.Since(start); elapsed < proxy.startupDelay {
+		t.Fatalf("the subscription was forwarded upstream after %v, before the startup delay %v", elapsed, proxy.startupDelay)
+	}
+}
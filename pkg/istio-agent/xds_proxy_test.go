@@ -19,9 +19,11 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,15 +31,22 @@ import (
 	wasm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
 	wasmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/wasm/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.uber.org/atomic"
+	"golang.org/x/net/http2"
 	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/features"
+	istiogrpc "istio.io/istio/pilot/pkg/grpc"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/model/status"
 	"istio.io/istio/pilot/pkg/util/protoconv"
@@ -48,9 +57,11 @@ import (
 	"istio.io/istio/pkg/config/mesh"
 	"istio.io/istio/pkg/config/schema/gvk"
 	"istio.io/istio/pkg/envoy"
+	istiokeepalive "istio.io/istio/pkg/keepalive"
 	"istio.io/istio/pkg/security"
 	"istio.io/istio/pkg/test"
 	"istio.io/istio/pkg/test/env"
+	"istio.io/istio/pkg/test/util/assert"
 	"istio.io/istio/pkg/test/util/retry"
 	wasmcache "istio.io/istio/pkg/wasm"
 )
@@ -256,6 +267,11 @@ func setupXdsProxy(t *testing.T) *XdsProxy {
 }
 
 func setupXdsProxyWithDownstreamOptions(t *testing.T, opts []grpc.ServerOption) *XdsProxy {
+	return setupXdsProxyWithAgentOptions(t, &AgentOptions{DownstreamGrpcOptions: opts})
+}
+
+// setupXdsProxyWithAgentOptions sets up a proxy with the given agent options. The XDS UDS path is overridden.
+func setupXdsProxyWithAgentOptions(t *testing.T, opts *AgentOptions) *XdsProxy {
 	secOpts := &security.Options{
 		FileMountedCerts: true,
 	}
@@ -269,11 +285,8 @@ func setupXdsProxyWithDownstreamOptions(t *testing.T, opts []grpc.ServerOption)
 		MetadataClientCertKey:   path.Join(env.IstioSrc, "tests/testdata/certs/pilot/key.pem"),
 		MetadataClientRootCert:  path.Join(env.IstioSrc, "tests/testdata/certs/pilot/root-cert.pem"),
 	}
-	dir := t.TempDir()
-	ia := NewAgent(proxyConfig, &AgentOptions{
-		XdsUdsPath:            filepath.Join(dir, "XDS"),
-		DownstreamGrpcOptions: opts,
-	}, secOpts, envoy.ProxyConfig{TestOnly: true})
+	opts.XdsUdsPath = filepath.Join(t.TempDir(), "XDS")
+	ia := NewAgent(proxyConfig, opts, secOpts, envoy.ProxyConfig{TestOnly: true})
 	t.Cleanup(func() {
 		ia.Close()
 	})
@@ -445,6 +458,408 @@ func TestXdsProxyReconnects(t *testing.T) {
 	})
 }
 
+func TestXdsProxyUpstreamKeepalive(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	defaults := istiokeepalive.DefaultOption()
+	assert.Equal(t, proxy.upstreamKeepaliveParams(), keepalive.ClientParameters{
+		Time:    defaults.Time,
+		Timeout: defaults.Timeout,
+	})
+
+	configured := keepalive.ClientParameters{
+		Time:                time.Minute,
+		Timeout:             time.Second * 5,
+		PermitWithoutStream: true,
+	}
+	proxy.upstreamKeepalive = &configured
+	assert.Equal(t, proxy.upstreamKeepaliveParams(), configured)
+
+	// The keepalive is appended after the default client options, so that it takes precedence.
+	defaultOpts, err := istiogrpc.ClientOptions(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := proxy.buildUpstreamClientDialOpts(proxy.ia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(opts), len(defaultOpts)+1)
+}
+
+func TestXdsProxyUpstreamCompression(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	opts, err := proxy.buildUpstreamClientDialOpts(proxy.ia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.upstreamCompression = true
+	compressedOpts, err := proxy.buildUpstreamClientDialOpts(proxy.ia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(compressedOpts), len(opts)+1)
+
+	// Istiod accepts the compressed stream.
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	compressor := atomic.NewString("")
+	proxy.dialOptions = append(proxy.dialOptions, upstreamCompressionOption(),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+			method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			for _, o := range opts {
+				if c, ok := o.(grpc.CompressorCallOption); ok {
+					compressor.Store(c.CompressorType)
+				}
+			}
+			return streamer(ctx, desc, cc, method, opts...)
+		}))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+	assert.Equal(t, compressor.Load(), "gzip")
+}
+
+func TestXdsProxyUpstreamMaxIdle(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.upstreamMaxIdle = time.Millisecond * 100
+	// The mock server never responds, so the upstream connection is idle.
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithoutResponse(t, downstream)
+	failed := make(chan error, 1)
+	go func() {
+		_, err := downstream.Recv()
+		failed <- err
+	}()
+
+	// The request of Envoy is resent, with its node, on a new upstream connection.
+	retry.UntilSuccessOrFail(t, func() error {
+		reqs := f.Requests(v3.ClusterType)
+		if len(reqs) < 2 {
+			return fmt.Errorf("expected the request to be resent upstream, got %v", reqs)
+		}
+		if reqs[1].Node.GetId() != "sidecar~0.0.0.0~debug~cluster.local" {
+			return fmt.Errorf("expected the resent request to carry the node, got %v", reqs[1])
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	select {
+	case err := <-failed:
+		t.Fatalf("expected the stream of Envoy to be kept, got %v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestXdsProxyUpstreamMaxIdleReconnects(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.upstreamMaxIdle = time.Millisecond * 200
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithNode(t, downstream, model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	})
+	// No more messages are exchanged, so the upstream connection goes idle and is replaced. The requests of Envoy
+	// are resent on the new connection, and its responses pushed on the same stream of Envoy.
+	res, err := downstream.Recv()
+	if err != nil {
+		t.Fatalf("expected the stream of Envoy to be kept, got %v", err)
+	}
+	assert.Equal(t, res.TypeUrl, v3.ClusterType)
+}
+
+func TestXdsProxyUpstreamDialTimeout(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.upstreamDialTimeout = time.Millisecond * 100
+	// Nothing accepts the connections, so the connection attempt stalls.
+	setDialOptions(proxy, bufconn.Listen(1024*1024))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithoutResponse(t, downstream)
+	start := time.Now()
+	if _, err := downstream.Recv(); err == nil {
+		t.Fatal("expected the stalled upstream connection to fail")
+	}
+	if elapsed := time.Since(start); elapsed >= defaultUpstreamDialTimeout {
+		t.Fatalf("expected the connection attempt to fail within the dial timeout, took %v", elapsed)
+	}
+}
+
+func TestXdsProxyMaxDownstreamStreams(t *testing.T) {
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{MaxDownstreamStreams: 1})
+	// Nothing accepts the upstream connections, so the streams are served until the dial timeout.
+	proxy.upstreamDialTimeout = time.Second * 2
+	setDialOptions(proxy, bufconn.Listen(1024*1024))
+	conn := setupDownstreamConnection(t, proxy)
+	waitStreams := func(want int32) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			if got := proxy.downstreamStreams.Load(); got != want {
+				return fmt.Errorf("expected %d streams, got %d", want, got)
+			}
+			return nil
+		}, retry.Timeout(time.Second*5))
+	}
+
+	first := stream(t, conn)
+	waitStreams(1)
+	// The next stream is rejected, while the first one is still served.
+	rejected := stream(t, conn)
+	if _, err := rejected.Recv(); grpcstatus.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the stream beyond the limit to be rejected with ResourceExhausted, got %v", err)
+	}
+	assert.Equal(t, proxy.downstreamStreams.Load(), int32(1))
+
+	// Once the first stream ends, a new stream is accepted.
+	if _, err := first.Recv(); grpcstatus.Code(err) == codes.ResourceExhausted {
+		t.Fatalf("expected the first stream to be served, got %v", err)
+	}
+	waitStreams(0)
+	stream(t, conn)
+	waitStreams(1)
+}
+
+func TestXdsProxyDownstreamHTTP2Settings(t *testing.T) {
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{DownstreamHTTP2: DownstreamHTTP2Settings{
+		MaxConcurrentStreams:  7,
+		InitialWindowSize:     1 << 20,
+		InitialConnWindowSize: 1 << 22,
+	}})
+	conn, err := net.Dial("unix", proxy.xdsUdsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server announces its settings, and then grows the window of the connection.
+	settings := map[http2.SettingID]uint32{}
+	var connWindowIncrement uint32
+	for connWindowIncrement == 0 {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				f.ForeachSetting(func(s http2.Setting) error {
+					settings[s.ID] = s.Val
+					return nil
+				})
+			}
+		case *http2.WindowUpdateFrame:
+			if f.StreamID == 0 {
+				connWindowIncrement = f.Increment
+			}
+		}
+	}
+	assert.Equal(t, settings[http2.SettingMaxConcurrentStreams], uint32(7))
+	assert.Equal(t, settings[http2.SettingInitialWindowSize], uint32(1<<20))
+	// The initial window of a connection is 64KiB before it is grown.
+	assert.Equal(t, connWindowIncrement, uint32(1<<22-65535))
+}
+
+func TestXdsProxyRequiredNodeMetadata(t *testing.T) {
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{RequiredNodeMetadata: []string{"NAMESPACE", "INSTANCE_IPS"}})
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	err := downstream.Send(&discovery.DiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node: &core.Node{
+			Id:       "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: model.NodeMetadata{Namespace: "default"}.ToStruct(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = downstream.Recv()
+	if grpcstatus.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected the request to be rejected with InvalidArgument, got %v", err)
+	}
+	if msg := grpcstatus.Convert(err).Message(); !strings.Contains(msg, "[INSTANCE_IPS]") {
+		t.Fatalf("expected the rejection to name the missing field, got %q", msg)
+	}
+}
+
+func TestXdsProxyDeniedTypeURLs(t *testing.T) {
+	expectDenied := func(t *testing.T, err error) {
+		t.Helper()
+		if grpcstatus.Code(err) != codes.PermissionDenied {
+			t.Fatalf("expected the request to be rejected with PermissionDenied, got %v", err)
+		}
+		if msg := grpcstatus.Convert(err).Message(); !strings.Contains(msg, v3.SecretType) {
+			t.Fatalf("expected the rejection to name the denied type URL, got %q", msg)
+		}
+	}
+	t.Run("sotw", func(t *testing.T) {
+		proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{DeniedTypeURLs: []string{v3.SecretType}})
+		f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+		setDialOptions(proxy, f.BufListener)
+		conn := setupDownstreamConnection(t, proxy)
+		downstream := stream(t, conn)
+		// An allowed type URL proceeds.
+		sendDownstreamWithNode(t, downstream, model.NodeMetadata{
+			Namespace:   "default",
+			InstanceIPs: []string{"1.1.1.1"},
+		})
+
+		// A denied type URL is rejected.
+		if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.SecretType}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := downstream.Recv()
+		expectDenied(t, err)
+	})
+	t.Run("shared delta upstream", func(t *testing.T) {
+		proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{DeniedTypeURLs: []string{v3.SecretType}})
+		proxy.sharedUpstream = true
+		f := xdstest.NewMockServer(t)
+		setDialOptions(proxy, f.Listener)
+		recorder := &upstreamKiller{}
+		proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+		conn := setupDownstreamConnection(t, proxy)
+		node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+		primary := deltaStream(t, conn)
+		if err := primary.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+			t.Fatal(err)
+		}
+		retry.UntilSuccessOrFail(t, func() error {
+			if sent := len(recorder.streamRequests(0)); sent == 0 {
+				return fmt.Errorf("expected the subscription to be forwarded upstream")
+			}
+			return nil
+		}, retry.Timeout(time.Second*5))
+
+		// The Envoy sharing the upstream stream is rejected too, and the type is not subscribed to upstream.
+		subscriber := deltaStream(t, conn)
+		if err := subscriber.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.SecretType, Node: node}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := subscriber.Recv()
+		expectDenied(t, err)
+		for _, req := range recorder.streamRequests(0) {
+			if req.TypeUrl == v3.SecretType {
+				t.Fatalf("expected the denied type URL not to be subscribed to upstream, got %v", req)
+			}
+		}
+	})
+}
+
+func TestXdsProxyAllowedTypeURLs(t *testing.T) {
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{AllowedTypeURLs: []string{v3.ClusterType, v3.ListenerType}})
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+
+	// An allowed type URL is forwarded upstream.
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "cds"})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "cds")
+
+	// A type URL which is not allowed is rejected, and not forwarded upstream.
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = downstream.Recv()
+	if grpcstatus.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the request to be rejected with PermissionDenied, got %v", err)
+	}
+	for _, req := range recorder.streamRequests(0) {
+		if req.TypeUrl == v3.EndpointType {
+			t.Fatalf("unexpected request forwarded upstream: %v", req)
+		}
+	}
+}
+
+func TestXdsProxyUpstreamDialTimeoutQuietStream(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.upstreamDialTimeout = time.Millisecond * 50
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	node := model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+	}
+	downstream := stream(t, conn)
+	sendDownstreamWithNode(t, downstream, node)
+	// The dial timeout does not apply once connected, so the quiet stream is kept.
+	time.Sleep(time.Millisecond * 200)
+	sendDownstreamWithNode(t, downstream, node)
+}
+
+func TestXdsProxyUpstreamRecvIdleTimeout(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.upstreamRecvIdleTimeout = time.Millisecond * 300
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithoutResponse(t, downstream)
+	retry.UntilSuccessOrFail(t, func() error {
+		if reqs := f.Requests(v3.ClusterType); len(reqs) != 1 {
+			return fmt.Errorf("expected the request to be forwarded, got %d requests", len(reqs))
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	f.SendResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1"})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "1")
+
+	// No more responses are received, so the request is resent on a new upstream connection.
+	retry.UntilSuccessOrFail(t, func() error {
+		if reqs := f.Requests(v3.ClusterType); len(reqs) != 2 {
+			return fmt.Errorf("expected the request to be resent, got %d requests", len(reqs))
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, f.Requests(v3.ClusterType)[1].Node != nil, true)
+	// Let the mock notice the previous connection is closed, so that it does not take the next push.
+	time.Sleep(time.Millisecond * 100)
+
+	// The stream of Envoy is kept, and receives the next push.
+	f.SendResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "2"})
+	resp, err = downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "2")
+}
+
 type fakeAckCache struct{}
 
 func (f *fakeAckCache) Get(string, wasmcache.GetOptions) (string, error) {
@@ -459,6 +874,19 @@ func (f *fakeNackCache) Get(string, wasmcache.GetOptions) (string, error) {
 }
 func (f *fakeNackCache) Cleanup() {}
 
+// fakeFlakyCache fails the configured number of times before behaving like fakeAckCache.
+type fakeFlakyCache struct {
+	failures *atomic.Int32
+}
+
+func (f *fakeFlakyCache) Get(string, wasmcache.GetOptions) (string, error) {
+	if f.failures.Dec() >= 0 {
+		return "", errors.New("error")
+	}
+	return "test", nil
+}
+func (f *fakeFlakyCache) Cleanup() {}
+
 func TestECDSWasmConversion(t *testing.T) {
 	node := model.NodeMetadata{
 		Namespace:   "default",
@@ -469,6 +897,7 @@ func TestECDSWasmConversion(t *testing.T) {
 	// Reset wasm cache to a fake ACK cache.
 	proxy.wasmCache.Cleanup()
 	proxy.wasmCache = &fakeAckCache{}
+	logs := captureJSONLogs(t)
 
 	// Initialize discovery server with an ECDS resource.
 	ef, err := os.ReadFile(path.Join(env.IstioSrc, "pilot/pkg/xds/testdata/ecds.yaml"))
@@ -531,6 +960,18 @@ func TestECDSWasmConversion(t *testing.T) {
 	if !proto.Equal(gotEcdsConfig, wantEcdsConfig) {
 		t.Errorf("xds proxy wasm config conversion got %v want %v", gotEcdsConfig, wantEcdsConfig)
 	}
+	// The rewrite is reported as a structured event, as for delta XDS.
+	var rewrites []map[string]any
+	for _, entry := range logs() {
+		if entry["scope"] == wasmRewriteLog.Name() {
+			rewrites = append(rewrites, entry)
+		}
+	}
+	if len(rewrites) != 1 {
+		t.Fatalf("expected one wasm rewrite event, got %v", rewrites)
+	}
+	assert.Equal(t, rewrites[0]["extension"], "extension-config")
+	assert.Equal(t, rewrites[0]["result"], wasmRewriteFetched)
 	v1 := proxy.ecdsLastAckVersion
 	n1 := proxy.ecdsLastNonce
 
@@ -570,6 +1011,88 @@ func TestECDSWasmConversion(t *testing.T) {
 	if v1.Load() == v2.Load() {
 		t.Errorf("last ack ecds request was updated. expect it to remain the same which represents a nack for ecds update")
 	}
+	// The reason of the NACK is exposed on the debug endpoint.
+	nack := proxy.ecdsLastNack.Load()
+	if nack == nil {
+		t.Fatal("expected the ecds nack to be recorded")
+	}
+	assert.Equal(t, nack.Resources, []string{"extension-config"})
+	rec := httptest.NewRecorder()
+	proxy.ecdsz(rec, nil)
+	if !strings.Contains(rec.Body.String(), "cannot fetch Wasm module https://test-url") {
+		t.Errorf("ecdsz output %v does not contain the last nack %+v", rec.Body.String(), nack)
+	}
+}
+
+func TestXdsProxyHandledTypeURLs(t *testing.T) {
+	alias := "type.googleapis.com/custom.ExtensionConfig"
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{ECDSTypeURLAliases: []string{alias}})
+	proxy.handlers[v3.NameTableType] = func(*anypb.Any) error { return nil }
+	assert.Equal(t, proxy.HandledTypeURLs(), map[string]string{
+		v3.ExtensionConfigurationType: "wasm-rewrite",
+		alias:                         "wasm-rewrite",
+		v3.NameTableType:              "agent-handler",
+	})
+	rec := httptest.NewRecorder()
+	proxy.handlerz(rec, nil)
+	if !strings.Contains(rec.Body.String(), fmt.Sprintf("%q: %q", v3.ExtensionConfigurationType, "wasm-rewrite")) {
+		t.Errorf("handlerz output %v does not contain the ECDS type URL", rec.Body.String())
+	}
+}
+
+// Validates a transient Wasm fetch failure on SotW XDS is retried, holding back the response until the
+// fetch succeeds instead of NACKing it.
+func TestECDSWasmConversionRetry(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = &fakeFlakyCache{failures: atomic.NewInt32(2)}
+	proxy.wasmFetchMaxAttempts = 3
+	proxy.wasmFetchInitialBackoff = time.Millisecond
+
+	ef, err := os.ReadFile(path.Join(env.IstioSrc, "pilot/pkg/xds/testdata/ecds.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{
+		ConfigString: string(ef),
+	})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+
+	err = downstream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       v3.ExtensionConfigurationType,
+		ResourceNames: []string{"extension-config"},
+		Node: &core.Node{
+			Id: "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: model.NodeMetadata{
+				Namespace:   "default",
+				InstanceIPs: []string{"1.1.1.1"},
+				ClusterID:   "Kubernetes",
+			}.ToStruct(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotResp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotResp.Resources) != 1 {
+		t.Fatalf("xds proxy ecds wasm conversion number of received resource got %v want 1", len(gotResp.Resources))
+	}
+	gotEcdsConfig := &core.TypedExtensionConfig{}
+	if err := gotResp.Resources[0].UnmarshalTo(gotEcdsConfig); err != nil {
+		t.Fatalf("wasm config conversion output %v failed to unmarshal", gotResp.Resources[0])
+	}
+	gotWasm := &wasm.Wasm{}
+	if err := gotEcdsConfig.TypedConfig.UnmarshalTo(gotWasm); err != nil {
+		t.Fatalf("wasm config conversion output %v failed to unmarshal", gotEcdsConfig)
+	}
+	assert.Equal(t, gotWasm.GetConfig().GetVmConfig().GetCode().GetLocal().GetFilename(), "test")
+	assert.Equal(t, proxy.ecdsLastNack.Load() == nil, true)
 }
 
 func stream(t *testing.T, conn *grpc.ClientConn) discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient {
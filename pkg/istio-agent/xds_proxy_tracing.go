@@ -0,0 +1,64 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names of the spans of the delta responses.
+const (
+	spanReceiveUpstream   = "xds_proxy.receive_upstream_response"
+	spanWasmRewrite       = "xds_proxy.wasm_rewrite"
+	spanForwardDownstream = "xds_proxy.forward_downstream"
+)
+
+// Attributes of the spans of the delta responses. The spans of a response are linked by its correlation ID.
+const (
+	attrConnectionID  = attribute.Key("xds.connection_id")
+	attrTypeURL       = attribute.Key("xds.type_url")
+	attrNonce         = attribute.Key("xds.nonce")
+	attrCorrelationID = attribute.Key("xds.correlation_id")
+	attrResources     = attribute.Key("xds.resources")
+)
+
+// startDeltaSpan starts the span name of resp on con. The span does nothing if no tracer is configured.
+func (con *ProxyConnection) startDeltaSpan(name string, resp *discovery.DeltaDiscoveryResponse) trace.Span {
+	if con.tracer == nil {
+		return trace.SpanFromContext(context.Background())
+	}
+	_, span := con.tracer.Start(context.Background(), name, trace.WithAttributes(
+		attrConnectionID.Int64(int64(con.conID)),
+		attrTypeURL.String(resp.TypeUrl),
+		attrNonce.String(resp.Nonce),
+		attrCorrelationID.String(deltaCorrelationID(con.conID, resp.Nonce)),
+		attrResources.Int(len(resp.Resources)),
+	))
+	return span
+}
+
+// endSpan ends span, marking it failed with err if set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
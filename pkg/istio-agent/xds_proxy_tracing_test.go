@@ -0,0 +1,106 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xds"
+	"istio.io/istio/pkg/test/env"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestDeltaECDSTracing(t *testing.T) {
+	node := model.NodeMetadata{
+		Namespace:   "default",
+		InstanceIPs: []string{"1.1.1.1"},
+		ClusterID:   "Kubernetes",
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	proxy := setupXdsProxy(t)
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = &fakeAckCache{}
+	proxy.tracer = provider.Tracer("test")
+
+	ef, err := os.ReadFile(path.Join(env.IstioSrc, "pilot/pkg/xds/testdata/ecds.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{
+		ConfigString: string(ef),
+	})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	err = downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                v3.ExtensionConfigurationType,
+		ResourceNamesSubscribe: []string{"extension-config"},
+		Node: &core.Node{
+			Id:       "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: node.ToStruct(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var spans tracetest.SpanStubs
+	retry.UntilSuccessOrFail(t, func() error {
+		spans = exporter.GetSpans()
+		if len(spans) != 3 {
+			return fmt.Errorf("expected 3 spans, got %d", len(spans))
+		}
+		return nil
+	}, retry.Timeout(time.Second), retry.Delay(time.Millisecond))
+
+	names := []string{}
+	correlations := map[string]bool{}
+	for _, span := range spans {
+		names = append(names, span.Name)
+		attrs := map[string]string{}
+		for _, kv := range span.Attributes {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		assert.Equal(t, attrs[string(attrTypeURL)], v3.ExtensionConfigurationType)
+		assert.Equal(t, attrs[string(attrNonce)], resp.Nonce)
+		correlations[attrs[string(attrCorrelationID)]] = true
+	}
+	// The receipt span ends once the rewrite is dispatched, so it may be exported after the rewrite span.
+	sort.Strings(names)
+	assert.Equal(t, names, []string{spanForwardDownstream, spanReceiveUpstream, spanWasmRewrite})
+	// The spans of the exchange are linked by a single correlation ID.
+	assert.Equal(t, len(correlations), 1)
+}
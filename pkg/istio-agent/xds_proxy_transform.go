@@ -0,0 +1,98 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// ResourceTransformer transforms the resources of a type URL before the XDS proxy forwards them to Envoy, for
+// instance to inject a local stat prefix into the clusters.
+type ResourceTransformer interface {
+	// Transform returns the resource forwarded to Envoy in place of resource, which it may mutate. The name of the
+	// resource must be preserved. An error rejects the whole response, which is NACKed upstream.
+	Transform(typeURL string, resource *anypb.Any) (*anypb.Any, error)
+}
+
+// ResourceTransformerFunc is a function implementing ResourceTransformer.
+type ResourceTransformerFunc func(typeURL string, resource *anypb.Any) (*anypb.Any, error)
+
+// Transform calls f.
+func (f ResourceTransformerFunc) Transform(typeURL string, resource *anypb.Any) (*anypb.Any, error) {
+	return f(typeURL, resource)
+}
+
+// transform applies the transformer of typeURL, if any, to resources. Either all the resources are transformed,
+// or none is if the transformer fails on one of them.
+func (p *XdsProxy) transform(typeURL string, resources []*anypb.Any, name func(i int) string) ([]*anypb.Any, error) {
+	t := p.resourceTransformers[typeURL]
+	if t == nil {
+		return resources, nil
+	}
+	out := make([]*anypb.Any, 0, len(resources))
+	for i, r := range resources {
+		transformed, err := t.Transform(typeURL, r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform %s %s: %v", v3.GetShortType(typeURL), name(i), err)
+		}
+		out = append(out, transformed)
+	}
+	return out, nil
+}
+
+// transformDelta applies the transformer of the type of resp to its resources. The names of the resources and the
+// removed resources are unchanged.
+func (p *XdsProxy) transformDelta(resp *discovery.DeltaDiscoveryResponse) error {
+	if p.resourceTransformers[resp.TypeUrl] == nil {
+		return nil
+	}
+	resources := make([]*anypb.Any, 0, len(resp.Resources))
+	for _, r := range resp.Resources {
+		resources = append(resources, r.Resource)
+	}
+	resources, err := p.transform(resp.TypeUrl, resources, func(i int) string { return resp.Resources[i].Name })
+	if err != nil {
+		return err
+	}
+	for i := range resources {
+		resp.Resources[i].Resource = resources[i]
+	}
+	return nil
+}
+
+// transformSotw applies the transformer of the type of resp to its resources.
+func (p *XdsProxy) transformSotw(resp *discovery.DiscoveryResponse) error {
+	resources, err := p.transform(resp.TypeUrl, resp.Resources, func(i int) string { return fmt.Sprint(i) })
+	if err != nil {
+		return err
+	}
+	resp.Resources = resources
+	return nil
+}
+
+// transformNack returns the status NACKing a response the transformers failed on.
+func transformNack(err error) *google_rpc.Status {
+	return &google_rpc.Status{
+		Code:    int32(codes.Internal),
+		Message: err.Error(),
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xds"
+	"istio.io/istio/pkg/test/util/assert"
+)
+
+func TestDeltaXdsProxyResourceTransformer(t *testing.T) {
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		ResourceTransformers: map[string]ResourceTransformer{
+			v3.ClusterType: ResourceTransformerFunc(func(typeURL string, resource *anypb.Any) (*anypb.Any, error) {
+				c := &cluster.Cluster{}
+				if err := resource.UnmarshalTo(c); err != nil {
+					return nil, err
+				}
+				c.AltStatName = "local." + c.Name
+				return protoconv.MessageToAny(c), nil
+			}),
+		},
+	})
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.BufListener)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node: &core.Node{
+			Id:       "sidecar~1.1.1.1~debug~cluster.local",
+			Metadata: model.NodeMetadata{Namespace: "default", InstanceIPs: []string{"1.1.1.1"}}.ToStruct(),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.TypeUrl, v3.ClusterType)
+	if len(resp.Resources) == 0 {
+		t.Fatal("expected clusters")
+	}
+	for _, r := range resp.Resources {
+		c := &cluster.Cluster{}
+		if err := r.Resource.UnmarshalTo(c); err != nil {
+			t.Fatal(err)
+		}
+		// The resources keep their names, and carry the mutation.
+		assert.Equal(t, r.Name, c.Name)
+		assert.Equal(t, c.AltStatName, "local."+c.Name)
+	}
+}
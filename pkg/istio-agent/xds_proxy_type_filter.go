@@ -0,0 +1,35 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pkg/util/sets"
+)
+
+// checkTypeURL returns a PermissionDenied error if Envoy is not allowed to subscribe to typeURL, either as it is
+// denied or as it is absent from the allowed type URLs if any. Such requests are not forwarded upstream.
+func (p *XdsProxy) checkTypeURL(typeURL string) error {
+	if p.deniedTypeURLs.Contains(typeURL) {
+		return status.Errorf(codes.PermissionDenied, "subscriptions to type URL %q are denied by the XDS proxy", typeURL)
+	}
+	if len(p.allowedTypeURLs) > 0 && !p.allowedTypeURLs.Contains(typeURL) {
+		return status.Errorf(codes.PermissionDenied, "subscriptions to type URL %q are not allowed by the XDS proxy, "+
+			"the allowed type URLs are %v", typeURL, sets.SortedList(p.allowedTypeURLs))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+
+	"istio.io/istio/pkg/slices"
+)
+
+// unixAddressPrefix prefixes the upstream addresses of the XDS servers listening on a Unix domain socket.
+const unixAddressPrefix = "unix://"
+
+// dialUpstream connects to the upstream XDS server at addr, which is either a network address, or the absolute path
+// of a Unix domain socket prefixed with unix://, e.g. unix:///var/run/xds/xds.sock for a local XDS broker.
+func dialUpstream(ctx context.Context, addr string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	path, ok := strings.CutPrefix(addr, unixAddressPrefix)
+	if !ok {
+		return grpc.DialContext(ctx, addr, opts...)
+	}
+	// The socket is dialed directly, with all the other options, e.g. TLS, unchanged. The authority is the one
+	// used by gRPC for Unix domain sockets, as the path is not a valid authority.
+	opts = append(slices.Clone(opts),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}),
+		grpc.WithAuthority("localhost"))
+	return grpc.DialContext(ctx, "passthrough:///"+path, opts...)
+}
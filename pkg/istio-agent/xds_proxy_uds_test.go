@@ -0,0 +1,58 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"path/filepath"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/uds"
+)
+
+func TestXdsProxyUpstreamUnixDomainSocket(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	path := filepath.Join(t.TempDir(), "xds.sock")
+	l, err := uds.NewListener(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := xdstest.NewMockServer(t)
+	server := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(server, f)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	proxy.istiodAddress = unixAddressPrefix + path
+	proxy.dialOptions = []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithoutResponse(t, downstream)
+	f.SendResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "nonce"})
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.Nonce, "nonce")
+}
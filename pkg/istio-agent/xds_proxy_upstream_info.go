@@ -0,0 +1,71 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"net/http"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/grpc/metadata"
+)
+
+// upstreamInfo identifies the upstream XDS server the proxy last connected to, as reported on the debug interface.
+type upstreamInfo struct {
+	Address     string    `json:"address"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// Headers are the response headers of the upstream stream.
+	Headers map[string][]string `json:"headers,omitempty"`
+	// ControlPlane is the identifier of the control plane sent by the upstream along with its responses. Istiod
+	// reports its instance and version.
+	ControlPlane string `json:"controlPlane,omitempty"`
+}
+
+// recordUpstreamHeaders records the response headers of the upstream stream once they are received.
+// It blocks until then, so it is run in its own goroutine.
+func (p *XdsProxy) recordUpstreamHeaders(con *ProxyConnection, upstream interface{ Header() (metadata.MD, error) }) {
+	md, err := upstream.Header()
+	if err != nil {
+		return
+	}
+	info := &upstreamInfo{
+		Address:     p.activeUpstreamAddress(),
+		ConnectedAt: time.Now(),
+		Headers:     md,
+	}
+	p.upstreamInfo.Store(info)
+	con.logger().WithLabels("address", info.Address).Infof("upstream XDS server headers: %v", info.Headers)
+}
+
+// recordControlPlane records the identifier of the control plane sending the responses on the upstream stream.
+func (p *XdsProxy) recordControlPlane(con *ProxyConnection, cp *core.ControlPlane) {
+	if id := cp.GetIdentifier(); id != "" && p.upstreamControlPlane.Swap(id) != id {
+		con.logger().Infof("upstream XDS control plane: %s", id)
+	}
+}
+
+// upstreamz reports the identity of the upstream XDS server the proxy last connected to.
+func (p *XdsProxy) upstreamz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, p.upstreamState())
+}
+
+func (p *XdsProxy) upstreamState() upstreamInfo {
+	out := upstreamInfo{}
+	if info := p.upstreamInfo.Load(); info != nil {
+		out = *info
+	}
+	out.ControlPlane = p.upstreamControlPlane.Load()
+	return out
+}
@@ -0,0 +1,90 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+const testControlPlane = `{"Component":"istiod","ID":"istiod-1","info":{"version":"1.22.0"}}`
+
+// versionedDiscoveryServer sends its version in the headers of the streams, and identifies itself in its responses.
+type versionedDiscoveryServer struct {
+	discovery.UnimplementedAggregatedDiscoveryServiceServer
+}
+
+func (*versionedDiscoveryServer) StreamAggregatedResources(s discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	if err := s.SendHeader(metadata.Pairs("x-istiod-version", "1.22.0")); err != nil {
+		return err
+	}
+	if _, err := s.Recv(); err != nil {
+		return err
+	}
+	if err := s.Send(&discovery.DiscoveryResponse{
+		TypeUrl:      v3.ClusterType,
+		Nonce:        "nonce",
+		ControlPlane: &core.ControlPlane{Identifier: testControlPlane},
+	}); err != nil {
+		return err
+	}
+	<-s.Context().Done()
+	return nil
+}
+
+func TestXdsProxyUpstreamInfo(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	l := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(server, &versionedDiscoveryServer{})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	setDialOptions(proxy, l)
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := stream(t, conn)
+	sendDownstreamWithoutResponse(t, downstream)
+	if _, err := downstream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got upstreamInfo
+	retry.UntilSuccessOrFail(t, func() error {
+		rec := httptest.NewRecorder()
+		proxy.upstreamz(rec, nil)
+		got = upstreamInfo{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			return err
+		}
+		if len(got.Headers["x-istiod-version"]) == 0 || got.ControlPlane == "" {
+			return fmt.Errorf("upstream info %v is not recorded yet", rec.Body.String())
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, got.Headers["x-istiod-version"], []string{"1.22.0"})
+	assert.Equal(t, got.ControlPlane, testControlPlane)
+}
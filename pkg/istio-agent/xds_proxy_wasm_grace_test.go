@@ -0,0 +1,111 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/channels"
+	"istio.io/istio/pkg/test/util/assert"
+	wasmcache "istio.io/istio/pkg/wasm"
+)
+
+// slowWasmCache fails to fetch the module until readyAt, as a slow registry would.
+type slowWasmCache struct {
+	module  string
+	readyAt time.Time
+}
+
+func (c *slowWasmCache) Get(string, wasmcache.GetOptions) (string, error) {
+	if time.Now().Before(c.readyAt) {
+		return "", errors.New("fetch in progress")
+	}
+	return c.module, nil
+}
+func (c *slowWasmCache) Cleanup() {}
+
+func TestECDSRewriteFetchGracePeriod(t *testing.T) {
+	module := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(module, []byte("module"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		readyIn  time.Duration
+		wantNack bool
+	}{
+		{name: "fetched within the grace period", readyIn: 300 * time.Millisecond},
+		{name: "grace period elapsed", readyIn: time.Minute, wantNack: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := setupXdsProxy(t)
+			proxy.wasmCache.Cleanup()
+			proxy.wasmCache = &slowWasmCache{module: module, readyAt: time.Now().Add(c.readyIn)}
+			// A single attempt would NACK the response straight away without the grace period.
+			proxy.wasmFetchMaxAttempts = 1
+			proxy.wasmFetchInitialBackoff = 10 * time.Millisecond
+			proxy.wasmFetchGracePeriod = time.Second
+			con := &ProxyConnection{
+				stopChan:          make(chan struct{}),
+				deltaRequestsChan: channels.NewUnbounded[*discovery.DeltaDiscoveryRequest](),
+			}
+
+			var forwarded *discovery.DeltaDiscoveryResponse
+			start := time.Now()
+			proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+				TypeUrl:   v3.ExtensionConfigurationType,
+				Nonce:     "n1",
+				Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+			}, func(resp *discovery.DeltaDiscoveryResponse) {
+				forwarded = resp
+			})
+
+			if !c.wantNack {
+				if forwarded == nil {
+					t.Fatal("expected the response to be forwarded for Envoy to ACK")
+				}
+				select {
+				case nack := <-con.deltaRequestsChan.Get():
+					t.Fatalf("unexpected NACK: %v", nack.ErrorDetail)
+				default:
+				}
+				return
+			}
+			if forwarded != nil {
+				t.Fatalf("unexpected response forwarded to Envoy: %v", forwarded)
+			}
+			if elapsed := time.Since(start); elapsed < proxy.wasmFetchGracePeriod {
+				t.Fatalf("NACKed after %v, before the grace period elapsed", elapsed)
+			}
+			select {
+			case nack := <-con.deltaRequestsChan.Get():
+				assert.Equal(t, nack.ResponseNonce, "n1")
+				if nack.ErrorDetail == nil {
+					t.Fatal("expected an error detail in the NACK")
+				}
+			default:
+				t.Fatal("expected the response to be NACKed")
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"net/http"
+
+	"istio.io/istio/pkg/wasm"
+)
+
+// wasmModule is a cached Wasm module as reported by /debug/wasm/list.
+type wasmModule struct {
+	wasm.ModuleInfo
+	// Referenced is true if an ECDS resource the module was fetched for is currently served with it.
+	Referenced bool `json:"referenced"`
+}
+
+// wasmList lists the Wasm modules of the cache, and whether they are referenced by an active ECDS config.
+func (p *XdsProxy) wasmList(w http.ResponseWriter, _ *http.Request) {
+	lister, ok := p.wasmCache.(wasm.Lister)
+	if !ok {
+		http.Error(w, fmt.Sprintf("the Wasm module cache %T does not support listing", p.wasmCache), http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, p.wasmModules(lister))
+}
+
+func (p *XdsProxy) wasmModules(lister wasm.Lister) []wasmModule {
+	statuses := p.ecdsStatuses.snapshot()
+	modules := lister.List()
+	out := make([]wasmModule, 0, len(modules))
+	for _, m := range modules {
+		module := wasmModule{ModuleInfo: m}
+		for _, resource := range m.Resources {
+			if statuses[resource].Status == ecdsFetchFetched {
+				module.Referenced = true
+				break
+			}
+		}
+		out = append(out, module)
+	}
+	return out
+}
@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/test/util/assert"
+	wasmcache "istio.io/istio/pkg/wasm"
+)
+
+func TestWasmList(t *testing.T) {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	sha := sha256.Sum256(module)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(module)
+	}))
+	defer ts.Close()
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		WASMCache: wasmcache.NewLocalFileCache(t.TempDir(), wasmcache.Options{}),
+	})
+	list := func() []wasmModule {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		proxy.wasmList(rec, httptest.NewRequest("GET", "/debug/wasm/list", nil))
+		assert.Equal(t, rec.Code, http.StatusOK)
+		var out []wasmModule
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	assert.Equal(t, len(list()), 0)
+
+	con := &ProxyConnection{stopChan: make(chan struct{})}
+	var forwarded *discovery.DeltaDiscoveryResponse
+	proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Resources: []*discovery.Resource{remoteWasmExtensionConfigWithURL("extension-config", ts.URL+"/plugin.wasm")},
+	}, func(resp *discovery.DeltaDiscoveryResponse) {
+		forwarded = resp
+	})
+	if forwarded == nil {
+		t.Fatal("expected the response to be forwarded")
+	}
+
+	modules := list()
+	assert.Equal(t, len(modules), 1)
+	got := modules[0]
+	assert.Equal(t, got.Name, ts.URL+"/plugin.wasm")
+	assert.Equal(t, got.Digest, hex.EncodeToString(sha[:]))
+	assert.Equal(t, got.Size, int64(len(module)))
+	assert.Equal(t, got.Resources, []string{"extension-config"})
+	assert.Equal(t, got.Referenced, true)
+}
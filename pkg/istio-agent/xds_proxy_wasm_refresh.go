@@ -0,0 +1,54 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"net/http"
+
+	"istio.io/istio/pkg/wasm"
+)
+
+// wasmRefreshResult is the outcome of /debug/wasm/refresh.
+type wasmRefreshResult struct {
+	Name string `json:"name"`
+	// Evicted is true if a cached Wasm module of the extension config was evicted.
+	Evicted bool `json:"evicted"`
+	// Rewrites is the number of remembered ECDS rewrites of the extension config which were dropped.
+	Rewrites int `json:"rewrites"`
+}
+
+// wasmRefresh evicts the cached Wasm module of the extension config named by the name query parameter, and
+// forgets its ECDS rewrites, so that the module is fetched again the next time an ECDS response references it.
+// This is a break-glass for a module pushed again under the same tag, which the cache would keep serving.
+func (p *XdsProxy) wasmRefresh(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing the name of the extension config to refresh", http.StatusBadRequest)
+		return
+	}
+	refresher, ok := p.wasmCache.(wasm.Refresher)
+	if !ok {
+		http.Error(w, fmt.Sprintf("the Wasm module cache %T does not support refreshes", p.wasmCache), http.StatusNotImplemented)
+		return
+	}
+	out := wasmRefreshResult{
+		Name:     name,
+		Evicted:  refresher.Refresh(name),
+		Rewrites: p.ecdsRewrites.forget(name),
+	}
+	proxyLog.Infof("refreshed the Wasm module of extension config %q: %+v", name, out)
+	writeJSON(w, out)
+}
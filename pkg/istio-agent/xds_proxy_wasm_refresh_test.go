@@ -0,0 +1,78 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.uber.org/atomic"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/test/util/assert"
+	wasmcache "istio.io/istio/pkg/wasm"
+)
+
+func TestWasmRefresh(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Inc()
+		w.Write([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+	}))
+	defer ts.Close()
+	proxy := setupXdsProxyWithAgentOptions(t, &AgentOptions{
+		WASMCache: wasmcache.NewLocalFileCache(t.TempDir(), wasmcache.Options{}),
+	})
+	con := &ProxyConnection{stopChan: make(chan struct{})}
+	push := func() {
+		t.Helper()
+		var forwarded *discovery.DeltaDiscoveryResponse
+		proxy.deltaRewriteAndForward(con, &discovery.DeltaDiscoveryResponse{
+			TypeUrl:   v3.ExtensionConfigurationType,
+			Resources: []*discovery.Resource{remoteWasmExtensionConfigWithURL("extension-config", ts.URL+"/plugin.wasm")},
+		}, func(resp *discovery.DeltaDiscoveryResponse) {
+			forwarded = resp
+		})
+		if forwarded == nil {
+			t.Fatal("expected the response to be forwarded")
+		}
+	}
+	refresh := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		proxy.wasmRefresh(rec, httptest.NewRequest("GET", "/debug/wasm/refresh"+query, nil))
+		return rec
+	}
+
+	push()
+	push()
+	assert.Equal(t, requests.Load(), int32(1))
+
+	rec := refresh("?name=extension-config")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	var out wasmRefreshResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, out, wasmRefreshResult{Name: "extension-config", Evicted: true, Rewrites: 1})
+
+	// The next reference fetches the module again.
+	push()
+	assert.Equal(t, requests.Load(), int32(2))
+
+	assert.Equal(t, refresh("").Code, http.StatusBadRequest)
+}
@@ -0,0 +1,86 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"errors"
+
+	"github.com/hashicorp/go-multierror"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// wasmFailureReason is the reason of the ErrorInfo reporting a Wasm module which failed to be fetched or verified.
+const wasmFailureReason = "WASM_MODULE_LOAD_FAILED"
+
+// wasmConversionError is the failure to convert the Wasm modules of ECDS resources, along with the rewrites
+// of the resources whose module failed to be fetched or verified.
+type wasmConversionError struct {
+	err      error
+	failures []ecdsRewrite
+	// identified is true if the failures are the only resources which failed to be converted.
+	identified bool
+}
+
+func newWasmConversionError(err error, failures []ecdsRewrite) *wasmConversionError {
+	cerr := &wasmConversionError{err: err, failures: failures}
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		// Each resource which failed to be converted contributes one error.
+		cerr.identified = len(merr.Errors) == len(failures)
+	}
+	return cerr
+}
+
+func (e *wasmConversionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *wasmConversionError) Unwrap() error {
+	return e.err
+}
+
+// wasmNackStatus returns the error detail of the NACK of an ECDS response whose Wasm modules failed to be
+// converted. If the failures are reported, it carries an ErrorInfo for each module which failed to be fetched
+// or verified, with the name of the resource, the URL of the module and the reason, so that Istiod surfaces them.
+func (p *XdsProxy) wasmNackStatus(err error) *google_rpc.Status {
+	st := &google_rpc.Status{
+		Code:    int32(codes.Internal),
+		Message: err.Error(),
+	}
+	var cerr *wasmConversionError
+	if !p.reportWasmFailures || !errors.As(err, &cerr) {
+		return st
+	}
+	for _, failure := range cerr.failures {
+		detail, err := anypb.New(&errdetails.ErrorInfo{
+			Reason: wasmFailureReason,
+			Domain: "istio.io",
+			Metadata: map[string]string{
+				"resource": failure.name,
+				"module":   failure.fetch.url,
+				"error":    failure.fetch.err.Error(),
+			},
+		})
+		if err != nil {
+			proxyLog.Warnf("failed to report the Wasm module failure of %v: %v", failure.name, err)
+			continue
+		}
+		st.Details = append(st.Details, detail)
+	}
+	return st
+}
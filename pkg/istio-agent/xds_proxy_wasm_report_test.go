@@ -0,0 +1,79 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// Validates the NACK of an ECDS response whose Wasm module fails to be fetched details the failure upstream.
+func TestDeltaXdsProxyReportsWasmFailures(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.reportWasmFailures = true
+	proxy.wasmCache.Cleanup()
+	proxy.wasmCache = &fakeNackCache{}
+	f := xdstest.NewMockServer(t)
+	setDialOptions(proxy, f.Listener)
+	recorder := &upstreamKiller{}
+	proxy.dialOptions = append(proxy.dialOptions, grpc.WithStreamInterceptor(recorder.interceptor()))
+	conn := setupDownstreamConnection(t, proxy)
+	downstream := deltaStream(t, conn)
+	if err := downstream.Send(&discovery.DeltaDiscoveryRequest{
+		TypeUrl: v3.ExtensionConfigurationType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.SendDeltaResponse(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:   v3.ExtensionConfigurationType,
+		Nonce:     "nonce",
+		Resources: []*discovery.Resource{remoteWasmExtensionConfig("extension-config")},
+	})
+
+	var nack *discovery.DeltaDiscoveryRequest
+	retry.UntilSuccessOrFail(t, func() error {
+		for _, req := range recorder.streamRequests(0) {
+			if req.ResponseNonce == "nonce" && req.ErrorDetail != nil {
+				nack = req
+				return nil
+			}
+		}
+		return fmt.Errorf("expected the ECDS response to be NACKed upstream")
+	}, retry.Timeout(time.Second*5))
+	assert.Equal(t, len(nack.ErrorDetail.Details), 1)
+	info := &errdetails.ErrorInfo{}
+	if err := nack.ErrorDetail.Details[0].UnmarshalTo(info); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, info.Reason, wasmFailureReason)
+	assert.Equal(t, info.Metadata, map[string]string{
+		"resource": "extension-config",
+		"module":   "http://test/plugin.wasm",
+		"error":    "error",
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// FetchAuthProvider authenticates the HTTP(S) fetches of Wasm modules and their signatures.
+type FetchAuthProvider interface {
+	// Headers returns the headers authenticating a request to u, or nil for an anonymous request. It is called for
+	// every request, including the retries, so that rotated credentials are picked up.
+	Headers(ctx context.Context, u *url.URL) (http.Header, error)
+}
+
+// FetchAuthProviderFunc adapts a function to a FetchAuthProvider, for custom authentication schemes.
+type FetchAuthProviderFunc func(ctx context.Context, u *url.URL) (http.Header, error)
+
+func (f FetchAuthProviderFunc) Headers(ctx context.Context, u *url.URL) (http.Header, error) {
+	return f(ctx, u)
+}
+
+// TokenSource provides a credential, such as a bearer token. It is called on every request, so that the
+// credential can be rotated.
+type TokenSource func() (string, error)
+
+// FileToken returns a TokenSource reading the credential from a file, such as a projected service account token,
+// with its surrounding whitespace trimmed.
+func FileToken(path string) TokenSource {
+	return func() (string, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read Wasm fetch token: %v", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+}
+
+// BearerTokenAuth returns a FetchAuthProvider authenticating the requests with the bearer token provided by token.
+func BearerTokenAuth(token TokenSource) FetchAuthProvider {
+	return FetchAuthProviderFunc(func(context.Context, *url.URL) (http.Header, error) {
+		t, err := token()
+		if err != nil {
+			return nil, err
+		}
+		return http.Header{"Authorization": []string{"Bearer " + t}}, nil
+	})
+}
+
+// BasicAuth returns a FetchAuthProvider authenticating the requests with the basic credentials of username,
+// and the password provided by password.
+func BasicAuth(username string, password TokenSource) FetchAuthProvider {
+	return FetchAuthProviderFunc(func(context.Context, *url.URL) (http.Header, error) {
+		p, err := password()
+		if err != nil {
+			return nil, err
+		}
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(username, p)
+		return req.Header, nil
+	})
+}
+
+// HostAuthProviders selects the FetchAuthProvider of a request by the host of its URL, matching either with or
+// without the port. The requests to the other hosts are anonymous.
+type HostAuthProviders map[string]FetchAuthProvider
+
+func (h HostAuthProviders) Headers(ctx context.Context, u *url.URL) (http.Header, error) {
+	p, f := h[u.Host]
+	if !f {
+		p, f = h[u.Hostname()]
+	}
+	if !f {
+		return nil, nil
+	}
+	return p.Headers(ctx, u)
+}
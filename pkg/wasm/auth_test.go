@@ -0,0 +1,136 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestWasmCacheFetchAuth(t *testing.T) {
+	binary := append(wasmHeader, []byte("data")...)
+	// The registry rotates its token on every request.
+	var token atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", token.Load()) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token.Inc()
+		w.Write(binary)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := defaultOptions()
+	options.FetchAuth = HostAuthProviders{
+		u.Hostname(): BearerTokenAuth(func() (string, error) {
+			return fmt.Sprintf("token-%d", token.Load()), nil
+		}),
+	}
+	cache := NewLocalFileCache(t.TempDir(), options)
+	defer close(cache.stopChan)
+
+	for _, module := range []string{"/first.wasm", "/second.wasm"} {
+		path, err := cache.Get(ts.URL+module, GetOptions{
+			ResourceName:   "namespace.resource",
+			RequestTimeout: time.Second * 10,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if path == "" {
+			t.Fatal("expected the module to be cached")
+		}
+	}
+	if got := token.Load(); got != 2 {
+		t.Fatalf("expected both fetches to be authenticated with a fresh token, got %v authenticated requests", got)
+	}
+}
+
+func TestWasmHTTPFetchAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("wasm"))
+	}))
+	defer ts.Close()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("password\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		auth    FetchAuthProvider
+		wantErr string
+	}{
+		{
+			name: "basic",
+			auth: BasicAuth("user", FileToken(passwordFile)),
+		},
+		{
+			name:    "other host",
+			auth:    HostAuthProviders{"example.com": BasicAuth("user", FileToken(passwordFile))},
+			wantErr: "status code 401",
+		},
+		{
+			name: "custom",
+			auth: FetchAuthProviderFunc(func(context.Context, *url.URL) (http.Header, error) {
+				return http.Header{"authorization": []string{"Basic dXNlcjpwYXNzd29yZA=="}}, nil
+			}),
+		},
+		{
+			name:    "missing credentials",
+			auth:    BasicAuth("user", FileToken(filepath.Join(t.TempDir(), "missing"))),
+			wantErr: "failed to authenticate",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fetcher := NewHTTPFetcher(DefaultHTTPRequestTimeout, 1)
+			fetcher.auth = c.auth
+			b, err := fetcher.Fetch(context.Background(), ts.URL, false)
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(b) != "wasm" {
+					t.Fatalf("downloaded wasm module got %v, want wasm", string(b))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -19,19 +19,24 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/sync/singleflight"
 
 	extensions "istio.io/api/extensions/v1alpha1"
 	"istio.io/istio/pkg/log"
+	"istio.io/istio/pkg/monitoring"
 	"istio.io/istio/pkg/util/sets"
 )
 
@@ -45,18 +50,54 @@ const (
 	sha256SchemePrefix = "sha256:"
 )
 
-// Cache models a Wasm module cache.
+// Cache models a Wasm module cache. LocalFileCache is the default implementation; custom backends can be
+// provided to the agent instead, for instance to serve the modules from an internal artifact service.
+// Implementations must be safe for concurrent use.
 type Cache interface {
+	// Get returns the path of a local file, readable by Envoy, holding the module downloadable from url.
+	// For the modules held in memory, it returns a data URI inlining the module instead.
 	Get(url string, opts GetOptions) (string, error)
+	// Cleanup releases the resources of the cache once it is no longer used.
 	Cleanup()
 }
 
-// LocalFileCache for downloaded Wasm modules. Currently it stores the Wasm module as local file.
+// Refresher is implemented by the caches whose modules can be evicted on demand, so that they are fetched again.
+type Refresher interface {
+	// Refresh evicts the module last returned for the resource, so that it is fetched again the next time the
+	// resource references it. It returns false if no module is cached for the resource.
+	Refresh(resourceName string) bool
+}
+
+// Lister is implemented by the caches whose modules can be listed, for instance to audit them.
+type Lister interface {
+	// List returns the cached modules, sorted by name.
+	List() []ModuleInfo
+}
+
+// ModuleInfo describes a cached Wasm module.
+type ModuleInfo struct {
+	// Name is the URL the module is fetched from, without its digest.
+	Name string `json:"name"`
+	// URLs are the tagged URLs resolved to the module.
+	URLs []string `json:"urls,omitempty"`
+	// Digest is the sha256 checksum of the module.
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+	// Resources are the names of the resources the module was last returned for.
+	Resources []string `json:"resources,omitempty"`
+}
+
+// LocalFileCache for downloaded Wasm modules. It stores the Wasm modules as local files, or in memory if
+// Options.InMemory is set.
 type LocalFileCache struct {
 	// Map from Wasm module checksum to cache entry.
 	modules map[moduleKey]*cacheEntry
 	// Map from tagged URL to checksum
 	checksums map[string]*checksumEntry
+	// Map from resource name to the module last returned for it. Modules referenced by a resource are not evicted
+	// when the cache exceeds its maximum size.
+	resourceModules map[string]moduleKey
 	// http fetcher fetches Wasm module with HTTP get.
 	httpFetcher *HTTPFetcher
 
@@ -65,6 +106,8 @@ type LocalFileCache struct {
 
 	// mux is needed because stale Wasm module files will be purged periodically.
 	mux sync.Mutex
+	// fetches deduplicates the concurrent fetches of the same module.
+	fetches singleflight.Group
 
 	// option sets for configurating the cache.
 	cacheOptions
@@ -72,7 +115,11 @@ type LocalFileCache struct {
 	stopChan chan struct{}
 }
 
-var _ Cache = &LocalFileCache{}
+var (
+	_ Cache     = &LocalFileCache{}
+	_ Refresher = &LocalFileCache{}
+	_ Lister    = &LocalFileCache{}
+)
 
 type checksumEntry struct {
 	checksum string
@@ -102,10 +149,30 @@ type cacheKey struct {
 type cacheEntry struct {
 	// File path to the downloaded wasm modules.
 	modulePath string
+	// inline is the data URI inlining the module if it is held in memory, in which case there is no file.
+	inline string
 	// Last time that this local Wasm module is referenced.
 	last time.Time
 	// set of URLs referencing this entry
 	referencingURLs sets.String
+	// Hex-encoded sha256 checksum of the module binary written to modulePath.
+	// It is used to verify the local file before the entry is served from the cache.
+	// An empty value means the checksum is unknown and only the existence of the file is verified.
+	binaryChecksum string
+	// Size in bytes of the module file.
+	size int64
+	// decompressedPath is the path of the decompressed copy of the module read by Envoy, if the module file at
+	// modulePath is compressed.
+	decompressedPath string
+	// verified is the stamp of the module file when its checksum was last verified, so that it is only hashed again
+	// once it changes. It is guarded by the mux of the cache.
+	verified fileStamp
+}
+
+// fileStamp identifies the content of a file by its size and modification time.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
 }
 
 type cacheOptions struct {
@@ -134,6 +201,23 @@ func (o cacheOptions) sanitize() cacheOptions {
 	if o.HTTPRequestMaxRetries != 0 {
 		ret.HTTPRequestMaxRetries = o.HTTPRequestMaxRetries
 	}
+	if o.MaxModuleSize != 0 {
+		ret.MaxModuleSize = o.MaxModuleSize
+	}
+	ret.MaxCacheSize = o.MaxCacheSize
+	ret.MaxModuleVersions = o.MaxModuleVersions
+	ret.ModuleFetchTimeout = o.ModuleFetchTimeout
+	ret.Verifier = o.Verifier
+	ret.FetchAuth = o.FetchAuth
+	ret.AllowedHosts = o.AllowedHosts
+	ret.InMemory = o.InMemory
+	ret.HTTPProxy = o.HTTPProxy
+	ret.ExtraDirs = o.ExtraDirs
+	ret.CompressModules = o.CompressModules && !o.InMemory
+	ret.DecompressedDir = o.DecompressedDir
+	if ret.DecompressedDir == "" {
+		ret.DecompressedDir = filepath.Join(os.TempDir(), "istio-wasm-decompressed")
+	}
 
 	return ret
 }
@@ -142,19 +226,30 @@ func (o cacheOptions) allowInsecure(host string) bool {
 	return o.allowAllInsecureRegistries || o.InsecureRegistries.Contains(host)
 }
 
+// allowHost returns true if the Wasm modules at u may be fetched.
+func (o cacheOptions) allowHost(u *url.URL) bool {
+	return o.AllowedHosts.IsEmpty() || o.AllowedHosts.Contains(u.Host) || o.AllowedHosts.Contains(u.Hostname())
+}
+
 // NewLocalFileCache create a new Wasm module cache which downloads and stores Wasm module files locally.
 func NewLocalFileCache(dir string, options Options) *LocalFileCache {
 	wasmLog.Debugf("LocalFileCache is created with the option\n%#v", options)
 
 	cacheOptions := cacheOptions{Options: options}
 	cache := &LocalFileCache{
-		httpFetcher:  NewHTTPFetcher(options.HTTPRequestTimeout, options.HTTPRequestMaxRetries),
-		modules:      make(map[moduleKey]*cacheEntry),
-		checksums:    make(map[string]*checksumEntry),
-		dir:          dir,
-		cacheOptions: cacheOptions.sanitize(),
-		stopChan:     make(chan struct{}),
+		httpFetcher:     NewHTTPFetcher(options.HTTPRequestTimeout, options.HTTPRequestMaxRetries),
+		modules:         make(map[moduleKey]*cacheEntry),
+		checksums:       make(map[string]*checksumEntry),
+		resourceModules: make(map[string]moduleKey),
+		dir:             dir,
+		cacheOptions:    cacheOptions.sanitize(),
+		stopChan:        make(chan struct{}),
 	}
+	cache.httpFetcher.maxModuleSize = cache.MaxModuleSize
+	cache.httpFetcher.auth = cache.FetchAuth
+	cache.httpFetcher.setProxy(httpProxyFunc(cache.HTTPProxy))
+	removeStaleFetches(dir)
+	cache.loadManifest()
 
 	go func() {
 		cache.purge()
@@ -187,13 +282,49 @@ func shouldIgnoreResourceVersion(pullPolicy extensions.PullPolicy, u *url.URL) b
 }
 
 func getModulePath(baseDir string, mkey moduleKey) (string, error) {
+	modulePath := modulePathOf(baseDir, mkey)
+	if err := os.Mkdir(filepath.Dir(modulePath), 0o755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return modulePath, nil
+}
+
+// modulePathOf returns the path of the file of the module in baseDir.
+func modulePathOf(baseDir string, mkey moduleKey) string {
 	sha := sha256.Sum256([]byte(mkey.name))
 	hashedName := hex.EncodeToString(sha[:])
-	moduleDir := filepath.Join(baseDir, hashedName)
-	if err := os.Mkdir(moduleDir, 0o755); err != nil && !os.IsExist(err) {
-		return "", err
+	return filepath.Join(baseDir, hashedName, fmt.Sprintf("%s.wasm", mkey.checksum))
+}
+
+// moduleDir returns the directory storing the module of mkey, of the given size: the extra directory the module
+// is explicitly placed in, otherwise the one for the largest modules it is large enough for, otherwise the cache
+// directory.
+func (c *LocalFileCache) moduleDir(mkey moduleKey, size int64) string {
+	dir, minSize := c.dir, int64(0)
+	for _, d := range c.ExtraDirs {
+		if d.Modules.Contains(mkey.name) {
+			return d.Path
+		}
+		if d.MinModuleSize > minSize && size >= d.MinModuleSize {
+			dir, minSize = d.Path, d.MinModuleSize
+		}
 	}
-	return filepath.Join(moduleDir, fmt.Sprintf("%s.wasm", mkey.checksum)), nil
+	return dir
+}
+
+// isModulePath returns true if path is the path of the module of mkey in one of the directories of the cache,
+// compressed or not.
+func (c *LocalFileCache) isModulePath(path string, mkey moduleKey) bool {
+	path = strings.TrimSuffix(path, compressedSuffix)
+	if path == modulePathOf(c.dir, mkey) {
+		return true
+	}
+	for _, d := range c.ExtraDirs {
+		if path == modulePathOf(d.Path, mkey) {
+			return true
+		}
+	}
+	return false
 }
 
 // Get returns path the local Wasm module file.
@@ -209,49 +340,134 @@ func (c *LocalFileCache) Get(downloadURL string, opts GetOptions) (string, error
 		resourceVersion: opts.ResourceVersion,
 	}
 
-	entry, err := c.getOrFetch(key, opts)
+	entry, hit, err := c.getOrFetchShared(key, opts)
+	if err == nil && entry.decompressedPath != "" {
+		if merr := entry.materialize(); merr != nil {
+			err = fmt.Errorf("failed to decompress Wasm module %s: %v", downloadURL, merr)
+		}
+	}
+	recordCacheLookup(hit, err, opts.MetricLabels)
 	if err != nil {
 		return "", err
 	}
+	return entry.location(), nil
+}
+
+// recordCacheLookup records the result of a lookup of the cache, with the metric labels of the requesting Envoy.
+func recordCacheLookup(hit bool, err error, labels []monitoring.LabelValue) {
+	result := lookupMiss
+	if err != nil {
+		result = lookupError
+	} else if hit {
+		result = lookupHit
+	}
+	wasmCacheLookupsTotal.With(append(slices.Clone(labels), resultTag.Value(result))...).Increment()
+}
 
-	return entry.modulePath, err
+// getOrFetchShared is getOrFetch, sharing the fetch of a module with the concurrent calls for the same URL and
+// checksum, e.g. when several ECDS resources reference the same module. The calls joining a fetch in flight use
+// the options of the call which started it, and share whether it was served from the cache.
+func (c *LocalFileCache) getOrFetchShared(key cacheKey, opts GetOptions) (*cacheEntry, bool, error) {
+	type result struct {
+		entry *cacheEntry
+		hit   bool
+	}
+	leader := false
+	v, err, _ := c.fetches.Do(key.downloadURL+"@"+key.checksum, func() (any, error) {
+		leader = true
+		entry, hit, err := c.getOrFetch(key, opts)
+		return result{entry: entry, hit: hit}, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	r := v.(result)
+	if leader {
+		return r.entry, r.hit, nil
+	}
+	wasmFetchDedupedCount.Increment()
+	wasmLog.Debugf("shared the concurrent fetch of Wasm module %s for resource %q", key.downloadURL, key.resourceName)
+	// Record the module as referenced by the resource of this call as well.
+	if ce, _ := c.getEntry(key, true); ce != nil {
+		return ce, r.hit, nil
+	}
+	return r.entry, r.hit, nil
 }
 
-func (c *LocalFileCache) getOrFetch(key cacheKey, opts GetOptions) (*cacheEntry, error) {
+// getOrFetch returns the cache entry of the module, fetching it unless it is cached. hit is true if the module
+// was served from the cache.
+func (c *LocalFileCache) getOrFetch(key cacheKey, opts GetOptions) (ce *cacheEntry, hit bool, err error) {
 	u, err := url.Parse(key.downloadURL)
 	if err != nil {
-		return nil, fmt.Errorf("fail to parse Wasm module fetch url: %s, error: %v", key.downloadURL, err)
+		return nil, false, fmt.Errorf("fail to parse Wasm module fetch url: %s, error: %v", key.downloadURL, err)
+	}
+	// Check the host before the cache as well, as the modules restored from the manifest may have been fetched
+	// with other options.
+	if !c.allowHost(u) {
+		wasmRemoteFetchCount.With(resultTag.Value(hostNotAllowed)).Increment()
+		return nil, false, fmt.Errorf("fetching Wasm modules from host %q is not allowed", u.Host)
 	}
 
 	// First check if the cache entry is already downloaded and policy does not require to pull always.
 	ce, checksum := c.getEntry(key, shouldIgnoreResourceVersion(opts.PullPolicy, u))
 	if ce != nil {
-		return ce, nil
+		return ce, true, nil
 	}
 	key.checksum = checksum
+	ce, err = c.fetch(key, u, opts)
+	return ce, false, err
+}
+
+// fetch fetches the module of key from u, which is not cached, and adds it to the cache.
+func (c *LocalFileCache) fetch(key cacheKey, u *url.URL, opts GetOptions) (*cacheEntry, error) {
+	var err error
+	fetchStart := time.Now()
+	defer func() {
+		wasmRemoteFetchDuration.With(opts.MetricLabels...).Record(float64(time.Since(fetchStart).Milliseconds()))
+	}()
 	// Fetch the image now as it is not available in cache.
 	var b []byte         // Byte array of Wasm binary.
 	var dChecksum string // Hex-Encoded sha256 checksum of binary.
 	var binaryFetcher func() ([]byte, error)
+	// tmpPath if set is the file the Wasm binary of size bytes is streamed to, instead of being held in b.
+	var tmpPath string
+	var size int64
+	defer func() {
+		if tmpPath != "" {
+			_ = os.Remove(tmpPath)
+		}
+	}()
 	insecure := c.allowInsecure(u.Host)
 
-	ctx, cancel := context.WithTimeout(context.Background(), opts.RequestTimeout)
+	timeout := opts.RequestTimeout
+	if c.ModuleFetchTimeout > 0 {
+		timeout = c.ModuleFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	switch u.Scheme {
 	case "http", "https":
 		// Download the Wasm module with http fetcher.
-		b, err = c.httpFetcher.Fetch(ctx, key.downloadURL, insecure)
+		if c.streamModules() {
+			tmpPath, dChecksum, size, err = c.httpFetcher.FetchToFile(ctx, key.downloadURL, insecure, c.dir)
+		} else {
+			b, err = c.httpFetcher.Fetch(ctx, key.downloadURL, insecure)
+		}
 		if err != nil {
 			wasmRemoteFetchCount.With(resultTag.Value(downloadFailure)).Increment()
-			return nil, err
+			return nil, fetchTimeoutError(ctx, timeout, err)
 		}
 
-		// Get sha256 checksum and check if it is the same as provided one.
-		sha := sha256.Sum256(b)
-		dChecksum = hex.EncodeToString(sha[:])
+		if tmpPath == "" {
+			// Get sha256 checksum and check if it is the same as provided one.
+			sha := sha256.Sum256(b)
+			dChecksum = hex.EncodeToString(sha[:])
+		}
 	case "oci":
 		imgFetcherOps := ImageFetcherOption{
-			Insecure: insecure,
+			Insecure:      insecure,
+			MaxModuleSize: c.MaxModuleSize,
+			Proxy:         c.httpFetcher.proxy,
 		}
 		if opts.PullSecret != nil {
 			imgFetcherOps.PullSecret = opts.PullSecret
@@ -261,7 +477,7 @@ func (c *LocalFileCache) getOrFetch(key cacheKey, opts GetOptions) (*cacheEntry,
 		binaryFetcher, dChecksum, err = fetcher.PrepareFetch(u.Host + u.Path)
 		if err != nil {
 			wasmRemoteFetchCount.With(resultTag.Value(manifestFailure)).Increment()
-			return nil, fmt.Errorf("could not fetch Wasm OCI image: %v", err)
+			return nil, fmt.Errorf("could not fetch Wasm OCI image: %v", fetchTimeoutError(ctx, timeout, err))
 		}
 	default:
 		return nil, fmt.Errorf("unsupported Wasm module downloading URL scheme: %v", u.Scheme)
@@ -282,24 +498,68 @@ func (c *LocalFileCache) getOrFetch(key cacheKey, opts GetOptions) (*cacheEntry,
 		b, err = binaryFetcher()
 		if err != nil {
 			wasmRemoteFetchCount.With(resultTag.Value(downloadFailure)).Increment()
-			return nil, fmt.Errorf("could not fetch Wasm binary: %v", err)
+			return nil, fmt.Errorf("could not fetch Wasm binary: %v", fetchTimeoutError(ctx, timeout, err))
 		}
 	}
 
-	if !isValidWasmBinary(b) {
+	if !isValidWasmBinary(b) && (tmpPath == "" || !isValidWasmFile(tmpPath)) {
 		wasmRemoteFetchCount.With(resultTag.Value(fetchFailure)).Increment()
 		return nil, fmt.Errorf("fetched Wasm binary from %s is invalid", key.downloadURL)
 	}
 
+	if c.Verifier != nil {
+		if err := c.verifySignature(ctx, u, b, insecure); err != nil {
+			wasmRemoteFetchCount.With(resultTag.Value(signatureFailure)).Increment()
+			return nil, fmt.Errorf("failed to verify Wasm module %s: %v", key.downloadURL, err)
+		}
+	}
+
 	wasmRemoteFetchCount.With(resultTag.Value(fetchSuccess)).Increment()
 
 	key.checksum = dChecksum
+	if tmpPath != "" {
+		path := tmpPath
+		tmpPath = ""
+		return c.addFileEntry(key, path, size)
+	}
 	return c.addEntry(key, b)
 }
 
+// streamModules returns true if the modules fetched with HTTP are streamed to a file instead of held in memory: they
+// are stored as is on disk, and not needed in memory for the verification of their signature.
+func (c *LocalFileCache) streamModules() bool {
+	return !c.InMemory && !c.CompressModules && c.Verifier == nil
+}
+
+// fetchTimeoutError returns err, annotated with the timeout if the fetch failed because it was exceeded.
+func fetchTimeoutError(ctx context.Context, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w (timed out after %v)", err, timeout)
+	}
+	return err
+}
+
+// verifySignature fetches the detached signature of the module downloaded from u, and verifies it.
+func (c *LocalFileCache) verifySignature(ctx context.Context, u *url.URL, module []byte, insecure bool) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("signature verification is not supported for %v modules", u.Scheme)
+	}
+	sigURL := *u
+	sigURL.Path += signatureSuffix
+	sigURL.RawPath = ""
+	signature, err := c.httpFetcher.Fetch(ctx, sigURL.String(), insecure)
+	if err != nil {
+		return fmt.Errorf("failed to fetch signature: %v", err)
+	}
+	return c.Verifier.Verify(module, signature)
+}
+
 // Cleanup closes background Wasm module purge routine.
 func (c *LocalFileCache) Cleanup() {
 	close(c.stopChan)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.saveManifest()
 }
 
 func (c *LocalFileCache) updateChecksum(key cacheKey) bool {
@@ -318,9 +578,63 @@ func (c *LocalFileCache) updateChecksum(key cacheKey) bool {
 	return needChecksumUpdate
 }
 
-// addEntry adds a wasmModule to cache with cacheKey, writes the module to the local file system,
-// and returns the created entry.
+// addEntry adds a wasmModule to cache with cacheKey, writes the module to the local file system unless the
+// modules are held in memory, and returns the created entry.
 func (c *LocalFileCache) addEntry(key cacheKey, wasmModule []byte) (*cacheEntry, error) {
+	sha := sha256.Sum256(wasmModule)
+	return c.storeEntry(key, hex.EncodeToString(sha[:]), func(ce *cacheEntry) error {
+		ce.size = int64(len(wasmModule))
+		if c.InMemory {
+			ce.inline = inlineModule(wasmModule)
+			return nil
+		}
+		modulePath, err := getModulePath(c.moduleDir(key.moduleKey, int64(len(wasmModule))), key.moduleKey)
+		if err != nil {
+			return err
+		}
+		stored := wasmModule
+		if c.CompressModules {
+			stored = compressModule(wasmModule)
+			modulePath += compressedSuffix
+			ce.decompressedPath = modulePathOf(c.DecompressedDir, key.moduleKey)
+			ce.size = int64(len(stored))
+		}
+		// Materialize the Wasm module into a local file. Use checksum as name of the module.
+		if err := os.WriteFile(modulePath, stored, 0o644); err != nil {
+			return err
+		}
+		ce.modulePath = modulePath
+		return nil
+	})
+}
+
+// addFileEntry adds the Wasm module of size bytes streamed to the file at tmpPath to cache with cacheKey, moving
+// the file in place of the module, and returns the created entry. The file is removed if it is not moved.
+func (c *LocalFileCache) addFileEntry(key cacheKey, tmpPath string, size int64) (*cacheEntry, error) {
+	moved := false
+	defer func() {
+		if !moved {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	return c.storeEntry(key, key.checksum, func(ce *cacheEntry) error {
+		modulePath, err := getModulePath(c.moduleDir(key.moduleKey, size), key.moduleKey)
+		if err != nil {
+			return err
+		}
+		if err := moveFile(tmpPath, modulePath); err != nil {
+			return err
+		}
+		moved = true
+		ce.modulePath = modulePath
+		ce.size = size
+		return nil
+	})
+}
+
+// storeEntry adds the module of key, with the given checksum, to cache unless it is already there, storing it with
+// store, and returns its entry.
+func (c *LocalFileCache) storeEntry(key cacheKey, checksum string, store func(ce *cacheEntry) error) (*cacheEntry, error) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	needChecksumUpdate := c.updateChecksum(key)
@@ -332,41 +646,229 @@ func (c *LocalFileCache) addEntry(key cacheKey, wasmModule []byte) (*cacheEntry,
 		if needChecksumUpdate {
 			ce.referencingURLs.Insert(key.downloadURL)
 		}
+		c.reference(key)
 		return ce, nil
 	}
 
-	modulePath, err := getModulePath(c.dir, key.moduleKey)
-	if err != nil {
-		return nil, err
-	}
-	// Materialize the Wasm module into a local file. Use checksum as name of the module.
-	if err := os.WriteFile(modulePath, wasmModule, 0o644); err != nil {
-		return nil, err
-	}
-
 	ce := cacheEntry{
-		modulePath:      modulePath,
 		last:            time.Now(),
 		referencingURLs: sets.New[string](),
+		binaryChecksum:  checksum,
+	}
+	if err := store(&ce); err != nil {
+		return nil, err
 	}
 	if needChecksumUpdate {
 		ce.referencingURLs.Insert(key.downloadURL)
 	}
 	c.modules[key.moduleKey] = &ce
+	c.reference(key)
+	c.pruneVersions(key.name)
+	c.evict()
+	c.saveManifest()
 	wasmCacheEntries.Record(float64(len(c.modules)))
 	return &ce, nil
 }
 
-// getEntry finds a cached module, and returns the found cache entry and its checksum.
-func (c *LocalFileCache) getEntry(key cacheKey, ignoreResourceVersion bool) (*cacheEntry, string) {
-	cacheHit := false
+// reference records the module of key as the one referenced by the resource of key.
+// The caller must hold c.mux.
+func (c *LocalFileCache) reference(key cacheKey) {
+	if key.resourceName != "" {
+		c.resourceModules[key.resourceName] = key.moduleKey
+	}
+}
+
+// evict removes the least recently used modules not referenced by any resource, until the total size of the
+// modules fits in the maximum cache size. The caller must hold c.mux, so that the modules being fetched are
+// referenced before they can be evicted.
+func (c *LocalFileCache) evict() {
+	if c.MaxCacheSize <= 0 {
+		return
+	}
+	referenced := sets.New[moduleKey]()
+	for _, k := range c.resourceModules {
+		referenced.Insert(k)
+	}
+	var total int64
+	for _, m := range c.modules {
+		total += m.size
+	}
+	for total > c.MaxCacheSize {
+		var oldest *cacheEntry
+		var oldestKey moduleKey
+		for k, m := range c.modules {
+			if referenced.Contains(k) {
+				continue
+			}
+			if oldest == nil || m.last.Before(oldest.last) {
+				oldest, oldestKey = m, k
+			}
+		}
+		if oldest == nil {
+			wasmLog.Warnf("Wasm module cache size %d exceeds the limit of %d bytes, but all the modules are in use", total, c.MaxCacheSize)
+			return
+		}
+		if err := c.removeModule(oldestKey, oldest); err != nil {
+			wasmLog.Errorf("failed to evict Wasm module %v: %v", oldestKey.name, err)
+			return
+		}
+		total -= oldest.size
+		wasmLog.Debugf("evicted least recently used Wasm module %v", oldestKey.name)
+	}
+}
+
+// pruneVersions removes the least recently used versions of the module name beyond MaxModuleVersions, which are
+// not referenced by any resource. The caller must hold c.mux.
+func (c *LocalFileCache) pruneVersions(name string) {
+	if c.MaxModuleVersions <= 0 {
+		return
+	}
+	referenced := sets.New[moduleKey]()
+	for _, k := range c.resourceModules {
+		referenced.Insert(k)
+	}
+	var versions []moduleKey
+	for k := range c.modules {
+		if k.name == name && !referenced.Contains(k) {
+			versions = append(versions, k)
+		}
+	}
+	if len(versions) <= c.MaxModuleVersions {
+		return
+	}
+	// Most recently used first.
+	slices.SortFunc(versions, func(a, b moduleKey) int {
+		return c.modules[b].last.Compare(c.modules[a].last)
+	})
+	for _, k := range versions[c.MaxModuleVersions:] {
+		if err := c.removeModule(k, c.modules[k]); err != nil {
+			wasmLog.Errorf("failed to prune Wasm module %v: %v", k.name, err)
+			return
+		}
+		wasmLog.Debugf("pruned stale version %v of Wasm module %v", k.checksum, k.name)
+	}
+}
+
+// Refresh evicts the module last returned for the resource, for instance after a new module was pushed under the
+// same tag, so that it is fetched again the next time the resource references it.
+func (c *LocalFileCache) Refresh(resourceName string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	k, ok := c.resourceModules[resourceName]
+	if !ok {
+		return false
+	}
+	m, ok := c.modules[k]
+	if !ok {
+		delete(c.resourceModules, resourceName)
+		return false
+	}
+	if err := c.removeModule(k, m); err != nil {
+		wasmLog.Errorf("failed to refresh Wasm module %v: %v", k.name, err)
+		return false
+	}
+	c.saveManifest()
+	wasmCacheEntries.Record(float64(len(c.modules)))
+	wasmLog.Infof("evicted Wasm module %v of resource %q to fetch it again", k.name, resourceName)
+	return true
+}
 
+// List returns the cached modules, sorted by name.
+func (c *LocalFileCache) List() []ModuleInfo {
 	c.mux.Lock()
+	defer c.mux.Unlock()
+	resources := map[moduleKey][]string{}
+	for resource, k := range c.resourceModules {
+		resources[k] = append(resources[k], resource)
+	}
+	out := make([]ModuleInfo, 0, len(c.modules))
+	for k, m := range c.modules {
+		slices.Sort(resources[k])
+		out = append(out, ModuleInfo{
+			Name:      k.name,
+			URLs:      sets.SortedList(m.referencingURLs),
+			Digest:    m.binaryChecksum,
+			Size:      m.size,
+			LastUsed:  m.last,
+			Resources: resources[k],
+		})
+	}
+	slices.SortFunc(out, func(a, b ModuleInfo) int {
+		if a.Name != b.Name {
+			return strings.Compare(a.Name, b.Name)
+		}
+		return strings.Compare(a.Digest, b.Digest)
+	})
+	return out
+}
+
+// removeModule deletes the module from the local dir as well as the cache. The caller must hold c.mux.
+func (c *LocalFileCache) removeModule(k moduleKey, m *cacheEntry) error {
+	if m.inline == "" {
+		// The file may have been removed externally already.
+		if err := os.Remove(m.modulePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		m.removeDecompressed()
+	}
+	for downloadURL := range m.referencingURLs {
+		delete(c.checksums, downloadURL)
+	}
+	for resource, rk := range c.resourceModules {
+		if rk == k {
+			delete(c.resourceModules, resource)
+		}
+	}
+	delete(c.modules, k)
+	return nil
+}
+
+// getEntry finds a cached module, and returns the found cache entry and its checksum. The local file of the entry
+// is verified without holding c.mux, so that hashing a large module does not block the other cache operations.
+func (c *LocalFileCache) getEntry(key cacheKey, ignoreResourceVersion bool) (*cacheEntry, string) {
+	cacheHit := false
 	defer func() {
-		c.mux.Unlock()
 		wasmCacheLookupCount.With(hitTag.Value(strconv.FormatBool(cacheHit))).Increment()
 	}()
 
+	ce, verified, key := c.lookupEntry(key, ignoreResourceVersion)
+	if ce == nil {
+		return nil, key.checksum
+	}
+	stamp, err := ce.verify(verified)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.modules[key.moduleKey] != ce {
+		// Removed or replaced while it was verified.
+		return nil, key.checksum
+	}
+	if err != nil {
+		// The local file does not match what was downloaded, e.g. it was partially written or modified on disk.
+		// Drop the entry so that the module is fetched again.
+		wasmLog.Warnf("cached Wasm module %v is invalid, fetching it again: %v", ce.modulePath, err)
+		if err := c.removeModule(key.moduleKey, ce); err != nil {
+			wasmLog.Errorf("failed to remove invalid Wasm module %v: %v", ce.modulePath, err)
+		}
+		c.saveManifest()
+		wasmCacheEntries.Record(float64(len(c.modules)))
+		return nil, key.checksum
+	}
+	ce.verified = stamp
+	// Update last touched time.
+	ce.last = time.Now()
+	cacheHit = true
+	c.updateChecksum(key)
+	c.reference(key)
+	return ce, key.checksum
+}
+
+// lookupEntry resolves the checksum of key, and returns the cached entry of the module if any, the stamp of its
+// file when it was last verified, and the resolved key.
+func (c *LocalFileCache) lookupEntry(key cacheKey, ignoreResourceVersion bool) (*cacheEntry, fileStamp, cacheKey) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
 	if len(key.checksum) == 0 && strings.HasPrefix(key.downloadURL, ociURLPrefix) {
 		if d, err := name.NewDigest(key.downloadURL[len(ociURLPrefix):]); err == nil {
 			// If there is no checksum and the digest is suffixed in URL, use the digest.
@@ -392,13 +894,9 @@ func (c *LocalFileCache) getEntry(key cacheKey, ignoreResourceVersion bool) (*ca
 	}
 
 	if ce, ok := c.modules[key.moduleKey]; ok {
-		// Update last touched time.
-		ce.last = time.Now()
-		cacheHit = true
-		c.updateChecksum(key)
-		return ce, key.checksum
+		return ce, ce.verified, key
 	}
-	return nil, key.checksum
+	return nil, fileStamp{}, key
 }
 
 // Purge periodically clean up the stale Wasm modules local file and the cache map.
@@ -414,16 +912,14 @@ func (c *LocalFileCache) purge() {
 					continue
 				}
 				// The module has not be touched for expiry duration, delete it from the map as well as the local dir.
-				if err := os.Remove(m.modulePath); err != nil {
-					wasmLog.Errorf("failed to purge Wasm module %v: %v", m.modulePath, err)
+				if err := c.removeModule(k, m); err != nil {
+					wasmLog.Errorf("failed to purge Wasm module %v: %v", k.name, err)
 				} else {
-					for downloadURL := range m.referencingURLs {
-						delete(c.checksums, downloadURL)
-					}
-					delete(c.modules, k)
-					wasmLog.Debugf("successfully removed stale Wasm module %v", m.modulePath)
+					wasmLog.Debugf("successfully removed stale Wasm module %v", k.name)
 				}
 			}
+			// Also persists the last time the remaining modules were used.
+			c.saveManifest()
 			wasmCacheEntries.Record(float64(len(c.modules)))
 			c.mux.Unlock()
 		case <-c.stopChan:
@@ -433,6 +929,64 @@ func (c *LocalFileCache) purge() {
 	}
 }
 
+// location returns the path of the module file, the path of its decompressed copy if it is compressed, or the data
+// URI inlining the module if it is held in memory.
+func (ce *cacheEntry) location() string {
+	if ce.inline != "" {
+		return ce.inline
+	}
+	if ce.decompressedPath != "" {
+		return ce.decompressedPath
+	}
+	return ce.modulePath
+}
+
+// verify checks that the local module file still has the checksum recorded when it was written, over the
+// decompressed content if it is compressed, unless the file is unchanged since it was verified with the given
+// stamp. It returns the stamp of the verified file. The file is hashed incrementally, so large modules are not
+// loaded into memory.
+func (ce *cacheEntry) verify(verified fileStamp) (fileStamp, error) {
+	if ce.inline != "" {
+		// The module held in memory cannot be modified.
+		return fileStamp{}, nil
+	}
+	info, err := os.Stat(ce.modulePath)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+	if ce.binaryChecksum == "" {
+		// The content cannot be verified, but the file must still exist.
+		return stamp, nil
+	}
+	if stamp.size == verified.size && stamp.modTime.Equal(verified.modTime) {
+		return stamp, nil
+	}
+	var got string
+	if ce.decompressedPath != "" {
+		sum, err := decompressedSum(ce.modulePath, io.Discard)
+		if err != nil {
+			return fileStamp{}, err
+		}
+		got = sum
+	} else {
+		f, err := os.Open(ce.modulePath)
+		if err != nil {
+			return fileStamp{}, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return fileStamp{}, err
+		}
+		got = hex.EncodeToString(h.Sum(nil))
+	}
+	if got != ce.binaryChecksum {
+		return fileStamp{}, fmt.Errorf("local file has checksum %v, which does not match: %v", got, ce.binaryChecksum)
+	}
+	return stamp, nil
+}
+
 // Expired returns true if the module has not been touched for Wasm module Expiry.
 func (ce *cacheEntry) expired(expiry time.Duration) bool {
 	now := time.Now()
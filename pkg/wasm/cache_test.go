@@ -15,17 +15,21 @@
 package wasm
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -40,6 +44,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/types"
 
 	extensions "istio.io/api/extensions/v1alpha1"
+	"istio.io/istio/pkg/monitoring/monitortest"
 	"istio.io/istio/pkg/util/sets"
 )
 
@@ -748,7 +753,7 @@ func TestWasmCache(t *testing.T) {
 			}
 
 			if diff := cmp.Diff(c.wantCachedModules, cache.modules,
-				cmpopts.IgnoreFields(cacheEntry{}, "last", "referencingURLs"),
+				cmpopts.IgnoreFields(cacheEntry{}, "last", "referencingURLs", "binaryChecksum", "size", "verified"),
 				cmp.AllowUnexported(cacheEntry{}),
 			); diff != "" {
 				t.Errorf("unexpected module cache: (-want, +got)\n%v", diff)
@@ -909,6 +914,763 @@ func TestWasmCachePolicyChangesUsingHTTP(t *testing.T) {
 	testWasmGet(url2, extensions.PullPolicy_Always, "4", wantFilePath2, 3)
 }
 
+func TestWasmCacheRefetchesCorruptedModule(t *testing.T) {
+	tmpDir := t.TempDir()
+	cache := NewLocalFileCache(tmpDir, defaultOptions())
+	defer close(cache.stopChan)
+
+	gotNumRequest := int32(0)
+	binary := append(wasmHeader, []byte("data")...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&gotNumRequest, 1)
+		w.Write(binary)
+	}))
+	defer ts.Close()
+	checksum := fmt.Sprintf("%x", sha256.Sum256(binary))
+	wantFilePath := generateModulePath(t, tmpDir, ts.URL, fmt.Sprintf("%s.wasm", checksum))
+
+	get := func(wantNumRequest int32) {
+		t.Helper()
+		gotFilePath, err := cache.Get(ts.URL, GetOptions{
+			Checksum:       checksum,
+			ResourceName:   "namespace.resource",
+			RequestTimeout: time.Second * 10,
+		})
+		if err != nil {
+			t.Fatalf("failed to download Wasm module: %v", err)
+		}
+		if gotFilePath != wantFilePath {
+			t.Fatalf("wasm download path got %v want %v", gotFilePath, wantFilePath)
+		}
+		if got := atomic.LoadInt32(&gotNumRequest); got != wantNumRequest {
+			t.Fatalf("wasm download call got %v want %v", got, wantNumRequest)
+		}
+	}
+
+	get(1)
+	// The module is served from the cache while the local file is intact.
+	get(1)
+
+	// Simulate a partially written file.
+	if err := os.WriteFile(wantFilePath, binary[:4], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	get(2)
+	got, err := os.ReadFile(wantFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(binary) {
+		t.Fatalf("wasm module file was not restored, got %v want %v", got, binary)
+	}
+
+	// Simulate an external cleanup of the file, including for an entry whose checksum is unknown.
+	if err := os.Remove(wantFilePath); err != nil {
+		t.Fatal(err)
+	}
+	get(3)
+	cache.mux.Lock()
+	for _, ce := range cache.modules {
+		ce.binaryChecksum = ""
+	}
+	cache.mux.Unlock()
+	if err := os.Remove(wantFilePath); err != nil {
+		t.Fatal(err)
+	}
+	get(4)
+}
+
+// Validates an invalid module is dropped along with the checksum and the resource referencing it.
+func TestWasmCacheDropsInvalidModule(t *testing.T) {
+	tmpDir := t.TempDir()
+	cache := NewLocalFileCache(tmpDir, defaultOptions())
+	defer close(cache.stopChan)
+
+	binary := append(wasmHeader, []byte("data")...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	}))
+	defer ts.Close()
+	gotFilePath, err := cache.Get(ts.URL, GetOptions{
+		ResourceName:   "namespace.resource",
+		RequestTimeout: time.Second * 10,
+	})
+	if err != nil {
+		t.Fatalf("failed to download Wasm module: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, manifestFile)); err != nil {
+		t.Fatalf("expected the manifest to be saved: %v", err)
+	}
+
+	if err := os.WriteFile(gotFilePath, binary[:4], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key := cacheKey{
+		downloadURL:  ts.URL,
+		moduleKey:    moduleKey{name: moduleNameFromURL(ts.URL)},
+		resourceName: "namespace.resource",
+	}
+	if ce, _ := cache.getEntry(key, true); ce != nil {
+		t.Fatal("expected the invalid module not to be served from the cache")
+	}
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if len(cache.modules) != 0 || len(cache.checksums) != 0 || len(cache.resourceModules) != 0 {
+		t.Fatalf("expected the invalid module to be dropped, got modules %v, checksums %v, resources %v",
+			cache.modules, cache.checksums, cache.resourceModules)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, manifestFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected the manifest of the empty cache to be removed, got %v", err)
+	}
+}
+
+func TestWasmCacheDecodesContentEncoding(t *testing.T) {
+	tmpDir := t.TempDir()
+	cache := NewLocalFileCache(tmpDir, defaultOptions())
+	defer close(cache.stopChan)
+
+	binary := append(wasmHeader, []byte("data")...)
+	gz := createGZ(t, binary)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz)
+	}))
+	defer ts.Close()
+	// The checksum is the one of the decoded module.
+	checksum := fmt.Sprintf("%x", sha256.Sum256(binary))
+	gotFilePath, err := cache.Get(ts.URL, GetOptions{
+		Checksum:       checksum,
+		ResourceName:   "namespace.resource",
+		RequestTimeout: time.Second * 10,
+	})
+	if err != nil {
+		t.Fatalf("failed to download Wasm module: %v", err)
+	}
+	got, err := os.ReadFile(gotFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(binary) {
+		t.Fatalf("wasm module file is not decoded, got %v want %v", got, binary)
+	}
+}
+
+func TestWasmCacheStreamsLargeModule(t *testing.T) {
+	// A module of 64MiB, and a header.
+	chunk := make([]byte, 64*1024)
+	const chunks = 1024
+	moduleSize := int64(len(wasmHeader) + chunks*len(chunk))
+	h := sha256.New()
+	h.Write(wasmHeader)
+	for i := 0; i < chunks; i++ {
+		h.Write(chunk)
+	}
+	wantChecksum := hex.EncodeToString(h.Sum(nil))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(wasmHeader)
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+		}
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	cache := NewLocalFileCache(dir, defaultOptions())
+	defer close(cache.stopChan)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	path, err := cache.Get(ts.URL+"/large.wasm", GetOptions{RequestTimeout: time.Minute})
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("failed to download the large Wasm module: %v", err)
+	}
+	// The module is streamed to disk, and never held in memory.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(moduleSize/4) {
+		t.Errorf("fetching a module of %d bytes allocated %d bytes", moduleSize, allocated)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := sha256.New()
+	n, err := io.Copy(got, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != moduleSize || hex.EncodeToString(got.Sum(nil)) != wantChecksum {
+		t.Errorf("got a module of %d bytes with checksum %x, want %d bytes with checksum %s", n, got.Sum(nil), moduleSize, wantChecksum)
+	}
+	if modules := cache.List(); len(modules) != 1 || modules[0].Digest != wantChecksum {
+		t.Errorf("unexpected cached modules %+v", modules)
+	}
+	// No temporary file of the fetch is left behind.
+	if stale, _ := filepath.Glob(filepath.Join(dir, fetchTempPattern)); len(stale) != 0 {
+		t.Errorf("unexpected temporary files %v", stale)
+	}
+}
+
+func TestWasmCacheInMemory(t *testing.T) {
+	tmpDir := t.TempDir()
+	options := defaultOptions()
+	options.InMemory = true
+	cache := NewLocalFileCache(tmpDir, options)
+
+	gotNumRequest := int32(0)
+	binary := append(wasmHeader, []byte("data")...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&gotNumRequest, 1)
+		w.Write(binary)
+	}))
+	defer ts.Close()
+	for i := 0; i < 2; i++ {
+		got, err := cache.Get(ts.URL, GetOptions{
+			ResourceName:   "namespace.resource",
+			RequestTimeout: time.Second * 10,
+		})
+		if err != nil {
+			t.Fatalf("failed to download Wasm module: %v", err)
+		}
+		module, inlined, err := inlinedModule(got)
+		if err != nil || !inlined {
+			t.Fatalf("expected a data URI inlining the module, got %v: %v", got, err)
+		}
+		if string(module) != string(binary) {
+			t.Fatalf("inlined module got %v want %v", module, binary)
+		}
+	}
+	if got := atomic.LoadInt32(&gotNumRequest); got != 1 {
+		t.Fatalf("wasm download call got %v want 1", got)
+	}
+	// Nothing is written to the cache directory, not even the manifest.
+	cache.Cleanup()
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the cache directory to be empty, got %v", entries)
+	}
+}
+
+func TestWasmCacheMetrics(t *testing.T) {
+	mt := monitortest.New(t)
+	tmpDir := t.TempDir()
+	cache := NewLocalFileCache(tmpDir, defaultOptions())
+	defer close(cache.stopChan)
+
+	binary := append(wasmHeader, []byte("data")...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(binary)
+	}))
+	defer ts.Close()
+	opts := GetOptions{
+		Checksum:       fmt.Sprintf("%x", sha256.Sum256(binary)),
+		ResourceName:   "namespace.resource",
+		RequestTimeout: time.Second * 10,
+	}
+
+	// The first lookup misses the cache and fetches the module.
+	if _, err := cache.Get(ts.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	mt.Assert(wasmCacheLookupCount.Name(), map[string]string{"hit": "false"}, monitortest.Exactly(1))
+	mt.Assert(wasmCacheLookupsTotal.Name(), map[string]string{"result": lookupMiss}, monitortest.Exactly(1))
+	mt.Assert(wasmRemoteFetchCount.Name(), map[string]string{"result": fetchSuccess}, monitortest.Exactly(1))
+
+	// The second lookup is served from the cache.
+	if _, err := cache.Get(ts.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	mt.Assert(wasmCacheLookupCount.Name(), map[string]string{"hit": "false"}, monitortest.Exactly(1))
+	mt.Assert(wasmCacheLookupCount.Name(), map[string]string{"hit": "true"}, monitortest.Exactly(1))
+	mt.Assert(wasmCacheLookupsTotal.Name(), map[string]string{"result": lookupHit}, monitortest.Exactly(1))
+	mt.Assert(wasmCacheLookupsTotal.Name(), map[string]string{"result": lookupMiss}, monitortest.Exactly(1))
+	mt.Assert(wasmRemoteFetchCount.Name(), map[string]string{"result": fetchSuccess}, monitortest.Exactly(1))
+
+	// A module that cannot be downloaded is a miss followed by a failed fetch, and a failed lookup.
+	if _, err := cache.Get(ts.URL+"/missing", opts); err == nil {
+		t.Fatal("expected an error for a missing module")
+	}
+	mt.Assert(wasmCacheLookupCount.Name(), map[string]string{"hit": "false"}, monitortest.Exactly(2))
+	mt.Assert(wasmCacheLookupsTotal.Name(), map[string]string{"result": lookupError}, monitortest.Exactly(1))
+	mt.Assert(wasmCacheLookupsTotal.Name(), map[string]string{"result": lookupMiss}, monitortest.Exactly(1))
+	mt.Assert(wasmRemoteFetchCount.Name(), map[string]string{"result": downloadFailure}, monitortest.Exactly(1))
+}
+
+func TestWasmCacheDedupsConcurrentFetches(t *testing.T) {
+	mt := monitortest.New(t)
+	cache := NewLocalFileCache(t.TempDir(), defaultOptions())
+	defer close(cache.stopChan)
+
+	binary := append(wasmHeader, []byte("data")...)
+	fetched := make(chan struct{}, 2)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- struct{}{}
+		<-release
+		w.Write(binary)
+	}))
+	defer ts.Close()
+
+	// Two resources reference the same module at the same time.
+	var wg sync.WaitGroup
+	paths := make([]string, 2)
+	get := func(i int) {
+		defer wg.Done()
+		path, err := cache.Get(ts.URL, GetOptions{
+			ResourceName:   fmt.Sprintf("namespace.resource-%d", i),
+			RequestTimeout: time.Second * 10,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		paths[i] = path
+	}
+	wg.Add(2)
+	go get(0)
+	<-fetched
+	go get(1)
+	// Let the second call join the fetch in flight before it completes.
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+	wg.Wait()
+
+	if len(fetched) != 0 {
+		t.Fatal("expected the module to be fetched once")
+	}
+	if paths[0] == "" || paths[0] != paths[1] {
+		t.Fatalf("expected both calls to get the same module, got %v", paths)
+	}
+	mt.Assert(wasmRemoteFetchCount.Name(), map[string]string{"result": fetchSuccess}, monitortest.Exactly(1))
+	mt.Assert(wasmFetchDedupedCount.Name(), nil, monitortest.Exactly(1))
+	// The module is referenced by both resources.
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if len(cache.resourceModules) != 2 {
+		t.Fatalf("expected the module to be referenced by both resources, got %v", cache.resourceModules)
+	}
+}
+
+func TestWasmCacheFetchesThroughHTTPProxy(t *testing.T) {
+	binary := append(wasmHeader, []byte("data")...)
+	newProxy := func(t *testing.T) (*httptest.Server, *[]string) {
+		var proxied []string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Requests sent to a proxy carry the absolute URL of the module.
+			proxied = append(proxied, r.URL.String())
+			w.Write(binary)
+		}))
+		t.Cleanup(proxy.Close)
+		return proxy, &proxied
+	}
+	// The host is not resolvable, so the module can only be fetched through the proxy.
+	moduleURL := "http://wasm.invalid/module.wasm"
+
+	cases := []struct {
+		name  string
+		setup func(t *testing.T, proxy *httptest.Server) Options
+	}{
+		{
+			name: "environment",
+			setup: func(t *testing.T, proxy *httptest.Server) Options {
+				t.Setenv("HTTP_PROXY", proxy.URL)
+				t.Setenv("NO_PROXY", "")
+				return defaultOptions()
+			},
+		},
+		{
+			name: "override",
+			setup: func(t *testing.T, proxy *httptest.Server) Options {
+				t.Setenv("HTTP_PROXY", "http://unused.invalid")
+				options := defaultOptions()
+				options.HTTPProxy = proxy.URL
+				return options
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy, proxied := newProxy(t)
+			cache := NewLocalFileCache(t.TempDir(), c.setup(t, proxy))
+			defer close(cache.stopChan)
+			if _, err := cache.Get(moduleURL, GetOptions{RequestTimeout: time.Second * 10}); err != nil {
+				t.Fatal(err)
+			}
+			if len(*proxied) != 1 || (*proxied)[0] != moduleURL {
+				t.Fatalf("expected the module to be fetched through the proxy, got %v", *proxied)
+			}
+		})
+	}
+}
+
+func TestWasmCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	tmpDir := t.TempDir()
+	binary := func(id string) []byte {
+		return append(append([]byte{}, wasmHeader...), []byte(id)...)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary(r.URL.Path))
+	}))
+	defer ts.Close()
+	moduleSize := int64(len(binary("/1")))
+	options := defaultOptions()
+	options.MaxCacheSize = 3 * moduleSize
+	cache := NewLocalFileCache(tmpDir, options)
+	defer close(cache.stopChan)
+
+	get := func(id, resource string) string {
+		t.Helper()
+		path, err := cache.Get(ts.URL+id, GetOptions{
+			ResourceName:   resource,
+			RequestTimeout: time.Second * 10,
+		})
+		if err != nil {
+			t.Fatalf("failed to download Wasm module: %v", err)
+		}
+		return path
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// The first module stays referenced, while the second resource moves on to newer modules.
+	referenced := get("/1", "namespace.first")
+	oldest := get("/2", "namespace.second")
+	newer := get("/3", "namespace.second")
+	if !exists(referenced) || !exists(oldest) || !exists(newer) {
+		t.Fatal("modules should not be evicted until the cache is full")
+	}
+	latest := get("/4", "namespace.second")
+
+	if exists(oldest) {
+		t.Errorf("the least recently used unreferenced module %v should be evicted", oldest)
+	}
+	for _, path := range []string{referenced, newer, latest} {
+		if !exists(path) {
+			t.Errorf("module %v should not be evicted", path)
+		}
+	}
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if got := len(cache.modules); got != 3 {
+		t.Errorf("cached modules got %v want 3", got)
+	}
+}
+
+func TestWasmCacheMaxModuleVersions(t *testing.T) {
+	const maxVersions = 2
+	var version atomic.Int32
+	binary := func(v int32) []byte {
+		return append(append([]byte{}, wasmHeader...), []byte(fmt.Sprint(v))...)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary(version.Load()))
+	}))
+	defer ts.Close()
+	options := defaultOptions()
+	options.MaxModuleVersions = maxVersions
+	cache := NewLocalFileCache(t.TempDir(), options)
+	defer close(cache.stopChan)
+
+	// Each push rolls the resource out to a new version of the module.
+	var paths []string
+	for v := int32(1); v <= maxVersions+2; v++ {
+		version.Store(v)
+		sha := sha256.Sum256(binary(v))
+		path, err := cache.Get(ts.URL+"/plugin.wasm", GetOptions{
+			Checksum:       hex.EncodeToString(sha[:]),
+			ResourceName:   "namespace.resource",
+			RequestTimeout: time.Second * 10,
+		})
+		if err != nil {
+			t.Fatalf("failed to download Wasm module: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	// The active version and the previous maxVersions remain.
+	for i, path := range paths {
+		_, err := os.Stat(path)
+		if pruned := i == 0; pruned != (err != nil) {
+			t.Errorf("version %d: pruned got %v want %v", i+1, err != nil, pruned)
+		}
+	}
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if got := len(cache.modules); got != maxVersions+1 {
+		t.Errorf("cached modules got %v want %v", got, maxVersions+1)
+	}
+}
+
+func TestWasmCacheRefresh(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(append(append([]byte{}, wasmHeader...), []byte(fmt.Sprint(requests.Load()))...))
+	}))
+	defer ts.Close()
+	cache := NewLocalFileCache(t.TempDir(), defaultOptions())
+	defer close(cache.stopChan)
+
+	get := func() {
+		t.Helper()
+		if _, err := cache.Get(ts.URL+"/plugin.wasm", GetOptions{
+			ResourceName:   "namespace.resource",
+			RequestTimeout: time.Second * 10,
+		}); err != nil {
+			t.Fatalf("failed to download Wasm module: %v", err)
+		}
+	}
+	get()
+	get()
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("expected the module to be fetched once, got %v fetches", got)
+	}
+
+	if !cache.Refresh("namespace.resource") {
+		t.Fatal("expected the module of the resource to be evicted")
+	}
+	get()
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("expected the module to be fetched again after the refresh, got %v fetches", got)
+	}
+	if cache.Refresh("namespace.other") {
+		t.Fatal("expected no module to be evicted for an unknown resource")
+	}
+}
+
+func TestWasmCacheList(t *testing.T) {
+	binary := append(append([]byte{}, wasmHeader...), []byte("module")...)
+	sha := sha256.Sum256(binary)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	}))
+	defer ts.Close()
+	cache := NewLocalFileCache(t.TempDir(), defaultOptions())
+	defer close(cache.stopChan)
+
+	for _, resource := range []string{"namespace.b", "namespace.a"} {
+		if _, err := cache.Get(ts.URL+"/plugin.wasm", GetOptions{
+			ResourceName:   resource,
+			RequestTimeout: time.Second * 10,
+		}); err != nil {
+			t.Fatalf("failed to download Wasm module: %v", err)
+		}
+	}
+
+	modules := cache.List()
+	if len(modules) != 1 {
+		t.Fatalf("expected one cached module, got %+v", modules)
+	}
+	got := modules[0]
+	if got.Name != ts.URL+"/plugin.wasm" || got.Digest != hex.EncodeToString(sha[:]) || got.Size != int64(len(binary)) {
+		t.Errorf("unexpected module %+v", got)
+	}
+	if diff := cmp.Diff([]string{"namespace.a", "namespace.b"}, got.Resources); diff != "" {
+		t.Errorf("unexpected resources (-want +got):\n%s", diff)
+	}
+	if got.LastUsed.IsZero() {
+		t.Error("expected the last use of the module to be set")
+	}
+}
+
+func TestWasmCacheManifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(append(append([]byte{}, wasmHeader...), []byte(r.URL.Path)...))
+	}))
+	defer ts.Close()
+	opts := GetOptions{ResourceName: "namespace.resource", RequestTimeout: time.Second * 10}
+
+	cache := NewLocalFileCache(tmpDir, defaultOptions())
+	valid, err := cache.Get(ts.URL+"/valid", opts)
+	if err != nil {
+		t.Fatalf("failed to download Wasm module: %v", err)
+	}
+	stale, err := cache.Get(ts.URL+"/stale", opts)
+	if err != nil {
+		t.Fatalf("failed to download Wasm module: %v", err)
+	}
+	cache.Cleanup()
+	// The file of a module is modified while the agent is down, it must not be served from the cache.
+	if err := os.WriteFile(stale, append(append([]byte{}, wasmHeader...), []byte("modified")...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is restored from the manifest by a new cache, as after an agent restart.
+	requests.Store(0)
+	cache = NewLocalFileCache(tmpDir, defaultOptions())
+	defer close(cache.stopChan)
+	cache.mux.Lock()
+	restored := len(cache.modules)
+	cache.mux.Unlock()
+	if restored != 1 {
+		t.Fatalf("restored modules got %v want 1", restored)
+	}
+
+	got, err := cache.Get(ts.URL+"/valid", opts)
+	if err != nil {
+		t.Fatalf("failed to get Wasm module: %v", err)
+	}
+	if got != valid {
+		t.Errorf("Wasm module local file path got %v, want %v", got, valid)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("expected the restored module to be served without a fetch, got %v requests", n)
+	}
+	if _, err := cache.Get(ts.URL+"/stale", opts); err != nil {
+		t.Fatalf("failed to download Wasm module: %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected the modified module to be fetched again, got %v requests", n)
+	}
+}
+
+func TestWasmCacheExtraDirs(t *testing.T) {
+	fastDir, bigDir := t.TempDir(), t.TempDir()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		module := append([]byte{}, wasmHeader...)
+		if strings.HasPrefix(r.URL.Path, "/large") {
+			module = append(module, bytes.Repeat([]byte("x"), 1024)...)
+		}
+		w.Write(append(module, []byte(r.URL.Path)...))
+	}))
+	defer ts.Close()
+	options := defaultOptions()
+	options.ExtraDirs = []CacheDir{{
+		Path:          bigDir,
+		MinModuleSize: 1024,
+		Modules:       sets.New(ts.URL + "/pinned"),
+	}}
+	opts := GetOptions{ResourceName: "namespace.resource", RequestTimeout: time.Second * 10}
+
+	cache := NewLocalFileCache(fastDir, options)
+	get := func(path string) string {
+		t.Helper()
+		got, err := cache.Get(ts.URL+path, opts)
+		if err != nil {
+			t.Fatalf("failed to download Wasm module: %v", err)
+		}
+		if _, err := os.Stat(got); err != nil {
+			t.Fatalf("Wasm module %v is not resolvable: %v", got, err)
+		}
+		return got
+	}
+	wantDirs := map[string]string{
+		"/small":  fastDir,
+		"/large":  bigDir,
+		"/pinned": bigDir,
+	}
+	paths := map[string]string{}
+	for path, dir := range wantDirs {
+		paths[path] = get(path)
+		if !strings.HasPrefix(paths[path], dir+string(os.PathSeparator)) {
+			t.Errorf("Wasm module %v got path %v, want in %v", path, paths[path], dir)
+		}
+	}
+	cache.Cleanup()
+
+	// The modules of every directory are restored from the manifest, and served from where they are.
+	cache = NewLocalFileCache(fastDir, options)
+	defer close(cache.stopChan)
+	cache.mux.Lock()
+	restored := len(cache.modules)
+	cache.mux.Unlock()
+	if restored != len(wantDirs) {
+		t.Fatalf("restored modules got %v want %v", restored, len(wantDirs))
+	}
+	for path, want := range paths {
+		if got := get(path); got != want {
+			t.Errorf("Wasm module %v got path %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestWasmCacheAllowedHosts(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(wasmHeader)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getOptions := GetOptions{
+		ResourceName:    "namespace.resource",
+		ResourceVersion: "0",
+		RequestTimeout:  time.Second * 10,
+	}
+
+	cases := []struct {
+		name         string
+		allowedHosts sets.String
+		url          string
+		wantErr      bool
+		wantRequests int32
+	}{
+		{
+			name:         "no allowlist",
+			url:          ts.URL + "/plugin.wasm",
+			wantRequests: 1,
+		},
+		{
+			name:         "allowed host",
+			allowedHosts: sets.New("example.com", u.Hostname()),
+			url:          ts.URL + "/plugin.wasm",
+			wantRequests: 1,
+		},
+		{
+			name:         "allowed host and port",
+			allowedHosts: sets.New(u.Host),
+			url:          ts.URL + "/plugin.wasm",
+			wantRequests: 1,
+		},
+		{
+			name:         "disallowed http host",
+			allowedHosts: sets.New("example.com"),
+			url:          ts.URL + "/plugin.wasm",
+			wantErr:      true,
+		},
+		{
+			name:         "disallowed oci host",
+			allowedHosts: sets.New("example.com"),
+			url:          fmt.Sprintf("oci://%s/test/valid/docker:v0.1.0", u.Host),
+			wantErr:      true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests.Store(0)
+			options := defaultOptions()
+			options.AllowedHosts = c.allowedHosts
+			cache := NewLocalFileCache(t.TempDir(), options)
+			defer close(cache.stopChan)
+
+			_, err := cache.Get(c.url, getOptions)
+			if gotErr := err != nil; gotErr != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if c.wantErr && !strings.Contains(err.Error(), "is not allowed") {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if got := requests.Load(); got != c.wantRequests {
+				t.Errorf("got %d requests, want %d", got, c.wantRequests)
+			}
+		})
+	}
+}
+
 func TestAllInsecureServer(t *testing.T) {
 	tmpDir := t.TempDir()
 	options := defaultOptions()
@@ -0,0 +1,98 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedSuffix suffixes the path of the module files stored compressed with zstd, see Options.CompressModules.
+const compressedSuffix = ".zst"
+
+// zstdEncoder compresses the modules. EncodeAll is safe for concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// compressModule returns module compressed with zstd.
+func compressModule(module []byte) []byte {
+	return zstdEncoder.EncodeAll(module, make([]byte, 0, len(module)/2))
+}
+
+// decompressedSum copies the decompressed content of the compressed module file at path to w, and returns its
+// hex-encoded sha256 checksum.
+func decompressedSum(path string, w io.Writer) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dec, err := zstd.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer dec.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), dec); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// materialize writes the decompressed copy of the compressed module of ce that Envoy reads, unless it already
+// exists. The copy is checked against the checksum of the original module before it is renamed in place, so the
+// decompressed copy is never partially written.
+func (ce *cacheEntry) materialize() error {
+	if _, err := os.Stat(ce.decompressedPath); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(ce.decompressedPath), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ce.decompressedPath), filepath.Base(ce.decompressedPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	sum, err := decompressedSum(ce.modulePath, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if ce.binaryChecksum != "" && sum != ce.binaryChecksum {
+		return fmt.Errorf("decompressed module has checksum %v, which does not match: %v", sum, ce.binaryChecksum)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ce.decompressedPath)
+}
+
+// removeDecompressed removes the decompressed copy of the module of ce, if any.
+func (ce *cacheEntry) removeDecompressed() {
+	if ce.decompressedPath == "" {
+		return
+	}
+	if err := os.Remove(ce.decompressedPath); err != nil && !os.IsNotExist(err) {
+		wasmLog.Errorf("failed to remove decompressed Wasm module %v: %v", ce.decompressedPath, err)
+	}
+}
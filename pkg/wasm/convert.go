@@ -39,6 +39,68 @@ import (
 	"istio.io/istio/pkg/util/istiomultierror"
 )
 
+// ConversionPool bounds the number of ECDS resources converted in parallel, across all the ECDS responses it
+// converts, so that many Wasm modules do not start all the fetches at once.
+type ConversionPool struct {
+	workers chan struct{}
+
+	mu sync.Mutex
+	// queued is the number of ECDS resources waiting for a worker.
+	queued int
+}
+
+// NewConversionPool returns a pool of workers converting ECDS resources. DefaultConversionWorkers is used if
+// workers is not positive.
+func NewConversionPool(workers int) *ConversionPool {
+	if workers <= 0 {
+		workers = DefaultConversionWorkers
+	}
+	return &ConversionPool{workers: make(chan struct{}, workers)}
+}
+
+// acquire blocks until a worker is available, and returns the function releasing it. Conversions waiting for a
+// worker are reported by the wasm_conversion_queue_depth metric.
+func (p *ConversionPool) acquire() func() {
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		p.recordQueued(1)
+		p.workers <- struct{}{}
+		p.recordQueued(-1)
+	}
+	return func() { <-p.workers }
+}
+
+func (p *ConversionPool) recordQueued(delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queued += delta
+	wasmConversionQueueDepth.Record(float64(p.queued))
+}
+
+// Saturated returns true if all the workers are busy, so that new conversions are queued.
+func (p *ConversionPool) Saturated() bool {
+	return len(p.workers) == cap(p.workers)
+}
+
+// WaitAvailable blocks while all the workers are busy, until one is available or stop is closed. waited is true
+// if it blocked, and ok is false if stop was closed first.
+func (p *ConversionPool) WaitAvailable(stop <-chan struct{}) (waited bool, ok bool) {
+	select {
+	case p.workers <- struct{}{}:
+		<-p.workers
+		return false, true
+	default:
+	}
+	select {
+	case p.workers <- struct{}{}:
+		<-p.workers
+		return true, true
+	case <-stop:
+		return true, false
+	}
+}
+
 var (
 	allowHTTPTypedConfig    = protoconv.MessageToAny(&httprbac.RBAC{})
 	allowNetworkTypedConfig = protoconv.MessageToAny(&networkrbac.RBAC{})
@@ -62,7 +124,16 @@ func createNetworkAllowAllFilter(name string) (*anypb.Any, error) {
 
 // MaybeConvertWasmExtensionConfig converts any presence of module remote download to local file.
 // It downloads the Wasm module and stores the module locally in the file system.
+// Resources are converted concurrently and rewritten in place, so the order of resources is preserved.
+// If any resource fails to be converted, an error is returned for the whole set.
+// At most DefaultConversionWorkers resources are converted in parallel, see ConversionPool.Convert to share the
+// workers with other conversions.
 func MaybeConvertWasmExtensionConfig(resources []*anypb.Any, cache Cache) error {
+	return NewConversionPool(DefaultConversionWorkers).Convert(resources, cache)
+}
+
+// Convert converts the resources like MaybeConvertWasmExtensionConfig, with the workers of the pool.
+func (p *ConversionPool) Convert(resources []*anypb.Any, cache Cache) error {
 	var wg sync.WaitGroup
 
 	numResources := len(resources)
@@ -77,6 +148,8 @@ func MaybeConvertWasmExtensionConfig(resources []*anypb.Any, cache Cache) error
 	for i := 0; i < numResources; i++ {
 		go func(i int) {
 			defer wg.Done()
+			release := p.acquire()
+			defer release()
 			extConfig, wasmHTTPConfig, wasmNetworkConfig, err := tryUnmarshal(resources[i])
 			if err != nil {
 				wasmConfigConversionCount.
@@ -352,14 +425,22 @@ func rewriteVMConfig(resourceName string, vm *wasmextensions.VmConfig, status *s
 		return fmt.Errorf("cannot fetch Wasm module %v: %w", remote.GetHttpUri().GetUri(), err)
 	}
 
-	// Rewrite remote fetch to local file.
+	// Rewrite remote fetch to local file, or to the inlined module if it is held in memory.
+	local := &core.DataSource{
+		Specifier: &core.DataSource_Filename{
+			Filename: f,
+		},
+	}
+	if module, inlined, err := inlinedModule(f); err != nil {
+		return fmt.Errorf("invalid inlined Wasm module: %v", err)
+	} else if inlined {
+		local.Specifier = &core.DataSource_InlineBytes{
+			InlineBytes: module,
+		}
+	}
 	vm.Code = &core.AsyncDataSource{
 		Specifier: &core.AsyncDataSource_Local{
-			Local: &core.DataSource{
-				Specifier: &core.DataSource_Filename{
-					Filename: f,
-				},
-			},
+			Local: local,
 		},
 	}
 	return nil
@@ -15,11 +15,21 @@
 package wasm
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	udpa "github.com/cncf/xds/go/udpa/type/v1"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
@@ -30,6 +40,7 @@ import (
 	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"google.golang.org/protobuf/proto"
 	anypb "google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/structpb"
 
@@ -37,6 +48,7 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/util/protoconv"
 	"istio.io/istio/pkg/config/xds"
+	"istio.io/istio/pkg/monitoring/monitortest"
 )
 
 type mockCache struct {
@@ -339,6 +351,331 @@ func TestWasmConvert(t *testing.T) {
 	}
 }
 
+// blockingCache blocks the lookup of "slow.wasm" until all other lookups are done.
+type blockingCache struct {
+	others sync.WaitGroup
+}
+
+func (c *blockingCache) Get(downloadURL string, _ GetOptions) (string, error) {
+	url, _ := url.Parse(downloadURL)
+	module := url.Query().Get("module")
+	if module == "slow.wasm" {
+		c.others.Wait()
+	} else {
+		defer c.others.Done()
+	}
+	return module, nil
+}
+func (c *blockingCache) Cleanup() {}
+
+func TestWasmConvertConcurrently(t *testing.T) {
+	remote := func(name, module string) *core.TypedExtensionConfig {
+		return buildTypedStructExtensionConfig(name, &wasm.Wasm{
+			Config: &v3.PluginConfig{
+				Vm: &v3.PluginConfig_VmConfig{
+					VmConfig: &v3.VmConfig{
+						Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Remote{
+							Remote: &core.RemoteDataSource{
+								HttpUri: &core.HttpUri{
+									Uri: "http://test?module=" + module,
+								},
+							},
+						}},
+					},
+				},
+			},
+		})
+	}
+	local := func(name, module string) *core.TypedExtensionConfig {
+		return buildAnyExtensionConfig(name, &wasm.Wasm{
+			Config: &v3.PluginConfig{
+				Vm: &v3.PluginConfig_VmConfig{
+					VmConfig: &v3.VmConfig{
+						Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Local{
+							Local: &core.DataSource{
+								Specifier: &core.DataSource_Filename{
+									Filename: module,
+								},
+							},
+						}},
+					},
+				},
+			},
+		})
+	}
+	resources := []*anypb.Any{
+		protoconv.MessageToAny(remote("first", "first.wasm")),
+		protoconv.MessageToAny(remote("slow", "slow.wasm")),
+		protoconv.MessageToAny(remote("last", "last.wasm")),
+	}
+	want := []*core.TypedExtensionConfig{
+		local("first", "first.wasm"),
+		local("slow", "slow.wasm"),
+		local("last", "last.wasm"),
+	}
+
+	// The slow module only completes after the others, so a sequential conversion would never finish.
+	c := &blockingCache{}
+	c.others.Add(2)
+	done := make(chan error)
+	go func() {
+		done <- MaybeConvertWasmExtensionConfig(resources, c)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("wasm config conversion got unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("wasm config conversion did not fetch modules concurrently")
+	}
+
+	for i, output := range resources {
+		ec := &core.TypedExtensionConfig{}
+		if err := output.UnmarshalTo(ec); err != nil {
+			t.Fatalf("wasm config conversion output %v failed to unmarshal", output)
+		}
+		if !proto.Equal(ec, want[i]) {
+			t.Errorf("wasm config conversion output index %d got %v want %v", i, ec, want[i])
+		}
+	}
+}
+
+// gatedCache blocks all lookups until the gate is closed.
+type gatedCache struct {
+	gate chan struct{}
+}
+
+func (c *gatedCache) Get(downloadURL string, _ GetOptions) (string, error) {
+	<-c.gate
+	return "module.wasm", nil
+}
+func (c *gatedCache) Cleanup() {}
+
+func TestWasmConvertQueueDepth(t *testing.T) {
+	mt := monitortest.New(t)
+	pool := NewConversionPool(2)
+	resources := make([]*anypb.Any, 0, 5)
+	for i := 0; i < cap(resources); i++ {
+		resources = append(resources, protoconv.MessageToAny(buildTypedStructExtensionConfig(fmt.Sprintf("ext-%d", i), &wasm.Wasm{
+			Config: &v3.PluginConfig{
+				Vm: &v3.PluginConfig_VmConfig{
+					VmConfig: &v3.VmConfig{
+						Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Remote{
+							Remote: &core.RemoteDataSource{
+								HttpUri: &core.HttpUri{Uri: fmt.Sprintf("http://test/%d.wasm", i)},
+							},
+						}},
+					},
+				},
+			},
+		})))
+	}
+
+	c := &gatedCache{gate: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- pool.Convert(resources, c)
+	}()
+	// All workers are busy fetching, and the remaining conversions are queued.
+	mt.Assert("wasm_conversion_queue_depth", nil, monitortest.Exactly(3))
+	if !pool.Saturated() {
+		t.Fatal("expected the conversions to be saturated")
+	}
+	stopped := make(chan struct{})
+	close(stopped)
+	if waited, ok := pool.WaitAvailable(stopped); !waited || ok {
+		t.Fatal("expected to wait for a worker until stopped")
+	}
+
+	close(c.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("wasm config conversion got unexpected error: %v", err)
+	}
+	mt.Assert("wasm_conversion_queue_depth", nil, monitortest.Exactly(0))
+	if pool.Saturated() {
+		t.Fatal("expected the conversions to be drained")
+	}
+	if waited, ok := pool.WaitAvailable(nil); waited || !ok {
+		t.Fatal("expected a worker to be available")
+	}
+}
+
+func TestWasmConvertOversizedModule(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "reported content length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				// The body is never sent, the fetch must be aborted from the reported length alone.
+				w.Header().Set("Content-Length", strconv.Itoa(1<<40))
+				w.WriteHeader(http.StatusOK)
+			},
+		},
+		{
+			name: "streamed body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(append(wasmHeader, make([]byte, 2048)...))
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(tc.handler)
+			defer ts.Close()
+			cache := NewLocalFileCache(t.TempDir(), Options{MaxModuleSize: 1024, HTTPRequestMaxRetries: 1})
+			defer cache.Cleanup()
+
+			resources := []*anypb.Any{protoconv.MessageToAny(buildTypedStructExtensionConfig("oversized", &wasm.Wasm{
+				Config: &v3.PluginConfig{
+					Vm: &v3.PluginConfig_VmConfig{
+						VmConfig: &v3.VmConfig{
+							Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Remote{
+								Remote: &core.RemoteDataSource{
+									HttpUri: &core.HttpUri{
+										Uri: ts.URL + "/oversized.wasm",
+									},
+								},
+							}},
+						},
+					},
+				},
+			}))}
+			err := MaybeConvertWasmExtensionConfig(resources, cache)
+			if err == nil || !strings.Contains(err.Error(), "exceeds the limit of 1024 bytes") {
+				t.Fatalf("wasm config conversion should be NACKed for the oversized module, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWasmConvertFetchTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never respond, until the fetch is cancelled.
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer ts.Close()
+	timeout := 200 * time.Millisecond
+	cache := NewLocalFileCache(t.TempDir(), Options{ModuleFetchTimeout: timeout, HTTPRequestMaxRetries: 1})
+	defer cache.Cleanup()
+
+	resources := []*anypb.Any{protoconv.MessageToAny(buildTypedStructExtensionConfig("hung", &wasm.Wasm{
+		Config: &v3.PluginConfig{
+			Vm: &v3.PluginConfig_VmConfig{
+				VmConfig: &v3.VmConfig{
+					Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Remote{
+						Remote: &core.RemoteDataSource{
+							HttpUri: &core.HttpUri{
+								Uri:     ts.URL + "/hung.wasm",
+								Timeout: durationpb.New(time.Minute),
+							},
+						},
+					}},
+				},
+			},
+		},
+	}))}
+	start := time.Now()
+	err := MaybeConvertWasmExtensionConfig(resources, cache)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatalf("wasm config conversion should be NACKed once the fetch times out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Fatalf("wasm config conversion took %v, expected to be NACKed within %v", elapsed, timeout)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request to the Wasm server was not cancelled")
+	}
+}
+
+func TestWasmConvertCompressedModule(t *testing.T) {
+	binary := append(append([]byte{}, wasmHeader...), bytes.Repeat([]byte("compressible"), 1024)...)
+	sha := sha256.Sum256(binary)
+	checksum := hex.EncodeToString(sha[:])
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	}))
+	defer ts.Close()
+	cache := NewLocalFileCache(t.TempDir(), Options{
+		CompressModules:       true,
+		DecompressedDir:       t.TempDir(),
+		HTTPRequestMaxRetries: 1,
+	})
+	defer cache.Cleanup()
+
+	convert := func() string {
+		t.Helper()
+		resources := []*anypb.Any{protoconv.MessageToAny(buildTypedStructExtensionConfig("compressed", &wasm.Wasm{
+			Config: &v3.PluginConfig{
+				Vm: &v3.PluginConfig_VmConfig{
+					VmConfig: &v3.VmConfig{
+						Code: &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Remote{
+							Remote: &core.RemoteDataSource{
+								HttpUri: &core.HttpUri{Uri: ts.URL + "/compressed.wasm"},
+								// The checksum is the one of the original module.
+								Sha256: checksum,
+							},
+						}},
+					},
+				},
+			},
+		}))}
+		if err := MaybeConvertWasmExtensionConfig(resources, cache); err != nil {
+			t.Fatalf("wasm config conversion got unexpected error: %v", err)
+		}
+		ec := &core.TypedExtensionConfig{}
+		if err := resources[0].UnmarshalTo(ec); err != nil {
+			t.Fatalf("wasm config conversion output failed to unmarshal: %v", err)
+		}
+		wasmConfig := &wasm.Wasm{}
+		if err := ec.GetTypedConfig().UnmarshalTo(wasmConfig); err != nil {
+			t.Fatalf("wasm config conversion output failed to unmarshal: %v", err)
+		}
+		path := wasmConfig.GetConfig().GetVmConfig().GetCode().GetLocal().GetFilename()
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read the module given to Envoy: %v", err)
+		}
+		if !bytes.Equal(got, binary) {
+			t.Fatalf("the module given to Envoy is not the original module")
+		}
+		return path
+	}
+	path := convert()
+
+	// The module is stored compressed, with the checksum of the original module.
+	cache.mux.Lock()
+	ce := cache.modules[moduleKey{name: ts.URL + "/compressed.wasm", checksum: checksum}]
+	cache.mux.Unlock()
+	if ce == nil {
+		t.Fatal("the module is not cached")
+	}
+	if !strings.HasSuffix(ce.modulePath, compressedSuffix) || ce.binaryChecksum != checksum {
+		t.Fatalf("unexpected cache entry %v, %v", ce.modulePath, ce.binaryChecksum)
+	}
+	stored, err := os.ReadFile(ce.modulePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) >= len(binary) {
+		t.Fatalf("the stored module is %d bytes, expected less than the %d bytes of the original", len(stored), len(binary))
+	}
+
+	// The decompressed copy is written again once removed, such as after a restart with a tmpfs.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := convert(); got != path {
+		t.Fatalf("the module given to Envoy moved from %v to %v", path, got)
+	}
+}
+
 func buildTypedStructExtensionConfig(name string, wasm *wasm.Wasm) *core.TypedExtensionConfig {
 	ws, _ := conversion.MessageToStruct(wasm)
 	return &core.TypedExtensionConfig{
@@ -23,8 +23,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/http/httpproxy"
+
 	"istio.io/istio/pkg/backoff"
 )
 
@@ -41,6 +47,11 @@ type HTTPFetcher struct {
 	insecureClient  *http.Client
 	initialBackoff  time.Duration
 	requestMaxRetry int
+	maxModuleSize   int64
+	// proxy if set returns the proxy of the requests, see setProxy.
+	proxy func(*http.Request) (*url.URL, error)
+	// auth if set provides the headers authenticating each request.
+	auth FetchAuthProvider
 }
 
 // NewHTTPFetcher create a new HTTP remote wasm module fetcher.
@@ -56,7 +67,8 @@ func NewHTTPFetcher(requestTimeout time.Duration, requestMaxRetry int) *HTTPFetc
 	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	return &HTTPFetcher{
 		client: &http.Client{
-			Timeout: requestTimeout,
+			Timeout:   requestTimeout,
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
 		},
 		insecureClient: &http.Client{
 			Timeout:   requestTimeout,
@@ -64,11 +76,76 @@ func NewHTTPFetcher(requestTimeout time.Duration, requestMaxRetry int) *HTTPFetc
 		},
 		initialBackoff:  time.Millisecond * 500,
 		requestMaxRetry: requestMaxRetry,
+		maxModuleSize:   DefaultMaxModuleSize,
+	}
+}
+
+// setProxy routes the requests of the fetcher through the proxy returned by proxy.
+func (f *HTTPFetcher) setProxy(proxy func(*http.Request) (*url.URL, error)) {
+	f.proxy = proxy
+	f.client.Transport.(*http.Transport).Proxy = proxy
+	f.insecureClient.Transport.(*http.Transport).Proxy = proxy
+}
+
+// httpProxyFunc returns the proxy of the Wasm module fetches: proxyURL if set, otherwise the proxy configured by
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables as they are when it is called.
+func httpProxyFunc(proxyURL string) func(*http.Request) (*url.URL, error) {
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err == nil {
+			return http.ProxyURL(u)
+		}
+		wasmLog.Errorf("invalid Wasm fetch proxy %q, using the proxy of the environment instead: %v", proxyURL, err)
+	}
+	fromEnv := httpproxy.FromEnvironment().ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return fromEnv(req.URL)
 	}
 }
 
 // Fetch downloads a wasm module with HTTP get.
 func (f *HTTPFetcher) Fetch(ctx context.Context, url string, allowInsecure bool) ([]byte, error) {
+	var body []byte
+	err := f.fetch(ctx, url, allowInsecure, func(resp *http.Response) error {
+		var err error
+		body, err = readEncodedModule(resp, f.maxModuleSize)
+		return err
+	})
+	if body == nil {
+		return nil, err
+	}
+	return unboxIfPossible(body), err
+}
+
+// FetchToFile downloads a wasm module with HTTP get, streaming it to a temporary file in dir instead of holding it
+// in memory. It returns the path of the file, to be moved or removed by the caller, along with the hex-encoded sha256
+// checksum and the size of the module, computed while it is written. Like Fetch, a boxed module is unboxed.
+func (f *HTTPFetcher) FetchToFile(ctx context.Context, url string, allowInsecure bool, dir string) (string, string, int64, error) {
+	var path, checksum string
+	var size int64
+	err := f.fetch(ctx, url, allowInsecure, func(resp *http.Response) error {
+		r, reportedSize, err := decodeBody(resp)
+		if err != nil {
+			return err
+		}
+		if reportedSize > f.maxModuleSize {
+			return fmt.Errorf("wasm module size %d exceeds the limit of %d bytes", reportedSize, f.maxModuleSize)
+		}
+		path, checksum, size, err = writeModuleFile(dir, r, f.maxModuleSize)
+		return err
+	})
+	if err != nil {
+		if path != "" {
+			_ = os.Remove(path)
+		}
+		return "", "", 0, err
+	}
+	path, checksum, size = unboxFileIfPossible(path, checksum, size, f.maxModuleSize)
+	return path, checksum, size, nil
+}
+
+// fetch gets url, retrying the failed requests, and passes the response to read once it succeeds.
+func (f *HTTPFetcher) fetch(ctx context.Context, url string, allowInsecure bool, read func(resp *http.Response) error) error {
 	c := f.client
 	if allowInsecure {
 		c = f.insecureClient
@@ -83,44 +160,50 @@ func (f *HTTPFetcher) Fetch(ctx context.Context, url string, allowInsecure bool)
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		if err != nil {
 			wasmLog.Debugf("wasm module download request failed: %v", err)
-			return nil, err
+			return err
+		}
+		// Setting the accepted encodings disables the transparent decompression of the transport, the
+		// responses are decoded according to their Content-Encoding instead.
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		if err := f.authenticate(ctx, req); err != nil {
+			return err
 		}
 		resp, err := c.Do(req)
 		if err != nil {
 			lastError = err
 			wasmLog.Debugf("wasm module download request failed: %v", err)
-			if ctx.Err() != nil {
+			if !waitBackoff(ctx, b.NextBackOff()) {
 				// If there is context timeout, exit this loop.
-				return nil, fmt.Errorf("wasm module download failed after %v attempts, last error: %v", attempts, lastError)
+				return fmt.Errorf("wasm module download failed after %v attempts, last error: %v", attempts, lastError)
 			}
-			time.Sleep(b.NextBackOff())
 			continue
 		}
 		if resp.StatusCode == http.StatusOK {
-			// Limit wasm module to 256mb; in reality it must be much smaller
-			body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024*256))
-			if err != nil {
-				return nil, err
+			if err := read(resp); err != nil {
+				_ = resp.Body.Close()
+				return err
 			}
 			err = resp.Body.Close()
 			if err != nil {
 				wasmLog.Infof("wasm server connection is not closed: %v", err)
 			}
-			return unboxIfPossible(body), err
+			return err
 		}
 		lastError = fmt.Errorf("wasm module download request failed: status code %v", resp.StatusCode)
 		if retryable(resp.StatusCode) {
 			// Limit wasm module to 256mb; in reality it must be much smaller
 			body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024*256))
 			if err != nil {
-				return nil, err
+				return err
 			}
 			wasmLog.Debugf("wasm module download failed: status code %v, body %v", resp.StatusCode, string(body))
 			err = resp.Body.Close()
 			if err != nil {
 				wasmLog.Infof("wasm server connection is not closed: %v", err)
 			}
-			time.Sleep(b.NextBackOff())
+			if !waitBackoff(ctx, b.NextBackOff()) {
+				break
+			}
 			continue
 		}
 		err = resp.Body.Close()
@@ -129,7 +212,91 @@ func (f *HTTPFetcher) Fetch(ctx context.Context, url string, allowInsecure bool)
 		}
 		break
 	}
-	return nil, fmt.Errorf("wasm module download failed after %v attempts, last error: %v", attempts, lastError)
+	return fmt.Errorf("wasm module download failed after %v attempts, last error: %v", attempts, lastError)
+}
+
+// authenticate sets the headers provided by the auth provider of the fetcher, if any, on req.
+func (f *HTTPFetcher) authenticate(ctx context.Context, req *http.Request) error {
+	if f.auth == nil {
+		return nil
+	}
+	headers, err := f.auth.Headers(ctx, req.URL)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate the Wasm module download request: %v", err)
+	}
+	for k, v := range headers {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	return nil
+}
+
+// waitBackoff waits for the backoff before the next attempt, returning false if ctx is done first.
+func waitBackoff(ctx context.Context, backoff time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// readModule reads a Wasm module of the given reported size, -1 if unknown, aborting as soon as it is known
+// to exceed maxSize.
+func readModule(r io.Reader, size, maxSize int64) ([]byte, error) {
+	if size > maxSize {
+		return nil, fmt.Errorf("wasm module size %d exceeds the limit of %d bytes", size, maxSize)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("wasm module size exceeds the limit of %d bytes", maxSize)
+	}
+	return b, nil
+}
+
+// readEncodedModule reads the Wasm module in the body of resp, decoding it according to its Content-Encoding.
+// The size limit applies to the decoded module.
+func readEncodedModule(resp *http.Response, maxSize int64) ([]byte, error) {
+	r, size, err := decodeBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	return readModule(r, size, maxSize)
+}
+
+// decodeBody returns the reader of the Wasm module in the body of resp, decoding it according to its
+// Content-Encoding, along with the size of the module, -1 if unknown.
+func decodeBody(resp *http.Response) (io.Reader, int64, error) {
+	encodings := strings.Split(resp.Header.Get("Content-Encoding"), ",")
+	var r io.Reader = resp.Body
+	size := resp.ContentLength
+	// The encodings are listed in the order they were applied, so they are decoded in reverse order.
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encoding := strings.ToLower(strings.TrimSpace(encodings[i])); encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to decode gzip encoded wasm module: %v", err)
+			}
+			r = zr
+		case "br":
+			r = brotli.NewReader(r)
+		default:
+			return nil, 0, fmt.Errorf("unsupported wasm module content encoding %q", encoding)
+		}
+		// The reported size is the one of the encoded module.
+		size = -1
+	}
+	return r, size, nil
 }
 
 func retryable(code int) bool {
@@ -19,14 +19,18 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -110,6 +114,33 @@ func TestWasmHTTPFetch(t *testing.T) {
 	}
 }
 
+// Validates no attempt is made once the fetch context expires during the backoff before a retry.
+func TestWasmHTTPFetchContextDoneDuringBackoff(t *testing.T) {
+	hits := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	fetcher := NewHTTPFetcher(DefaultHTTPRequestTimeout, DefaultHTTPRequestMaxRetries)
+	fetcher.initialBackoff = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := fetcher.Fetch(ctx, ts.URL, false); err == nil {
+		t.Fatal("Wasm download succeeded unexpectedly")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected the fetch to stop once its context is done, took %v", elapsed)
+	}
+	// Wait past the backoff: no further attempt must reach the server.
+	time.Sleep(1500 * time.Millisecond)
+	if got := len(hits); got != 1 {
+		t.Errorf("expected a single attempt, got %d", got)
+	}
+}
+
 func TestWasmHTTPInsecureServer(t *testing.T) {
 	var ts *httptest.Server
 
@@ -263,6 +294,119 @@ func TestWasmHTTPFetchCompressedOrTarFile(t *testing.T) {
 				}
 				t.Errorf("unexpected binary: (-want, +got)\n%v", diff)
 			}
+
+			// The module streamed to a file is unboxed the same way.
+			dir := t.TempDir()
+			path, checksum, size, err := fetcher.FetchToFile(ctx, ts.URL, false, dir)
+			if err != nil {
+				t.Fatalf("Wasm download to file got an unexpected error: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(wasmBinary, got); diff != "" {
+				t.Errorf("unexpected streamed binary: (-want, +got)\n%v", diff)
+			}
+			sha := sha256.Sum256(wasmBinary)
+			if checksum != hex.EncodeToString(sha[:]) || size != int64(len(wasmBinary)) {
+				t.Errorf("unexpected checksum %s and size %d of the streamed binary", checksum, size)
+			}
+			// The boxed module is removed once unboxed.
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("expected only the streamed binary in %s, got %v", dir, entries)
+			}
+		})
+	}
+}
+
+func createBrotli(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	if _, err := bw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWasmHTTPFetchContentEncoding(t *testing.T) {
+	wasmBinary := append(wasmMagicNumber, 0x00, 0x00, 0x00, 0x00)
+	// Not a Wasm module, so that it is not unboxed.
+	opaque := []byte("opaque module")
+	cases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte
+		wantErr  string
+	}{
+		{
+			name: "no encoding",
+			body: opaque,
+			want: opaque,
+		},
+		{
+			name:     "identity",
+			encoding: "identity",
+			body:     opaque,
+			want:     opaque,
+		},
+		{
+			name:     "gzip",
+			encoding: "gzip",
+			body:     createGZ(t, opaque),
+			want:     opaque,
+		},
+		{
+			name:     "brotli",
+			encoding: "br",
+			body:     createBrotli(t, wasmBinary),
+			want:     wasmBinary,
+		},
+		{
+			name:     "multiple encodings",
+			encoding: "br, gzip",
+			body:     createGZ(t, createBrotli(t, opaque)),
+			want:     opaque,
+		},
+		{
+			name:     "unsupported encoding",
+			encoding: "zstd",
+			body:     opaque,
+			wantErr:  `unsupported wasm module content encoding "zstd"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if c.encoding != "" {
+					w.Header().Set("Content-Encoding", c.encoding)
+				}
+				w.Write(c.body)
+			}))
+			defer ts.Close()
+			fetcher := NewHTTPFetcher(DefaultHTTPRequestTimeout, DefaultHTTPRequestMaxRetries)
+			fetcher.initialBackoff = time.Microsecond
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			b, err := fetcher.Fetch(ctx, ts.URL, false)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("Wasm download got error %v, want %v", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Wasm download got an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(c.want, b); diff != "" {
+				t.Errorf("unexpected binary: (-want, +got)\n%v", diff)
+			}
 		})
 	}
 }
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
 
@@ -45,6 +46,11 @@ type ImageFetcherOption struct {
 	// TODO(mathetake) Add signature verification stuff.
 	PullSecret []byte
 	Insecure   bool
+	// MaxModuleSize if set is the maximum size in bytes of the image layers, checked before they are downloaded.
+	MaxModuleSize int64
+	// Proxy if set returns the proxy of the requests to the registry, instead of the proxy configured by the
+	// environment variables.
+	Proxy func(*http.Request) (*url.URL, error)
 }
 
 func (o *ImageFetcherOption) useDefaultKeyChain() bool {
@@ -59,7 +65,8 @@ func (o ImageFetcherOption) String() string {
 }
 
 type ImageFetcher struct {
-	fetchOpts []remote.Option
+	fetchOpts     []remote.Option
+	maxModuleSize int64
 }
 
 func NewImageFetcher(ctx context.Context, opt ImageFetcherOption) *ImageFetcher {
@@ -73,18 +80,24 @@ func NewImageFetcher(ctx context.Context, opt ImageFetcherOption) *ImageFetcher
 		fetchOpts = append(fetchOpts, remote.WithAuthFromKeychain(&wasmKeyChain{data: opt.PullSecret}))
 	}
 
-	if opt.Insecure {
+	if opt.Insecure || opt.Proxy != nil {
 		t := remote.DefaultTransport.(*http.Transport).Clone()
-		// nolint: gosec
-		// This is only when a user explicitly sets a flag to enable insecure mode
-		t.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: opt.Insecure,
+		if opt.Insecure {
+			// nolint: gosec
+			// This is only when a user explicitly sets a flag to enable insecure mode
+			t.TLSClientConfig = &tls.Config{
+				InsecureSkipVerify: opt.Insecure,
+			}
+		}
+		if opt.Proxy != nil {
+			t.Proxy = opt.Proxy
 		}
 		fetchOpts = append(fetchOpts, remote.WithTransport(t))
 	}
 
 	return &ImageFetcher{
-		fetchOpts: append(fetchOpts, remote.WithContext(ctx)),
+		fetchOpts:     append(fetchOpts, remote.WithContext(ctx)),
+		maxModuleSize: opt.MaxModuleSize,
 	}
 }
 
@@ -131,6 +144,13 @@ func (o *ImageFetcher) PrepareFetch(url string) (binaryFetcher func() ([]byte, e
 		if err != nil {
 			return nil, fmt.Errorf("could not retrieve manifest: %v", err)
 		}
+		if o.maxModuleSize > 0 {
+			for _, l := range manifest.Layers {
+				if l.Size > o.maxModuleSize {
+					return nil, fmt.Errorf("image layer size %d exceeds the limit of %d bytes", l.Size, o.maxModuleSize)
+				}
+			}
+		}
 
 		if manifest.MediaType == types.DockerManifestSchema2 {
 			// This case, assume we have docker images with "application/vnd.docker.distribution.manifest.v2+json"
@@ -0,0 +1,54 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+)
+
+// inlineModulePrefix prefixes the data URIs inlining the Wasm modules held in memory, see Options.InMemory.
+const inlineModulePrefix = "data:application/wasm;base64,"
+
+// inlineModule returns the data URI inlining module.
+func inlineModule(module []byte) string {
+	return inlineModulePrefix + base64.StdEncoding.EncodeToString(module)
+}
+
+// InlineModuleFile returns the data URI inlining the Wasm module at location, as returned by Cache.Get, so that
+// the module is inlined in the rewritten extension config instead of referenced by its file. The module file is
+// read, unless the module is already inlined.
+func InlineModuleFile(location string) (string, error) {
+	if strings.HasPrefix(location, inlineModulePrefix) {
+		return location, nil
+	}
+	module, err := os.ReadFile(location)
+	if err != nil {
+		return "", err
+	}
+	return inlineModule(module), nil
+}
+
+// inlinedModule returns the module inlined by location if it is a data URI, as returned by Cache.Get for the
+// modules held in memory. It returns false if location is the path of a module file.
+func inlinedModule(location string) ([]byte, bool, error) {
+	encoded, ok := strings.CutPrefix(location, inlineModulePrefix)
+	if !ok {
+		return nil, false, nil
+	}
+	module, err := base64.StdEncoding.DecodeString(encoded)
+	return module, true, err
+}
@@ -0,0 +1,187 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"istio.io/istio/pkg/util/sets"
+)
+
+// manifestFile is the name of the file in the cache directory recording the cached modules, so that they are
+// served from the cache after a restart without being fetched again.
+const manifestFile = "wasm-cache-manifest.json"
+
+// manifest is the persisted content of a LocalFileCache.
+type manifest struct {
+	Modules []manifestModule `json:"modules"`
+	// Checksums are the checksums of the modules last fetched from URLs which do not pin the checksum.
+	Checksums []manifestChecksum `json:"checksums,omitempty"`
+}
+
+type manifestModule struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+	Path     string `json:"path"`
+	// Digest is the hex-encoded sha256 checksum of the module file.
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+	URLs     []string  `json:"urls,omitempty"`
+	// Compressed is true if the module file is compressed with zstd.
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+type manifestChecksum struct {
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"`
+	// ResourceVersions are the resource versions of the resources referencing the URL, by resource name.
+	ResourceVersions map[string]string `json:"resourceVersions,omitempty"`
+}
+
+// saveManifest persists the cached modules, removing the manifest once the cache is empty. Nothing is persisted
+// for the modules held in memory. The caller must hold c.mux.
+func (c *LocalFileCache) saveManifest() {
+	if c.InMemory {
+		return
+	}
+	path := filepath.Join(c.dir, manifestFile)
+	if len(c.modules) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			wasmLog.Errorf("failed to remove Wasm cache manifest: %v", err)
+		}
+		return
+	}
+	m := manifest{}
+	for k, ce := range c.modules {
+		m.Modules = append(m.Modules, manifestModule{
+			Name:       k.name,
+			Checksum:   k.checksum,
+			Path:       ce.modulePath,
+			Digest:     ce.binaryChecksum,
+			Size:       ce.size,
+			LastUsed:   ce.last,
+			URLs:       sets.SortedList(ce.referencingURLs),
+			Compressed: ce.decompressedPath != "",
+		})
+	}
+	for url, ce := range c.checksums {
+		m.Checksums = append(m.Checksums, manifestChecksum{
+			URL:              url,
+			Checksum:         ce.checksum,
+			ResourceVersions: ce.resourceVersionByResource,
+		})
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		wasmLog.Errorf("failed to encode Wasm cache manifest: %v", err)
+		return
+	}
+	// Write to a temporary file first, so that a crash does not leave a truncated manifest behind.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		wasmLog.Errorf("failed to write Wasm cache manifest: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		wasmLog.Errorf("failed to write Wasm cache manifest: %v", err)
+	}
+}
+
+// loadManifest restores the modules recorded in the manifest of the cache directory, if any. Modules whose file
+// is missing or does not match the recorded size and digest are skipped, and their file is removed.
+func (c *LocalFileCache) loadManifest() {
+	if c.InMemory {
+		return
+	}
+	b, err := os.ReadFile(filepath.Join(c.dir, manifestFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			wasmLog.Warnf("failed to read Wasm cache manifest: %v", err)
+		}
+		return
+	}
+	m := manifest{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		wasmLog.Warnf("ignoring invalid Wasm cache manifest: %v", err)
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	urls := sets.New[string]()
+	for _, mm := range m.Modules {
+		k := moduleKey{name: mm.Name, checksum: mm.Checksum}
+		ce := &cacheEntry{
+			modulePath:      mm.Path,
+			last:            mm.LastUsed,
+			referencingURLs: sets.New(mm.URLs...),
+			binaryChecksum:  mm.Digest,
+			size:            mm.Size,
+		}
+		if mm.Compressed {
+			ce.decompressedPath = modulePathOf(c.DecompressedDir, k)
+		}
+		if !c.isModulePath(mm.Path, k) {
+			// Never touch files outside of the cache directories.
+			wasmLog.Warnf("dropping Wasm module %v from the cache manifest: unexpected path", mm.Path)
+			continue
+		}
+		stamp, err := validateManifestModule(ce)
+		if err != nil {
+			wasmLog.Warnf("dropping Wasm module %v from the cache manifest: %v", mm.Path, err)
+			if err := os.Remove(mm.Path); err != nil && !os.IsNotExist(err) {
+				wasmLog.Errorf("failed to remove invalid Wasm module %v: %v", mm.Path, err)
+			}
+			continue
+		}
+		ce.verified = stamp
+		c.modules[k] = ce
+		urls.InsertAll(mm.URLs...)
+	}
+	for _, mc := range m.Checksums {
+		// Only restore the checksums of the URLs referencing a restored module.
+		if !urls.Contains(mc.URL) {
+			continue
+		}
+		versions := mc.ResourceVersions
+		if versions == nil {
+			versions = map[string]string{}
+		}
+		c.checksums[mc.URL] = &checksumEntry{checksum: mc.Checksum, resourceVersionByResource: versions}
+	}
+	wasmCacheEntries.Record(float64(len(c.modules)))
+	wasmLog.Infof("restored %d Wasm modules from the cache manifest", len(c.modules))
+}
+
+// validateManifestModule checks that the file of a module recorded in the manifest has the recorded size and
+// digest, and returns the stamp of the verified file.
+func validateManifestModule(ce *cacheEntry) (fileStamp, error) {
+	if ce.binaryChecksum == "" {
+		return fileStamp{}, errors.New("missing digest")
+	}
+	info, err := os.Stat(ce.modulePath)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	if info.Size() != ce.size {
+		return fileStamp{}, fmt.Errorf("local file has size %d, which does not match: %d", info.Size(), ce.size)
+	}
+	return ce.verify(fileStamp{})
+}
@@ -23,6 +23,8 @@ const (
 	downloadFailure  = "download_failure"
 	manifestFailure  = "manifest_failure"
 	checksumMismatch = "checksum_mismatched"
+	signatureFailure = "signature_failure"
+	hostNotAllowed   = "host_not_allowed"
 
 	// For Wasm conversion metric.
 	conversionSuccess   = "success"
@@ -31,6 +33,11 @@ const (
 	unmarshalFailure    = "unmarshal_failure"
 	fetchFailure        = "fetch_failure"
 	missRemoteFetchHint = "miss_remote_fetch_hint"
+
+	// For Wasm cache lookups metric.
+	lookupHit   = "hit"
+	lookupMiss  = "miss"
+	lookupError = "error"
 )
 
 var (
@@ -47,16 +54,37 @@ var (
 		"number of Wasm remote fetch cache lookups.",
 	)
 
+	wasmCacheLookupsTotal = monitoring.NewSum(
+		"wasm_cache_lookups_total",
+		"number of Wasm module lookups, by result: hit if served from the cache, miss if fetched, or error.",
+	)
+
 	wasmRemoteFetchCount = monitoring.NewSum(
 		"wasm_remote_fetch_count",
 		"number of Wasm remote fetches and results, including success, download failure, and checksum mismatch.",
 	)
 
+	wasmFetchDedupedCount = monitoring.NewSum(
+		"wasm_fetch_deduped_total",
+		"number of Wasm module fetches avoided by sharing a concurrent fetch of the same module.",
+	)
+
+	wasmRemoteFetchDuration = monitoring.NewDistribution(
+		"wasm_remote_fetch_duration",
+		"Total time in milliseconds istio-agent spends on fetching a Wasm module from the remote site, including failed fetches.",
+		[]float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384},
+	)
+
 	wasmConfigConversionCount = monitoring.NewSum(
 		"wasm_config_conversion_count",
 		"number of Wasm config conversion count and results, including success, no remote load, marshal failure, remote fetch failure, miss remote fetch hint.",
 	)
 
+	wasmConversionQueueDepth = monitoring.NewGauge(
+		"wasm_conversion_queue_depth",
+		"number of Wasm config conversions waiting for a worker, as all workers are busy fetching Wasm modules.",
+	)
+
 	wasmConfigConversionDuration = monitoring.NewDistribution(
 		"wasm_config_conversion_duration",
 		"Total time in milliseconds istio-agent spends on converting remote load in Wasm config.",
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	extensions "istio.io/api/extensions/v1alpha1"
+	"istio.io/istio/pkg/monitoring"
 	"istio.io/istio/pkg/util/sets"
 )
 
@@ -26,6 +27,12 @@ const (
 	DefaultModuleExpiry          = 24 * time.Hour
 	DefaultHTTPRequestTimeout    = 15 * time.Second
 	DefaultHTTPRequestMaxRetries = 5
+	DefaultFetchMaxAttempts      = 1
+	DefaultFetchMaxElapsedTime   = 30 * time.Second
+	DefaultPrewarmTimeout        = 30 * time.Second
+	DefaultConversionWorkers     = 8
+	// DefaultMaxModuleSize limits Wasm modules to 256mb; in reality they must be much smaller.
+	DefaultMaxModuleSize = 256 * 1024 * 1024
 )
 
 // Options contains configurations to create a Cache instance.
@@ -35,6 +42,81 @@ type Options struct {
 	InsecureRegistries    sets.String
 	HTTPRequestTimeout    time.Duration
 	HTTPRequestMaxRetries int
+	// FetchMaxAttempts is the number of times the agent tries to fetch the Wasm modules referenced by an
+	// ECDS response before the response is NACKed. The ECDS response is held back while retrying.
+	FetchMaxAttempts int
+	// FetchMaxElapsedTime bounds the total time spent on retrying a failed fetch.
+	FetchMaxElapsedTime time.Duration
+	// FetchGracePeriod if set holds an ECDS update, neither accepted nor rejected, while the fetches of its
+	// modules are retried, and only rejects it once the period elapses. It supersedes the retry settings above.
+	FetchGracePeriod time.Duration
+	// Verifier if set verifies the detached signature of fetched modules before they are accepted into the cache.
+	// The signature of a module is fetched from the module URL suffixed with ".sig". Only HTTP(S) modules can be
+	// verified, OCI modules are rejected.
+	Verifier ModuleVerifier
+	// FetchAuth if set authenticates the HTTP(S) fetches of the modules and their signatures, see HostAuthProviders
+	// to select the credentials by host. OCI modules are authenticated by their pull secret instead.
+	FetchAuth FetchAuthProvider
+	// MaxModuleSize is the maximum size in bytes of a fetched Wasm module. Larger modules are rejected while
+	// they are downloaded, without being buffered entirely.
+	MaxModuleSize int64
+	// MaxCacheSize if set is the maximum total size in bytes of the cached Wasm modules. When it is exceeded,
+	// the least recently used modules which are not referenced by any resource are evicted.
+	MaxCacheSize int64
+	// MaxModuleVersions if positive is the number of versions of a module, by checksum of the same URL or OCI
+	// repository, kept in the cache besides the versions referenced by a resource. The least recently used
+	// versions beyond it are pruned, whatever the total size of the cache.
+	MaxModuleVersions int
+	// ModuleFetchTimeout if set bounds the time to fetch a single Wasm module, including the retries of its
+	// requests and the fetch of its signature, instead of the timeout of the remote data source. The fetch is
+	// cancelled once the timeout is exceeded, and the resource referencing the module is NACKed.
+	ModuleFetchTimeout time.Duration
+	// AllowedHosts if not empty is the list of hosts the Wasm modules may be fetched from, over HTTP(S) or OCI.
+	// A host matches either with or without the port of the module URL. Modules at any other host are rejected
+	// before any request is made, whatever the configuration pushed by Istiod.
+	AllowedHosts sets.String
+	// PrewarmURLs are the URLs of the Wasm modules fetched into the cache when the agent starts, before Envoy
+	// connects, so that the first ECDS push referencing them is not held back by the fetch.
+	PrewarmURLs []string
+	// PrewarmTimeout bounds the time the agent startup waits for the modules in PrewarmURLs to be fetched.
+	// DefaultPrewarmTimeout is used if it is not set.
+	PrewarmTimeout time.Duration
+	// LocalOverrides maps the names of extension configs to the local Wasm module files used for them instead
+	// of the modules pushed by Istiod, which are not fetched. See WithLocalOverrides.
+	LocalOverrides map[string]string
+	// InMemory if true holds the Wasm modules in memory instead of writing them to the cache directory, for agents
+	// without a writable filesystem. The modules are then inlined in the rewritten extension configs, and the cache
+	// is not persisted across restarts.
+	InMemory bool
+	// HTTPProxy if set is the URL of the proxy the HTTP(S) and OCI Wasm module fetches go through, instead of the
+	// proxy configured by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	HTTPProxy string
+	// CompressModules if true stores the Wasm module files compressed with zstd, and decompresses them on demand
+	// into DecompressedDir, where Envoy reads them. The checksums still apply to the original modules. It is not
+	// used if InMemory is set.
+	CompressModules bool
+	// DecompressedDir is the directory of the decompressed copies of the compressed modules, such as a tmpfs.
+	// A directory in the temporary directory is used if it is not set.
+	DecompressedDir string
+	// ExtraDirs are the directories storing the Wasm modules selected by their placement policy, in addition to
+	// the cache directory which stores the other modules. They are not used if InMemory is set.
+	ExtraDirs []CacheDir
+	// ConversionWorkers is the number of ECDS resources the XDS proxy converts in parallel, across all the ECDS
+	// responses being converted. DefaultConversionWorkers is used if it is not positive.
+	ConversionWorkers int
+}
+
+// CacheDir is a directory of the cache storing the Wasm modules selected by its placement policy, such as a larger
+// but slower volume than the cache directory, which keeps the hot small modules on a fast volume.
+type CacheDir struct {
+	// Path of the directory.
+	Path string
+	// MinModuleSize if positive places the modules of at least this size in bytes in the directory. A module
+	// matching several directories by size is placed in the one with the largest MinModuleSize.
+	MinModuleSize int64
+	// Modules are the names of the modules placed in the directory whatever their size: the URL of the HTTP(S)
+	// modules, or the repository of the OCI modules such as oci://docker.io/test.
+	Modules sets.String
 }
 
 func defaultOptions() Options {
@@ -44,6 +126,9 @@ func defaultOptions() Options {
 		InsecureRegistries:    sets.New[string](),
 		HTTPRequestTimeout:    DefaultHTTPRequestTimeout,
 		HTTPRequestMaxRetries: DefaultHTTPRequestMaxRetries,
+		FetchMaxAttempts:      DefaultFetchMaxAttempts,
+		FetchMaxElapsedTime:   DefaultFetchMaxElapsedTime,
+		MaxModuleSize:         DefaultMaxModuleSize,
 	}
 }
 
@@ -55,4 +140,7 @@ type GetOptions struct {
 	RequestTimeout  time.Duration
 	PullSecret      []byte
 	PullPolicy      extensions.PullPolicy
+	// MetricLabels are added to the metrics of the fetch, such as the mesh and cluster IDs of the requesting Envoy.
+	// A fetch shared by concurrent calls is recorded with the labels of the call that started it.
+	MetricLabels []monitoring.LabelValue
 }
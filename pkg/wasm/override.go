@@ -0,0 +1,49 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"fmt"
+	"os"
+)
+
+// overrideCache serves the Wasm modules of the resources with a local override from local files, and the
+// modules of the other resources from the wrapped cache.
+type overrideCache struct {
+	Cache
+	overrides map[string]string
+}
+
+// WithLocalOverrides returns a cache serving the Wasm module of the resources named in overrides from the local
+// file mapped to their name, regardless of the module pushed by Istiod, which is never fetched. The modules of
+// the other resources are served by cache. This is a break-glass control to pin a known-good module.
+func WithLocalOverrides(cache Cache, overrides map[string]string) Cache {
+	if len(overrides) == 0 {
+		return cache
+	}
+	return &overrideCache{Cache: cache, overrides: overrides}
+}
+
+func (c *overrideCache) Get(url string, opts GetOptions) (string, error) {
+	path, f := c.overrides[opts.ResourceName]
+	if !f {
+		return c.Cache.Get(url, opts)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("invalid local override of the Wasm module of %s: %v", opts.ResourceName, err)
+	}
+	wasmLog.Debugf("using local override %s of Wasm module %s for %s", path, url, opts.ResourceName)
+	return path, nil
+}
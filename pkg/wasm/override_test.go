@@ -0,0 +1,77 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fixedCache serves the same module for every fetch, recording the fetched URLs.
+type fixedCache struct {
+	module  string
+	fetched []string
+}
+
+func (c *fixedCache) Get(url string, _ GetOptions) (string, error) {
+	c.fetched = append(c.fetched, url)
+	return c.module, nil
+}
+
+func (c *fixedCache) Cleanup() {}
+
+func TestWithLocalOverrides(t *testing.T) {
+	override := filepath.Join(t.TempDir(), "known-good.wasm")
+	if err := os.WriteFile(override, wasmHeader, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inner := &fixedCache{module: "/fetched.wasm"}
+	cache := WithLocalOverrides(inner, map[string]string{
+		"namespace.overridden": override,
+		"namespace.missing":    filepath.Join(t.TempDir(), "missing.wasm"),
+	})
+
+	cases := []struct {
+		name     string
+		resource string
+		want     string
+		wantErr  bool
+	}{
+		{name: "overridden", resource: "namespace.overridden", want: override},
+		{name: "not overridden", resource: "namespace.other", want: "/fetched.wasm"},
+		{name: "missing override", resource: "namespace.missing", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			inner.fetched = nil
+			got, err := cache.Get("http://test/plugin.wasm", GetOptions{ResourceName: c.resource})
+			if gotErr := err != nil; gotErr != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("got module %q, want %q", got, c.want)
+			}
+			// The remote module of an overridden resource is never fetched.
+			if wantFetch := c.want == "/fetched.wasm"; (len(inner.fetched) > 0) != wantFetch {
+				t.Errorf("got fetches %v", inner.fetched)
+			}
+		})
+	}
+
+	if WithLocalOverrides(inner, nil) != Cache(inner) {
+		t.Error("expected the cache to be returned as is without overrides")
+	}
+}
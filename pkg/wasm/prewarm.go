@@ -0,0 +1,71 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	extensions "istio.io/api/extensions/v1alpha1"
+)
+
+// maxConcurrentPrewarms bounds the number of Wasm modules fetched at the same time while prewarming.
+const maxConcurrentPrewarms = 4
+
+// Prewarm fetches the Wasm modules at urls into cache, so that the first extension configs referencing them are
+// converted without waiting for a fetch. Prewarm returns the number of modules fetched once all the fetches are
+// done, or once timeout expired; the fetches still in progress then complete in the background.
+// Modules requiring a pull secret cannot be prewarmed, and are fetched on their first use instead.
+func Prewarm(cache Cache, urls []string, timeout time.Duration) int {
+	if len(urls) == 0 {
+		return 0
+	}
+	start := time.Now()
+	var fetched atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		workers := make(chan struct{}, maxConcurrentPrewarms)
+		for _, u := range urls {
+			workers <- struct{}{}
+			wg.Add(1)
+			go func(u string) {
+				defer func() {
+					<-workers
+					wg.Done()
+				}()
+				if _, err := cache.Get(u, GetOptions{RequestTimeout: timeout, PullPolicy: extensions.PullPolicy_IfNotPresent}); err != nil {
+					wasmLog.Warnf("failed to prewarm Wasm module %v: %v", u, err)
+					return
+				}
+				fetched.Add(1)
+			}(u)
+		}
+		wg.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		wasmLog.Warnf("prewarming Wasm modules did not complete within %v, continuing in the background", timeout)
+	}
+	n := int(fetched.Load())
+	wasmLog.Infof("prewarmed %d of %d Wasm modules in %v", n, len(urls), time.Since(start))
+	return n
+}
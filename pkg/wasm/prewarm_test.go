@@ -0,0 +1,79 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrewarm(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/missing.wasm" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(wasmHeader)
+	}))
+	defer ts.Close()
+	cache := NewLocalFileCache(t.TempDir(), defaultOptions())
+	defer close(cache.stopChan)
+
+	// The missing module fails to be prewarmed, without failing the others.
+	urls := []string{ts.URL + "/a.wasm", ts.URL + "/b.wasm", ts.URL + "/missing.wasm"}
+	if n := Prewarm(cache, urls, time.Second*10); n != 2 {
+		t.Fatalf("expected 2 prewarmed modules, got %d", n)
+	}
+
+	// The prewarmed modules are served from the cache for any resource.
+	requests.Store(0)
+	for _, u := range urls[:2] {
+		if _, err := cache.Get(u, GetOptions{
+			ResourceName:    "namespace.resource",
+			ResourceVersion: "0",
+			RequestTimeout:  time.Second * 10,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("expected the prewarmed modules to be cached, got %d requests", got)
+	}
+}
+
+func TestPrewarmTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Write(wasmHeader)
+	}))
+	defer ts.Close()
+	defer close(unblock)
+	cache := NewLocalFileCache(t.TempDir(), defaultOptions())
+	defer close(cache.stopChan)
+
+	start := time.Now()
+	if n := Prewarm(cache, []string{ts.URL + "/slow.wasm"}, time.Millisecond*100); n != 0 {
+		t.Fatalf("expected no prewarmed module, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("prewarming blocked for %v, beyond its timeout", elapsed)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// fetchTempPattern is the pattern of the temporary files the Wasm modules are streamed to while they are fetched.
+const fetchTempPattern = ".fetch-*.wasm"
+
+// writeModuleFile streams the Wasm module read from r to a new temporary file in dir, computing its checksum on the
+// way, so that the module is never held in memory. It returns the path of the file along with the hex-encoded sha256
+// checksum and the size of the module. No file is left behind if the module exceeds maxSize or cannot be written.
+func writeModuleFile(dir string, r io.Reader, maxSize int64) (string, string, int64, error) {
+	f, err := os.CreateTemp(dir, fetchTempPattern)
+	if err != nil {
+		return "", "", 0, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, maxSize+1))
+	if err == nil && size > maxSize {
+		err = fmt.Errorf("wasm module size exceeds the limit of %d bytes", maxSize)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", "", 0, err
+	}
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// unboxFileIfPossible is the streaming unboxIfPossible: the module in the file at path, of the given checksum and
+// size, is unboxed into a new file while it is in a tarball or gzipped, and the boxed file removed. It returns the
+// path, checksum and size of the unboxed module. Like unboxIfPossible, it does its best: if an error is encountered,
+// the file is returned as is, and rejected by the upper layers.
+func unboxFileIfPossible(path, checksum string, size, maxSize int64) (string, string, int64) {
+	for {
+		unboxed, unboxedChecksum, unboxedSize, ok := unboxFile(path, maxSize)
+		if !ok {
+			return path, checksum, size
+		}
+		_ = os.Remove(path)
+		path, checksum, size = unboxed, unboxedChecksum, unboxedSize
+	}
+}
+
+// unboxFile unboxes the module in the file at path into a new file of the same directory, if it is in a tarball or
+// gzipped. It returns false if the module is not boxed, or cannot be unboxed.
+func unboxFile(path string, maxSize int64) (string, string, int64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", 0, false
+	}
+	defer f.Close()
+	// The header is long enough to tell a tarball, see isPosixTar.
+	header := make([]byte, 263)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", "", 0, false
+	}
+	var r io.Reader
+	switch {
+	case isValidWasmBinary(header):
+		return "", "", 0, false
+	case isGZ(header):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return "", "", 0, false
+		}
+		r = zr
+	case isPosixTar(header):
+		// wasm plugin should be the only file in the tarball.
+		tr := tar.NewReader(f)
+		if _, err := tr.Next(); err != nil {
+			return "", "", 0, false
+		}
+		r = tr
+	default:
+		return "", "", 0, false
+	}
+	unboxed, checksum, size, err := writeModuleFile(filepath.Dir(path), r, maxSize)
+	if err != nil {
+		return "", "", 0, false
+	}
+	return unboxed, checksum, size, true
+}
+
+// isValidWasmFile returns true if the file at path holds a Wasm module, by its header.
+func isValidWasmFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	n, _ := io.ReadFull(f, header)
+	return isValidWasmBinary(header[:n])
+}
+
+// moveFile atomically moves the file at src to dst. If they are on different file systems, src is copied to a
+// temporary file next to dst, which is then renamed to dst.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// removeStaleFetches removes the temporary files of the fetches interrupted by a restart from dir.
+func removeStaleFetches(dir string) {
+	stale, _ := filepath.Glob(filepath.Join(dir, fetchTempPattern))
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			wasmLog.Warnf("failed to remove the stale Wasm module fetch %s: %v", path, err)
+		}
+	}
+}
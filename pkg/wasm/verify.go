@@ -0,0 +1,110 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// signatureSuffix is appended to the URL of a module to fetch its detached signature.
+const signatureSuffix = ".sig"
+
+// ModuleVerifier verifies a fetched Wasm module before it is accepted into the cache.
+type ModuleVerifier interface {
+	// Verify returns an error if signature is not a valid signature of module.
+	Verify(module, signature []byte) error
+}
+
+// PublicKeySource provides the public key used to verify the signatures of Wasm modules.
+// It is called on every verification, so that the key can be rotated.
+type PublicKeySource func() (crypto.PublicKey, error)
+
+// FilePublicKey returns a PublicKeySource reading a PEM encoded public key from a file.
+func FilePublicKey(path string) PublicKeySource {
+	return func() (crypto.PublicKey, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Wasm module public key: %v", err)
+		}
+		return ParsePublicKey(b)
+	}
+}
+
+// ParsePublicKey parses a PEM encoded PKIX public key.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("failed to decode Wasm module public key: no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Wasm module public key: %v", err)
+	}
+	return key, nil
+}
+
+// signatureVerifier verifies cosign-style detached signatures, as produced by `cosign sign-blob`:
+// the base64 encoded signature of the sha256 digest of the module.
+type signatureVerifier struct {
+	key PublicKeySource
+}
+
+var _ ModuleVerifier = &signatureVerifier{}
+
+// NewSignatureVerifier returns a ModuleVerifier for cosign-style detached signatures made with the key
+// provided by key. ECDSA, RSA (PKCS #1 v1.5) and Ed25519 keys are supported.
+func NewSignatureVerifier(key PublicKeySource) ModuleVerifier {
+	return &signatureVerifier{key: key}
+}
+
+func (v *signatureVerifier) Verify(module, signature []byte) error {
+	key, err := v.key()
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err != nil {
+		return fmt.Errorf("failed to decode Wasm module signature: %v", err)
+	}
+	digest := sha256.Sum256(module)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("invalid Wasm module signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("invalid Wasm module signature: %v", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, module, sig) {
+			return errors.New("invalid Wasm module signature")
+		}
+	default:
+		return fmt.Errorf("unsupported Wasm module public key type %T", key)
+	}
+	return nil
+}
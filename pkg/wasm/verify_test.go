@@ -0,0 +1,229 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/istio/pkg/monitoring/monitortest"
+)
+
+func staticKey(key crypto.PublicKey) PublicKeySource {
+	return func() (crypto.PublicKey, error) {
+		return key, nil
+	}
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	module := append(wasmHeader, []byte("data")...)
+	digest := sha256.Sum256(module)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSig := ed25519.Sign(edKey, module)
+
+	cases := []struct {
+		name      string
+		key       crypto.PublicKey
+		signature []byte
+		module    []byte
+		wantErr   string
+	}{
+		{
+			name:      "ecdsa",
+			key:       &ecKey.PublicKey,
+			signature: ecSig,
+			module:    module,
+		},
+		{
+			name:      "rsa",
+			key:       &rsaKey.PublicKey,
+			signature: rsaSig,
+			module:    module,
+		},
+		{
+			name:      "ed25519",
+			key:       edPub,
+			signature: edSig,
+			module:    module,
+		},
+		{
+			name:      "modified module",
+			key:       &ecKey.PublicKey,
+			signature: ecSig,
+			module:    append(module, 0),
+			wantErr:   "invalid Wasm module signature",
+		},
+		{
+			name:      "signed with another key",
+			key:       &ecKey.PublicKey,
+			signature: rsaSig,
+			module:    module,
+			wantErr:   "invalid Wasm module signature",
+		},
+		{
+			name:      "unsupported key",
+			key:       "key",
+			signature: ecSig,
+			module:    module,
+			wantErr:   "unsupported Wasm module public key type",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			signature := base64.StdEncoding.EncodeToString(c.signature) + "\n"
+			err := NewSignatureVerifier(staticKey(c.key)).Verify(c.module, []byte(signature))
+			if c.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilePublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := FilePublicKey(path)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(got) {
+		t.Fatalf("got public key %v, want %v", got, key.PublicKey)
+	}
+	if _, err := FilePublicKey(filepath.Join(t.TempDir(), "missing.pub"))(); err == nil {
+		t.Fatal("expected an error for a missing public key")
+	}
+}
+
+func TestWasmCacheVerifiesSignature(t *testing.T) {
+	mt := monitortest.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := append(wasmHeader, []byte("data")...)
+	digest := sha256.Sum256(binary)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/signed.wasm.sig":
+			w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+		case "/badly-signed.wasm.sig":
+			w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("not a signature"))))
+		case "/signed.wasm", "/badly-signed.wasm", "/unsigned.wasm":
+			w.Write(binary)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	options := defaultOptions()
+	options.Verifier = NewSignatureVerifier(staticKey(&key.PublicKey))
+	cache := NewLocalFileCache(t.TempDir(), options)
+	defer close(cache.stopChan)
+
+	cases := []struct {
+		name    string
+		url     string
+		wantErr string
+	}{
+		{
+			name: "valid signature",
+			url:  ts.URL + "/signed.wasm",
+		},
+		{
+			name:    "invalid signature",
+			url:     ts.URL + "/badly-signed.wasm",
+			wantErr: "invalid Wasm module signature",
+		},
+		{
+			name:    "missing signature",
+			url:     ts.URL + "/unsigned.wasm",
+			wantErr: "failed to fetch signature",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, err := cache.Get(c.url, GetOptions{
+				ResourceName:   "namespace.resource",
+				RequestTimeout: time.Second * 10,
+			})
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if path == "" {
+					t.Fatal("expected the module to be cached")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+	mt.Assert(wasmRemoteFetchCount.Name(), map[string]string{"result": signatureFailure}, monitortest.Exactly(2))
+}